@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	ptcp "github.com/macronut/phantomsocks/phantomtcp"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// certificates of the doh and admin services with "acme" set to their name
+type ACMEConfig struct {
+	Email     string `json:"email,omitempty"`
+	Directory string `json:"directory,omitempty"` //Let's Encrypt by default
+	Cache     string `json:"cache,omitempty"`     //directory the account and certificates are kept in
+	Challenge string `json:"challenge,omitempty"` //"http-01" or "dns-01"
+	HTTP      string `json:"http,omitempty"`      //listener of the http-01 challenges, ":80" by default
+}
+
+var ACME ACMEConfig
+
+var acmeLock sync.Mutex
+var acmeNames = make(map[string]bool)
+var acmeManager *autocert.Manager
+var acmeIssuer *dnsIssuer
+
+func (config *ACMEConfig) client() *acme.Client {
+	directory := config.Directory
+	if directory == "" {
+		directory = acme.LetsEncryptURL
+	}
+	return &acme.Client{DirectoryURL: directory}
+}
+
+func (config *ACMEConfig) cache() autocert.DirCache {
+	if config.Cache == "" {
+		return autocert.DirCache("acme")
+	}
+	return autocert.DirCache(config.Cache)
+}
+
+// ACMETLSConfig returns a tls.Config whose certificate for name is
+// obtained and renewed through ACME
+func ACMETLSConfig(name string) (*tls.Config, error) {
+	acmeLock.Lock()
+	defer acmeLock.Unlock()
+	acmeNames[name] = true
+
+	if ACME.Challenge == "dns-01" {
+		if acmeIssuer == nil {
+			acmeIssuer = &dnsIssuer{client: ACME.client(), cache: ACME.cache(), certs: make(map[string]*tls.Certificate), renewing: make(map[string]bool)}
+		}
+		// listeners of a name started again on reload share its renewal
+		if !acmeIssuer.renewing[name] {
+			acmeIssuer.renewing[name] = true
+			go acmeIssuer.renew(name)
+		}
+		return &tls.Config{GetCertificate: acmeIssuer.GetCertificate}, nil
+	} else if ACME.Challenge != "" && ACME.Challenge != "http-01" {
+		return nil, errors.New("unsupported acme challenge: " + ACME.Challenge)
+	}
+
+	if acmeManager == nil {
+		acmeManager = &autocert.Manager{
+			Prompt: autocert.AcceptTOS,
+			Cache:  ACME.cache(),
+			Email:  ACME.Email,
+			Client: ACME.client(),
+			HostPolicy: func(ctx context.Context, host string) error {
+				acmeLock.Lock()
+				defer acmeLock.Unlock()
+				if !acmeNames[host] {
+					return errors.New("acme: " + host + " is not configured")
+				}
+				return nil
+			},
+		}
+		address := ACME.HTTP
+		if address == "" {
+			address = ":80"
+		}
+		go func() {
+			err := http.ListenAndServe(address, acmeManager.HTTPHandler(nil))
+			log.Println("acme:", err)
+		}()
+	}
+	return acmeManager.TLSConfig(), nil
+}
+
+// dnsIssuer obtains certificates with DNS-01 challenges answered by the
+// DNS service, _acme-challenge of each name must be delegated to it
+type dnsIssuer struct {
+	client *acme.Client
+	cache  autocert.DirCache
+
+	lock  sync.Mutex
+	certs map[string]*tls.Certificate
+
+	renewing map[string]bool //names renew runs for, guarded by acmeLock
+
+	accountLock sync.Mutex
+}
+
+func (issuer *dnsIssuer) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	issuer.lock.Lock()
+	defer issuer.lock.Unlock()
+	cert, ok := issuer.certs[hello.ServerName]
+	if !ok && len(issuer.certs) == 1 {
+		for _, c := range issuer.certs {
+			cert, ok = c, true
+		}
+	}
+	if !ok {
+		return nil, errors.New("acme: no certificate for " + hello.ServerName)
+	}
+	return cert, nil
+}
+
+func (issuer *dnsIssuer) load(ctx context.Context, name string) *tls.Certificate {
+	data, err := issuer.cache.Get(ctx, name)
+	if err != nil {
+		return nil
+	}
+	cert, err := tls.X509KeyPair(data, data)
+	if err != nil {
+		return nil
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil
+	}
+	return &cert
+}
+
+// renew keeps the certificate of name valid for at least 30 days
+func (issuer *dnsIssuer) renew(name string) {
+	for {
+		ctx := context.Background()
+		cert := issuer.load(ctx, name)
+		if cert == nil || time.Until(cert.Leaf.NotAfter) < time.Hour*24*30 {
+			var err error
+			cert, err = issuer.obtain(ctx, name)
+			if err != nil {
+				log.Println("acme:", name, err)
+				time.Sleep(time.Hour)
+				continue
+			}
+			log.Println("acme:", name, "certificate valid until", cert.Leaf.NotAfter)
+		}
+		issuer.lock.Lock()
+		issuer.certs[name] = cert
+		issuer.lock.Unlock()
+		time.Sleep(time.Hour * 12)
+	}
+}
+
+func (issuer *dnsIssuer) register(ctx context.Context) error {
+	issuer.accountLock.Lock()
+	defer issuer.accountLock.Unlock()
+	if issuer.client.Key != nil {
+		return nil
+	}
+
+	var key *ecdsa.PrivateKey
+	data, err := issuer.cache.Get(ctx, "acme_account+key")
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block != nil {
+			key, _ = x509.ParseECPrivateKey(block.Bytes)
+		}
+	}
+	if key == nil {
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return err
+		}
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return err
+		}
+		err = issuer.cache.Put(ctx, "acme_account+key", pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}))
+		if err != nil {
+			return err
+		}
+	}
+	issuer.client.Key = key
+
+	account := &acme.Account{}
+	if ACME.Email != "" {
+		account.Contact = []string{"mailto:" + ACME.Email}
+	}
+	_, err = issuer.client.Register(ctx, account, acme.AcceptTOS)
+	if err != nil && err != acme.ErrAccountAlreadyExists {
+		issuer.client.Key = nil
+		return err
+	}
+	return nil
+}
+
+func (issuer *dnsIssuer) obtain(ctx context.Context, name string) (*tls.Certificate, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute*10)
+	defer cancel()
+
+	err := issuer.register(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	client := issuer.client
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(name))
+	if err != nil {
+		return nil, err
+	}
+	for _, url := range order.AuthzURLs {
+		authz, err := client.GetAuthorization(ctx, url)
+		if err != nil {
+			return nil, err
+		}
+		if authz.Status == acme.StatusValid {
+			continue
+		}
+
+		var challenge *acme.Challenge
+		for _, c := range authz.Challenges {
+			if c.Type == "dns-01" {
+				challenge = c
+			}
+		}
+		if challenge == nil {
+			return nil, errors.New("no dns-01 challenge offered")
+		}
+		value, err := client.DNS01ChallengeRecord(challenge.Token)
+		if err != nil {
+			return nil, err
+		}
+		record := "_acme-challenge." + authz.Identifier.Value
+		ptcp.SetTXT(record, value)
+		defer ptcp.DeleteTXT(record)
+
+		_, err = client.Accept(ctx, challenge)
+		if err != nil {
+			return nil, err
+		}
+		_, err = client.WaitAuthorization(ctx, authz.URI)
+		if err != nil {
+			return nil, err
+		}
+	}
+	order, err = client.WaitOrder(ctx, order.URI)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: []string{name}}, key)
+	if err != nil {
+		return nil, err
+	}
+	chain, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, err
+	}
+
+	// the same format as autocert, the key followed by the chain
+	var buf bytes.Buffer
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	pem.Encode(&buf, &pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	for _, c := range chain {
+		pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: c})
+	}
+	err = issuer.cache.Put(ctx, name, buf.Bytes())
+	if err != nil {
+		log.Println("acme:", err)
+	}
+
+	cert := issuer.load(ctx, name)
+	if cert == nil {
+		return nil, fmt.Errorf("invalid certificate for %s", name)
+	}
+	return cert, nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+
+	ptcp "github.com/macronut/phantomsocks/phantomtcp"
+)
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(v)
+}
+
+func loopbackRequest(r *http.Request) bool {
+	host, _, _ := net.SplitHostPort(r.RemoteAddr)
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// AdminHandler serves the state of an instance as JSON, only the
+// clients of the instance are allowed when it has a client list
+func (inst *Instance) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/findings", func(w http.ResponseWriter, r *http.Request) {
+		bundle, err := Findings.FindingBundle(inst.Profile)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, bundle)
+	})
+	mux.HandleFunc("/fronting", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, inst.Profile.FrontingStats())
+	})
+	mux.HandleFunc("/lies", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, inst.Profile.LieLog(r.URL.Query().Get("client")))
+	})
+	mux.HandleFunc("/protocols", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, inst.Profile.ProtocolStats())
+	})
+	mux.HandleFunc("/rules", func(w http.ResponseWriter, r *http.Request) {
+		days := 0
+		if unused := r.URL.Query().Get("unused"); unused != "" {
+			var err error
+			days, err = strconv.Atoi(unused)
+			if err != nil || days <= 0 {
+				http.Error(w, "bad unused", http.StatusBadRequest)
+				return
+			}
+		}
+		writeJSON(w, inst.Profile.RuleHits(days))
+	})
+	mux.HandleFunc("/upstreams", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, ptcp.UpstreamHealth())
+	})
+	mux.HandleFunc("/resolve", func(w http.ResponseWriter, r *http.Request) {
+		// a lookup sends queries upstream, like /reload it is kept to
+		// this machine without a client list
+		if inst.allowlist == nil && !loopbackRequest(r) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		query := r.URL.Query()
+		names := ptcp.ParseNames(query.Get("names"))
+		if r.Method == http.MethodPost {
+			body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			var list []string
+			if json.Unmarshal(body, &list) == nil {
+				names = append(names, list...)
+			} else {
+				names = append(names, ptcp.ParseNames(string(body))...)
+			}
+		}
+		if len(names) == 0 || len(names) > ptcp.ResolveLimit {
+			http.Error(w, "bad names", http.StatusBadRequest)
+			return
+		}
+		lookup := query.Get("lookup") == "1"
+		writeJSON(w, inst.Profile.Resolve(names, lookup))
+	})
+	mux.HandleFunc("/reload", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "POST only", http.StatusMethodNotAllowed)
+			return
+		}
+		// without a client list, only this machine may change the state
+		if inst.allowlist == nil && !loopbackRequest(r) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		done := make(chan error, 1)
+		select {
+		case reloadRequests <- done:
+		case <-r.Context().Done():
+			return
+		}
+		if err := <-done; err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, map[string]bool{"reloaded": true})
+	})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if inst.allowlist != nil {
+			host, _, _ := net.SplitHostPort(r.RemoteAddr)
+			if !inst.allowlist[host] {
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
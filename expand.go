@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// included configs may include others up to that depth
+const configIncludeDepth = 4
+
+// readConfig reads a config with its "include" files merged in and the
+// ${VAR} of its strings expanded, the files read are added to files
+func readConfig(filename string, depth int, files *[]string) (map[string]interface{}, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var tree map[string]interface{}
+	err = decoder.Decode(&tree)
+	if err == nil {
+		*files = append(*files, filename)
+		var value interface{}
+		value, err = expandValue(tree, filepath.Dir(filename), depth, files)
+		tree, _ = value.(map[string]interface{})
+	}
+	if err != nil && depth > 0 {
+		// the callers name the config itself
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	return tree, err
+}
+
+// expandValue expands the strings of value and merges the includes of
+// its objects, paths are relative to dir
+func expandValue(value interface{}, dir string, depth int, files *[]string) (interface{}, error) {
+	switch v := value.(type) {
+	case string:
+		return expandEnv(v)
+	case []interface{}:
+		for i := range v {
+			e, err := expandValue(v[i], dir, depth, files)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = e
+		}
+		return v, nil
+	case map[string]interface{}:
+		include, ok := v["include"]
+		delete(v, "include")
+		for key := range v {
+			e, err := expandValue(v[key], dir, depth, files)
+			if err != nil {
+				return nil, err
+			}
+			v[key] = e
+		}
+		if !ok {
+			return v, nil
+		}
+
+		var patterns []string
+		switch i := include.(type) {
+		case string:
+			patterns = []string{i}
+		case []interface{}:
+			for _, p := range i {
+				s, ok := p.(string)
+				if !ok {
+					return nil, errors.New("include is a path or a list of paths")
+				}
+				patterns = append(patterns, s)
+			}
+		default:
+			return nil, errors.New("include is a path or a list of paths")
+		}
+
+		merged := make(map[string]interface{})
+		for _, pattern := range patterns {
+			pattern, err := expandEnv(pattern)
+			if err != nil {
+				return nil, err
+			}
+			if !filepath.IsAbs(pattern) {
+				pattern = filepath.Join(dir, pattern)
+			}
+			matches, err := filepath.Glob(pattern)
+			if err != nil {
+				return nil, err
+			}
+			if len(matches) == 0 && !strings.ContainsAny(pattern, "*?[") {
+				// a path that is not a glob has to be there
+				matches = []string{pattern}
+			}
+			for _, match := range matches {
+				if depth >= configIncludeDepth {
+					return nil, errors.New(match + ": includes nested too deep")
+				}
+				included, err := readConfig(match, depth+1, files)
+				if err != nil {
+					return nil, err
+				}
+				merged = mergeConfig(merged, included)
+			}
+		}
+		return mergeConfig(merged, v), nil
+	}
+	return value, nil
+}
+
+// mergeConfig merges over into base: objects are merged, lists appended
+// and other values of over replace those of base
+func mergeConfig(base, over map[string]interface{}) map[string]interface{} {
+	for key, value := range over {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			if b, ok := base[key].(map[string]interface{}); ok {
+				base[key] = mergeConfig(b, v)
+				continue
+			}
+		case []interface{}:
+			if b, ok := base[key].([]interface{}); ok {
+				base[key] = append(b, v...)
+				continue
+			}
+		}
+		base[key] = value
+	}
+	return base
+}
+
+// expandEnv replaces the ${VAR} of s with the environment variable VAR,
+// a variable that is not set is an error rather than an empty string
+func expandEnv(s string) (string, error) {
+	if !strings.Contains(s, "${") {
+		return s, nil
+	}
+	var b strings.Builder
+	for {
+		start := strings.Index(s, "${")
+		if start == -1 {
+			break
+		}
+		end := strings.IndexByte(s[start:], '}')
+		if end == -1 {
+			return "", errors.New("${ without }")
+		}
+		name := s[start+2 : start+end]
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return "", errors.New("environment variable " + name + " is not set")
+		}
+		b.WriteString(s[:start])
+		b.WriteString(value)
+		s = s[start+end+1:]
+	}
+	b.WriteString(s)
+	return b.String(), nil
+}
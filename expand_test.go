@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestExpandEnv(t *testing.T) {
+	t.Setenv("PHANTOM_DNS", "udp://8.8.8.8:53")
+	t.Setenv("PHANTOM_EMPTY", "")
+	tests := []struct {
+		s    string
+		want string
+		ok   bool
+	}{
+		{"eth0", "eth0", true},
+		{"${PHANTOM_DNS}", "udp://8.8.8.8:53", true},
+		{"${PHANTOM_DNS}/?ecs=auto", "udp://8.8.8.8:53/?ecs=auto", true},
+		{"a${PHANTOM_EMPTY}b${PHANTOM_EMPTY}c", "abc", true},
+		{"$PHANTOM_DNS", "$PHANTOM_DNS", true},
+		{"${PHANTOM_UNSET}", "", false},
+		{"${PHANTOM_DNS", "", false},
+		{"${}", "", false},
+	}
+	for _, tt := range tests {
+		got, err := expandEnv(tt.s)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("%q: %q %v, want %q", tt.s, got, err, tt.want)
+		}
+	}
+}
+
+func TestMergeConfig(t *testing.T) {
+	base := map[string]interface{}{
+		"loglevel":   "1",
+		"interfaces": []interface{}{"a"},
+		"acme":       map[string]interface{}{"email": "a@example.com", "cache": "acme"},
+	}
+	over := map[string]interface{}{
+		"loglevel":   "2",
+		"interfaces": []interface{}{"b"},
+		"acme":       map[string]interface{}{"email": "b@example.com"},
+		"services":   "x",
+	}
+	want := map[string]interface{}{
+		"loglevel":   "2",
+		"interfaces": []interface{}{"a", "b"},
+		"acme":       map[string]interface{}{"email": "b@example.com", "cache": "acme"},
+		"services":   "x",
+	}
+	if got := mergeConfig(base, over); !reflect.DeepEqual(got, want) {
+		t.Errorf("%v, want %v", got, want)
+	}
+}
+
+func TestReadConfigInclude(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, data string) string {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	t.Setenv("PHANTOM_SHARED", "shared")
+	write("shared/dns.json", `{"interfaces": [{"name": "dns", "dns": "udp://8.8.8.8:53"}]}`)
+	write("shared/proxy.json", `{"interfaces": [{"name": "proxy", "protocol": "socks5"}], "loglevel": 1}`)
+	write("loop.json", `{"include": "loop.json"}`)
+
+	tests := []struct {
+		name   string
+		config string
+		want   map[string]interface{}
+		files  int
+		ok     bool
+	}{
+		{"glob", `{"include": "${PHANTOM_SHARED}/*.json", "loglevel": 2}`, map[string]interface{}{
+			"interfaces": []interface{}{
+				map[string]interface{}{"name": "dns", "dns": "udp://8.8.8.8:53"},
+				map[string]interface{}{"name": "proxy", "protocol": "socks5"},
+			},
+			"loglevel": json.Number("2"),
+		}, 3, true},
+		{"list", `{"include": ["shared/proxy.json"], "services": []}`, map[string]interface{}{
+			"interfaces": []interface{}{map[string]interface{}{"name": "proxy", "protocol": "socks5"}},
+			"loglevel":   json.Number("1"),
+			"services":   []interface{}{},
+		}, 2, true},
+		{"empty glob", `{"include": "none/*.json"}`, map[string]interface{}{}, 1, true},
+		{"missing", `{"include": "missing.json"}`, nil, 0, false},
+		{"not a path", `{"include": 1}`, nil, 0, false},
+		{"nested too deep", `{"include": "loop.json"}`, nil, 0, false},
+		{"unset variable", `{"device": "${PHANTOM_UNSET}"}`, nil, 0, false},
+	}
+	for _, tt := range tests {
+		var files []string
+		tree, err := readConfig(write("config.json", tt.config), 0, &files)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !tt.ok {
+			continue
+		}
+		if !reflect.DeepEqual(tree, tt.want) || len(files) != tt.files {
+			t.Errorf("%s: %v %d files, want %v %d", tt.name, tree, len(files), tt.want, tt.files)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	ptcp "github.com/macronut/phantomsocks/phantomtcp"
+)
+
+// sharing of the methods that work for the rules, off unless key is set:
+// /findings of the admin service gives the signed findings of the
+// instance and -findings turns the bundles of others into a config
+type FindingsConfig struct {
+	Key   string   `json:"key,omitempty"`   //file of the signing key, made when missing
+	ASN   string   `json:"asn,omitempty"`   //network the findings are made on, AS12389
+	Trust []string `json:"trust,omitempty"` //public keys whose bundles are imported
+}
+
+var Findings FindingsConfig
+
+// FindingBundle signs the findings of profile
+func (config *FindingsConfig) FindingBundle(profile *ptcp.PhantomProfile) (*ptcp.FindingBundle, error) {
+	if config.Key == "" {
+		return nil, errors.New("findings are not shared")
+	}
+	key, err := ptcp.LoadFindingsKey(config.Key)
+	if err != nil {
+		return nil, err
+	}
+	return ptcp.NewFindingBundle(config.ASN, profile.Findings(), key), nil
+}
+
+// ImportFindings prints the interfaces and rules of the bundles in files,
+// separated by commas, that are signed with a trusted key
+func (config *FindingsConfig) ImportFindings(files string) error {
+	if len(config.Trust) == 0 {
+		return errors.New("no trusted key in findings.trust")
+	}
+	var bundles []*ptcp.FindingBundle
+	for _, name := range strings.Split(files, ",") {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		var bundle ptcp.FindingBundle
+		err = json.Unmarshal(data, &bundle)
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		err = bundle.Verify(config.Trust)
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		bundles = append(bundles, &bundle)
+	}
+
+	interfaces, rules := ptcp.FindingsConfig(bundles, config.ASN)
+	if len(interfaces) == 0 {
+		fmt.Println("no method works for more connections than it fails")
+		return nil
+	}
+	b, _ := json.MarshalIndent(map[string]interface{}{"interfaces": interfaces}, "", "    ")
+	fmt.Println(string(b))
+	fmt.Print(rules)
+	return nil
+}
@@ -7,12 +7,14 @@ require (
 	github.com/google/gopacket v1.1.19
 	github.com/macronut/go-tproxy v0.0.0-20190726054950-ef7efd7f24ed
 	github.com/macronut/godivert v0.0.0-20220121081532-78e5dd672daf
+	golang.org/x/crypto v0.5.0
 	golang.org/x/sys v0.5.0
 )
 
 require (
 	github.com/williamfhe/godivert v0.0.0-20181229124620-a48c5b872c73 // indirect
 	golang.org/x/net v0.7.0 // indirect
+	golang.org/x/text v0.7.0 // indirect
 )
 
 replace (
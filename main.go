@@ -3,16 +3,20 @@ package main
 import (
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"log"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"reflect"
 	"runtime"
 	"strings"
+	"syscall"
+	"time"
 
 	ptcp "github.com/macronut/phantomsocks/phantomtcp"
 	proxy "github.com/macronut/phantomsocks/proxy"
@@ -22,79 +26,85 @@ var ConfigFile string = "config.json"
 var LogLevel int = 0
 var MaxProcs int = 1
 var PassiveMode bool = false
-var allowlist map[string]bool = nil
 
-func ListenAndServe(addr string, key string, serve func(net.Conn)) {
-	var l net.Listener = nil
+type Listener struct {
+	Config  ptcp.ServiceConfig
+	closers []io.Closer
+}
+
+// an instance serves its listeners with its own profile, the unnamed
+// instance is configured by the top level of the config
+type Instance struct {
+	Profile     *ptcp.PhantomProfile
+	ListenerMap map[string]*Listener
+	allowlist   map[string]bool
+}
+
+var InstanceMap map[string]*Instance = make(map[string]*Instance)
+
+func (l *Listener) Close() {
+	for _, c := range l.closers {
+		c.Close()
+	}
+}
+
+func Listen(addr string, key string) (net.Listener, error) {
 	keys := strings.Split(key, ",")
 	if len(keys) == 2 {
 		cer, err := tls.LoadX509KeyPair(keys[0], keys[1])
 		if err != nil {
-			fmt.Println("TLS", err)
-			return
+			return nil, err
 		}
 		config := &tls.Config{Certificates: []tls.Certificate{cer}}
-		l, err = tls.Listen("tcp", addr, config)
+		return tls.Listen("tcp", addr, config)
+	}
+
+	if addr != "" && addr[0] == '[' {
+		return net.Listen("tcp6", addr)
+	}
+	return net.Listen("tcp", addr)
+}
+
+func (inst *Instance) Serve(l net.Listener, serve func(net.Conn)) {
+	for {
+		client, err := l.Accept()
 		if err != nil {
-			fmt.Println("TLS:", err)
-			return
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Println(err)
+			continue
 		}
-	} else {
-		var err error
-		l, err = net.Listen("tcp", addr)
+		err = proxy.SetKeepAlive(client)
 		if err != nil {
-			fmt.Println("Serve:", err)
+			log.Println(err)
 		}
-	}
-
-	if allowlist != nil {
-		for {
-			client, err := l.Accept()
-			if err != nil {
-				log.Panic(err)
-			}
-			err = proxy.SetKeepAlive(client)
-			if err != nil {
-				log.Panic(err)
-			}
 
+		if inst.allowlist != nil {
 			remoteAddr := client.RemoteAddr()
 			remoteTCPAddr, _ := net.ResolveTCPAddr(remoteAddr.Network(), remoteAddr.String())
-			_, ok := allowlist[remoteTCPAddr.IP.String()]
-			if ok {
-				go serve(client)
-			} else {
+			_, ok := inst.allowlist[remoteTCPAddr.IP.String()]
+			if !ok {
 				client.Close()
+				continue
 			}
 		}
-	} else {
-		for {
-			client, err := l.Accept()
-			if err != nil {
-				log.Panic(err)
-			}
-			err = proxy.SetKeepAlive(client)
-			if err != nil {
-				log.Panic(err)
-			}
 
-			go serve(client)
-		}
+		go serve(client)
 	}
 }
 
-func PACServer(listenAddr string, proxyAddr string) {
-	l, err := net.Listen("tcp", listenAddr)
-	if err != nil {
-		log.Panic(err)
-	}
-	pac := ptcp.GetPAC(proxyAddr)
+func PACServer(l net.Listener, profile *ptcp.PhantomProfile, proxyAddr string) {
+	pac := profile.GetPAC(proxyAddr)
 	response := []byte(fmt.Sprintf("HTTP/1.1 200 OK\r\nContent-Length:%d\r\n\r\n%s", len(pac), pac))
-	fmt.Println("PACServer:", listenAddr)
 	for {
 		client, err := l.Accept()
 		if err != nil {
-			log.Panic(err)
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Println(err)
+			continue
 		}
 
 		go func() {
@@ -112,63 +122,580 @@ func PACServer(listenAddr string, proxyAddr string) {
 	}
 }
 
-func DNSServer(listenAddr string) error {
-	addr, err := net.ResolveUDPAddr("udp", listenAddr)
-	if err != nil {
-		return err
+func (inst *Instance) StartListener(service ptcp.ServiceConfig, default_socks string) (*Listener, error) {
+	listener := &Listener{Config: service}
+	profile := inst.Profile
+
+	switch service.Protocol {
+	case "dns":
+		addr, err := net.ResolveUDPAddr("udp", service.Address)
+		if err != nil {
+			return nil, err
+		}
+		conn, err := net.ListenUDP("udp", addr)
+		if err != nil {
+			return nil, err
+		}
+		listener.closers = append(listener.closers, conn)
+		l, err := Listen(service.Address, "")
+		if err != nil {
+			listener.Close()
+			return nil, err
+		}
+		listener.closers = append(listener.closers, l)
+		fmt.Println("DNS:", service.Address)
+		go (&ptcp.DNSServer{Profile: profile}).ServeUDP(conn)
+		go inst.Serve(l, profile.DNSTCPServer)
+	case "dot":
+		var config *tls.Config
+		if service.ACME != "" {
+			var err error
+			config, err = ACMETLSConfig(service.ACME)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			keys := strings.Split(service.PrivateKey, ",")
+			if len(keys) != 2 {
+				return nil, errors.New("dot requires privatekey=cert,key or acme=name")
+			}
+			cer, err := tls.LoadX509KeyPair(keys[0], keys[1])
+			if err != nil {
+				return nil, err
+			}
+			config = &tls.Config{Certificates: []tls.Certificate{cer}}
+		}
+		config.NextProtos = append(config.NextProtos, "dot")
+		l, err := Listen(service.Address, "")
+		if err != nil {
+			return nil, err
+		}
+		listener.closers = append(listener.closers, l)
+		fmt.Println("DoT:", service.Address)
+		go inst.Serve(l, func(client net.Conn) {
+			profile.DNSTCPServer(tls.Server(client, config))
+		})
+	case "doh":
+		mux := http.NewServeMux()
+		mux.HandleFunc("/dns-query", profile.DoHServer)
+		server := &http.Server{Addr: service.Address, Handler: mux}
+		if service.ACME != "" {
+			config, err := ACMETLSConfig(service.ACME)
+			if err != nil {
+				return nil, err
+			}
+			server.TLSConfig = config
+		} else {
+			keys := strings.Split(service.PrivateKey, ",")
+			if len(keys) != 2 {
+				return nil, errors.New("doh requires privatekey=cert,key or acme=name")
+			}
+			cer, err := tls.LoadX509KeyPair(keys[0], keys[1])
+			if err != nil {
+				return nil, err
+			}
+			server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cer}}
+		}
+		l, err := Listen(service.Address, "")
+		if err != nil {
+			return nil, err
+		}
+		// the listener too, the server only tracks it once ServeTLS runs
+		listener.closers = append(listener.closers, l, server)
+		fmt.Println("DoH:", service.Address)
+		go func() {
+			err := server.ServeTLS(l, "", "")
+			if err != nil && err != http.ErrServerClosed {
+				fmt.Println("DoH:", err)
+			}
+		}()
+	case "admin":
+		var l net.Listener
+		var err error
+		if service.ACME != "" {
+			var config *tls.Config
+			config, err = ACMETLSConfig(service.ACME)
+			if err != nil {
+				return nil, err
+			}
+			l, err = tls.Listen("tcp", service.Address, config)
+		} else {
+			l, err = Listen(service.Address, service.PrivateKey)
+		}
+		if err != nil {
+			return nil, err
+		}
+		server := &http.Server{Handler: inst.AdminHandler()}
+		listener.closers = append(listener.closers, server)
+		fmt.Println("Admin:", service.Address)
+		go server.Serve(l)
+	case "blockpage":
+		page, err := ptcp.NewBlockPage(service.PrivateKey)
+		if err != nil {
+			return nil, err
+		}
+		l, err := Listen(service.Address, "")
+		if err != nil {
+			return nil, err
+		}
+		listener.closers = append(listener.closers, l)
+		fmt.Println("BlockPage:", service.Address)
+		go inst.Serve(l, page.Serve)
+	case "socks":
+		l, err := Listen(service.Address, service.PrivateKey)
+		if err != nil {
+			return nil, err
+		}
+		listener.closers = append(listener.closers, l)
+		addr, err := net.ResolveUDPAddr("udp", service.Address)
+		if err == nil {
+			conn, err := net.ListenUDP("udp", addr)
+			if err == nil {
+				listener.closers = append(listener.closers, conn)
+				go profile.SocksUDPProxy(conn)
+			} else {
+				log.Println(err)
+			}
+		}
+		if service.Upstream != "" {
+			upstream, err := profile.NewUpstream(service.Upstream)
+			if err != nil {
+				listener.Close()
+				return nil, err
+			}
+			fmt.Println("Socks:", service.Address, "->", service.Upstream)
+			go inst.Serve(l, profile.SocksGateway(upstream))
+		} else {
+			fmt.Println("Socks:", service.Address)
+			go inst.Serve(l, profile.SocksProxy)
+		}
+	case "http":
+		var upstream *ptcp.PhantomInterface
+		if service.Upstream != "" {
+			var err error
+			upstream, err = profile.NewUpstream(service.Upstream)
+			if err != nil {
+				return nil, err
+			}
+		}
+		l, err := Listen(service.Address, service.PrivateKey)
+		if err != nil {
+			return nil, err
+		}
+		listener.closers = append(listener.closers, l)
+		fmt.Println("HTTP:", service.Address, service.Upstream)
+		go inst.Serve(l, profile.HTTPGateway(upstream))
+	case "redirect":
+		l, err := Listen(service.Address, service.PrivateKey)
+		if err != nil {
+			return nil, err
+		}
+		listener.closers = append(listener.closers, l)
+		fmt.Println("Redirect:", service.Address)
+		go inst.Serve(l, profile.RedirectProxy)
+	case "pf":
+		l, err := Listen(service.Address, service.PrivateKey)
+		if err != nil {
+			return nil, err
+		}
+		listener.closers = append(listener.closers, l)
+		fmt.Println("PF:", service.Address)
+		go inst.Serve(l, profile.PFProxy)
+	case "tproxy":
+		conn, err := ptcp.ListenTProxyUDP(service.Address)
+		if err != nil {
+			return nil, err
+		}
+		listener.closers = append(listener.closers, conn)
+		l, err := ptcp.ListenTProxyTCP(service.Address)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		listener.closers = append(listener.closers, l)
+		fmt.Println("TProxy:", service.Address)
+		go profile.TProxyUDP(conn)
+		go inst.Serve(l, profile.TProxyProxy)
+	case "tun":
+		// the name is kept for a capture of the whole device
+		return nil, errors.New("tun: a whole-device capture is not supported, fake-tun only takes the fake addresses")
+	case "fake-tun":
+		name, address, mtu := service.Device, service.Address, service.MTU
+		if name == "" {
+			name = "phantom0"
+		}
+		if address == "" {
+			address = "198.18.0.1/30"
+		}
+		if mtu == 0 {
+			mtu = 1500
+		}
+		dev, err := profile.StartFakeTUN(name, address, mtu)
+		if err != nil {
+			return nil, err
+		}
+		listener.closers = append(listener.closers, dev)
+		fmt.Println("Fake TUN:", name, address)
+	case "divert":
+		svc, err := profile.StartDivert(service.Address, service.Ports, service.Processes)
+		if err != nil {
+			return nil, err
+		}
+		listener.closers = append(listener.closers, svc)
+		fmt.Println("Divert:", service.Address, service.Ports, strings.Join(service.Processes, ","))
+	case "tcp":
+		if len(service.Peers) == 0 {
+			return nil, errors.New("tcp mapping requires a peer")
+		}
+		l, err := Listen(service.Address, service.PrivateKey)
+		if err != nil {
+			return nil, err
+		}
+		listener.closers = append(listener.closers, l)
+		fmt.Println("TCP:", service.Address, service.Peers[0].Endpoint)
+		go ptcp.TCPMapping(l, service.Peers[0].Endpoint)
+	case "udp":
+		if len(service.Peers) == 0 {
+			return nil, errors.New("udp mapping requires a peer")
+		}
+		conn, err := ptcp.ListenUDPMapping(service.Address)
+		if err != nil {
+			return nil, err
+		}
+		listener.closers = append(listener.closers, conn)
+		fmt.Println("UDP:", service.Address, service.Peers[0].Endpoint)
+		go ptcp.ServeUDPMapping(conn, service.Address, service.Peers[0].Endpoint)
+	case "pac":
+		if default_socks == "" {
+			return nil, errors.New("pac requires a socks service")
+		}
+		l, err := Listen(service.Address, "")
+		if err != nil {
+			return nil, err
+		}
+		listener.closers = append(listener.closers, l)
+		fmt.Println("PACServer:", service.Address)
+		go PACServer(l, profile, default_socks)
+	case "dhcp":
+		if service.PAC == "" {
+			return nil, errors.New("dhcp requires pac=url")
+		}
+		addr, err := net.ResolveUDPAddr("udp4", service.Address)
+		if err != nil {
+			return nil, err
+		}
+		conn, err := net.ListenUDP("udp4", addr)
+		if err != nil {
+			return nil, err
+		}
+		listener.closers = append(listener.closers, conn)
+		fmt.Println("DHCP:", service.Address)
+		go ptcp.DHCPInformServer(conn, service.PAC)
+	case "reverse":
+		// a host without a port takes HTTPS and HTTP
+		addresses := []string{service.Address}
+		if _, _, err := net.SplitHostPort(service.Address); err != nil {
+			host := strings.Trim(service.Address, "[]")
+			addresses = []string{net.JoinHostPort(host, "443"), net.JoinHostPort(host, "80")}
+		}
+		for i, address := range addresses {
+			l, err := Listen(address, service.PrivateKey)
+			if err != nil {
+				listener.Close()
+				return nil, err
+			}
+			listener.closers = append(listener.closers, l)
+			if i == 0 {
+				conn, err := ptcp.ListenUDP(address)
+				if err == nil {
+					listener.closers = append(listener.closers, conn)
+					go profile.QUICProxy(conn)
+				} else {
+					log.Println(err)
+				}
+			}
+			fmt.Println("Reverse:", address)
+			go inst.Serve(l, profile.SNIProxy)
+		}
+	default:
+		return nil, errors.New("unsupported protocol: " + service.Protocol)
 	}
-	conn, err := net.ListenUDP("udp", addr)
-	if err != nil {
-		return err
+
+	return listener, nil
+}
+
+// ConfigureListeners starts, stops and rebinds listeners so they match
+// services. Unchanged listeners keep running and closing a listener does
+// not affect connections it has already accepted.
+func (inst *Instance) ConfigureListeners(services []ptcp.ServiceConfig) {
+	default_socks := ""
+	for _, service := range services {
+		if service.Protocol == "socks" {
+			default_socks = service.Address
+			break
+		}
 	}
-	defer conn.Close()
 
-	fmt.Println("DNS:", listenAddr)
-	go ListenAndServe(listenAddr, "", ptcp.DNSTCPServer)
+	keep := make(map[string]bool)
+	for _, service := range services {
+		name := service.Name
+		if name == "" {
+			name = service.Protocol + "://" + service.Address
+		}
+		keep[name] = true
 
-	data := make([]byte, 512)
-	for {
-		n, clientAddr, err := conn.ReadFromUDP(data)
+		l, ok := inst.ListenerMap[name]
+		if ok {
+			if reflect.DeepEqual(l.Config, service) {
+				continue
+			}
+			fmt.Println("Close:", name)
+			l.Close()
+			delete(inst.ListenerMap, name)
+		}
+
+		l, err := inst.StartListener(service, default_socks)
 		if err != nil {
+			fmt.Println(name, err)
 			continue
 		}
+		inst.ListenerMap[name] = l
+	}
 
-		request := make([]byte, n)
-		copy(request, data[:n])
-		go func(clientAddr *net.UDPAddr, request []byte) {
-			_, response := ptcp.NSRequest(request, true)
-			conn.WriteToUDP(response, clientAddr)
-		}(clientAddr, request)
+	for name, l := range inst.ListenerMap {
+		if !keep[name] {
+			fmt.Println("Close:", name)
+			l.Close()
+			delete(inst.ListenerMap, name)
+		}
 	}
 }
 
-func StartService() {
-	conf, err := os.Open(ConfigFile)
+type InstanceConfig struct {
+	Name      string `json:"name,omitempty"`
+	HostsFile string `json:"hosts,omitempty"`
+	Preset    string `json:"preset,omitempty"`
+
+	Blocklists []string `json:"blocklists,omitempty"`
+	Allowlists []string `json:"allowlists,omitempty"`
+
+	Clients    []string               `json:"clients,omitempty"`
+	Profiles   []string               `json:"profiles,omitempty"`
+	Services   []ptcp.ServiceConfig   `json:"services,omitempty"`
+	Interfaces []ptcp.InterfaceConfig `json:"interfaces,omitempty"`
+}
+
+type Config struct {
+	VirtualAddrPrefix int    `json:"vaddrprefix,omitempty"`
+	VirtualAddrHash   bool   `json:"vaddrhash,omitempty"`
+	SystemProxy       string `json:"proxy,omitempty"`
+	Hook              string `json:"hook,omitempty"`
+	Preload           string `json:"preload,omitempty"`
+	Trace             string `json:"trace,omitempty"`
+	IdleTimeout       int    `json:"idletimeout,omitempty"`
+	MaxLifetime       int    `json:"maxlifetime,omitempty"`
+
+	FirstByteTimeout int    `json:"firstbytetimeout,omitempty"`
+	SilentAction     string `json:"silentaction,omitempty"`
+	UnknownAction    string `json:"unknownaction,omitempty"`
+	Fail             string `json:"fail,omitempty"` //"open" passes traffic through when capture, DNS or the proxy is unavailable
+
+	State    string `json:"state,omitempty"`
+	DNSCache string `json:"dnscache,omitempty"` //older name of state
+
+	DisableRules int `json:"disablerules,omitempty"` //days after which rules that never matched are disabled
+
+	Chaos    *ptcp.ChaosConfig `json:"chaos,omitempty"`
+	ACME     *ACMEConfig       `json:"acme,omitempty"`
+	Findings *FindingsConfig   `json:"findings,omitempty"`
+
+	InstanceConfig
+	Instances []InstanceConfig `json:"instances,omitempty"`
+
+	included []string //the files of "include"
+}
+
+func LoadConfig(filename string) (*Config, error) {
+	var files []string
+	tree, err := readConfig(filename, 0, &files)
 	if err != nil {
-		fmt.Println(err)
+		return nil, err
+	}
+	bytes, err := json.Marshal(tree)
+	if err != nil {
+		return nil, err
+	}
+
+	var config Config
+	err = json.Unmarshal(bytes, &config)
+	if err != nil {
+		return nil, err
+	}
+	config.included = files[1:]
+
+	config.Interfaces, err = ptcp.PresetInterfaces(config.Preset, config.Interfaces)
+	if err != nil {
+		return nil, err
+	}
+	for i, c := range config.Instances {
+		config.Instances[i].Interfaces, err = ptcp.PresetInterfaces(c.Preset, c.Interfaces)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &config, nil
+}
+
+func (inst *Instance) SetAllowlist(clients []string) {
+	if len(clients) == 0 {
+		inst.allowlist = nil
 		return
 	}
 
-	bytes, err := ioutil.ReadAll(conf)
+	list := make(map[string]bool)
+	for _, c := range clients {
+		list[c] = true
+	}
+	inst.allowlist = list
+}
+
+func (inst *Instance) LoadProfiles(config InstanceConfig) error {
+	return loadRules(inst.Profile, config)
+}
+
+// ReloadProfiles reads the rules and hosts files of the instance again,
+// the current rules are kept if one of them fails
+func (inst *Instance) ReloadProfiles(config InstanceConfig) error {
+	return inst.Profile.ReloadRules(func(profile *ptcp.PhantomProfile) error {
+		return loadRules(profile, config)
+	})
+}
+
+func loadRules(profile *ptcp.PhantomProfile, config InstanceConfig) error {
+	if config.Preset != "" {
+		err := profile.LoadPreset(config.Preset)
+		if err != nil {
+			return err
+		}
+	}
+	for _, filename := range config.Profiles {
+		err := profile.LoadProfile(filename)
+		if err != nil {
+			return err
+		}
+	}
+	if config.HostsFile != "" {
+		err := profile.LoadHosts(config.HostsFile)
+		if err != nil {
+			return err
+		}
+	}
+	for _, filename := range config.Allowlists {
+		err := profile.LoadFilter(filename, true)
+		if err != nil {
+			return err
+		}
+	}
+	for _, filename := range config.Blocklists {
+		err := profile.LoadFilter(filename, false)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// the files a reload reads, config.json first
+func ruleFiles(config *Config) []string {
+	files := append([]string{ConfigFile}, config.included...)
+	for _, c := range append([]InstanceConfig{config.InstanceConfig}, config.Instances...) {
+		files = append(files, c.Profiles...)
+		files = append(files, c.HostsFile)
+		files = append(files, c.Allowlists...)
+		files = append(files, c.Blocklists...)
+	}
+	return append(files, ptcp.IncludeFiles()...)
+}
+
+// the reloads asked for by the admin services, each answered with the
+// error of the reload
+var reloadRequests = make(chan chan error)
+
+// reloadConfig reads config.json again, applies it and reloads the
+// rules of every instance; it returns the config read, nil when it
+// failed, and the first error
+func reloadConfig() (*Config, error) {
+	config, err := LoadConfig(ConfigFile)
 	if err != nil {
-		log.Panic(err)
+		fmt.Println(err)
+		return nil, err
+	}
+	ptcp.SetRelayTimeouts(time.Duration(config.IdleTimeout)*time.Second, time.Duration(config.MaxLifetime)*time.Second)
+	ConfigureInstances(config)
+	for _, ic := range append([]InstanceConfig{config.InstanceConfig}, config.Instances...) {
+		inst, ok := InstanceMap[ic.Name]
+		if !ok {
+			continue
+		}
+		if e := inst.ReloadProfiles(ic); e != nil {
+			log.Println(ic.Name, e)
+			if err == nil {
+				err = fmt.Errorf("%s: %v", ic.Name, e)
+			}
+		}
+	}
+	rebuildCapture()
+	return config, err
+}
+
+// the capture filters follow the rules and cached names of every instance
+func rebuildCapture() {
+	profiles := make([]*ptcp.PhantomProfile, 0, len(InstanceMap))
+	for _, inst := range InstanceMap {
+		profiles = append(profiles, inst.Profile)
+	}
+	ptcp.RebuildCapture(profiles...)
+}
+
+// ConfigureInstances applies the clients and services of each instance,
+// instances are only created at startup, removed ones stop listening
+func ConfigureInstances(config *Config) {
+	keep := make(map[string]bool)
+	for _, c := range append([]InstanceConfig{config.InstanceConfig}, config.Instances...) {
+		inst, ok := InstanceMap[c.Name]
+		if !ok {
+			fmt.Println(c.Name, "new instances require a restart")
+			continue
+		}
+		keep[c.Name] = true
+		inst.SetAllowlist(c.Clients)
+		inst.ConfigureListeners(c.Services)
 	}
-	conf.Close()
 
-	var ServiceConfig struct {
-		VirtualAddrPrefix int    `json:"vaddrprefix,omitempty"`
-		SystemProxy       string `json:"proxy,omitempty"`
-		HostsFile         string `json:"hosts,omitempty"`
+	for name, inst := range InstanceMap {
+		if !keep[name] {
+			inst.ConfigureListeners(nil)
+		}
+	}
+}
 
-		Clients    []string               `json:"clients,omitempty"`
-		Profiles   []string               `json:"profiles,omitempty"`
-		Services   []ptcp.ServiceConfig   `json:"services,omitempty"`
-		Interfaces []ptcp.InterfaceConfig `json:"interfaces,omitempty"`
+func saveState(filename string) {
+	profiles := make(map[string]*ptcp.PhantomProfile)
+	for name, inst := range InstanceMap {
+		profiles[name] = inst.Profile
 	}
+	err := ptcp.SaveState(filename, profiles)
+	if err != nil {
+		log.Println(err)
+	}
+}
 
-	err = json.Unmarshal(bytes, &ServiceConfig)
+func StartService() {
+	ServiceConfig, err := LoadConfig(ConfigFile)
 	if err != nil {
-		log.Panic(err)
+		fmt.Println(err)
+		return
 	}
 
 	if MaxProcs > 0 {
@@ -177,19 +704,86 @@ func StartService() {
 
 	ptcp.LogLevel = LogLevel
 	ptcp.PassiveMode = PassiveMode
-	devices := ptcp.CreateInterfaces(ServiceConfig.Interfaces)
+	ptcp.AddressHook = ServiceConfig.Hook
+	ptcp.Chaos = ServiceConfig.Chaos
+	if ServiceConfig.ACME != nil {
+		ACME = *ServiceConfig.ACME
+	}
+	if ServiceConfig.Findings != nil {
+		Findings = *ServiceConfig.Findings
+	}
+	ptcp.TraceDir = ServiceConfig.Trace
+	ptcp.SetRelayTimeouts(time.Duration(ServiceConfig.IdleTimeout)*time.Second, time.Duration(ServiceConfig.MaxLifetime)*time.Second)
+	if ServiceConfig.FirstByteTimeout != 0 {
+		ptcp.FirstByteTimeout = time.Duration(ServiceConfig.FirstByteTimeout) * time.Second
+	}
+	if ServiceConfig.SilentAction != "" {
+		ptcp.SilentAction = ServiceConfig.SilentAction
+	}
+	if ServiceConfig.UnknownAction != "" {
+		ptcp.UnknownAction = ServiceConfig.UnknownAction
+	}
+	switch ServiceConfig.Fail {
+	case "", "closed":
+	case "open":
+		ptcp.FailOpen = true
+	default:
+		fmt.Println("fail:", ServiceConfig.Fail, "is neither open nor closed")
+		return
+	}
+	if ServiceConfig.VirtualAddrPrefix != 0 {
+		ptcp.SetVirtualNet(fmt.Sprintf("%d.0.0.0/8", ServiceConfig.VirtualAddrPrefix))
+	}
+	ptcp.HashedFakeAddresses = ServiceConfig.VirtualAddrHash
+	if ServiceConfig.State == "" {
+		ServiceConfig.State = ServiceConfig.DNSCache
+	}
+	if ServiceConfig.State != "" {
+		err := ptcp.LoadState(ServiceConfig.State)
+		if err != nil && !os.IsNotExist(err) {
+			log.Println(err)
+		}
+	}
+	devices, err := ptcp.CreateInterfaces(ServiceConfig.Interfaces)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	InstanceMap[""] = &Instance{Profile: ptcp.DefaultProfile, ListenerMap: make(map[string]*Listener)}
 
-	for _, filename := range ServiceConfig.Profiles {
-		err := ptcp.LoadProfile(filename)
+	capture := devices
+	for _, c := range ServiceConfig.Instances {
+		if _, ok := InstanceMap[c.Name]; ok {
+			fmt.Println(c.Name, "duplicate instance")
+			return
+		}
+		profile, profileDevices, err := ptcp.NewProfile(c.Interfaces)
 		if err != nil {
-			if ptcp.LogLevel > 0 {
-				log.Println(err)
+			fmt.Println(c.Name, err)
+			return
+		}
+		profile.Instance = c.Name
+		InstanceMap[c.Name] = &Instance{Profile: profile, ListenerMap: make(map[string]*Listener)}
+		for _, dev := range profileDevices {
+			found := false
+			for _, d := range capture {
+				found = found || d == dev
 			}
+			if !found {
+				capture = append(capture, dev)
+			}
+		}
+	}
+	if !preflight(ServiceConfig, capture, false) {
+		if !ptcp.FailOpen {
+			fmt.Println("phantomsocks -check lists what is missing, \"fail\": \"open\" starts without it")
 			return
 		}
 	}
-	if ServiceConfig.HostsFile != "" {
-		err := ptcp.LoadHosts(ServiceConfig.HostsFile)
+	ptcp.StartMonitor(capture)
+
+	for _, c := range append([]InstanceConfig{ServiceConfig.InstanceConfig}, ServiceConfig.Instances...) {
+		err := InstanceMap[c.Name].LoadProfiles(c)
 		if err != nil {
 			if ptcp.LogLevel > 0 {
 				log.Println(err)
@@ -198,80 +792,39 @@ func StartService() {
 		}
 	}
 
-	if len(ServiceConfig.Clients) > 0 {
-		allowlist = make(map[string]bool)
-		list := ServiceConfig.Clients
-		for _, c := range list {
-			allowlist[c] = true
-		}
+	if err := ptcp.InstallVirtualRoute(); err != nil {
+		log.Println(err)
 	}
 
-	default_socks := ""
-	for _, service := range ServiceConfig.Services {
-		switch service.Protocol {
-		case "dns":
-			go func(addr string) {
-				err := DNSServer(addr)
-				if err != nil {
-					fmt.Println("DNS:", err)
-				}
-			}(service.Address)
-		case "doh":
-			go func(addr string, certs []string) {
-				fmt.Println("DoH:", addr)
-				http.HandleFunc("/dns-query", ptcp.DoHServer)
-				err := http.ListenAndServeTLS(addr, certs[0], certs[1], nil)
-				if err != nil {
-					fmt.Println("DoH:", err)
-				}
-			}(service.Address, strings.Split(service.PrivateKey, ","))
-		case "socks":
-			fmt.Println("Socks:", service.Address)
-			go ListenAndServe(service.Address, service.PrivateKey, ptcp.SocksProxy)
-			go ptcp.SocksUDPProxy(service.Address)
-			default_socks = service.Address
-		case "redirect":
-			fmt.Println("Redirect:", service.Address)
-			go ListenAndServe(service.Address, service.PrivateKey, ptcp.RedirectProxy)
-		case "tproxy":
-			fmt.Println("TProxy:", service.Address)
-			go ptcp.TProxyUDP(service.Address)
-		case "tcp":
-			fmt.Println("TCP:", service.Address, service.Peers[0].Endpoint)
-			var l net.Listener
-			keys := strings.Split(service.PrivateKey, ",")
-			if len(keys) == 2 {
-				cer, err := tls.LoadX509KeyPair(keys[0], keys[1])
-				if err == nil {
-					config := &tls.Config{Certificates: []tls.Certificate{cer}}
-					l, err = tls.Listen("tcp", service.Address, config)
-				}
-			} else {
-				if service.Address[0] == '[' {
-					l, err = net.Listen("tcp6", service.Address)
-				} else {
-					l, err = net.Listen("tcp", service.Address)
-				}
+	if ServiceConfig.State != "" {
+		for name, inst := range InstanceMap {
+			inst.Profile.RestoreDNSCache(name)
+			inst.Profile.RestoreRuleHits(name)
+			if ServiceConfig.DisableRules > 0 {
+				inst.Profile.DisableIdleRules(ServiceConfig.DisableRules)
 			}
-			if err != nil {
-				log.Println(err)
-				continue
+		}
+		go func() {
+			for {
+				time.Sleep(ptcp.StateInterval)
+				saveState(ServiceConfig.State)
 			}
+		}()
+	}
 
-			go ptcp.TCPMapping(l, service.Peers[0].Endpoint)
-		case "udp":
-			go ptcp.UDPMapping(service.Address, service.Peers[0].Endpoint)
-		case "pac":
-			if default_socks != "" {
-				go PACServer(service.Address, default_socks)
+	rebuildCapture()
+
+	if ServiceConfig.Preload != "" {
+		go func() {
+			err := ptcp.DefaultProfile.Preload(ServiceConfig.Preload)
+			if err != nil {
+				log.Println(err)
 			}
-		case "reverse":
-			fmt.Println("Reverse:", service.Address)
-			go ListenAndServe(service.Address, service.PrivateKey, ptcp.SNIProxy)
-			go ptcp.QUICProxy(service.Address)
-		}
+		}()
 	}
 
+	ConfigureInstances(ServiceConfig)
+
 	if ServiceConfig.SystemProxy != "" {
 		for _, dev := range devices {
 			err := proxy.SetProxy(dev, ServiceConfig.SystemProxy, true)
@@ -281,14 +834,47 @@ func StartService() {
 		}
 	}
 
-	if ServiceConfig.VirtualAddrPrefix != 0 {
-		ptcp.VirtualAddrPrefix = byte(ServiceConfig.VirtualAddrPrefix)
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, os.Kill, syscall.SIGHUP)
+	watch := ptcp.NewFileWatch(ruleFiles(ServiceConfig))
+	var changed <-chan time.Time
+	if ptcp.RulesWatchInterval > 0 {
+		ticker := time.NewTicker(ptcp.RulesWatchInterval)
+		defer ticker.Stop()
+		changed = ticker.C
 	}
+signals:
+	for {
+		var done chan error
+		select {
+		case s := <-c:
+			fmt.Println(s)
+			if s != syscall.SIGHUP {
+				break signals
+			}
+		case <-changed:
+			files := watch.Changed()
+			if len(files) == 0 {
+				continue
+			}
+			fmt.Println("changed:", strings.Join(files, " "))
+		case done = <-reloadRequests:
+			fmt.Println("reload requested")
+		}
 
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, os.Kill)
-	s := <-c
-	fmt.Println(s)
+		config, err := reloadConfig()
+		if config != nil {
+			watch = ptcp.NewFileWatch(ruleFiles(config))
+		}
+		if done != nil {
+			done <- err
+		}
+	}
+
+	if ServiceConfig.State != "" {
+		saveState(ServiceConfig.State)
+	}
+	ptcp.RemoveVirtualRoute()
 
 	if ServiceConfig.SystemProxy != "" {
 		for _, dev := range devices {
@@ -307,6 +893,11 @@ func main() {
 	var flagServiceRemove bool
 	var flagServiceStart bool
 	var flagServiceStop bool
+	var flagReplay string
+	var flagStrategy string
+	var flagFindings string
+	var flagCheck bool
+	var flagValidate bool
 
 	if len(os.Args) > 1 {
 		flag.StringVar(&ConfigFile, "c", "config.json", "Config file")
@@ -317,6 +908,11 @@ func main() {
 		flag.BoolVar(&flagServiceRemove, "remove", false, "Remove service")
 		flag.BoolVar(&flagServiceStart, "start", false, "Start service")
 		flag.BoolVar(&flagServiceStop, "stop", false, "Stop service")
+		flag.StringVar(&flagReplay, "replay", "", "Replay a connection trace")
+		flag.StringVar(&flagStrategy, "strategy", "", "Translate a zapret/byedpi/GoodbyeDPI strategy")
+		flag.StringVar(&flagFindings, "findings", "", "Print the config of shared findings bundles")
+		flag.BoolVar(&flagCheck, "check", false, "Check the privileges and kernel features the config needs")
+		flag.BoolVar(&flagValidate, "validate", false, "Check the config, rules and servers without starting")
 		flag.Parse()
 
 		if flagServiceInstall {
@@ -338,6 +934,57 @@ func main() {
 			proxy.StopService()
 			return
 		}
+
+		if flagCheck {
+			ptcp.LogLevel = LogLevel
+			if !CheckConfig(ConfigFile) {
+				os.Exit(1)
+			}
+			return
+		}
+
+		if flagValidate {
+			ptcp.LogLevel = LogLevel
+			if !ValidateConfig(ConfigFile) {
+				os.Exit(1)
+			}
+			return
+		}
+
+		if flagReplay != "" {
+			err := ptcp.ReplayTrace(flagReplay)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			return
+		}
+
+		if flagFindings != "" {
+			config, err := LoadConfig(ConfigFile)
+			if err == nil && config.Findings != nil {
+				Findings = *config.Findings
+			}
+			err = Findings.ImportFindings(flagFindings)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			return
+		}
+
+		if flagStrategy != "" {
+			hints, ttl, unsupported := ptcp.TranslateStrategy(flagStrategy)
+			fmt.Printf("\"hint\": \"%s\"", strings.Join(hints, ","))
+			if ttl > 0 {
+				fmt.Printf(", \"ttl\": %d", ttl)
+			}
+			fmt.Println()
+			if len(unsupported) > 0 {
+				fmt.Println("unsupported:", strings.Join(unsupported, " "))
+			}
+			return
+		}
 	} else {
 		if proxy.RunAsService(StartService) {
 			return
@@ -0,0 +1,409 @@
+//go:build linux && afpacket
+// +build linux,afpacket
+
+package phantomtcp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"golang.org/x/sys/unix"
+)
+
+type packetSocket struct {
+	fd       int
+	ifindex  int
+	linkType layers.LinkType
+	closed   int32
+	buf      []byte //read into, the packets returned are copies
+}
+
+// the filter accepts at most that much of a packet
+const packetSnapLen = 0xffff
+
+// closing a socket does not wake up a Recvfrom blocked on it, so it reads
+// with a timeout and the reader closes the socket once Close was called
+const packetSocketTimeout = time.Second
+
+// above that many targets their addresses are widened to networks, an
+// IPv6 network takes up to 22 of the 4096 instructions of a filter
+const packetFilterMaxTargets = 128
+
+// the scratch memory of a filter keeps the offsets of the IP header and
+// of the TCP header
+const (
+	bpfIPOffset  = 0
+	bpfTCPOffset = 1
+)
+
+type bpfInsn struct {
+	label  string
+	code   uint16
+	k      uint32
+	jt, jf string //jt of a BPF_JA is its offset, it may jump that far
+}
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
+
+func assembleBPF(insns []bpfInsn) []unix.SockFilter {
+	labels := make(map[string]int)
+	for i, insn := range insns {
+		if insn.label != "" {
+			labels[insn.label] = i
+		}
+	}
+
+	prog := make([]unix.SockFilter, len(insns))
+	for i, insn := range insns {
+		prog[i] = unix.SockFilter{Code: insn.code, K: insn.k}
+		if insn.code == unix.BPF_JMP|unix.BPF_JA {
+			prog[i].K = uint32(labels[insn.jt] - i - 1)
+			continue
+		}
+		if insn.jt != "" {
+			prog[i].Jt = uint8(labels[insn.jt] - i - 1)
+		}
+		if insn.jf != "" {
+			prog[i].Jf = uint8(labels[insn.jf] - i - 1)
+		}
+	}
+	return prog
+}
+
+// a field of the IP or TCP header, masked, that a target needs to equal
+type bpfCond struct {
+	offset uint32 //scratch memory of the header offset
+	size   uint16
+	k      uint32
+	mask   uint32 //0 for the whole field
+	value  uint32
+}
+
+// targetConds returns the fields of packets from or to target, of an
+// IPv4 header or of an IPv6 header
+func targetConds(target CaptureTarget, ipv6 bool, dst bool) []bpfCond {
+	var conds []bpfCond
+	if target.Net != nil {
+		k := uint32(12)
+		if ipv6 {
+			k = 8
+		}
+		if dst {
+			k += uint32(len(target.Net.IP))
+		}
+		for i := 0; i < len(target.Net.IP); i += 4 {
+			mask := binary.BigEndian.Uint32(target.Net.Mask[i:])
+			if mask == 0 {
+				continue
+			}
+			value := binary.BigEndian.Uint32(target.Net.IP[i:]) & mask
+			if mask == 0xffffffff {
+				mask = 0
+			}
+			conds = append(conds, bpfCond{bpfIPOffset, unix.BPF_W, k + uint32(i), mask, value})
+		}
+	}
+	if target.Port != 0 {
+		k := uint32(0)
+		if dst {
+			k = 2
+		}
+		conds = append(conds, bpfCond{bpfTCPOffset, unix.BPF_H, k, 0, uint32(target.Port)})
+	}
+	return conds
+}
+
+// targetInsns accepts the packets from or to one of the targets of the
+// family, X holds the offset the fields of a condition are loaded at
+func targetInsns(prefix string, targets []CaptureTarget, ipv6 bool) []bpfInsn {
+	var checks [][]bpfCond
+	for _, target := range targets {
+		if target.Net != nil && (len(target.Net.IP) == net.IPv6len) != ipv6 {
+			continue
+		}
+		checks = append(checks, targetConds(target, ipv6, false), targetConds(target, ipv6, true))
+	}
+
+	var insns []bpfInsn
+	for i, conds := range checks {
+		start := len(insns)
+		next := prefix + strconv.Itoa(i+1)
+		for j, cond := range conds {
+			if j == 0 || cond.offset != conds[j-1].offset {
+				insns = append(insns, bpfInsn{code: unix.BPF_LDX | unix.BPF_W | unix.BPF_MEM, k: cond.offset})
+			}
+			insns = append(insns, bpfInsn{code: unix.BPF_LD | cond.size | unix.BPF_IND, k: cond.k})
+			if cond.mask != 0 {
+				insns = append(insns, bpfInsn{code: unix.BPF_ALU | unix.BPF_AND | unix.BPF_K, k: cond.mask})
+			}
+			insns = append(insns, bpfInsn{code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, k: cond.value, jf: next})
+		}
+		insns = append(insns, bpfInsn{code: unix.BPF_RET | unix.BPF_K, k: packetSnapLen})
+		insns[start].label = prefix + strconv.Itoa(i)
+	}
+	return append(insns, bpfInsn{label: prefix + strconv.Itoa(len(checks)), code: unix.BPF_RET | unix.BPF_K, k: 0})
+}
+
+// SYNs of the IPv4 and IPv6 headers at the offset in X, to or from the
+// targets or of every address without them
+func synInsns(targets []CaptureTarget) []bpfInsn {
+	insns := []bpfInsn{
+		{label: "ip4", code: unix.BPF_STX, k: bpfIPOffset},
+		{code: unix.BPF_LD | unix.BPF_B | unix.BPF_IND, k: 9},
+		{code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, k: 6, jt: "tcp4"},
+		{code: unix.BPF_RET | unix.BPF_K, k: 0},
+		{label: "tcp4", code: unix.BPF_LD | unix.BPF_B | unix.BPF_IND, k: 0},
+		{code: unix.BPF_ALU | unix.BPF_AND | unix.BPF_K, k: 0xf},
+		{code: unix.BPF_ALU | unix.BPF_LSH | unix.BPF_K, k: 2},
+		{code: unix.BPF_ALU | unix.BPF_ADD | unix.BPF_X},
+		{code: unix.BPF_ST, k: bpfTCPOffset},
+		{code: unix.BPF_MISC | unix.BPF_TAX},
+		{code: unix.BPF_LD | unix.BPF_B | unix.BPF_IND, k: 13},
+		{code: unix.BPF_JMP | unix.BPF_JSET | unix.BPF_K, k: 2, jt: "syn4.0"},
+		{code: unix.BPF_RET | unix.BPF_K, k: 0},
+	}
+	all := len(targets) == 0 || targets[0] == CaptureTarget{}
+	if all {
+		insns = append(insns, bpfInsn{label: "syn4.0", code: unix.BPF_RET | unix.BPF_K, k: packetSnapLen})
+	} else {
+		insns = append(insns, targetInsns("syn4.", targets, false)...)
+	}
+
+	insns = append(insns,
+		bpfInsn{label: "ip6", code: unix.BPF_STX, k: bpfIPOffset},
+		bpfInsn{code: unix.BPF_LD | unix.BPF_B | unix.BPF_IND, k: 6},
+		bpfInsn{code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, k: 6, jt: "tcp6"},
+		bpfInsn{code: unix.BPF_RET | unix.BPF_K, k: 0},
+		bpfInsn{label: "tcp6", code: unix.BPF_MISC | unix.BPF_TXA},
+		bpfInsn{code: unix.BPF_ALU | unix.BPF_ADD | unix.BPF_K, k: 40},
+		bpfInsn{code: unix.BPF_ST, k: bpfTCPOffset},
+		bpfInsn{code: unix.BPF_LD | unix.BPF_B | unix.BPF_IND, k: 53},
+		bpfInsn{code: unix.BPF_JMP | unix.BPF_JSET | unix.BPF_K, k: 2, jt: "syn6.0"},
+		bpfInsn{code: unix.BPF_RET | unix.BPF_K, k: 0},
+	)
+	if all {
+		insns = append(insns, bpfInsn{label: "syn6.0", code: unix.BPF_RET | unix.BPF_K, k: packetSnapLen})
+	} else {
+		insns = append(insns, targetInsns("syn6.", targets, true)...)
+	}
+	return insns
+}
+
+// libpcap is not available to compile filter expressions, so the filter
+// is assembled by hand; X is set to the offset of the IP header, behind
+// 802.1Q tags and PPPoE sessions as well
+func captureFilter(linkType layers.LinkType, targets []CaptureTarget) []unix.SockFilter {
+	var insns []bpfInsn
+	if linkType == layers.LinkTypeEthernet {
+		insns = []bpfInsn{
+			{code: unix.BPF_LD | unix.BPF_H | unix.BPF_ABS, k: 12},
+			{code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, k: 0x0800, jt: "eth4"},
+			{code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, k: 0x86dd, jt: "eth6"},
+			{code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, k: 0x8100, jt: "vlan"},
+			{code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, k: 0x8864, jt: "pppoe", jf: "drop"},
+			{label: "vlan", code: unix.BPF_LD | unix.BPF_H | unix.BPF_ABS, k: 16},
+			{code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, k: 0x0800, jt: "vlan4"},
+			{code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, k: 0x86dd, jt: "vlan6", jf: "drop"},
+			{label: "pppoe", code: unix.BPF_LD | unix.BPF_H | unix.BPF_ABS, k: 20},
+			{code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, k: 0x0021, jt: "pppoe4"},
+			{code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, k: 0x0057, jt: "pppoe6", jf: "drop"},
+			{label: "eth4", code: unix.BPF_LDX | unix.BPF_W | unix.BPF_IMM, k: 14},
+			{code: unix.BPF_JMP | unix.BPF_JA, jt: "ip4"},
+			{label: "eth6", code: unix.BPF_LDX | unix.BPF_W | unix.BPF_IMM, k: 14},
+			{code: unix.BPF_JMP | unix.BPF_JA, jt: "ip6"},
+			{label: "vlan4", code: unix.BPF_LDX | unix.BPF_W | unix.BPF_IMM, k: 18},
+			{code: unix.BPF_JMP | unix.BPF_JA, jt: "ip4"},
+			{label: "vlan6", code: unix.BPF_LDX | unix.BPF_W | unix.BPF_IMM, k: 18},
+			{code: unix.BPF_JMP | unix.BPF_JA, jt: "ip6"},
+			{label: "pppoe4", code: unix.BPF_LDX | unix.BPF_W | unix.BPF_IMM, k: 22},
+			{code: unix.BPF_JMP | unix.BPF_JA, jt: "ip4"},
+			{label: "pppoe6", code: unix.BPF_LDX | unix.BPF_W | unix.BPF_IMM, k: 22},
+			{code: unix.BPF_JMP | unix.BPF_JA, jt: "ip6"},
+		}
+	} else {
+		insns = []bpfInsn{
+			{code: unix.BPF_LDX | unix.BPF_W | unix.BPF_IMM, k: 0},
+			{code: unix.BPF_LD | unix.BPF_B | unix.BPF_ABS, k: 0},
+			{code: unix.BPF_ALU | unix.BPF_AND | unix.BPF_K, k: 0xf0},
+			{code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, k: 0x40, jt: "ip4"},
+			{code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, k: 0x60, jt: "raw6", jf: "drop"},
+			{label: "raw6", code: unix.BPF_JMP | unix.BPF_JA, jt: "ip6"},
+		}
+	}
+	insns = append(insns, bpfInsn{label: "drop", code: unix.BPF_RET | unix.BPF_K, k: 0})
+	insns = append(insns, synInsns(targets)...)
+
+	return assembleBPF(insns)
+}
+
+func (s *packetSocket) attachFilter(filter []unix.SockFilter) error {
+	prog := unix.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+	return unix.SetsockoptSockFprog(s.fd, syscall.SOL_SOCKET, syscall.SO_ATTACH_FILTER, &prog)
+}
+
+func openCaptureHandle(device string) (captureHandle, error) {
+	iface, err := net.InterfaceByName(device)
+	if err != nil {
+		return nil, err
+	}
+
+	// bound with protocol 0 nothing is received until the filter is attached
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	err = syscall.Bind(fd, &syscall.SockaddrLinklayer{Ifindex: iface.Index})
+	if err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+
+	sa, err := syscall.Getsockname(fd)
+	if err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+
+	// devices without a link header, such as ppp and tun, carry bare IP packets
+	linkType := layers.LinkTypeRaw
+	switch sa.(*syscall.SockaddrLinklayer).Hatype {
+	case syscall.ARPHRD_ETHER, syscall.ARPHRD_LOOPBACK:
+		linkType = layers.LinkTypeEthernet
+	}
+
+	s := &packetSocket{fd: fd, ifindex: iface.Index, linkType: linkType, buf: make([]byte, packetSnapLen)}
+	if err = s.attachFilter(captureFilter(linkType, nil)); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+
+	err = syscall.Bind(fd, &syscall.SockaddrLinklayer{Protocol: htons(syscall.ETH_P_ALL), Ifindex: iface.Index})
+	if err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+
+	tv := syscall.NsecToTimeval(int64(packetSocketTimeout))
+	err = syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv)
+	if err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// setCaptureFilter replaces the filter of the socket, it is left as it is
+// when nothing is to be captured like that of libpcap
+func setCaptureFilter(handle captureHandle) error {
+	targets := CaptureTargets(packetFilterMaxTargets)
+	if len(targets) == 0 {
+		return nil
+	}
+	err := handle.(*packetSocket).attachFilter(captureFilter(handle.LinkType(), targets))
+	if err != nil {
+		return err
+	}
+	logPrintln(2, "bpf filter:", targets)
+	return nil
+}
+
+func (s *packetSocket) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	data, ci, err := s.ZeroCopyReadPacketData()
+	if err != nil {
+		return nil, ci, err
+	}
+	return append([]byte(nil), data...), ci, nil
+}
+
+// the data returned is overwritten by the next read
+func (s *packetSocket) ZeroCopyReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	data := s.buf
+	var n int
+	for {
+		if atomic.LoadInt32(&s.closed) != 0 {
+			if atomic.CompareAndSwapInt32(&s.closed, 1, 2) {
+				syscall.Close(s.fd)
+			}
+			return nil, gopacket.CaptureInfo{}, io.EOF
+		}
+		var err error
+		n, _, err = syscall.Recvfrom(s.fd, data, 0)
+		if err == nil {
+			break
+		} else if err != syscall.EAGAIN && err != syscall.EINTR {
+			return nil, gopacket.CaptureInfo{}, err
+		}
+	}
+
+	ci := gopacket.CaptureInfo{
+		Timestamp:      time.Now(),
+		CaptureLength:  n,
+		Length:         n,
+		InterfaceIndex: s.ifindex,
+	}
+	return data[:n], ci, nil
+}
+
+func (s *packetSocket) WritePacketData(data []byte) error {
+	if atomic.LoadInt32(&s.closed) != 0 {
+		return io.ErrClosedPipe
+	}
+	protocol := uint16(syscall.ETH_P_IP)
+	if s.linkType == layers.LinkTypeRaw && len(data) > 0 && data[0]>>4 == 6 {
+		protocol = syscall.ETH_P_IPV6
+	}
+	return syscall.Sendto(s.fd, data, 0, &syscall.SockaddrLinklayer{Protocol: htons(protocol), Ifindex: s.ifindex})
+}
+
+func (s *packetSocket) LinkType() layers.LinkType {
+	return s.linkType
+}
+
+func (s *packetSocket) Close() {
+	atomic.CompareAndSwapInt32(&s.closed, 0, 1)
+}
+
+func DevicePrint() {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	fmt.Println("Devices found:")
+	for _, iface := range ifaces {
+		fmt.Println("\nName: ", iface.Name)
+		addrs, _ := iface.Addrs()
+		for _, addr := range addrs {
+			fmt.Println("- IP address: ", addr.String())
+		}
+	}
+}
+
+// packet sockets capture, raw sockets send the modified segments
+func captureCheck(devices []string) []PreflightCheck {
+	fix := "run as root or setcap cap_net_raw,cap_net_admin+ep phantomsocks"
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, 0)
+	if err == nil {
+		syscall.Close(fd)
+	}
+	checks := []PreflightCheck{newCheck("packet socket", err, fix)}
+	fd, err = syscall.Socket(syscall.AF_INET, syscall.SOCK_RAW, syscall.IPPROTO_RAW)
+	if err == nil {
+		syscall.Close(fd)
+	}
+	checks = append(checks, newCheck("raw socket", err, fix))
+	return append(checks, deviceCheck(devices)...)
+}
@@ -0,0 +1,84 @@
+package phantomtcp
+
+import (
+	"encoding/binary"
+	"strings"
+)
+
+// "alpn" on an interface rewrites the ALPN extension of the fake
+// ClientHellos sent for its rules: "none" removes it and a list like
+// "http/1.1" replaces the protocols offered, so a DPI keyed on ALPN
+// classifies the connection by the fake. The ClientHello of the client
+// itself is left as is, its handshake covers every byte of it.
+
+// alpnExtension returns the offset and length of the data of the ALPN
+// extension of the ClientHello b, -1 when it has none
+func alpnExtension(b []byte) (int, int) {
+	offset, length := -1, 0
+	hello := helloExtensions(b, func(ext uint16, data []byte) {
+		if ext == 16 {
+			// data is a slice of b, its offset is what b has beyond it
+			offset = cap(b) - cap(data)
+			length = len(data)
+		}
+	})
+	if hello != 1 {
+		return -1, 0
+	}
+	return offset, length
+}
+
+// the data of an ALPN extension offering protocols
+func alpnData(protocols string) []byte {
+	data := []byte{0, 0}
+	for _, p := range strings.Split(protocols, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" || len(p) > 255 {
+			continue
+		}
+		data = append(data, byte(len(p)))
+		data = append(data, p...)
+	}
+	binary.BigEndian.PutUint16(data, uint16(len(data)-2))
+	return data
+}
+
+// rewriteALPN rewrites the ALPN extension of the ClientHello b in place,
+// the length of b stays the same: a removed or shorter extension leaves
+// a padding extension (RFC 7685) behind, a longer one or one a byte
+// shorter is not written
+func rewriteALPN(b []byte, alpn string) bool {
+	offset, length := alpnExtension(b)
+	if offset < 4 {
+		return false
+	}
+	padding := func(at, size int) {
+		binary.BigEndian.PutUint16(b[at:], 21)
+		binary.BigEndian.PutUint16(b[at+2:], uint16(size))
+		for i := at + 4; i < at+4+size; i++ {
+			b[i] = 0
+		}
+	}
+	if alpn == "none" {
+		padding(offset-4, length)
+		return true
+	}
+
+	data := alpnData(alpn)
+	if diff := length - len(data); diff == 2 || diff == 3 {
+		// too short for a padding extension, a GREASE protocol (RFC 8701)
+		// fills it
+		data = append(data, byte(diff-1), 0x0a, 0x0a)[:length]
+		binary.BigEndian.PutUint16(data, uint16(length-2))
+	}
+	if len(data) != length && len(data)+4 > length {
+		logPrintln(3, "alpn:", alpn, "does not fit", length)
+		return false
+	}
+	copy(b[offset:], data)
+	if len(data) < length {
+		binary.BigEndian.PutUint16(b[offset-2:], uint16(len(data)))
+		padding(offset+len(data), length-len(data)-4)
+	}
+	return true
+}
@@ -0,0 +1,241 @@
+package phantomtcp
+
+import (
+	"encoding/base64"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// lists loaded from http:// or https:// URLs with autoproxy= are
+// downloaded again every AutoProxyRefreshInterval, 0 never
+var AutoProxyRefreshInterval = time.Hour * 24
+
+// a name of an AutoProxy list
+type autoproxyEntry struct {
+	key    string //of DomainMap
+	direct bool   //an @@ exception
+}
+
+// a gfwlist.txt or another AutoProxy list whose names use pface
+type autoproxyList struct {
+	source  string
+	pface   *PhantomInterface
+	entries []autoproxyEntry
+	added   map[string]*PhantomInterface //the rules of DomainMap it added
+}
+
+// the names of an AutoProxy line: ||name and a keyword name cover name
+// and its subdomains, .name its subdomains and |http://name/ the name
+// alone. Comments, regular expressions and lines with wildcards or
+// without a name do not map to rules and are skipped.
+func parseAutoProxy(line string) []autoproxyEntry {
+	direct := strings.HasPrefix(line, "@@")
+	line = strings.TrimPrefix(line, "@@")
+	if line == "" || line[0] == '!' || line[0] == '[' || line[0] == '/' || strings.Contains(line, "*") {
+		return nil
+	}
+
+	self, sub := true, true
+	switch {
+	case strings.HasPrefix(line, "||"):
+		line = line[2:]
+	case strings.HasPrefix(line, "|"):
+		scheme := strings.Index(line, "://")
+		if scheme == -1 {
+			return nil
+		}
+		line = line[scheme+3:]
+		sub = false
+	case strings.HasPrefix(line, "."):
+		line = line[1:]
+		self = false
+	}
+	if end := strings.IndexAny(line, "/?^|$"); end != -1 {
+		line = line[:end]
+	}
+	name, _ := splitHostPort(line)
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+
+	if ip := net.ParseIP(name); ip != nil {
+		return []autoproxyEntry{{ip.String(), direct}}
+	}
+	if !strings.Contains(name, ".") || strings.Trim(name, "abcdefghijklmnopqrstuvwxyz0123456789.-_") != "" {
+		return nil
+	}
+	var entries []autoproxyEntry
+	if self {
+		entries = append(entries, autoproxyEntry{name, direct})
+	}
+	if sub {
+		entries = append(entries, autoproxyEntry{"*." + name, direct})
+	}
+	return entries
+}
+
+func readAutoProxy(source string) ([]autoproxyEntry, error) {
+	file, err := openFilter(source)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+
+	// gfwlist.txt is the base64 of the list
+	decoded, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(string(data)), ""))
+	if err == nil && len(decoded) > 0 {
+		data = decoded
+	}
+
+	var entries []autoproxyEntry
+	for _, line := range strings.Split(string(data), "\n") {
+		entries = append(entries, parseAutoProxy(strings.TrimSpace(line))...)
+	}
+	logPrintln(1, "loaded", len(entries), "autoproxy rules from", source)
+	return entries, nil
+}
+
+// LoadAutoProxy reads a gfwlist.txt or another AutoProxy list, plain or
+// in base64, from a file or an URL: its names use pface and its @@
+// exceptions get a rule without an interface. A name that already has a
+// rule keeps it. A list that cannot be downloaded is tried again at the
+// next refresh.
+func (profile *PhantomProfile) LoadAutoProxy(source string, pface *PhantomInterface) error {
+	remote := strings.Contains(source, "://")
+	entries, err := readAutoProxy(source)
+	if err != nil {
+		if !remote {
+			return err
+		}
+		logPrintln(1, err)
+	}
+	profile.addAutoProxy(&autoproxyList{source: source, pface: pface, entries: entries})
+
+	if remote {
+		// the lists are refreshed by the profile itself, not by the one
+		// its rules are read again into
+		owner := profile
+		if profile.reloading != nil {
+			owner = profile.reloading
+		}
+		owner.autoproxyRefresh.Do(func() {
+			go owner.refreshAutoProxy()
+		})
+	}
+	return nil
+}
+
+// addAutoProxy adds the names of list that have no rule yet
+func (profile *PhantomProfile) addAutoProxy(list *autoproxyList) {
+	list.added = make(map[string]*PhantomInterface)
+	for _, entry := range list.entries {
+		if _, ok := profile.DomainMap[entry.key]; ok {
+			continue
+		}
+		pface := list.pface
+		if entry.direct {
+			pface = nil
+		}
+		if net.ParseIP(entry.key) == nil {
+			// as a name listed under an interface without DNS
+			if pface != nil && pface.DNS == "" && pface.Protocol == 0 {
+				pface = nil
+			}
+			if isDomainPattern(entry.key) {
+				profile.addPattern(entry.key)
+			}
+			if pface != nil {
+				profile.DNSCache.Store(entry.key, new(DNSRecords))
+			}
+		}
+		profile.DomainMap[entry.key] = pface
+		list.added[entry.key] = pface
+	}
+	profile.autoproxy = append(profile.autoproxy, list)
+}
+
+// download the remote lists again every AutoProxyRefreshInterval, a list
+// that fails keeps its names
+func (profile *PhantomProfile) refreshAutoProxy() {
+	for {
+		time.Sleep(AutoProxyRefreshInterval)
+		if AutoProxyRefreshInterval <= 0 {
+			return
+		}
+
+		current := profile.Rules()
+		fresh := make(map[*autoproxyList][]autoproxyEntry)
+		for _, list := range current.autoproxy {
+			if !strings.Contains(list.source, "://") {
+				continue
+			}
+			entries, err := readAutoProxy(list.source)
+			if err != nil {
+				logPrintln(1, "autoproxy refresh:", err)
+				continue
+			}
+			fresh[list] = entries
+		}
+		if len(fresh) == 0 {
+			continue
+		}
+
+		profile.reloadLock.Lock()
+		// a reload in the meantime has read the lists again
+		if profile.Rules() == current {
+			stale := profile.replaceRules(profile.withAutoProxy(current, fresh))
+			logPrintln(1, "refreshed", len(fresh), "autoproxy lists,", stale, "names resolved again")
+		}
+		profile.reloadLock.Unlock()
+	}
+}
+
+// withAutoProxy returns a profile to replace the rules with, a copy of
+// rules whose lists are added again, with the entries of fresh for those
+// in it
+func (profile *PhantomProfile) withAutoProxy(rules *RuleSet, fresh map[*autoproxyList][]autoproxyEntry) *PhantomProfile {
+	copied := *rules
+	copied.DomainMap = make(map[string]*PhantomInterface, len(rules.DomainMap))
+	for key, pface := range rules.DomainMap {
+		copied.DomainMap[key] = pface
+	}
+	copied.patterns = rules.patterns.clone()
+	copied.autoproxy = nil
+
+	listed := make(map[string]bool)
+	for _, list := range rules.autoproxy {
+		for key, pface := range list.added {
+			if current, ok := copied.DomainMap[key]; ok && current == pface {
+				delete(copied.DomainMap, key)
+				if isDomainPattern(key) {
+					copied.patterns.remove(key)
+				}
+				listed[key] = true
+			}
+		}
+	}
+
+	next := &PhantomProfile{
+		RuleSet:      &copied,
+		Instance:     profile.Instance,
+		InterfaceMap: profile.InterfaceMap,
+		reloading:    profile,
+	}
+	for _, name := range profile.DNSCache.Pinned() {
+		if records, ok := profile.DNSCache.Load(name); ok && !listed[name] {
+			next.DNSCache.Store(name, records)
+		}
+	}
+	for _, list := range rules.autoproxy {
+		entries, ok := fresh[list]
+		if !ok {
+			entries = list.entries
+		}
+		next.addAutoProxy(&autoproxyList{source: list.source, pface: list.pface, entries: entries})
+	}
+	return next
+}
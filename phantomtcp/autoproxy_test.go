@@ -0,0 +1,138 @@
+package phantomtcp
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseAutoProxy(t *testing.T) {
+	tests := []struct {
+		line string
+		want []autoproxyEntry
+	}{
+		{"||example.com", []autoproxyEntry{{"example.com", false}, {"*.example.com", false}}},
+		{"||Example.COM^", []autoproxyEntry{{"example.com", false}, {"*.example.com", false}}},
+		{"example.com", []autoproxyEntry{{"example.com", false}, {"*.example.com", false}}},
+		{".example.com", []autoproxyEntry{{"*.example.com", false}}},
+		{"|http://www.example.com/path", []autoproxyEntry{{"www.example.com", false}}},
+		{"|https://example.com:8443/", []autoproxyEntry{{"example.com", false}}},
+		{"@@||example.org", []autoproxyEntry{{"example.org", true}, {"*.example.org", true}}},
+		{"||1.2.3.4", []autoproxyEntry{{"1.2.3.4", false}}},
+		{"|http://[2001:db8::1]:80/", []autoproxyEntry{{"2001:db8::1", false}}},
+		{"! a comment", nil},
+		{"[AutoProxy 0.2.9]", nil},
+		{"/^https?:\\/\\/[^\\/]+example\\.com/", nil},
+		{"||*.example.com", nil},
+		{"|example.com", nil},
+		{"localhost", nil},
+		{"||exa mple.com", nil},
+		{"@@", nil},
+		{"", nil},
+	}
+	for _, tt := range tests {
+		if got := parseAutoProxy(tt.line); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: %v, want %v", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestReadAutoProxy(t *testing.T) {
+	list := "[AutoProxy 0.2.9]\n! comment\n||example.com\r\n@@||direct.example.com\n"
+	encoded := base64.StdEncoding.EncodeToString([]byte(list))
+	// gfwlist.txt wraps its base64 at 64 columns
+	var wrapped []string
+	for len(encoded) > 64 {
+		wrapped = append(wrapped, encoded[:64])
+		encoded = encoded[64:]
+	}
+	wrapped = append(wrapped, encoded)
+
+	want := []autoproxyEntry{{"example.com", false}, {"*.example.com", false}, {"direct.example.com", true}, {"*.direct.example.com", true}}
+	dir := t.TempDir()
+	for name, data := range map[string]string{"plain.txt": list, "gfwlist.txt": strings.Join(wrapped, "\n") + "\n"} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		entries, err := readAutoProxy(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(entries, want) {
+			t.Errorf("%s: %v, want %v", name, entries, want)
+		}
+	}
+
+	if _, err := readAutoProxy(filepath.Join(dir, "missing.txt")); err == nil {
+		t.Error("missing list loaded")
+	}
+}
+
+func TestAutoProxyRefreshHours(t *testing.T) {
+	saved := AutoProxyRefreshInterval
+	defer func() { AutoProxyRefreshInterval = saved }()
+
+	tests := []struct {
+		hours string
+		want  time.Duration
+		ok    bool
+	}{
+		{"6", time.Hour * 6, true},
+		{"0", time.Hour * 24, true},
+		{"-3", time.Hour * 24, true},
+		{"daily", time.Hour * 24, false},
+	}
+	for _, tt := range tests {
+		AutoProxyRefreshInterval = time.Hour * 24
+		profile, _, err := NewProfile(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = profile.ReadProfile(strings.NewReader("autoproxy-refresh="+tt.hours+"\n"), "autoproxy")
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: %v", tt.hours, err)
+		}
+		if AutoProxyRefreshInterval != tt.want {
+			t.Errorf("%s: %v, want %v", tt.hours, AutoProxyRefreshInterval, tt.want)
+		}
+	}
+}
+
+func TestLoadAutoProxy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "list.txt")
+	if err := os.WriteFile(path, []byte("||example.com\n@@||direct.example.com\n||other.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	profile, _, err := NewProfile([]InterfaceConfig{{Name: "proxy", DNS: "udp://8.8.8.8:53"}, {Name: "other", DNS: "udp://1.1.1.1:53"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules := "[other]\nother.com\nautoproxy=proxy," + path + "\n"
+	if err := profile.ReadProfile(strings.NewReader(rules), "autoproxy"); err != nil {
+		t.Fatal(err)
+	}
+	proxy, other := profile.Rules().GetInterface("example.com"), profile.Rules().GetInterface("other.com")
+	if proxy == nil || other == nil || proxy == other {
+		t.Fatalf("example.com %v, other.com %v", proxy, other)
+	}
+	tests := []struct {
+		name string
+		want *PhantomInterface
+	}{
+		{"www.example.com", proxy},
+		{"direct.example.com", nil},
+		{"a.direct.example.com", nil},
+		{"www.other.com", proxy}, //the list adds the subdomains
+		{"example.org", nil},
+	}
+	for _, tt := range tests {
+		if got := profile.Rules().GetInterface(tt.name); got != tt.want {
+			t.Errorf("%s: %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
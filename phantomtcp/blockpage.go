@@ -0,0 +1,153 @@
+package phantomtcp
+
+import (
+	"bufio"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"html"
+	"math/big"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maximum number of generated certificates kept by a block page
+var BlockPageCertCache = 1024
+
+// BlockPage answers the connections to names sinkholed to its address
+// with a page that says they are blocked. TLS connections get a
+// certificate for the SNI signed by a CA the user has installed, without
+// a CA they are closed.
+type BlockPage struct {
+	ca   *x509.Certificate
+	key  crypto.Signer
+	leaf *ecdsa.PrivateKey
+
+	lock  sync.Mutex
+	certs map[string]*tls.Certificate
+}
+
+// NewBlockPage loads the CA from "cert,key", an empty ca only serves HTTP
+func NewBlockPage(ca string) (*BlockPage, error) {
+	page := &BlockPage{certs: make(map[string]*tls.Certificate)}
+	if ca == "" {
+		return page, nil
+	}
+
+	files := strings.Split(ca, ",")
+	if len(files) != 2 {
+		return nil, errors.New("blockpage requires privatekey=cacert,cakey")
+	}
+	pair, err := tls.LoadX509KeyPair(files[0], files[1])
+	if err != nil {
+		return nil, err
+	}
+	page.ca, err = x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	if !page.ca.IsCA {
+		return nil, errors.New(files[0] + " is not a CA certificate")
+	}
+	signer, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New(files[1] + " is not a signing key")
+	}
+	page.key = signer
+	page.leaf, err = ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+// a certificate for name and the wildcard of its parent
+func (page *BlockPage) certificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(hello.ServerName)
+	if name == "" {
+		return nil, errors.New("no server name")
+	}
+
+	page.lock.Lock()
+	defer page.lock.Unlock()
+	if cert, ok := page.certs[name]; ok {
+		return cert, nil
+	}
+
+	names := []string{name}
+	if dot := strings.IndexByte(name, '.'); dot != -1 && strings.Contains(name[dot+1:], ".") {
+		names = append(names, "*"+name[dot:])
+	}
+	serial, err := crand.Int(crand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour * 24 * 30),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(crand.Reader, template, page.ca, &page.leaf.PublicKey, page.key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(page.certs) >= BlockPageCertCache {
+		page.certs = make(map[string]*tls.Certificate)
+	}
+	cert := &tls.Certificate{Certificate: [][]byte{der, page.ca.Raw}, PrivateKey: page.leaf}
+	page.certs[name] = cert
+	return cert, nil
+}
+
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (page *BlockPage) Serve(client net.Conn) {
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(time.Second * 30))
+
+	conn := &bufferedConn{client, bufio.NewReader(client)}
+	first, err := conn.r.Peek(1)
+	if err != nil {
+		return
+	}
+
+	var c net.Conn = conn
+	if first[0] == 0x16 {
+		if page.ca == nil {
+			return
+		}
+		c = tls.Server(conn, &tls.Config{GetCertificate: page.certificate})
+	}
+
+	req, err := http.ReadRequest(bufio.NewReader(c))
+	if err != nil {
+		logPrintln(3, "blockpage:", client.RemoteAddr(), err)
+		return
+	}
+	host, _ := splitHostPort(req.Host)
+	logPrintln(2, "blockpage:", client.RemoteAddr(), host)
+
+	body := fmt.Sprintf("<!DOCTYPE html>\n<html><head><title>Blocked</title></head><body><h1>Blocked</h1><p>%s is blocked by phantomsocks.</p></body></html>\n", html.EscapeString(host))
+	fmt.Fprintf(c, "HTTP/1.1 403 Forbidden\r\nContent-Type: text/html; charset=utf-8\r\nCache-Control: no-store\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s", len(body), body)
+}
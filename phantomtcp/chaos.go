@@ -0,0 +1,67 @@
+package phantomtcp
+
+import (
+	"math/rand"
+	"net"
+	"time"
+)
+
+// testing mode, connections and DNS queries are delayed, dropped or reset
+// so that rules and fallbacks can be checked without a censored network
+type ChaosConfig struct {
+	Delay int `json:"delay,omitempty"` //milliseconds added before dialing
+	Drop  int `json:"drop,omitempty"`  //percent of connections that time out
+	Reset int `json:"reset,omitempty"` //percent of connections reset after the first payload
+
+	DNSDelay int `json:"dnsdelay,omitempty"` //milliseconds added to DNS queries
+	DNSDrop  int `json:"dnsdrop,omitempty"`  //percent of DNS queries without answer
+}
+
+var Chaos *ChaosConfig = nil
+
+func chance(percent int) bool {
+	return percent > 0 && rand.Intn(100) < percent
+}
+
+// false if the connection should be dropped
+func (chaos *ChaosConfig) Dial(client net.Conn) bool {
+	if chaos == nil {
+		return true
+	}
+	if chaos.Delay > 0 {
+		time.Sleep(time.Millisecond * time.Duration(chaos.Delay))
+	}
+	if chance(chaos.Drop) {
+		logPrintln(2, "chaos: drop", client.RemoteAddr())
+		time.Sleep(time.Second * 10)
+		return false
+	}
+	return true
+}
+
+// true if the connection should be reset, the client gets a RST
+func (chaos *ChaosConfig) ResetConn(client net.Conn) bool {
+	if chaos == nil || !chance(chaos.Reset) {
+		return false
+	}
+	logPrintln(2, "chaos: reset", client.RemoteAddr())
+	if conn, ok := client.(*net.TCPConn); ok {
+		conn.SetLinger(0)
+	}
+	return true
+}
+
+// false if the query should not be answered
+func (chaos *ChaosConfig) Query(name string) bool {
+	if chaos == nil {
+		return true
+	}
+	if chaos.DNSDelay > 0 {
+		time.Sleep(time.Millisecond * time.Duration(chaos.DNSDelay))
+	}
+	if chance(chaos.DNSDrop) {
+		logPrintln(2, "chaos: drop query", name)
+		return false
+	}
+	return true
+}
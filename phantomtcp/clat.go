@@ -0,0 +1,125 @@
+package phantomtcp
+
+import (
+	"net"
+	"strings"
+	"sync/atomic"
+)
+
+// clat=auto: on a 464XLAT host (mobile tethering, Android v4-* and clatd
+// interfaces) the IPv4 traffic goes through a local translator (CLAT) to
+// the NAT64 prefix. The translator rewrites the crafted packets of the
+// interfaces that modify them, so their connections go to the synthesized
+// IPv6 addresses instead, and the AAAA answers of the proxied names are
+// their fake IPv4 addresses in the NAT64 prefix when there is no IPv6
+// range of fake addresses. clat=v4-rmnet0 names the interface.
+var CLATMode = ""
+
+var clatDevice atomic.Value
+
+// the addresses of the IPv4 side of a CLAT (RFC 7335)
+var clatNet = &net.IPNet{IP: net.IP{192, 0, 0, 0}, Mask: net.CIDRMask(29, 32)}
+
+// the well-known prefix when the NAT64 prefix is not discovered
+var wellKnownNAT64 = parseNAT64("64:ff9b::/96")
+
+func isCLATInterface(iface net.Interface) bool {
+	if iface.Flags&net.FlagUp == 0 {
+		return false
+	}
+	if iface.Name == "clat" || iface.Name == "clat4" || strings.HasPrefix(iface.Name, "v4-") {
+		return true
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && clatNet.Contains(ipnet.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// detectCLAT returns the name of the CLAT interface of CLATMode, "" when
+// there is none
+func detectCLAT() string {
+	if CLATMode == "" || CLATMode == "off" {
+		return ""
+	}
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return ""
+	}
+	for _, iface := range ifaces {
+		if CLATMode != "auto" && iface.Name != CLATMode {
+			continue
+		}
+		if isCLATInterface(iface) || CLATMode != "auto" {
+			return iface.Name
+		}
+	}
+	return ""
+}
+
+// CLATDevice returns the CLAT interface found by the last address check
+func CLATDevice() string {
+	device, _ := clatDevice.Load().(string)
+	return device
+}
+
+func refreshCLAT() {
+	device := detectCLAT()
+	if device != CLATDevice() {
+		logPrintln(1, "CLAT:", device)
+	}
+	clatDevice.Store(device)
+}
+
+// the prefix the CLAT translates to, nil without a CLAT
+func clatPrefix() *net.IPNet {
+	if CLATDevice() == "" {
+		return nil
+	}
+	prefix := parseNAT64(GetNAT64Prefix())
+	if prefix == nil {
+		prefix = wellKnownNAT64
+	}
+	return prefix
+}
+
+// clatSynthesize returns the IPv6 address of ip4 on the translated path,
+// nil without a CLAT
+func clatSynthesize(ip4 net.IP) net.IP {
+	prefix := clatPrefix()
+	ip4 = ip4.To4()
+	if prefix == nil || ip4 == nil {
+		return nil
+	}
+	return nat64Embed(prefix, ip4)
+}
+
+// clatEmbedded returns the IPv4 address in a synthesized address, nil if
+// ip is not in the prefix of the CLAT
+func clatEmbedded(ip net.IP) net.IP {
+	prefix := clatPrefix()
+	if prefix == nil {
+		return nil
+	}
+	return nat64Extract(prefix, ip)
+}
+
+// clatAddresses moves the IPv4 addresses of an interface that modifies
+// packets to the translated path, so the packets leave as sent
+func (server *PhantomInterface) clatAddresses(addrs []*net.TCPAddr) []*net.TCPAddr {
+	if server.Hint&HINT_MODIFY == 0 || clatPrefix() == nil {
+		return addrs
+	}
+	for i, addr := range addrs {
+		if ip := clatSynthesize(addr.IP); ip != nil {
+			addrs[i] = &net.TCPAddr{IP: ip, Port: addr.Port}
+		}
+	}
+	return addrs
+}
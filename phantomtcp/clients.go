@@ -0,0 +1,133 @@
+package phantomtcp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// the rules of some clients: the lines after client=192.168.1.0/24 in a
+// profile, up to the next client= line, are the whole rules of the
+// connections and DNS queries of those clients. A block is read into a
+// profile of its own, with its own lists and DNS cache, that lives
+// across reloads like the profile. The cache of a block is expired by
+// the profile while the block is in its rules.
+type clientBlock struct {
+	spec    string //the value of the client= line
+	nets    []*net.IPNet
+	profile *PhantomProfile
+}
+
+func parseClients(spec string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range strings.Split(spec, ",") {
+		s = strings.TrimSpace(s)
+		if ip := net.ParseIP(s); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("bad client %s", s)
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets, nil
+}
+
+// ForClient returns the profile of the rules of the client address ip,
+// the one of the first block that holds it or the profile itself
+func (profile *PhantomProfile) ForClient(ip net.IP) *PhantomProfile {
+	if ip == nil {
+		return profile
+	}
+	for _, block := range profile.Rules().clients {
+		for _, ipnet := range block.nets {
+			if ipnet.Contains(ip) {
+				return block.profile
+			}
+		}
+	}
+	return profile
+}
+
+// readClientBlock reads the lines of the block spec from br into the
+// profile of the block, it returns the value of the client= line that
+// ends it, "" at the end of conf or for a client= line without one
+func (profile *PhantomProfile) readClientBlock(spec string, br *bufio.Reader, name string) (string, error) {
+	nets, err := parseClients(spec)
+	if err != nil {
+		return "", err
+	}
+
+	var lines strings.Builder
+	next := ""
+	for {
+		line, _, err := br.ReadLine()
+		if err == io.EOF {
+			break
+		}
+		l := strings.TrimSpace(strings.SplitN(string(line), "#", 2)[0])
+		if strings.HasPrefix(l, "client=") {
+			next = l[len("client="):]
+			break
+		}
+		lines.Write(line)
+		lines.WriteByte('\n')
+	}
+
+	client := profile.clientProfile(spec, nets)
+	return next, client.ReadProfile(strings.NewReader(lines.String()), name+" client="+spec)
+}
+
+// clientProfile returns the profile the block spec is read into: the
+// one of a block already read, a new one that reloads the profile of the
+// block in the rules being reloaded, or a new profile
+func (profile *PhantomProfile) clientProfile(spec string, nets []*net.IPNet) *PhantomProfile {
+	for _, block := range profile.clients {
+		if block.spec == spec {
+			return block.profile
+		}
+	}
+
+	var client *PhantomProfile
+	if profile.reloading != nil {
+		for _, block := range profile.reloading.Rules().clients {
+			if block.spec == spec {
+				client = &PhantomProfile{
+					RuleSet:      newRuleSet(),
+					Instance:     profile.Instance,
+					InterfaceMap: block.profile.InterfaceMap,
+					FilterMap:    make(map[string]*DNSFilter),
+
+					reloading:     block.profile,
+					filterRefresh: true,
+				}
+				break
+			}
+		}
+	}
+	if client == nil {
+		client = &PhantomProfile{
+			RuleSet:      newRuleSet(),
+			Instance:     profile.Instance,
+			InterfaceMap: make(map[string]PhantomInterface, len(profile.InterfaceMap)),
+			FilterMap:    make(map[string]*DNSFilter),
+		}
+		// the interfaces resolve names with the cache of the block
+		for name, face := range profile.InterfaceMap {
+			face.profile = client
+			client.InterfaceMap[name] = face
+		}
+		client.hits.start = time.Now().Unix()
+	}
+	profile.clients = append(profile.clients, &clientBlock{spec, nets, client})
+	return client
+}
@@ -0,0 +1,52 @@
+package phantomtcp
+
+import "net"
+
+// with coalesce=1, names of the same rule that resolve to a common address
+// share a fake address, so that browsers coalesce their HTTP/2 connections
+// to it instead of opening one per name. Names of different rules never
+// share one, as their connections need different treatment, nor do names
+// with an ECH config, whose connections are told apart by their fake
+// address only. Off by default: PTR answers and logs of a shared address
+// give the name that took it first.
+var CoalesceNames = false
+
+type coalesceKey struct {
+	pface *PhantomInterface
+	ip    string
+}
+
+// fakeIndex gives name the fake address of a name of the same rule with
+// a common address, or a new one
+func (profile *PhantomProfile) fakeIndex(name string, pface *PhantomInterface, records *DNSRecords) uint32 {
+	coalesce := CoalesceNames && len(records.Ech) == 0
+	var addrs []net.IP
+	if records.IPv4Hint != nil {
+		addrs = append(addrs, records.IPv4Hint.Addresses...)
+	}
+	if records.IPv6Hint != nil {
+		addrs = append(addrs, records.IPv6Hint.Addresses...)
+	}
+
+	NoseLock.Lock()
+	defer NoseLock.Unlock()
+	if coalesce {
+		for _, ip := range addrs {
+			if index, ok := profile.coalesce[coalesceKey{pface, ip.String()}]; ok {
+				logPrintln(3, "coalesce:", name, profile.fakeName(int(index)), ip)
+				return index
+			}
+		}
+	}
+
+	index := newIndex(profile.noseKey(name))
+	if index != 0 && coalesce && len(addrs) > 0 {
+		if profile.coalesce == nil || (DNSCacheSize > 0 && len(profile.coalesce) > DNSCacheSize) {
+			profile.coalesce = make(map[coalesceKey]uint32)
+		}
+		for _, ip := range addrs {
+			profile.coalesce[coalesceKey{pface, ip.String()}] = index
+		}
+	}
+	return index
+}
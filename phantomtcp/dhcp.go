@@ -0,0 +1,106 @@
+package phantomtcp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+)
+
+const (
+	dhcpMagic       = 0x63825363
+	dhcpOptionsOff  = 240
+	dhcpMessageType = 53
+	dhcpServerID    = 54
+	dhcpParamList   = 55
+	dhcpWPAD        = 252
+	dhcpEnd         = 255
+
+	dhcpInform = 8
+	dhcpAck    = 5
+)
+
+// DHCP options of a BOOTP packet, nil if it is not DHCP
+func dhcpOptions(packet []byte) map[byte][]byte {
+	if len(packet) < dhcpOptionsOff || binary.BigEndian.Uint32(packet[236:240]) != dhcpMagic {
+		return nil
+	}
+	options := make(map[byte][]byte)
+	for off := dhcpOptionsOff; off < len(packet); {
+		code := packet[off]
+		if code == dhcpEnd {
+			break
+		}
+		if code == 0 {
+			off++
+			continue
+		}
+		if off+2 > len(packet) || off+2+int(packet[off+1]) > len(packet) {
+			return nil
+		}
+		options[code] = packet[off+2 : off+2+int(packet[off+1])]
+		off += 2 + int(packet[off+1])
+	}
+	return options
+}
+
+// dhcpAckWPAD answers a DHCPINFORM with the PAC URL in option 252
+func dhcpAckWPAD(request []byte, server net.IP, pac string) []byte {
+	reply := make([]byte, dhcpOptionsOff, dhcpOptionsOff+len(pac)+12)
+	copy(reply, request[:dhcpOptionsOff])
+	reply[0] = 2 //BOOTREPLY
+	reply[3] = 0 //hops
+	copy(reply[16:20], net.IPv4zero.To4())
+	copy(reply[20:24], server)
+	reply = append(reply, dhcpMessageType, 1, dhcpAck)
+	reply = append(reply, dhcpServerID, 4)
+	reply = append(reply, server...)
+	reply = append(reply, dhcpWPAD, byte(len(pac)))
+	reply = append(reply, pac...)
+	return append(reply, dhcpEnd)
+}
+
+// DHCPInformServer answers the DHCPINFORM requests Windows sends to
+// find a WPAD URL with pac, leases are left to the DHCP server of the
+// network
+func DHCPInformServer(conn *net.UDPConn, pac string) error {
+	if len(pac) > 255 {
+		return errors.New("pac URL is longer than 255 bytes")
+	}
+
+	data := make([]byte, 1500)
+	for {
+		n, addr, err := conn.ReadFromUDP(data)
+		if err != nil {
+			return err
+		}
+		request := data[:n]
+		options := dhcpOptions(request)
+		if options == nil || request[0] != 1 || !bytes.Equal(options[dhcpMessageType], []byte{dhcpInform}) {
+			continue
+		}
+		if params, ok := options[dhcpParamList]; ok && bytes.IndexByte(params, dhcpWPAD) == -1 {
+			continue
+		}
+
+		// the reply goes to the relay agent or to the address the client has
+		ciaddr := net.IP(append([]byte(nil), request[12:16]...))
+		giaddr := net.IP(append([]byte(nil), request[24:28]...))
+		dst := &net.UDPAddr{IP: ciaddr, Port: 68}
+		if !giaddr.Equal(net.IPv4zero) {
+			dst = &net.UDPAddr{IP: giaddr, Port: 67}
+		} else if ciaddr.Equal(net.IPv4zero) {
+			dst = addr
+		}
+
+		server := routeSource(dst.String())
+		if server == nil || server.To4() == nil {
+			continue
+		}
+		logPrintln(2, "DHCPINFORM:", ciaddr, "wpad", pac)
+		_, err = conn.WriteToUDP(dhcpAckWPAD(request, server.To4(), pac), dst)
+		if err != nil {
+			logPrintln(1, "DHCPINFORM:", err)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package phantomtcp
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// divertFilter returns the WinDivert filter of the outbound IPv4 TCP
+// packets to ports, listed as 80,443,8000-8100 or empty for any, and of
+// the replies of the listener at proxyPort
+func divertFilter(ports string, proxyPort int) (string, error) {
+	var match []string
+	for _, r := range strings.Split(ports, ",") {
+		r = strings.TrimSpace(r)
+		if r == "" {
+			continue
+		}
+		lo, hi, err := parsePortRange(r)
+		if err != nil {
+			return "", err
+		}
+		if lo == hi {
+			match = append(match, fmt.Sprintf("tcp.DstPort == %d", lo))
+		} else {
+			match = append(match, fmt.Sprintf("(tcp.DstPort >= %d and tcp.DstPort <= %d)", lo, hi))
+		}
+	}
+	filter := fmt.Sprintf("outbound and ip and tcp and not loopback and (tcp.SrcPort == %d", proxyPort)
+	if len(match) == 0 {
+		return filter + " or tcp.DstPort != 0)", nil
+	}
+	return filter + " or " + strings.Join(match, " or ") + ")", nil
+}
+
+// 443 or 8000-8100
+func parsePortRange(r string) (int, int, error) {
+	bounds := strings.SplitN(r, "-", 2)
+	lo, err := strconv.Atoi(bounds[0])
+	hi := lo
+	if err == nil && len(bounds) == 2 {
+		hi, err = strconv.Atoi(bounds[1])
+	}
+	if err != nil || lo <= 0 || hi > 65535 || lo > hi {
+		return 0, 0, fmt.Errorf("bad port range %s", r)
+	}
+	return lo, hi, nil
+}
+
+// divertProcess tells if the process of the image path is one of
+// processes, listed by image name such as chrome.exe, any when there are
+// none. phantomsocks itself is never diverted.
+func divertProcess(path string, processes []string) bool {
+	if len(processes) == 0 {
+		return true
+	}
+	name := filepath.Base(strings.ReplaceAll(path, `\`, "/"))
+	for _, p := range processes {
+		if strings.EqualFold(name, p) {
+			return true
+		}
+	}
+	return false
+}
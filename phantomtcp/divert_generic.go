@@ -0,0 +1,13 @@
+//go:build !windows || !windivert
+// +build !windows !windivert
+
+package phantomtcp
+
+import (
+	"errors"
+	"io"
+)
+
+func (profile *PhantomProfile) StartDivert(address string, ports string, processes []string) (io.Closer, error) {
+	return nil, errors.New("divert needs a windows build with the windivert tag")
+}
@@ -0,0 +1,345 @@
+//go:build windows && windivert
+// +build windows,windivert
+
+package phantomtcp
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/macronut/godivert"
+	"golang.org/x/sys/windows"
+)
+
+// divert services forget the flows without a packet for that long
+var DivertTimeout = time.Hour * 2
+
+// the owners of the sockets are read again after that long
+const divertOwnerTTL = time.Second * 10
+
+var procGetExtendedTcpTable = windows.NewLazySystemDLL("iphlpapi.dll").NewProc("GetExtendedTcpTable")
+
+// a divert service: the outbound connections it takes are turned into
+// inbound ones from the server to its listener, which proxies them, and
+// the replies of the listener are turned back, as streamdump does
+type divertService struct {
+	handle    *godivert.WinDivertHandle
+	listener  net.Listener
+	port      uint16
+	processes []string
+	closed    bool
+
+	lock     sync.Mutex
+	flows    map[uint16]*divertFlow  //by the port of the client
+	images   map[uint32]string       //image paths by process id
+	owners   map[divertSocket]uint32 //process ids of the IPv4 TCP sockets
+	ownersAt time.Time
+}
+
+// a local IPv4 TCP socket, the address is zero for any
+type divertSocket struct {
+	ip   [4]byte
+	port uint16
+}
+
+type divertFlow struct {
+	src   [4]byte //of the client
+	dst   [4]byte
+	dport uint16
+	seen  int64 //unix seconds of the last packet
+	done  bool  //a FIN or RST was seen
+}
+
+// StartDivert takes the outbound IPv4 TCP connections of processes to
+// ports, see divertFilter, and proxies them from a listener at address
+func (profile *PhantomProfile) StartDivert(address string, ports string, processes []string) (io.Closer, error) {
+	l, err := net.Listen("tcp4", address)
+	if err != nil {
+		return nil, err
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	filter, err := divertFilter(ports, port)
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	winDivertLock.Lock()
+	handle, err := godivert.WinDivertOpen(filter, 0, 0, 0)
+	winDivertLock.Unlock()
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	svc := &divertService{
+		handle:    handle,
+		listener:  l,
+		port:      uint16(port),
+		processes: processes,
+		flows:     make(map[uint16]*divertFlow),
+		images:    make(map[uint32]string),
+	}
+	go svc.divert()
+	go svc.expire()
+	go svc.serve(profile)
+	return svc, nil
+}
+
+func (svc *divertService) Close() error {
+	svc.lock.Lock()
+	svc.closed = true
+	svc.lock.Unlock()
+	svc.listener.Close()
+	return svc.handle.Close()
+}
+
+func (svc *divertService) isClosed() bool {
+	svc.lock.Lock()
+	defer svc.lock.Unlock()
+	return svc.closed
+}
+
+func (svc *divertService) divert() {
+	for {
+		packet, err := svc.handle.Recv()
+		if err != nil {
+			if svc.isClosed() {
+				return
+			}
+			logPrintln(1, "divert:", err)
+			continue
+		}
+
+		raw := packet.Raw[:packet.PacketLen]
+		ihl := int(raw[0]&0x0f) * 4
+		if raw[0]>>4 == 4 && len(raw) >= ihl+20 {
+			src := net.IP(append([]byte(nil), raw[12:16]...))
+			dst := net.IP(append([]byte(nil), raw[16:20]...))
+			sport := binary.BigEndian.Uint16(raw[ihl:])
+			dport := binary.BigEndian.Uint16(raw[ihl+2:])
+			flags := raw[ihl+13]
+			if sport == svc.port {
+				// a reply of the listener, back to the client as from the server
+				if flow := svc.reply(src, dst, dport, flags); flow != nil {
+					packet.SetSrcIP(dst)
+					packet.SetDstIP(src)
+					packet.SetSrcPort(flow.dport)
+					packet.Addr.Data |= 0x1
+				}
+			} else if flow := svc.take(src, dst, sport, dport, flags); flow != nil {
+				// to the listener, as from the server
+				packet.SetSrcIP(dst)
+				packet.SetDstIP(src)
+				packet.SetDstPort(svc.port)
+				packet.Addr.Data |= 0x1
+			}
+		}
+
+		packet.CalcNewChecksum(svc.handle)
+		svc.handle.Send(packet)
+	}
+}
+
+// take returns the flow of a packet of a client, a new one for the SYN
+// of a connection of the processes, nil for the packets left alone
+func (svc *divertService) take(src, dst net.IP, sport, dport uint16, flags byte) *divertFlow {
+	now := time.Now().Unix()
+	svc.lock.Lock()
+	flow, ok := svc.flows[sport]
+	if ok && flow.match(dst, src) && flow.dport == dport {
+		flow.seen = now
+		if flags&0x05 != 0 {
+			flow.done = true
+		}
+		svc.lock.Unlock()
+		return flow
+	}
+	svc.lock.Unlock()
+
+	if flags&0x12 != 0x02 {
+		return nil
+	}
+	pid, ok := svc.owner(src, sport)
+	if !ok || pid == uint32(os.Getpid()) || !divertProcess(svc.image(pid), svc.processes) {
+		return nil
+	}
+
+	flow = &divertFlow{dport: dport, seen: now}
+	copy(flow.src[:], src.To4())
+	copy(flow.dst[:], dst.To4())
+	svc.lock.Lock()
+	svc.flows[sport] = flow
+	svc.lock.Unlock()
+	return flow
+}
+
+// match tells if a packet from server to client is of the flow
+func (flow *divertFlow) match(server, client net.IP) bool {
+	return net.IP(flow.dst[:]).Equal(server) && net.IP(flow.src[:]).Equal(client)
+}
+
+// reply returns the flow of a packet of the listener from src to the
+// client port of dst, nil when the addresses are not those of the flow
+func (svc *divertService) reply(src, dst net.IP, port uint16, flags byte) *divertFlow {
+	svc.lock.Lock()
+	defer svc.lock.Unlock()
+	flow, ok := svc.flows[port]
+	if !ok || !flow.match(dst, src) {
+		return nil
+	}
+	flow.seen = time.Now().Unix()
+	if flags&0x05 != 0 {
+		flow.done = true
+	}
+	return flow
+}
+
+// image returns the image path of the process pid, "" when it is gone
+func (svc *divertService) image(pid uint32) string {
+	svc.lock.Lock()
+	path, ok := svc.images[pid]
+	svc.lock.Unlock()
+	if ok {
+		return path
+	}
+
+	h, err := windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION, false, pid)
+	if err != nil {
+		return ""
+	}
+	defer windows.CloseHandle(h)
+	buf := make([]uint16, windows.MAX_LONG_PATH)
+	size := uint32(len(buf))
+	if windows.QueryFullProcessImageName(h, 0, &buf[0], &size) != nil {
+		return ""
+	}
+	path = windows.UTF16ToString(buf[:size])
+	svc.lock.Lock()
+	svc.images[pid] = path
+	svc.lock.Unlock()
+	return path
+}
+
+// owner returns the id of the process of the IPv4 TCP socket bound to
+// ip and port. The table of the sockets is read again when it has none
+// or is older than divertOwnerTTL, so the SYNs sent again and those of
+// the sockets of one read do not read it each.
+func (svc *divertService) owner(ip net.IP, port uint16) (uint32, bool) {
+	svc.lock.Lock()
+	pid, ok := lookupOwner(svc.owners, ip, port)
+	fresh := time.Since(svc.ownersAt) < divertOwnerTTL
+	svc.lock.Unlock()
+	if ok && fresh {
+		return pid, true
+	}
+
+	owners := tcpOwners()
+	if owners == nil {
+		return 0, false
+	}
+	svc.lock.Lock()
+	svc.owners = owners
+	svc.ownersAt = time.Now()
+	svc.lock.Unlock()
+	return lookupOwner(owners, ip, port)
+}
+
+func lookupOwner(owners map[divertSocket]uint32, ip net.IP, port uint16) (uint32, bool) {
+	socket := divertSocket{port: port}
+	copy(socket.ip[:], ip.To4())
+	if pid, ok := owners[socket]; ok {
+		return pid, true
+	}
+	pid, ok := owners[divertSocket{port: port}]
+	return pid, ok
+}
+
+// tcpOwners returns the ids of the processes of the IPv4 TCP sockets,
+// nil when the table cannot be read
+func tcpOwners() map[divertSocket]uint32 {
+	const tcpTableOwnerPidAll = 5
+	size := uint32(0)
+	var buf []byte
+	for i := 0; i < 3; i++ {
+		var p uintptr
+		if len(buf) > 0 {
+			p = uintptr(unsafe.Pointer(&buf[0]))
+		}
+		r, _, _ := procGetExtendedTcpTable.Call(p, uintptr(unsafe.Pointer(&size)), 0, windows.AF_INET, tcpTableOwnerPidAll, 0)
+		if r == 0 && len(buf) > 0 {
+			break
+		}
+		if r != uintptr(windows.ERROR_INSUFFICIENT_BUFFER) && r != 0 {
+			return nil
+		}
+		buf = make([]byte, size)
+	}
+	if len(buf) < 4 {
+		return nil
+	}
+
+	// MIB_TCPROW_OWNER_PID: state, local address, local port, remote
+	// address, remote port and pid, the ports in network order
+	n := int(binary.LittleEndian.Uint32(buf))
+	owners := make(map[divertSocket]uint32, n)
+	for i := 0; i < n && 4+i*24+24 <= len(buf); i++ {
+		row := buf[4+i*24:]
+		var socket divertSocket
+		copy(socket.ip[:], row[4:8])
+		socket.port = binary.BigEndian.Uint16(row[8:10])
+		owners[socket] = binary.LittleEndian.Uint32(row[20:24])
+	}
+	return owners
+}
+
+func (svc *divertService) expire() {
+	for {
+		time.Sleep(time.Minute)
+		if svc.isClosed() {
+			return
+		}
+		now := time.Now().Unix()
+		svc.lock.Lock()
+		for port, flow := range svc.flows {
+			if now-flow.seen > int64(DivertTimeout/time.Second) || (flow.done && now-flow.seen > 60) {
+				delete(svc.flows, port)
+			}
+		}
+		// the ids of processes are reused
+		svc.images = make(map[uint32]string)
+		svc.lock.Unlock()
+	}
+}
+
+func (svc *divertService) serve(profile *PhantomProfile) {
+	for {
+		conn, err := svc.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				logPrintln(1, "divert:", err)
+			}
+			return
+		}
+		raddr := conn.RemoteAddr().(*net.TCPAddr)
+		laddr := conn.LocalAddr().(*net.TCPAddr)
+		svc.lock.Lock()
+		flow, ok := svc.flows[uint16(raddr.Port)]
+		svc.lock.Unlock()
+		if !ok || !flow.match(raddr.IP, laddr.IP) {
+			conn.Close()
+			continue
+		}
+
+		// the client is the local address the connection was made from
+		client := &addrConn{conn, &net.TCPAddr{IP: laddr.IP, Port: raddr.Port}}
+		dst := &net.TCPAddr{IP: append(net.IP(nil), flow.dst[:]...), Port: int(flow.dport)}
+		logPrintln(3, "divert:", client.RemoteAddr(), "->", dst)
+		go profile.tcp_redirect(client, dst, "", nil, nil)
+	}
+}
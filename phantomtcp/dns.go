@@ -2,11 +2,14 @@ package phantomtcp
 
 import (
 	"bytes"
+	crand "crypto/rand"
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/base64"
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"log"
+	"io"
 	"math/rand"
 	"net"
 	"net/http"
@@ -14,224 +17,347 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type RecordAddresses struct {
-	TTL       int64
+	TTL       int64 //unix time the addresses expire, 0 for static ones
 	Addresses []net.IP
 }
 
+func (rec *RecordAddresses) Expired(now int64) bool {
+	return rec.TTL != 0 && rec.TTL <= now
+}
+
+// order of the addresses of an answer: "rotate" starts each answer at
+// the next address, "shuffle" in random order and "fixed" as stored
+var AnswerOrder = "rotate"
+
+var answerRotation uint32
+
+// ordered returns the addresses in the order of AnswerOrder
+func (rec *RecordAddresses) ordered() []net.IP {
+	n := len(rec.Addresses)
+	if n < 2 {
+		return rec.Addresses
+	}
+	addrs := make([]net.IP, n)
+	switch AnswerOrder {
+	case "rotate":
+		start := int(atomic.AddUint32(&answerRotation, 1) % uint32(n))
+		copy(addrs, rec.Addresses[start:])
+		copy(addrs[n-start:], rec.Addresses[:start])
+	case "shuffle":
+		for i, j := range rand.Perm(n) {
+			addrs[i] = rec.Addresses[j]
+		}
+	default:
+		return rec.Addresses
+	}
+	return addrs
+}
+
 type DNSRecords struct {
 	Index    uint32
 	ALPN     uint32
 	IPv4Hint *RecordAddresses
 	IPv6Hint *RecordAddresses
 	Ech      []byte
+	HTTPSTTL int64 //unix time the HTTPS record expires
+
+	hits        uint32 //cache hits since the last prefetch
+	prefetching int32
 }
 
 var DNSMinTTL uint32 = 0
-var VirtualAddrPrefix byte = 255
-var DNSCache sync.Map
+var DNSNegativeTTL uint32 = 60
+var DNSCacheInterval = time.Minute
+
+// UDP payload size advertised in the OPT record of upstream queries
+var EDNSBufferSize uint16 = 4096
 var Nose []string = []string{"phantom.socks"}
 var NoseLock sync.Mutex
 
-func TCPlookup(request []byte, address string, server *PhantomInterface) ([]byte, error) {
-	data := make([]byte, 1024)
-	binary.BigEndian.PutUint16(data[:2], uint16(len(request)))
-	copy(data[2:], request)
+// ranges of the fake addresses answered for proxied names,
+// the host part of a fake address is the index of the name in Nose
+var VirtualNet = &net.IPNet{IP: net.IP{255, 0, 0, 0}, Mask: net.CIDRMask(8, 32)}
+var VirtualNet6 *net.IPNet = nil
 
-	var conn net.Conn
-	var err error = nil
-	if server != nil {
-		host, port := splitHostPort(address)
-		conn, _, err = server.Dial(host, port, data[:len(request)+2])
-		if err != nil {
-			return nil, err
-		}
+func SetVirtualNet(cidr string) error {
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+	ones, bits := ipnet.Mask.Size()
+	if bits-ones < 8 {
+		return fmt.Errorf("%s is too small for fake addresses", cidr)
+	}
+	NoseLock.Lock()
+	defer NoseLock.Unlock()
+	if bits == 32 {
+		VirtualNet = ipnet
 	} else {
-		conn, err = net.DialTimeout("tcp", address, time.Second*5)
-		if err != nil {
-			return nil, err
-		}
-
-		_, err = conn.Write(data[:len(request)+2])
-		if err != nil {
-			conn.Close()
-			return nil, err
+		if !ulaNet.Contains(ipnet.IP) {
+			logPrintln(1, cidr, "is not a unique local prefix, fake addresses may be routed away")
 		}
+		VirtualNet6 = ipnet
 	}
-	defer conn.Close()
+	trimNose()
+	return nil
+}
 
-	n, err := conn.Read(data)
-	if err != nil || n < 2 {
-		return nil, err
+// fake address of the name at index, nil if there is no IPv6 range,
+// behind a CLAT the IPv6 one is the IPv4 one in the NAT64 prefix
+func VirtualAddress(index uint32, ipv6 bool) net.IP {
+	ipnet := VirtualNet
+	if ipv6 {
+		ipnet = VirtualNet6
+		if ipnet == nil {
+			return clatSynthesize(VirtualAddress(index, false))
+		}
+	}
+	ip := append(net.IP(nil), ipnet.IP...)
+	n := len(ip)
+	host := index &^ binary.BigEndian.Uint32(ipnet.Mask[n-4:])
+	binary.BigEndian.PutUint32(ip[n-4:], binary.BigEndian.Uint32(ip[n-4:])|host)
+	return ip
+}
+
+// index in Nose of a fake address, -1 if ip is not in the fake ranges
+func VirtualIndex(ip net.IP) int {
+	ipnet := VirtualNet6
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		ipnet = VirtualNet
+	} else if ip4 := clatEmbedded(ip); ip4 != nil && (ipnet == nil || !ipnet.Contains(ip)) {
+		ip = ip4
+		ipnet = VirtualNet
+	}
+	if ipnet == nil || !ipnet.Contains(ip) {
+		return -1
+	}
+	n := len(ip)
+	return int(binary.BigEndian.Uint32(ip[n-4:]) &^ binary.BigEndian.Uint32(ipnet.Mask[n-4:]))
+}
+
+// redirectIndex is the VirtualIndex of the destination of a redirected
+// connection, which is also ::index when the IPv6 rules send the fake
+// addresses to it
+func redirectIndex(ip net.IP) int {
+	if index := VirtualIndex(ip); index != -1 {
+		return index
 	}
-	length := int(binary.BigEndian.Uint16(data[:2]) + 2)
-	recvlen := n
-	for recvlen < length && n > 0 {
-		n, err = conn.Read(data[recvlen:])
-		if err != nil {
-			return nil, err
-		}
-		recvlen += n
+	if len(ip) == net.IPv6len && ip.To4() == nil && !ip.IsLoopback() && ip.Mask(net.CIDRMask(96, 128)).IsUnspecified() {
+		return int(binary.BigEndian.Uint32(ip[12:]))
 	}
-	return data[2:recvlen], nil
+	return -1
 }
 
-func TCPlookupDNS64(request []byte, address string, offset int, prefix []byte) ([]byte, error) {
-	response6 := make([]byte, 1024)
-	offset6 := offset
-	offset4 := offset
+// TXT records answered for names this resolver is delegated, the ACME
+// DNS-01 challenges of the certificates of its listeners
+var txtRecords sync.Map
 
-	binary.BigEndian.PutUint16(request[offset-4:offset-2], 1)
-	response, err := TCPlookup(request, address, nil)
-	if err != nil {
-		return nil, err
+func SetTXT(name, value string) {
+	txtRecords.Store(strings.ToLower(name), value)
+}
+
+func DeleteTXT(name string) {
+	txtRecords.Delete(strings.ToLower(name))
+}
+
+func txtResponse(request []byte, name string) []byte {
+	value, ok := txtRecords.Load(strings.ToLower(name))
+	if !ok {
+		return nil
+	}
+	text := value.(string)
+	if len(text) > 255 {
+		text = text[:255]
 	}
 
-	copy(response6, response[:offset])
-	binary.BigEndian.PutUint16(response6[offset-4:offset-2], 28)
+	response := make([]byte, len(request), len(request)+13+len(text))
+	copy(response, request)
+	response[2] = 0x85
+	response[3] = 0x80
+	binary.BigEndian.PutUint16(response[6:], 1)
+	response = append(response, 0xC0, 0x0C, 0x00, 16, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00)
+	response = append(response, byte((len(text)+1)>>8), byte(len(text)+1), byte(len(text)))
+	return append(response, text...)
+}
 
-	count := int(binary.BigEndian.Uint16(response[6:8]))
-	for i := 0; i < count; i++ {
-		for {
-			if offset >= len(response) {
-				log.Println(offset)
-				return nil, nil
-			}
-			length := response[offset]
-			offset++
-			if length == 0 {
-				break
-			}
-			if length < 63 {
-				offset += int(length)
-				if offset+2 > len(response) {
-					log.Println(offset)
-					return nil, nil
-				}
-			} else {
-				offset++
-				break
+// ReverseAddress parses the name of a PTR query, nil if it is not in
+// in-addr.arpa or ip6.arpa
+func ReverseAddress(name string) net.IP {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if strings.HasSuffix(name, ".in-addr.arpa") {
+		labels := strings.Split(strings.TrimSuffix(name, ".in-addr.arpa"), ".")
+		if len(labels) != 4 {
+			return nil
+		}
+		for i, j := 0, 3; i < j; i, j = i+1, j-1 {
+			labels[i], labels[j] = labels[j], labels[i]
+		}
+		return net.ParseIP(strings.Join(labels, ".")).To4()
+	} else if strings.HasSuffix(name, ".ip6.arpa") {
+		nibbles := strings.Split(strings.TrimSuffix(name, ".ip6.arpa"), ".")
+		if len(nibbles) != 32 {
+			return nil
+		}
+		ip := make(net.IP, 16)
+		for i, nibble := range nibbles {
+			n, err := strconv.ParseUint(nibble, 16, 8)
+			if err != nil || len(nibble) != 1 {
+				return nil
 			}
+			ip[15-i/2] |= byte(n) << (4 * (i % 2))
 		}
-		if offset+2 > len(response) {
-			log.Println(offset)
-			return nil, nil
-		}
+		return ip
+	}
+	return nil
+}
 
-		copy(response6[offset6:], response[offset4:offset])
-		offset6 += offset - offset4
-		offset4 = offset
+// answer a PTR query for a fake address with the name it stands for
+func (profile *PhantomProfile) reverseLookup(request []byte, name string) []byte {
+	ip := ReverseAddress(name)
+	if ip == nil {
+		return nil
+	}
+	domain := profile.FakeName(VirtualIndex(ip))
+	if domain == "" {
+		return nil
+	}
 
-		AType := binary.BigEndian.Uint16(response[offset : offset+2])
-		offset += 8
-		if offset+2 > len(response) {
-			log.Println(offset)
-			return nil, nil
-		}
-		DataLength := binary.BigEndian.Uint16(response[offset : offset+2])
-		offset += 2
+	logPrintln(3, "ptr:", ip, domain)
+	target := PackQName(domain)
+	response := make([]byte, len(request), len(request)+12+len(target))
+	copy(response, request)
+	response[2] = 0x81
+	response[3] = 0x80
+	binary.BigEndian.PutUint16(response[6:], 1)
+	response = append(response, 0xC0, 0x0C, 0x00, 12, 0x00, 0x01, 0x00, 0x00, 0x0E, 0x10)
+	response = append(response, byte(len(target)>>8), byte(len(target)))
+	return append(response, target...)
+}
 
-		offset += int(DataLength)
-		if AType == 1 {
-			if offset > len(response) {
-				log.Println(offset)
-				return nil, nil
-			}
-			binary.BigEndian.PutUint16(response6[offset6:], 28)
-			offset6 += 2
-			offset4 += 2
-			copy(response6[offset6:], response[offset4:offset4+6])
-			offset6 += 6
-			offset4 += 6
-			binary.BigEndian.PutUint16(response6[offset6:], DataLength+12)
-			offset6 += 2
-			offset4 += 2
-
-			copy(response6[offset6:], prefix[:12])
-			offset6 += 12
-			copy(response6[offset6:], response[offset4:offset])
-			offset6 += offset - offset4
-			offset4 = offset
-		} else {
-			copy(response6[offset6:], response[offset4:offset])
-			offset6 += offset - offset4
-			offset4 = offset
-		}
+func TCPlookup(request []byte, address string, server *PhantomInterface) ([]byte, error) {
+	if server == nil {
+		return pooledLookup("tcp://"+address, request, func() (net.Conn, error) {
+			return net.DialTimeout("tcp", address, time.Second*5)
+		})
 	}
 
-	return response6[:offset6], nil
-}
+	data := make([]byte, len(request)+2)
+	binary.BigEndian.PutUint16(data[:2], uint16(len(request)))
+	copy(data[2:], request)
 
-func UDPlookup(request []byte, address string) ([]byte, error) {
-	conn, err := net.Dial("udp", address)
+	host, port := splitHostPort(address)
+	conn, _, err := server.Dial(host, port, data)
 	if err != nil {
 		return nil, err
 	}
 	defer conn.Close()
-	_, err = conn.Write(request)
+
+	response, err := readTCPResponse(conn)
+	FinishTrace(conn, int64(len(response)), err)
+	return response, err
+}
+
+// read a length prefixed message of DNS over TCP
+func readTCPResponse(conn net.Conn) ([]byte, error) {
+	var prefix [2]byte
+	_, err := io.ReadFull(conn, prefix[:])
 	if err != nil {
 		return nil, err
 	}
-	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
-	response := make([]byte, 1024)
+	response := make([]byte, binary.BigEndian.Uint16(prefix[:]))
+	_, err = io.ReadFull(conn, response)
+	if err != nil {
+		return nil, err
+	}
+	return response, nil
+}
 
-	if request[11] == 0 {
-		n, err := conn.Read(response[:])
-		return response[:n], err
-	} else {
-		var n int
-		for {
-			n, err = conn.Read(response[:])
-			if err != nil {
-				return nil, err
-			}
+// random transaction ID of an upstream query
+func randomID() uint16 {
+	var b [2]byte
+	crand.Read(b[:])
+	return binary.BigEndian.Uint16(b[:])
+}
 
-			if request[11] == 0 || response[11] > 0 {
-				break
-			}
-		}
-		return response[:n], nil
+// a response answers request if it has the same ID and question
+func matchResponse(request, response []byte) bool {
+	if len(response) < 12 || request[0] != response[0] || request[1] != response[1] {
+		return false
 	}
+	_, _, end := GetQName(request)
+	if end == 0 || end > len(response) {
+		return false
+	}
+	return bytes.Equal(request[4:6], response[4:6]) && bytes.EqualFold(request[12:end], response[12:end])
 }
 
-func TLSlookup(request []byte, address string) ([]byte, error) {
-	conf := &tls.Config{
-		InsecureSkipVerify: true,
-	}
-	conn, err := tls.Dial("tcp", address, conf)
+// UDPlookup sends request with a random ID, responses that do not
+// echo the ID and the question are dropped as spoofed
+func UDPlookup(request []byte, address string) ([]byte, error) {
+	conn, err := net.Dial("udp", address)
 	if err != nil {
 		return nil, err
 	}
 	defer conn.Close()
-	data := make([]byte, 1024)
-	binary.BigEndian.PutUint16(data[:2], uint16(len(request)))
-	copy(data[2:], request)
 
-	_, err = conn.Write(data[:len(request)+2])
+	id := binary.BigEndian.Uint16(request[:2])
+	query := make([]byte, len(request))
+	copy(query, request)
+	binary.BigEndian.PutUint16(query[:2], randomID())
+	_, err = conn.Write(query)
 	if err != nil {
 		return nil, err
 	}
+	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	response := make([]byte, EDNSBufferSize)
 
-	n, err := conn.Read(data)
-	if err != nil || n < 2 {
-		return nil, err
-	}
-	length := int(binary.BigEndian.Uint16(data[:2]) + 2)
-	recvlen := n
-	for recvlen < length && n > 0 {
-		n, err = conn.Read(data[recvlen:])
+	for {
+		n, err := conn.Read(response[:])
 		if err != nil {
 			return nil, err
 		}
-		recvlen += n
+		if !matchResponse(query, response[:n]) {
+			logPrintln(3, "mismatched response from", address)
+			continue
+		}
+
+		if query[11] == 0 || response[11] > 0 {
+			if response[2]&0x02 != 0 {
+				logPrintln(4, "truncated response from", address)
+				return TCPlookup(request, address, nil)
+			}
+			binary.BigEndian.PutUint16(response[:2], id)
+			return response[:n], nil
+		}
 	}
-	return data[2:recvlen], nil
 }
 
-func HTTPSlookup(request []byte, u *url.URL, domain string) ([]byte, error) {
+func TLSlookup(request []byte, address string, options ServerOptions) ([]byte, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	conf := options.TLSConfig(host)
+	key := fmt.Sprintf("tls://%s/%s/%t/%s", address, conf.ServerName, options.Verify, options.SPKI)
+	if options.Proxy != "" {
+		key = options.Proxy + "/" + key
+	}
+	return pooledLookup(key, request, func() (net.Conn, error) {
+		if options.Proxy != "" {
+			return proxyTLS(options, address, conf)
+		}
+		dialer := &net.Dialer{Timeout: time.Second * 5}
+		return tls.DialWithDialer(dialer, "tcp", address, conf)
+	})
+}
+
+func HTTPSlookup(request []byte, u *url.URL, options ServerOptions) ([]byte, error) {
 	address := u.Host
 	host, port, err := net.SplitHostPort(address)
 	if err != nil {
@@ -240,19 +366,18 @@ func HTTPSlookup(request []byte, u *url.URL, domain string) ([]byte, error) {
 		address += ":443"
 	}
 
-	if domain == "" {
-		domain = host
-	}
+	conf := options.TLSConfig(host)
 	path := u.Path
 	if port != "443" {
 		host = address
 	}
 
-	conf := &tls.Config{
-		InsecureSkipVerify: true,
-		ServerName:         domain,
+	var conn net.Conn
+	if options.Proxy != "" {
+		conn, err = proxyTLS(options, address, conf)
+	} else {
+		conn, err = tls.Dial("tcp", address, conf)
 	}
-	conn, err := tls.Dial("tcp", address, conf)
 	if err != nil {
 		return nil, err
 	}
@@ -274,6 +399,9 @@ func HTTPSlookup(request []byte, u *url.URL, domain string) ([]byte, error) {
 	headerLen := 0
 	contentLength := 0
 	for {
+		if recvlen == len(data) {
+			data = append(data, make([]byte, len(data))...)
+		}
 		n, err := conn.Read(data[recvlen:])
 		recvlen += n
 
@@ -308,7 +436,7 @@ func HTTPSlookup(request []byte, u *url.URL, domain string) ([]byte, error) {
 }
 
 func TFOlookup(request []byte, address string) ([]byte, error) {
-	data := make([]byte, 1024)
+	data := make([]byte, len(request)+2)
 	binary.BigEndian.PutUint16(data[:2], uint16(len(request)))
 	copy(data[2:], request)
 
@@ -330,51 +458,45 @@ func TFOlookup(request []byte, address string) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	defer conn.Close()
 
-	n, err := conn.Read(data)
-	if err != nil || n < 2 {
-		return nil, err
-	}
-	length := int(binary.BigEndian.Uint16(data[:2]) + 2)
-	recvlen := n
-	for recvlen < length && n > 0 {
-		n, err = conn.Read(data[recvlen:])
-		if err != nil {
-			return nil, err
-		}
-		recvlen += n
-	}
-	return data[2:recvlen], nil
+	return readTCPResponse(conn)
 }
 
+// maximum length of a name on the wire, its labels and their lengths
+const maxNameLength = 255
+
+// GetQName returns the name, type and end of the question of buf; end is
+// 0 when the question is malformed: a label longer than 63 bytes or past
+// the end, or a name longer than 255 bytes
 func GetQName(buf []byte) (string, int, int) {
 	bufflen := len(buf)
 	if bufflen < 13 {
 		return "", 0, 0
 	}
-	length := buf[12]
-	off := 13
-	end := off + int(length)
-	qname := string(buf[off:end])
-	off = end
 
+	qname := ""
+	off := 12
 	for {
 		if off >= bufflen {
 			return "", 0, 0
 		}
-		length := buf[off]
+		length := int(buf[off])
 		off++
 		if length == 0x00 {
 			break
 		}
-		end := off + int(length)
-		if end > bufflen {
+		end := off + length
+		if length > 63 || end > bufflen || end-12 >= maxNameLength {
 			return "", 0, 0
 		}
-		qname += "." + string(buf[off:end])
+		if qname != "" {
+			qname += "."
+		}
+		qname += string(buf[off:end])
 		off = end
 	}
-	end = off + 4
+	end := off + 4
 	if end > bufflen {
 		return "", 0, 0
 	}
@@ -437,7 +559,23 @@ func GetNameOffset(response []byte, offset int) int {
 	return offset
 }
 
-func (records *DNSRecords) GetAnswers(response []byte, options ServerOptions) {
+// NXDOMAIN, SERVFAIL and empty answers are cached for DNSNegativeTTL
+// seconds so that dead names are not queried upstream again and again
+func negativeAnswer() *RecordAddresses {
+	return &RecordAddresses{int64(DNSNegativeTTL) + time.Now().Unix(), []net.IP{}}
+}
+
+// keep the expiry of the shortest lived record of a set
+func (rec *RecordAddresses) lowerTTL(ttl uint32) {
+	expiry := int64(ttl) + time.Now().Unix()
+	if rec.TTL != 0 && expiry < rec.TTL {
+		rec.TTL = expiry
+	}
+}
+
+// GetAnswers adds the addresses of response to records and returns the
+// target of its last CNAME record
+func (records *DNSRecords) GetAnswers(response []byte, options ServerOptions) string {
 	nsfilter := func(address net.IP) net.IP {
 		if options.BadSubnet != nil {
 			if options.BadSubnet.Contains(address) {
@@ -457,20 +595,20 @@ func (records *DNSRecords) GetAnswers(response []byte, options ServerOptions) {
 
 	offset := 12
 	if offset > responseLen {
-		return
+		return ""
 	}
 
 	QDCount := int(binary.BigEndian.Uint16(response[4:6]))
 	ANCount := int(binary.BigEndian.Uint16(response[6:8]))
 
 	if ANCount == 0 {
-		return
+		return ""
 	}
 
 	for i := 0; i < QDCount; i++ {
 		_offset := GetNameOffset(response, offset)
 		if _offset == 0 {
-			return
+			return ""
 		}
 		offset = _offset + 4
 	}
@@ -479,16 +617,16 @@ func (records *DNSRecords) GetAnswers(response []byte, options ServerOptions) {
 	for i := 0; i < ANCount; i++ {
 		_offset := GetNameOffset(response, offset)
 		if _offset == 0 {
-			return
+			return cname
 		}
 		offset = _offset
 		if offset+2 > responseLen {
-			return
+			return cname
 		}
 		AType := binary.BigEndian.Uint16(response[offset : offset+2])
 		offset += 4
 		if offset+4 > responseLen {
-			return
+			return cname
 		}
 		TTL := binary.BigEndian.Uint32(response[offset : offset+4])
 		if TTL < DNSMinTTL {
@@ -497,7 +635,7 @@ func (records *DNSRecords) GetAnswers(response []byte, options ServerOptions) {
 
 		offset += 4
 		if offset+2 > responseLen {
-			return
+			return cname
 		}
 		DataLength := binary.BigEndian.Uint16(response[offset : offset+2])
 		offset += 2
@@ -505,7 +643,7 @@ func (records *DNSRecords) GetAnswers(response []byte, options ServerOptions) {
 		switch AType {
 		case 1:
 			if offset+4 > responseLen {
-				return
+				return cname
 			}
 			data := response[offset : offset+4]
 			ip := net.IPv4(data[0], data[1], data[2], data[3])
@@ -517,11 +655,12 @@ func (records *DNSRecords) GetAnswers(response []byte, options ServerOptions) {
 				records.IPv4Hint = &RecordAddresses{int64(TTL) + time.Now().Unix(), []net.IP{ip}}
 			} else {
 				records.IPv4Hint.Addresses = append(records.IPv4Hint.Addresses, ip)
+				records.IPv4Hint.lowerTTL(TTL)
 			}
 		case 28:
 			var data [16]byte
 			if offset+16 > responseLen {
-				return
+				return cname
 			}
 			copy(data[:], response[offset:offset+16])
 			ip := net.IP(response[offset : offset+16])
@@ -533,30 +672,41 @@ func (records *DNSRecords) GetAnswers(response []byte, options ServerOptions) {
 				records.IPv6Hint = &RecordAddresses{int64(TTL) + time.Now().Unix(), []net.IP{ip}}
 			} else {
 				records.IPv6Hint.Addresses = append(records.IPv6Hint.Addresses, ip)
+				records.IPv6Hint.lowerTTL(TTL)
 			}
 		case 65:
-			offset += 3
-			for offset+4 < responseLen {
-				SvcParamKey := binary.BigEndian.Uint16(response[offset : offset+2])
-				offset += 2
-				SvcParamLen := int(binary.BigEndian.Uint16(response[offset : offset+2]))
-				offset += 2
-				SvcParamEnd := offset + SvcParamLen
-				if SvcParamEnd > responseLen {
+			end := offset + int(DataLength)
+			if end > responseLen || DataLength < 3 {
+				return cname
+			}
+			// SvcPriority 0 is the alias form without parameters
+			if binary.BigEndian.Uint16(response[offset:offset+2]) == 0 {
+				break
+			}
+			p := GetNameOffset(response, offset+2)
+			if p == 0 || p > end {
+				break
+			}
+			records.ALPN |= HINT_ALPN
+			records.HTTPSTTL = int64(TTL) + time.Now().Unix()
+			for p+4 <= end {
+				SvcParamKey := binary.BigEndian.Uint16(response[p : p+2])
+				SvcParamLen := int(binary.BigEndian.Uint16(response[p+2 : p+4]))
+				p += 4
+				if p+SvcParamLen > end {
 					break
 				}
-				records.ALPN |= HINT_ALPN
+				value := response[p : p+SvcParamLen]
+				p += SvcParamLen
 				switch SvcParamKey {
 				case 1:
-					for offset+1 < SvcParamEnd {
-						ALPNLen := int(response[offset])
-						offset++
-						if offset+ALPNLen > SvcParamEnd {
+					for i := 0; i < len(value); {
+						ALPNLen := int(value[i])
+						i++
+						if i+ALPNLen > len(value) {
 							break
 						}
-						ALPN := string(response[offset : offset+ALPNLen])
-						offset += ALPNLen
-						switch ALPN {
+						switch string(value[i : i+ALPNLen]) {
 						case "http/1.1":
 							records.ALPN |= HINT_HTTP
 						case "h2":
@@ -564,28 +714,29 @@ func (records *DNSRecords) GetAnswers(response []byte, options ServerOptions) {
 						case "h3":
 							records.ALPN |= HINT_HTTP3
 						}
+						i += ALPNLen
 					}
 				case 4:
+					if records.IPv4Hint != nil {
+						continue
+					}
 					var IPv4Hint []net.IP
-					for offset < SvcParamEnd {
-						data := response[offset : offset+4]
-						IPv4Hint = append(IPv4Hint, net.IPv4(data[0], data[1], data[2], data[3]))
-						offset += 4
+					for i := 0; i+4 <= len(value); i += 4 {
+						IPv4Hint = append(IPv4Hint, net.IPv4(value[i], value[i+1], value[i+2], value[i+3]))
 					}
 					records.IPv4Hint = &RecordAddresses{int64(TTL) + time.Now().Unix(), IPv4Hint}
 				case 5:
-					records.Ech = make([]byte, SvcParamLen)
-					copy(records.Ech, response[offset:SvcParamEnd])
+					records.Ech = append([]byte(nil), value...)
 				case 6:
+					if records.IPv6Hint != nil {
+						continue
+					}
 					var IPv6Hint []net.IP
-					for offset < SvcParamEnd {
-						ip := net.IP(response[offset : offset+16])
-						IPv6Hint = append(IPv6Hint, ip)
-						offset += 16
+					for i := 0; i+16 <= len(value); i += 16 {
+						IPv6Hint = append(IPv6Hint, append(net.IP(nil), value[i:i+16]...))
 					}
 					records.IPv6Hint = &RecordAddresses{int64(TTL) + time.Now().Unix(), IPv6Hint}
 				}
-				offset = SvcParamEnd
 			}
 		case 5:
 			cname, _ = GetName(response, offset)
@@ -594,21 +745,168 @@ func (records *DNSRecords) GetAnswers(response []byte, options ServerOptions) {
 
 		offset += int(DataLength)
 	}
+
+	return cname
+}
+
+// maximum number of CNAME records followed for one name
+var CNAMEDepth = 8
+
+// query the canonical name while the answers only hold CNAME records
+func (records *DNSRecords) followCNAME(name, cname string, qtype uint16, servers []*url.URL, ecs string, options ServerOptions) {
+	seen := map[string]bool{name: true}
+	for depth := 0; cname != ""; depth++ {
+		if (qtype == 1 && records.IPv4Hint != nil) || (qtype == 28 && records.IPv6Hint != nil) || qtype > 28 {
+			return
+		}
+		if depth == CNAMEDepth || seen[cname] {
+			logPrintln(2, "CNAME loop:", name, cname)
+			return
+		}
+		seen[cname] = true
+
+		logPrintln(4, "follow CNAME:", name, cname)
+		response, err := Race(servers, PackRequest(cname, qtype, 0, ecs), options)
+		if err != nil {
+			logPrintln(1, err)
+			return
+		}
+		cname = records.GetAnswers(response, options)
+	}
+}
+
+// ParseServers parses a comma separated list of DNS servers, the
+// options of the first one apply to all of them
+func ParseServers(servers string) ([]*url.URL, error) {
+	var list []*url.URL
+	for _, server := range strings.Split(servers, ",") {
+		u, err := url.Parse(strings.TrimSpace(server))
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, u)
+	}
+	return list, nil
+}
+
+// Race sends request to all servers that are not down at once and
+// returns the first answer that is not SERVFAIL or REFUSED
+func Race(servers []*url.URL, request []byte, options ServerOptions) ([]byte, error) {
+	live := healthyServers(servers)
+	if len(live) == 0 {
+		return nil, downError(servers)
+	}
+	servers = live
+	if len(servers) == 1 {
+		return exchange(servers[0], request, options)
+	}
+
+	type result struct {
+		response []byte
+		err      error
+	}
+	ch := make(chan result, len(servers))
+	for _, u := range servers {
+		go func(u *url.URL) {
+			response, err := exchange(u, request, options)
+			if err == nil {
+				if len(response) < 12 {
+					err = errors.New(u.Host + ": short response")
+				} else if rcode := response[3] & 0x0f; rcode == 2 || rcode == 5 {
+					err = fmt.Errorf("%s: rcode %d", u.Host, rcode)
+				}
+			}
+			ch <- result{response, err}
+		}(u)
+	}
+
+	var err error
+	for range servers {
+		r := <-ch
+		if r.err == nil {
+			return r.response, nil
+		}
+		logPrintln(4, r.err)
+		err = r.err
+	}
+	return nil, err
+}
+
+type lookupCall struct {
+	done     chan struct{}
+	response []byte
+	err      error
+}
+
+var lookupLock sync.Mutex
+var lookupCalls = make(map[string]*lookupCall)
+
+// RaceOnce is Race with concurrent queries of the same key sharing one
+// upstream query and its response
+func RaceOnce(key string, servers []*url.URL, request []byte, options ServerOptions) ([]byte, error) {
+	lookupLock.Lock()
+	call, ok := lookupCalls[key]
+	if ok {
+		lookupLock.Unlock()
+		<-call.done
+		logPrintln(4, "coalesced:", key)
+		return call.response, call.err
+	}
+	call = &lookupCall{done: make(chan struct{})}
+	lookupCalls[key] = call
+	lookupLock.Unlock()
+
+	call.response, call.err = Race(servers, request, options)
+
+	lookupLock.Lock()
+	delete(lookupCalls, key)
+	lookupLock.Unlock()
+	close(call.done)
+	return call.response, call.err
+}
+
+// Exchange sends request to the DNS server u
+func Exchange(u *url.URL, request []byte, options ServerOptions) ([]byte, error) {
+	if options.DNSSEC {
+		return exchangeDNSSEC(u, request, options)
+	}
+	if options.Proxy != "" && (u.Scheme == "udp" || u.Scheme == "tcp") {
+		return proxyTCPlookup(request, u.Host, options)
+	}
+	switch u.Scheme {
+	case "udp":
+		if options.Hold > 0 || options.MinRTT > 0 || options.Bogus != "" {
+			return holdLookup(request, u.Host, options)
+		}
+		return UDPlookup(request, u.Host)
+	case "tcp":
+		return TCPlookup(request, u.Host, nil)
+	case "tls":
+		return TLSlookup(request, u.Host, options)
+	case "https":
+		return HTTPSlookup(request, u, options)
+	case "tfo":
+		return TFOlookup(request, u.Host)
+	case "mock":
+		return MockLookup(request, u)
+	}
+	return nil, errors.New("unknown protocol: " + u.Scheme)
 }
 
 func (records *DNSRecords) PackAnswers(qtype int, minttl uint32) (int, []byte) {
 	packA := func(rec *RecordAddresses) (int, []byte) {
 		var ttl uint32 = 0
-		if rec.TTL > 0 {
+		if rec.TTL > time.Now().Unix() {
 			ttl = uint32(rec.TTL - time.Now().Unix())
 		}
 		if ttl < minttl {
 			ttl = minttl
 		}
 
+		addrs := rec.ordered()
 		count := 0
 		totalLen := 0
-		for _, ip := range rec.Addresses {
+		for _, ip := range addrs {
 			ip4 := ip.To4()
 			if ip4 != nil {
 				count++
@@ -621,7 +919,7 @@ func (records *DNSRecords) PackAnswers(qtype int, minttl uint32) (int, []byte) {
 
 		answers := make([]byte, totalLen)
 		length := 0
-		for _, ip := range rec.Addresses {
+		for _, ip := range addrs {
 			ip4 := ip.To4()
 			if ip4 != nil {
 				copy(answers[length:], []byte{0xC0, 0x0C, 0x00, 1,
@@ -764,7 +1062,9 @@ func (records *DNSRecords) PackAnswers(qtype int, minttl uint32) (int, []byte) {
 }
 
 func (records DNSRecords) BuildResponse(request []byte, qtype int, minttl uint32) []byte {
-	response := make([]byte, 1024)
+	// the question and the largest answer of a fake address, an HTTPS
+	// record with both addresses and the ECH config
+	response := make([]byte, len(request)+64+len(records.Ech))
 	copy(response, request)
 	length := len(request)
 	response[2] = 0x81
@@ -774,26 +1074,24 @@ func (records DNSRecords) BuildResponse(request []byte, qtype int, minttl uint32
 		switch qtype {
 		case 1:
 			answer := []byte{0xC0, 0x0C, 0x00, 1,
-				0x00, 0x01, 0x00, 0x00, 0x00, 0x10, 0x00, 0x04,
-				VirtualAddrPrefix, 0}
+				0x00, 0x01, 0x00, 0x00, 0x00, 0x10, 0x00, 0x04}
 			copy(response[length:], answer)
-			length += 14
-			binary.BigEndian.PutUint16(response[length:], uint16(records.Index))
-			length += 2
+			length += 12
+			copy(response[length:], VirtualAddress(records.Index, false))
+			length += 4
 			binary.BigEndian.PutUint16(response[6:], 1)
 		case 28:
-			return response[:length]
-			/*
-				answer := []byte{0xC0, 0x0C, 0x00, 28,
-					0x00, 0x01, 0x00, 0x00, 0x00, 0x10, 0x00, 0x10,
-					0x00, 0x64, 0xff, VirtualAddrPrefix, 0x00, 0x00, 0x00, 0x00,
-					0x00, 0x00, 0x00, 0x00}
-				copy(response[length:], answer)
-				length += 24
-				binary.BigEndian.PutUint32(response[length:], uint32(records.Index))
-				length += 4
-				binary.BigEndian.PutUint16(response[6:], 1)
-			*/
+			ip := VirtualAddress(records.Index, true)
+			if ip == nil {
+				return response[:length]
+			}
+			answer := []byte{0xC0, 0x0C, 0x00, 28,
+				0x00, 0x01, 0x00, 0x00, 0x00, 0x10, 0x00, 0x10}
+			copy(response[length:], answer)
+			length += 12
+			copy(response[length:], ip)
+			length += 16
+			binary.BigEndian.PutUint16(response[6:], 1)
 		case 65:
 			copy(response[length:], []byte{0xC0, 0x0C, 0x00, 65, 0, 1, 0, 0, 0, 16, 0, 0, 0, 1, 0})
 			dataLenOffset := length + 10
@@ -814,10 +1112,23 @@ func (records DNSRecords) BuildResponse(request []byte, qtype int, minttl uint32
 				}
 				binary.BigEndian.PutUint16(response[svcLenOffset:], uint16(length-svcLenOffset-2))
 			}
-			copy(response[length:], []byte{0, 4, 0, 4, VirtualAddrPrefix, 0})
-			length += 6
-			binary.BigEndian.PutUint16(response[length:], uint16(records.Index))
-			length += 2
+			copy(response[length:], []byte{0, 4, 0, 4})
+			length += 4
+			copy(response[length:], VirtualAddress(records.Index, false))
+			length += 4
+			if len(records.Ech) > 0 && len(records.Ech) < 512 {
+				binary.BigEndian.PutUint16(response[length:], 5)
+				binary.BigEndian.PutUint16(response[length+2:], uint16(len(records.Ech)))
+				length += 4
+				copy(response[length:], records.Ech)
+				length += len(records.Ech)
+			}
+			if ip := VirtualAddress(records.Index, true); ip != nil {
+				copy(response[length:], []byte{0, 6, 0, 16})
+				length += 4
+				copy(response[length:], ip)
+				length += 16
+			}
 			binary.BigEndian.PutUint16(response[6:], 1)
 			binary.BigEndian.PutUint16(response[dataLenOffset:], uint16(length-dataLenOffset-2))
 		}
@@ -825,8 +1136,8 @@ func (records DNSRecords) BuildResponse(request []byte, qtype int, minttl uint32
 		count, answer := records.PackAnswers(qtype, minttl)
 		if count > 0 {
 			binary.BigEndian.PutUint16(response[6:], uint16(count))
-			copy(response[length:], answer)
-			length += len(answer)
+			response = append(response[:length], answer...)
+			length = len(response)
 		}
 	}
 
@@ -859,6 +1170,40 @@ type ServerOptions struct {
 	Domain    string
 	BadSubnet *net.IPNet
 	Fallback  net.IP
+	Verify    bool
+	SPKI      string
+	DNS64     string
+	DNSSEC    bool
+	Hold      time.Duration
+	MinRTT    time.Duration
+	Bogus     string
+	Proxy     string
+}
+
+// tls.Config of a DoT or DoH server, its certificate is only checked
+// with verify=1 or against the base64 SHA-256 pin of spki=
+func (options *ServerOptions) TLSConfig(host string) *tls.Config {
+	serverName := options.Domain
+	if serverName == "" {
+		serverName = host
+	}
+	conf := &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: !options.Verify,
+	}
+	if options.SPKI != "" {
+		pin := options.SPKI
+		conf.VerifyConnection = func(state tls.ConnectionState) error {
+			for _, cert := range state.PeerCertificates {
+				sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+				if base64.StdEncoding.EncodeToString(sum[:]) == pin {
+					return nil
+				}
+			}
+			return errors.New("no certificate of " + serverName + " matches the spki pin")
+		}
+	}
+	return conf
 }
 
 func ParseOptions(options string) ServerOptions {
@@ -874,12 +1219,30 @@ func ParseOptions(options string) ServerOptions {
 				serverOpts.PD = key[1]
 			case "type":
 				serverOpts.Type = key[1]
-			case "domain":
+			case "domain", "servername":
 				serverOpts.Domain = key[1]
+			case "verify":
+				serverOpts.Verify = key[1] == "1" || key[1] == "true"
+			case "spki":
+				serverOpts.SPKI = key[1]
+			case "dns64":
+				serverOpts.DNS64 = key[1]
+			case "dnssec":
+				serverOpts.DNSSEC = key[1] == "1" || key[1] == "true"
 			case "badsubnet":
 				_, serverOpts.BadSubnet, _ = net.ParseCIDR(key[1])
 			case "fallback":
 				serverOpts.Fallback = net.ParseIP(key[1])
+			case "hold":
+				ms, _ := strconv.Atoi(key[1])
+				serverOpts.Hold = time.Duration(ms) * time.Millisecond
+			case "minrtt":
+				ms, _ := strconv.Atoi(key[1])
+				serverOpts.MinRTT = time.Duration(ms) * time.Millisecond
+			case "bogus":
+				serverOpts.Bogus = key[1]
+			case "proxy":
+				serverOpts.Proxy = key[1]
 			}
 		}
 	}
@@ -888,20 +1251,18 @@ func ParseOptions(options string) ServerOptions {
 }
 
 func PackRequest(name string, qtype uint16, id uint16, ecs string) []byte {
-	Request := make([]byte, 512)
+	qname := PackQName(name)
+	// the header, the question and an OPT record with a subnet of at most
+	// 16 bytes
+	Request := make([]byte, 12+len(qname)+4+11+8+16)
 
 	binary.BigEndian.PutUint16(Request[:], id)      //ID
 	binary.BigEndian.PutUint16(Request[2:], 0x0100) //Flag
 	binary.BigEndian.PutUint16(Request[4:], 1)      //QDCount
 	binary.BigEndian.PutUint16(Request[6:], 0)      //ANCount
 	binary.BigEndian.PutUint16(Request[8:], 0)      //NSCount
-	if ecs != "" {
-		binary.BigEndian.PutUint16(Request[10:], 1) //ARCount
-	} else {
-		binary.BigEndian.PutUint16(Request[10:], 0) //ARCount
-	}
+	binary.BigEndian.PutUint16(Request[10:], 1)     //ARCount
 
-	qname := PackQName(name)
 	length := len(qname)
 	copy(Request[12:], qname)
 	length += 12
@@ -910,110 +1271,342 @@ func PackRequest(name string, qtype uint16, id uint16, ecs string) []byte {
 	binary.BigEndian.PutUint16(Request[length:], 0x01) //QClass
 	length += 2
 
-	if ecs != "" {
-		Request[length] = 0 //Name
-		length++
-		binary.BigEndian.PutUint16(Request[length:], 41) // Type
+	Request[length] = 0 //Name
+	length++
+	binary.BigEndian.PutUint16(Request[length:], 41) // Type
+	length += 2
+	binary.BigEndian.PutUint16(Request[length:], EDNSBufferSize) // UDP Payload
+	length += 2
+	Request[length] = 0 // Highter bits in extended RCCODE
+	length++
+	Request[length] = 0 // EDNS0 Version
+	length++
+	binary.BigEndian.PutUint16(Request[length:], 0) // Z, the DO bit is set by withDO when validating
+	length += 2
+
+	ecsip, bits := parseECS(ecs)
+	if ecsip == nil {
+		binary.BigEndian.PutUint16(Request[length:], 0) // Length
+		length += 2
+	} else {
+		family := 2
+		if ecsip4 := ecsip.To4(); ecsip4 != nil {
+			ecsip = ecsip4
+			family = 1
+		}
+		size := (bits + 7) / 8
+		addr := ecsip.Mask(net.CIDRMask(bits, len(ecsip)*8))
+		binary.BigEndian.PutUint16(Request[length:], uint16(8+size)) // Length
+		length += 2
+		binary.BigEndian.PutUint16(Request[length:], 8) // Option Code
+		length += 2
+		binary.BigEndian.PutUint16(Request[length:], uint16(4+size)) // Option Length
 		length += 2
-		binary.BigEndian.PutUint16(Request[length:], 4096) // UDP Payload
+		binary.BigEndian.PutUint16(Request[length:], uint16(family)) // Family
 		length += 2
-		Request[length] = 0 // Highter bits in extended RCCODE
+		Request[length] = byte(bits) // Source Netmask
 		length++
-		Request[length] = 0 // EDNS0 Version
+		Request[length] = 0 // Scope Netmask
 		length++
-		binary.BigEndian.PutUint16(Request[length:], 0x800) // Z
-		length += 2
+		copy(Request[length:], addr[:size])
+		length += size
+	}
 
-		ecsip := net.ParseIP(ecs)
-		ecsip4 := ecsip.To4()
-		if ecsip4 != nil {
-			binary.BigEndian.PutUint16(Request[length:], 11) // Length
-			length += 2
-			binary.BigEndian.PutUint16(Request[length:], 8) // Option Code
-			length += 2
-			binary.BigEndian.PutUint16(Request[length:], 7) // Option Length
-			length += 2
-			binary.BigEndian.PutUint16(Request[length:], 1) // Family
-			length += 2
-			Request[length] = 24 // Source Netmask
-			length++
-			Request[length] = 0 // Scope Netmask
-			length++
-			copy(Request[length:], ecsip4[:3])
-			length += 3
-		} else {
-			binary.BigEndian.PutUint16(Request[length:], 15) // Length
-			length += 2
-			binary.BigEndian.PutUint16(Request[length:], 8) // Option Code
-			length += 2
-			binary.BigEndian.PutUint16(Request[length:], 11) // Option Length
-			length += 2
-			binary.BigEndian.PutUint16(Request[length:], 2) // Family
-			length += 2
-			Request[length] = 56 // Source Netmask
-			length++
-			Request[length] = 0 // Scope Netmask
-			length++
-			copy(Request[length:], ecsip[:7])
-			length += 7
+	return Request[:length]
+}
+
+// address and source prefix length of an ecs option: an address,
+// "1.2.3.0/20", or auto for the subnet of this network, which also takes
+// a prefix length as "auto/20"; the default lengths are /24 and /56.
+// "off" sends no subnet, nor does client, whose subnet is that of the
+// querying client and replaced by it before a request is packed.
+func parseECS(ecs string) (net.IP, int) {
+	bits := 0
+	if i := strings.IndexByte(ecs, '/'); i != -1 {
+		n, err := strconv.Atoi(ecs[i+1:])
+		if err != nil || n < 0 {
+			return nil, 0
 		}
+		ecs, bits = ecs[:i], n
+	}
+	if ecs == "auto" {
+		ecs = GetAutoECS()
 	}
+	ip := net.ParseIP(ecs)
+	if ip == nil {
+		return nil, 0
+	}
+	max := 128
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		max = 32
+	}
+	if bits == 0 || bits > max {
+		bits = 56
+		if max == 32 {
+			bits = 24
+		}
+	}
+	return ip, bits
+}
 
-	return Request[:length]
+// largest UDP response the client of request accepts
+func UDPPayloadSize(request []byte) int {
+	_, _, end := GetQName(request)
+	if end == 0 || binary.BigEndian.Uint16(request[10:12]) == 0 {
+		return 512
+	}
+	offset := GetNameOffset(request, end)
+	if offset == 0 || offset+4 > len(request) || binary.BigEndian.Uint16(request[offset:]) != 41 {
+		return 512
+	}
+	size := int(binary.BigEndian.Uint16(request[offset+2:]))
+	if size < 512 {
+		return 512
+	}
+	return size
 }
 
-func LoadDNSCache(qname string) *DNSRecords {
-	var ok bool
-	var result interface{}
-	result, ok = DNSCache.Load(qname)
-	if ok {
-		return result.(*DNSRecords)
+// TruncateResponse drops the records of a response larger than size
+// and sets the TC bit so that the client retries over TCP
+func TruncateResponse(response []byte, size int) []byte {
+	if len(response) <= size {
+		return response
+	}
+	_, _, end := GetQName(response)
+	if end == 0 {
+		return nil
 	}
+	response[2] |= 0x02
+	copy(response[6:12], []byte{0, 0, 0, 0, 0, 0})
+	return response[:end]
+}
+
+// address, source and scope prefix length of the client subnet option
+// of the OPT record among the count records at offset
+func GetECS(msg []byte, offset int, count int) (net.IP, int, int) {
+	for i := 0; i < count; i++ {
+		offset = GetNameOffset(msg, offset)
+		if offset == 0 || offset+10 > len(msg) {
+			return nil, 0, 0
+		}
+		rtype := binary.BigEndian.Uint16(msg[offset:])
+		end := offset + 10 + int(binary.BigEndian.Uint16(msg[offset+8:]))
+		offset += 10
+		if end > len(msg) {
+			return nil, 0, 0
+		}
+		if rtype == 41 {
+			for offset+4 <= end {
+				code := binary.BigEndian.Uint16(msg[offset:])
+				optEnd := offset + 4 + int(binary.BigEndian.Uint16(msg[offset+2:]))
+				offset += 4
+				if optEnd > end {
+					break
+				}
+				if code == 8 && optEnd-offset >= 4 {
+					ip := make(net.IP, 16)
+					if binary.BigEndian.Uint16(msg[offset:]) == 1 {
+						ip = make(net.IP, 4)
+					}
+					copy(ip, msg[offset+4:optEnd])
+					return ip, int(msg[offset+2]), int(msg[offset+3])
+				}
+				offset = optEnd
+			}
+		}
+		offset = end
+	}
+	return nil, 0, 0
+}
 
+// scope prefix length of an answer, 0 if it does not depend on the subnet
+func GetECSScope(response []byte) int {
+	_, _, end := GetQName(response)
+	if end == 0 {
+		return 0
+	}
+	count := int(binary.BigEndian.Uint16(response[6:8])) +
+		int(binary.BigEndian.Uint16(response[8:10])) +
+		int(binary.BigEndian.Uint16(response[10:12]))
+	_, _, scope := GetECS(response, end, count)
+	return scope
+}
+
+// subnet a query is answered for, from the subnet option of the query
+// or the address of the client
+func clientSubnet(request []byte, end int, client net.IP) *net.IPNet {
+	if end == 0 {
+		return nil
+	}
+	count := int(binary.BigEndian.Uint16(request[6:8])) +
+		int(binary.BigEndian.Uint16(request[8:10])) +
+		int(binary.BigEndian.Uint16(request[10:12]))
+	ip, source, _ := GetECS(request, end, count)
+	if ip == nil {
+		if client == nil || !client.IsGlobalUnicast() {
+			return nil
+		}
+		ip, source = client, 0
+	}
+
+	bits := 56
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		bits = 24
+	}
+	if source > 0 && source < bits {
+		bits = source
+	}
+	mask := net.CIDRMask(bits, len(ip)*8)
+	return &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+}
+
+// answers that depend on the client subnet are cached as name@subnet/scope
+func ecsKey(name string, subnet *net.IPNet, bits int) string {
+	mask := net.CIDRMask(bits, len(subnet.IP)*8)
+	return name + "@" + (&net.IPNet{IP: subnet.IP.Mask(mask), Mask: mask}).String()
+}
+
+func (profile *PhantomProfile) loadSubnetCache(name string, subnet *net.IPNet, qtype int, now int64) *DNSRecords {
+	ones, _ := subnet.Mask.Size()
+	for bits := ones; bits > 0; bits-- {
+		records := profile.LoadDNSCache(ecsKey(name, subnet, bits))
+		if records == nil {
+			continue
+		}
+		rec := records.IPv4Hint
+		if qtype == 28 {
+			rec = records.IPv6Hint
+		}
+		if rec != nil && !rec.Expired(now) {
+			return records
+		}
+	}
 	return nil
 }
 
-func StoreDNSCache(qname string, record *DNSRecords) {
-	DNSCache.Store(qname, record)
+func (profile *PhantomProfile) subnetRecords(name string, subnet *net.IPNet, scope int, qtype int) *DNSRecords {
+	ones, _ := subnet.Mask.Size()
+	if scope > ones {
+		scope = ones
+	}
+	key := ecsKey(name, subnet, scope)
+	records := profile.LoadDNSCache(key)
+	if records == nil {
+		records = new(DNSRecords)
+		profile.StoreDNSCache(key, records)
+	}
+	if qtype == 28 {
+		records.IPv6Hint = nil
+	} else {
+		records.IPv4Hint = nil
+	}
+	return records
+}
+
+// HTTPSRecord returns the ALPN hints and the ECH config learned from the
+// HTTPS record of name
+func (profile *PhantomProfile) HTTPSRecord(name string) (uint32, []byte) {
+	records := profile.LoadDNSCache(name)
+	if records == nil || records.HTTPSTTL < time.Now().Unix() {
+		return 0, nil
+	}
+	return records.ALPN & (HINT_HTTP | HINT_HTTPS | HINT_HTTP3), records.Ech
+}
+
+func (profile *PhantomProfile) LoadDNSCache(qname string) *DNSRecords {
+	records, _ := profile.DNSCache.Load(qname)
+	return records
+}
+
+func (profile *PhantomProfile) StoreDNSCache(qname string, record *DNSRecords) {
+	profile.DNSCache.Add(qname, record)
+}
+
+// ExpireDNSCache drops expired addresses from the cache of the profile
+// and of its client blocks, records that only held those addresses are
+// removed, the ones that carry a rule or a fake address index are kept
+func (profile *PhantomProfile) ExpireDNSCache() {
+	for {
+		time.Sleep(DNSCacheInterval)
+
+		profile.expireDNSCache()
+		for _, block := range profile.Rules().clients {
+			block.profile.expireDNSCache()
+		}
+	}
+}
+
+func (profile *PhantomProfile) expireDNSCache() {
+	count := 0
+	CurrentTime := time.Now().Unix()
+	profile.DNSCache.Range(func(key string, records *DNSRecords) bool {
+		expired := false
+		if records.IPv4Hint != nil && records.IPv4Hint.Expired(CurrentTime) {
+			records.IPv4Hint = nil
+			expired = true
+		}
+		if records.IPv6Hint != nil && records.IPv6Hint.Expired(CurrentTime) {
+			records.IPv6Hint = nil
+			expired = true
+		}
+		if expired && records.Index == 0 && records.ALPN == 0 && records.Ech == nil &&
+			records.IPv4Hint == nil && records.IPv6Hint == nil {
+			profile.DNSCache.Delete(key)
+			count++
+		}
+		return true
+	})
+	if count > 0 {
+		logPrintln(4, "expired", count, "names,", profile.DNSCache.Len(), "cached")
+	}
 }
 
-func NSLookup(name string, hint uint32, server string) (uint32, []net.IP) {
+func (profile *PhantomProfile) NSLookup(name string, hint uint32, server string) (uint32, []net.IP) {
+	if HappyEyeballs && hint&(HINT_IPV4|HINT_IPV6) == 0 {
+		return profile.happyLookup(name, hint, server)
+	}
+
 	var qtype uint16 = 1
 	if hint&HINT_IPV6 != 0 {
 		qtype = 28
 	}
 
-	records := LoadDNSCache(name)
+	if filter := profile.GetFilter(name); filter != nil && filter.Action != FILTER_ALLOW {
+		return 0, filter.Lookup(qtype)
+	}
+	server = profile.routeServer(name, server)
+
+	records := profile.LoadDNSCache(name)
 	if records == nil {
 		records = new(DNSRecords)
-		StoreDNSCache(name, records)
+		profile.StoreDNSCache(name, records)
 
-		offset := 0
-		for i := 0; i < SubdomainDepth; i++ {
-			off := strings.Index(name[offset:], ".")
-			if off == -1 {
-				break
-			}
-			offset += off
-			top := LoadDNSCache(name[offset:])
-			if top != nil {
-				*records = *top
-				break
-			}
-
-			offset++
+		rules := profile.Rules()
+		if top := profile.parentRecords(rules, name); top != nil {
+			*records = *top
+		} else if top := profile.patternRecords(rules, name); top != nil {
+			*records = *top
 		}
 	}
+	CurrentTime := time.Now().Unix()
 	switch qtype {
 	case 1:
 		if records.IPv4Hint != nil {
-			logPrintln(3, "cached:", name, qtype, records.IPv4Hint.Addresses)
-			return records.Index, records.IPv4Hint.Addresses
+			if !records.IPv4Hint.Expired(CurrentTime) {
+				logPrintln(3, "cached:", name, qtype, records.IPv4Hint.Addresses)
+				return records.Index, records.IPv4Hint.Addresses
+			}
+			records.IPv4Hint = nil
 		}
 	case 28:
 		if records.IPv6Hint != nil {
-			logPrintln(3, "cached:", name, qtype, records.IPv6Hint.Addresses)
-			return records.Index, records.IPv6Hint.Addresses
+			if !records.IPv6Hint.Expired(CurrentTime) {
+				logPrintln(3, "cached:", name, qtype, records.IPv6Hint.Addresses)
+				return records.Index, records.IPv6Hint.Addresses
+			}
+			records.IPv6Hint = nil
 		}
 	default:
 		return 0, nil
@@ -1024,37 +1617,29 @@ func NSLookup(name string, hint uint32, server string) (uint32, []net.IP) {
 	var err error
 
 	var options ServerOptions
-	u, err := url.Parse(server)
+	servers, err := ParseServers(server)
 	if err != nil {
 		logPrintln(1, err)
 		return 0, nil
 	}
+	u := servers[0]
 	if u.RawQuery != "" {
 		options = ParseOptions(u.RawQuery)
+		if profile.noECS(name) {
+			options.ECS = ""
+		}
 	}
 
-	if u.Host != "" {
+	if u.Host != "" || u.Scheme == "mock" {
 		switch u.Scheme {
-		case "udp":
-			request = PackRequest(name, qtype, uint16(0), options.ECS)
-			response, err = UDPlookup(request, u.Host)
-		case "tcp":
-			request = PackRequest(name, qtype, uint16(0), options.ECS)
-			response, err = TCPlookup(request, u.Host, nil)
-		case "tls":
+		case "udp", "tcp", "tls", "https", "tfo", "mock":
 			request = PackRequest(name, qtype, uint16(0), options.ECS)
-			response, err = TLSlookup(request, u.Host)
-		case "https":
-			request = PackRequest(name, qtype, uint16(0), options.ECS)
-			response, err = HTTPSlookup(request, u, options.Domain)
-		case "tfo":
-			request = PackRequest(name, qtype, uint16(0), options.ECS)
-			response, err = TFOlookup(request, u.Host)
+			key := fmt.Sprint(name, " ", qtype, " ", server, " ", options.ECS)
+			response, err = RaceOnce(key, servers, request, options)
 		default:
 			NoseLock.Lock()
-			records.Index = uint32(len(Nose))
+			records.Index = newIndex(profile.noseKey(name))
 			records.ALPN = hint
-			Nose = append(Nose, name)
 			NoseLock.Unlock()
 			return records.Index, nil
 		}
@@ -1066,13 +1651,21 @@ func NSLookup(name string, hint uint32, server string) (uint32, []net.IP) {
 
 	if records.Index == 0 && hint != 0 {
 		NoseLock.Lock()
-		records.Index = uint32(len(Nose))
+		records.Index = newIndex(profile.noseKey(name))
 		records.ALPN = hint & HINT_DNS
-		Nose = append(Nose, name)
 		NoseLock.Unlock()
 	}
 
-	records.GetAnswers(response, options)
+	cname := records.GetAnswers(response, options)
+	if u.Host != "" || u.Scheme == "mock" {
+		records.followCNAME(name, cname, qtype, servers, options.ECS, options)
+		if qtype == 28 {
+			records.synthesizeDNS64(name, servers, options.ECS, options)
+		}
+	}
+	if hint&HINT_MODIFY != 0 {
+		records.Capture()
+	}
 
 	switch qtype {
 	case 1:
@@ -1083,7 +1676,7 @@ func NSLookup(name string, hint uint32, server string) (uint32, []net.IP) {
 			}
 		}
 		if records.IPv4Hint == nil {
-			records.IPv4Hint = &RecordAddresses{0, []net.IP{}}
+			records.IPv4Hint = negativeAnswer()
 		}
 		logPrintln(3, "nslookup", name, qtype, records.IPv4Hint.Addresses)
 		return records.Index, records.IPv4Hint.Addresses
@@ -1094,7 +1687,7 @@ func NSLookup(name string, hint uint32, server string) (uint32, []net.IP) {
 			}
 		}
 		if records.IPv6Hint == nil {
-			records.IPv6Hint = &RecordAddresses{0, []net.IP{}}
+			records.IPv6Hint = negativeAnswer()
 		}
 		logPrintln(3, "nslookup", name, qtype, records.IPv6Hint.Addresses)
 		return records.Index, records.IPv6Hint.Addresses
@@ -1103,8 +1696,17 @@ func NSLookup(name string, hint uint32, server string) (uint32, []net.IP) {
 	return records.Index, nil
 }
 
-func NSRequest(request []byte, cache bool) (uint32, []byte) {
+func (profile *PhantomProfile) NSRequest(request []byte, cache bool, client net.IP) (index uint32, response []byte) {
+	// the queries of the clients of a client= block use its rules
+	if scoped := profile.ForClient(client); scoped != profile {
+		return scoped.NSRequest(request, cache, client)
+	}
 	name, qtype, end := GetQName(request)
+	// the rules the query was received with, a reload does not change
+	// them halfway
+	rules := profile.Rules()
+	subnet := clientSubnet(request, end, client)
+	clientNet := subnet
 	binary.BigEndian.PutUint16(request[10:12], 0)
 	request = request[:end]
 	if name == "" {
@@ -1112,26 +1714,60 @@ func NSRequest(request []byte, cache bool) (uint32, []byte) {
 		return 0, nil
 	}
 
+	if !Chaos.Query(name) {
+		return 0, nil
+	}
+
+	entry := newQueryLogEntry(name, qtype, client)
+	defer func() {
+		if entry != nil && index > 0 {
+			entry.Action = "intercepted"
+		}
+		entry.finish(response)
+	}()
+	entry.setAction("local")
+
+	if qtype == 12 {
+		if response := profile.reverseLookup(request, name); response != nil {
+			return 0, response
+		}
+	}
+	if qtype == 16 {
+		if response := txtResponse(request, name); response != nil {
+			return 0, response
+		}
+	}
+	if response := localResponse(request, name, qtype); response != nil {
+		return 0, response
+	}
+
+	if filter := profile.GetFilter(name); filter != nil && filter.Action != FILTER_ALLOW {
+		logPrintln(3, "filtered:", name, qtype)
+		entry.setAction("blocked")
+		return 0, filter.BuildResponse(request, qtype)
+	}
+
+	// an aliased name is answered with the addresses of its alias
+	qname := name
+	name = rules.GetAlias(name)
+	defer func() {
+		if index > 0 && response != nil {
+			profile.logLie(client, name, qtype)
+		}
+	}()
+
 	var records *DNSRecords
 	if cache {
-		records = LoadDNSCache(name)
+		records = profile.LoadDNSCache(name)
 		if records == nil {
 			records = new(DNSRecords)
-			StoreDNSCache(name, records)
+			profile.StoreDNSCache(name, records)
 
-			offset := 0
-			for i := 0; i < SubdomainDepth; i++ {
-				off := strings.Index(name[offset:], ".")
-				if off == -1 {
-					break
-				}
-				offset += off
-				top := LoadDNSCache(name[offset:])
-				if top != nil {
-					*records = *top
-					break
-				}
-				offset++
+			if top := profile.parentRecords(rules, name); top != nil {
+				*records = *top
+				records.hits, records.prefetching = 0, 0
+			} else if top := profile.patternRecords(rules, name); top != nil {
+				*records = *top
 			}
 		}
 	} else {
@@ -1140,33 +1776,72 @@ func NSRequest(request []byte, cache bool) (uint32, []byte) {
 
 	CurrentTime := time.Now().Unix()
 
+	pface := profile.routeDNS(name, rules.GetInterface(name))
+	rule := profile.hitRule(name)
+	if entry != nil {
+		entry.Rule = rule
+	}
+	if !cache || (qtype != 1 && qtype != 28) || pface == nil || rules.noECS(name) {
+		subnet = nil
+	}
+	if subnet != nil {
+		bits, ok := pface.clientECS()
+		if !ok {
+			subnet = nil
+		} else {
+			subnet = truncateSubnet(subnet, bits)
+		}
+	}
+	if subnet != nil {
+		scoped := profile.loadSubnetCache(name, subnet, qtype, CurrentTime)
+		if scoped != nil {
+			entry.setCached(1)
+			return 0, scoped.BuildResponse(request, qtype, 60)
+		}
+	}
+
 	switch qtype {
 	case 1:
 		if records.IPv4Hint != nil {
-			if records.IPv4Hint.TTL == 0 || records.IPv4Hint.TTL > CurrentTime {
+			if !records.IPv4Hint.Expired(CurrentTime) {
+				entry.setCached(records.IPv4Hint.TTL)
+				profile.prefetch(name, 1, pface, records, records.IPv4Hint, CurrentTime)
 				return records.Index, records.BuildResponse(request, qtype, 60)
 			}
 			records.IPv4Hint = nil
 		}
 	case 28:
 		if records.IPv6Hint != nil {
-			if records.IPv6Hint.TTL == 0 || records.IPv6Hint.TTL > CurrentTime {
+			if !records.IPv6Hint.Expired(CurrentTime) {
+				entry.setCached(records.IPv6Hint.TTL)
+				profile.prefetch(name, 28, pface, records, records.IPv6Hint, CurrentTime)
 				return records.Index, records.BuildResponse(request, qtype, 60)
 			}
 			records.IPv6Hint = nil
 		}
 	case 65:
-		if records.ALPN&(HINT_ALPN|HINT_HTTP|HINT_HTTPS|HINT_HTTP3) != 0 {
+		if pface != nil && pface.Hint&(HINT_ALPN|HINT_HTTP|HINT_HTTPS|HINT_HTTP3) != 0 {
 			return records.Index, records.BuildResponse(request, qtype, 3600)
 		}
+		if records.HTTPSTTL > CurrentTime {
+			entry.setCached(records.HTTPSTTL)
+			return records.Index, records.BuildResponse(request, qtype, uint32(records.HTTPSTTL-CurrentTime))
+		}
+		records.Ech = nil
 	default:
-		return records.Index, records.BuildResponse(request, qtype, 3600)
+		if pface == nil || pface.DNS == "" {
+			return records.Index, records.BuildResponse(request, qtype, 3600)
+		}
+		response = profile.forward(request, qname, qtype, pface, entry)
+		if response == nil && FailOpen {
+			entry.setAction("fail-open")
+			return 0, records.BuildResponse(request, qtype, 0)
+		}
+		return 0, response
 	}
 
-	var response []byte
 	var err error
 
-	pface := DefaultProfile.GetInterface(name)
 	var options ServerOptions
 	DNS := ""
 	if pface != nil {
@@ -1181,21 +1856,22 @@ func NSRequest(request []byte, cache bool) (uint32, []byte) {
 	if DNS == "" {
 		if records.Index == 0 && pface.Protocol != 0 {
 			NoseLock.Lock()
-			records.Index = uint32(len(Nose))
-			Nose = append(Nose, name)
+			records.Index = newIndex(profile.noseKey(name))
 			NoseLock.Unlock()
 		}
 		return records.Index, records.BuildResponse(request, qtype, 3600)
 	}
 
-	u, err := url.Parse(DNS)
+	servers, err := ParseServers(DNS)
 	if err != nil {
 		logPrintln(1, err)
 		return 0, nil
 	}
+	u := servers[0]
 
 	_request := request
 	_qtype := uint16(qtype)
+	repack := name != qname || subnet != nil
 	if u.RawQuery != "" {
 		if records.ALPN&HINT_IPV6 != 0 {
 			_qtype = 28
@@ -1209,36 +1885,68 @@ func NSRequest(request []byte, cache bool) (uint32, []byte) {
 			return records.Index, records.BuildResponse(request, qtype, 0)
 		}
 
-		if options.ECS != "" || _qtype != uint16(qtype) {
-			id := binary.BigEndian.Uint16(request[:2])
-			_request = PackRequest(name, _qtype, id, options.ECS)
+		if rules.noECS(name) {
+			options.ECS = ""
 		}
-	}
 
-	switch u.Scheme {
-	case "udp":
-		response, err = UDPlookup(_request, u.Host)
-	case "tcp":
-		response, err = TCPlookup(_request, u.Host, nil)
-	case "tls":
-		response, err = TLSlookup(_request, u.Host)
-	case "https":
-		response, err = HTTPSlookup(_request, u, options.Domain)
-	case "tfo":
-		response, err = TFOlookup(_request, u.Host)
-	default:
-		logPrintln(1, "unknown protocol")
-		return 0, nil
+		repack = repack || options.ECS != "" || _qtype != uint16(qtype)
+	}
+	ecs := options.ECS
+	if subnet != nil {
+		ecs = subnet.String()
+	} else if bits, ok := clientECSBits(ecs); ok {
+		// not cached by subnet, the subnet of the client is still sent
+		ecs = ""
+		if clientNet != nil {
+			ecs = truncateSubnet(clientNet, bits).String()
+		}
+	}
+	if repack {
+		id := binary.BigEndian.Uint16(request[:2])
+		_request = PackRequest(name, _qtype, id, ecs)
 	}
 
+	key := fmt.Sprint(name, " ", _qtype, " ", DNS, " ", ecs)
+	start := time.Now()
+	response, err = RaceOnce(key, servers, _request, options)
+	entry.setUpstream(DNS, start)
 	if err != nil {
 		logPrintln(1, err)
-		return 0, nil
+		if !FailOpen {
+			return 0, nil
+		}
+		entry.setAction("fail-open")
+		if records.Index == 0 && ((pface.Hint&HINT_MODIFY) != 0 || pface.Protocol != 0) {
+			records.Index = profile.fakeIndex(name, pface, records)
+		}
+		if records.Index > 0 {
+			return records.Index, records.BuildResponse(request, qtype, 0)
+		}
+		return 0, systemAnswer(request, qname, qtype)
 	}
 
-	records.GetAnswers(response, options)
+	if subnet != nil {
+		scope := GetECSScope(response)
+		if scope > 0 {
+			records = profile.subnetRecords(name, subnet, scope, qtype)
+		}
+	}
+
+	cname := records.GetAnswers(response, options)
+	records.followCNAME(name, cname, _qtype, servers, ecs, options)
+	if _qtype == 28 {
+		records.synthesizeDNS64(name, servers, ecs, options)
+	}
+	if pface.Hint&HINT_MODIFY != 0 {
+		records.Capture()
+	}
 
 	switch _qtype {
+	case 65:
+		if records.HTTPSTTL <= CurrentTime {
+			records.HTTPSTTL = CurrentTime + int64(DNSNegativeTTL)
+		}
+		logPrintln(3, "response:", name, qtype, records.ALPN, len(records.Ech))
 	case 1:
 		if records.IPv4Hint == nil && options.Fallback != nil {
 			if options.Fallback.To4() != nil {
@@ -1248,7 +1956,7 @@ func NSRequest(request []byte, cache bool) (uint32, []byte) {
 		}
 		if records.IPv4Hint == nil {
 			logPrintln(4, "request:", name, qtype, "no answer")
-			records.IPv4Hint = &RecordAddresses{0, []net.IP{}}
+			records.IPv4Hint = negativeAnswer()
 			return 0, records.BuildResponse(request, qtype, 0)
 		}
 		logPrintln(3, "response:", name, qtype, records.IPv4Hint.Addresses)
@@ -1261,31 +1969,125 @@ func NSRequest(request []byte, cache bool) (uint32, []byte) {
 		}
 		if records.IPv6Hint == nil {
 			logPrintln(4, "request:", name, qtype, "no answer")
-			records.IPv6Hint = &RecordAddresses{0, []net.IP{}}
+			records.IPv6Hint = negativeAnswer()
 			return 0, records.BuildResponse(request, qtype, 0)
 		}
 		logPrintln(3, "response:", name, qtype, records.IPv6Hint.Addresses)
 	}
 
 	if records.Index == 0 && ((pface.Hint&HINT_MODIFY) != 0 || pface.Protocol != 0) {
-		NoseLock.Lock()
-		records.Index = uint32(len(Nose))
-		Nose = append(Nose, name)
-		NoseLock.Unlock()
+		records.Index = profile.fakeIndex(name, pface, records)
 	}
 
 	return records.Index, records.BuildResponse(request, qtype, 0)
 }
 
+// forward relays a query for a type without addresses (TXT, MX, SRV,
+// NAPTR...) to the DNS servers of pface and returns the answer unchanged,
+// it is not cached
+func (profile *PhantomProfile) forward(request []byte, name string, qtype int, pface *PhantomInterface, entry *QueryLogEntry) []byte {
+	servers, err := ParseServers(pface.DNS)
+	if err != nil {
+		logPrintln(1, err)
+		return nil
+	}
+	var options ServerOptions
+	if servers[0].RawQuery != "" {
+		options = ParseOptions(servers[0].RawQuery)
+	}
+
+	logPrintln(2, "forward:", name, qtype, pface.DNS)
+	key := fmt.Sprint(name, " ", qtype, " ", pface.DNS)
+	start := time.Now()
+	response, err := RaceOnce(key, servers, request, options)
+	entry.setUpstream(pface.DNS, start)
+	if err != nil {
+		logPrintln(1, err)
+		return nil
+	}
+	if len(response) < 12 {
+		return nil
+	}
+	// the answer may be shared with coalesced queries of other ids
+	answer := make([]byte, len(response))
+	copy(answer, response)
+	copy(answer[:2], request[:2])
+	return answer
+}
+
+// with ecs=client the answers of a DNS only interface depend on the
+// subnet of the client, ecs=client/20 sends at most 20 bits of it
+func (pface *PhantomInterface) clientECS() (int, bool) {
+	if pface.Hint&HINT_MODIFY != 0 || pface.Protocol != 0 {
+		return 0, false
+	}
+	servers, err := ParseServers(pface.DNS)
+	if err != nil {
+		return 0, false
+	}
+	return clientECSBits(ParseOptions(servers[0].RawQuery).ECS)
+}
+
+// clientECSBits reports whether ecs is client or client/bits, with bits
+func clientECSBits(ecs string) (int, bool) {
+	if ecs == "client" {
+		return 0, true
+	}
+	if !strings.HasPrefix(ecs, "client/") {
+		return 0, false
+	}
+	bits, err := strconv.Atoi(ecs[len("client/"):])
+	return bits, err == nil
+}
+
+// truncateSubnet returns subnet shortened to bits when they are fewer
+func truncateSubnet(subnet *net.IPNet, bits int) *net.IPNet {
+	ones, size := subnet.Mask.Size()
+	if bits <= 0 || bits >= ones {
+		return subnet
+	}
+	mask := net.CIDRMask(bits, size)
+	return &net.IPNet{IP: subnet.IP.Mask(mask), Mask: mask}
+}
+
+// names under a no-ecs rule are resolved without a client subnet
+func (profile *PhantomProfile) noECS(name string) bool {
+	return profile.Rules().noECS(name)
+}
+
+func (rules *RuleSet) noECS(name string) bool {
+	if len(rules.NoECSMap) == 0 {
+		return false
+	}
+	if rules.NoECSMap[name] {
+		return true
+	}
+	for offset := strings.Index(name, "."); offset != -1; {
+		if rules.NoECSMap[name[offset:]] || rules.NoECSMap[name[offset+1:]] {
+			return true
+		}
+		next := strings.Index(name[offset+1:], ".")
+		if next == -1 {
+			break
+		}
+		offset += next + 1
+	}
+	return false
+}
+
 func (server *PhantomInterface) ResolveTCPAddr(host string, port int) (*net.TCPAddr, error) {
 	ip := net.ParseIP(host)
 	if ip != nil {
 		return &net.TCPAddr{IP: ip, Port: port}, nil
 	}
 
-	_, addrs := NSLookup(host, server.Hint, server.DNS)
+	profile := server.Profile()
+	_, addrs := profile.NSLookup(host, server.Hint, server.DNS)
 	if len(addrs) == 0 {
-		return nil, errors.New("no such host")
+		return nil, profile.dnsError(host, addrs)
+	}
+	if HappyEyeballs {
+		return &net.TCPAddr{IP: addrs[0], Port: port}, nil
 	}
 	rand.Seed(time.Now().UnixNano())
 	return &net.TCPAddr{IP: addrs[rand.Intn(len(addrs))], Port: port}, nil
@@ -1299,9 +2101,10 @@ func (server *PhantomInterface) ResolveTCPAddrs(host string, port int) ([]*net.T
 		return tcpAddrs, nil
 	}
 
-	_, addrs := NSLookup(host, server.Hint, server.DNS)
+	profile := server.Profile()
+	_, addrs := profile.NSLookup(host, server.Hint, server.DNS)
 	if len(addrs) == 0 {
-		return nil, errors.New("no such host")
+		return nil, profile.dnsError(host, addrs)
 	}
 	tcpAddrs := make([]*net.TCPAddr, len(addrs))
 	for i, addr := range addrs {
@@ -1311,37 +2114,66 @@ func (server *PhantomInterface) ResolveTCPAddrs(host string, port int) ([]*net.T
 	return tcpAddrs, nil
 }
 
-func DNSTCPServer(client net.Conn) {
-	defer client.Close()
+// how long a DNS over TCP or TLS connection is kept without queries
+var DNSTCPIdleTimeout = time.Second * 10
 
-	var data [2048]byte
-	n, err := client.Read(data[:])
-	if err != nil {
+// DNSTCPServer answers the queries of a DNS over TCP or TLS client
+func (profile *PhantomProfile) DNSTCPServer(client net.Conn) {
+	(&DNSServer{Profile: profile}).ServeConn(client)
+}
+
+// DoHServer answers DNS queries sent with GET ?dns= or POST (RFC 8484)
+func (profile *PhantomProfile) DoHServer(w http.ResponseWriter, req *http.Request) {
+	(&DNSServer{Profile: profile}).ServeHTTP(w, req)
+}
+
+// ServeHTTP answers DNS queries sent with GET ?dns= or POST (RFC 8484)
+func (server *DNSServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var request []byte
+	var err error
+	switch req.Method {
+	case http.MethodGet:
+		request, err = base64.RawURLEncoding.DecodeString(req.URL.Query().Get("dns"))
+	case http.MethodPost:
+		if ct := req.Header.Get("Content-Type"); ct != "" && ct != "application/dns-message" {
+			http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		request, err = io.ReadAll(io.LimitReader(req.Body, 65535))
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	requestLen := int(binary.BigEndian.Uint16(data[:2]))
-	if requestLen > (n - 2) {
+	if err != nil || len(request) < 12 {
+		http.Error(w, "bad request", http.StatusBadRequest)
 		return
 	}
-	request := make([]byte, requestLen)
-	copy(request, data[2:requestLen+2])
-
-	_, response := NSRequest(request, true)
-	responseLen := len(response)
-	binary.BigEndian.PutUint16(data[:2], uint16(responseLen))
-	copy(data[2:], response)
-	client.Write(data[:responseLen+2])
-}
 
-func DoHServer(w http.ResponseWriter, req *http.Request) {
-	var data [2048]byte
-	n, err := req.Body.Read(data[:])
-	if err != nil {
+	host, _, _ := net.SplitHostPort(req.RemoteAddr)
+	response := server.Resolve(request, net.ParseIP(host))
+	if response == nil {
+		http.Error(w, "no answer", http.StatusBadGateway)
 		return
 	}
-	request := data[:n]
-	_, response := NSRequest(request, true)
 
 	w.Header().Set("Content-Type", "application/dns-message")
+	if ttl, ok := responseTTL(response); ok {
+		w.Header().Set("Cache-Control", "max-age="+strconv.Itoa(int(ttl)))
+	}
 	w.Write(response)
 }
+
+// the lowest TTL of the answers of response, for the caches of HTTP
+func responseTTL(response []byte) (uint32, bool) {
+	msg, err := parseMsg(response)
+	if err != nil || len(msg.answer) == 0 {
+		return 0, false
+	}
+	ttl := msg.answer[0].ttl
+	for _, rr := range msg.answer {
+		if rr.ttl < ttl {
+			ttl = rr.ttl
+		}
+	}
+	return ttl, true
+}
@@ -0,0 +1,191 @@
+package phantomtcp
+
+import (
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how long a prefix discovered from a server is used before asking again
+var DNS64Interval = time.Hour
+
+type dns64Prefix struct {
+	prefix *net.IPNet
+	expiry time.Time
+}
+
+var dns64Lock sync.Mutex
+var dns64Prefixes = make(map[string]dns64Prefix)
+
+// the lengths of NAT64 prefixes (RFC 6052 2.2), the longest first
+var nat64Lengths = []int{96, 64, 56, 48, 40, 32}
+
+// parseNAT64 parses a NAT64 prefix: "64:ff9b::" is a /96, "2001:db8::/64"
+// any of nat64Lengths
+func parseNAT64(prefix string) *net.IPNet {
+	if !strings.Contains(prefix, "/") {
+		prefix += "/96"
+	}
+	ip, ipnet, err := net.ParseCIDR(prefix)
+	if err != nil || ip.To4() != nil {
+		return nil
+	}
+	bits, _ := ipnet.Mask.Size()
+	for _, length := range nat64Lengths {
+		if bits == length {
+			return ipnet
+		}
+	}
+	return nil
+}
+
+// nat64Embed returns the IPv6 address of ip4 in prefix, the byte at bits
+// 64 to 71 is left zero
+func nat64Embed(prefix *net.IPNet, ip4 net.IP) net.IP {
+	bits, _ := prefix.Mask.Size()
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, prefix.IP.To16()[:bits/8])
+	i := bits / 8
+	for _, b := range ip4.To4() {
+		if i == 8 {
+			i++
+		}
+		ip[i] = b
+		i++
+	}
+	return ip
+}
+
+// nat64Extract returns the IPv4 address embedded in ip, nil when ip is
+// not in prefix
+func nat64Extract(prefix *net.IPNet, ip net.IP) net.IP {
+	if len(ip) != net.IPv6len || ip.To4() != nil || !prefix.Contains(ip) {
+		return nil
+	}
+	bits, _ := prefix.Mask.Size()
+	ip4 := make(net.IP, net.IPv4len)
+	i := bits / 8
+	for j := range ip4 {
+		if i == 8 {
+			i++
+		}
+		ip4[j] = ip[i]
+		i++
+	}
+	return ip4
+}
+
+// nat64FromWKA returns the prefix the AAAA records of ipv4only.arpa were
+// synthesized with, the length at which every one of them holds
+// 192.0.0.170 or 192.0.0.171 with the byte at bits 64 to 71 zero (RFC 7050
+// 3), nil when there is none
+func nat64FromWKA(ips []net.IP) *net.IPNet {
+	var prefix *net.IPNet
+	for _, length := range nat64Lengths {
+		mask := net.CIDRMask(length, 8*net.IPv6len)
+		found := 0
+		for _, ip := range ips {
+			if len(ip) != net.IPv6len || ip.To4() != nil || (length < 96 && ip[8] != 0) {
+				continue
+			}
+			candidate := &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+			ip4 := nat64Extract(candidate, ip)
+			if ip4[0] != 192 || ip4[1] != 0 || ip4[2] != 0 || (ip4[3] != 170 && ip4[3] != 171) {
+				continue
+			}
+			if prefix == nil {
+				prefix = candidate
+			} else if !prefix.IP.Equal(candidate.IP) {
+				found = -1
+				break
+			}
+			found++
+		}
+		if found > 0 {
+			return prefix
+		}
+		prefix = nil
+	}
+	return nil
+}
+
+// RFC 7050, the AAAA records of ipv4only.arpa a DNS64 server synthesizes
+// from its well-known addresses 192.0.0.170 and 192.0.0.171 give its prefix
+func discoverDNS64(servers []*url.URL, options ServerOptions) *net.IPNet {
+	key := servers[0].String()
+	dns64Lock.Lock()
+	cached, ok := dns64Prefixes[key]
+	dns64Lock.Unlock()
+	if ok && time.Now().Before(cached.expiry) {
+		return cached.prefix
+	}
+
+	var prefix *net.IPNet
+	options.PD = ""
+	options.BadSubnet = nil
+	response, err := Race(servers, PackRequest("ipv4only.arpa", 28, 0, ""), options)
+	if err == nil {
+		var records DNSRecords
+		records.GetAnswers(response, options)
+		if records.IPv6Hint != nil {
+			prefix = nat64FromWKA(records.IPv6Hint.Addresses)
+		}
+	} else {
+		logPrintln(2, "dns64:", key, err)
+	}
+	if prefix == nil {
+		// not a DNS64 server, use the prefix of the local network
+		prefix = parseNAT64(GetNAT64Prefix())
+	}
+	logPrintln(3, "dns64:", key, prefix)
+
+	dns64Lock.Lock()
+	dns64Prefixes[key] = dns64Prefix{prefix, time.Now().Add(DNS64Interval)}
+	dns64Lock.Unlock()
+	return prefix
+}
+
+// synthesizeDNS64 maps the A records of name into the dns64 prefix of
+// the servers when they have no AAAA record
+func (records *DNSRecords) synthesizeDNS64(name string, servers []*url.URL, ecs string, options ServerOptions) {
+	if options.DNS64 == "" || (records.IPv6Hint != nil && len(records.IPv6Hint.Addresses) > 0) {
+		return
+	}
+	var prefix *net.IPNet
+	if options.DNS64 == "auto" {
+		prefix = discoverDNS64(servers, options)
+	} else {
+		prefix = parseNAT64(options.DNS64)
+	}
+	if prefix == nil {
+		logPrintln(2, "dns64:", name, "no prefix")
+		return
+	}
+
+	if records.IPv4Hint == nil || records.IPv4Hint.Expired(time.Now().Unix()) {
+		records.IPv4Hint = nil
+		response, err := Race(servers, PackRequest(name, 1, 0, ecs), options)
+		if err != nil {
+			logPrintln(1, err)
+			return
+		}
+		cname := records.GetAnswers(response, options)
+		records.followCNAME(name, cname, 1, servers, ecs, options)
+		if records.IPv4Hint == nil {
+			return
+		}
+	}
+
+	var addresses []net.IP
+	for _, ip := range records.IPv4Hint.Addresses {
+		if ip4 := ip.To4(); ip4 != nil {
+			addresses = append(addresses, nat64Embed(prefix, ip4))
+		}
+	}
+	if len(addresses) > 0 {
+		logPrintln(4, "dns64:", name, addresses)
+		records.IPv6Hint = &RecordAddresses{records.IPv4Hint.TTL, addresses}
+	}
+}
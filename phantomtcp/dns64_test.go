@@ -0,0 +1,66 @@
+package phantomtcp
+
+import (
+	"net"
+	"testing"
+)
+
+func TestNAT64Embed(t *testing.T) {
+	// RFC 6052 2.4
+	ip4 := net.ParseIP("192.0.2.33")
+	tests := []struct {
+		prefix, ip string
+	}{
+		{"2001:db8::/32", "2001:db8:c000:221::"},
+		{"2001:db8:100::/40", "2001:db8:1c0:2:21::"},
+		{"2001:db8:122::/48", "2001:db8:122:c000:2:2100::"},
+		{"2001:db8:122:300::/56", "2001:db8:122:3c0:0:221::"},
+		{"2001:db8:122:344::/64", "2001:db8:122:344:c0:2:2100:0"},
+		{"2001:db8:122:344::/96", "2001:db8:122:344::192.0.2.33"},
+		{"2001:db8:122:344::", "2001:db8:122:344::192.0.2.33"},
+	}
+	for _, tt := range tests {
+		prefix := parseNAT64(tt.prefix)
+		if prefix == nil {
+			t.Errorf("parseNAT64(%s) failed", tt.prefix)
+			continue
+		}
+		ip := nat64Embed(prefix, ip4)
+		if !ip.Equal(net.ParseIP(tt.ip)) {
+			t.Errorf("%s: embedded %v, want %s", tt.prefix, ip, tt.ip)
+		}
+		if got := nat64Extract(prefix, ip); !got.Equal(ip4) {
+			t.Errorf("%s: extracted %v", tt.prefix, got)
+		}
+	}
+
+	for _, prefix := range []string{"2001:db8::/80", "192.0.2.0/24", "64:ff9b::/33", "bad"} {
+		if parseNAT64(prefix) != nil {
+			t.Errorf("parseNAT64(%s) accepted", prefix)
+		}
+	}
+}
+
+func TestNAT64FromWKA(t *testing.T) {
+	tests := []struct {
+		ips    []string
+		prefix string
+	}{
+		{[]string{"64:ff9b::192.0.0.170", "64:ff9b::192.0.0.171"}, "64:ff9b::/96"},
+		{[]string{"2001:db8:122:344:c0:0:aa00:0", "2001:db8:122:344:c0:0:ab00:0"}, "2001:db8:122:344::/64"},
+		{[]string{"2001:db8:c000:aa::"}, "2001:db8::/32"},
+		{[]string{"2001:db8:1c0:0:aa::"}, "2001:db8:100::/40"},
+		{[]string{"192.0.0.170", "2001:db8:122:3c0:0:aa::"}, "2001:db8:122:300::/56"},
+		{[]string{"2001:db8::1"}, "<nil>"},
+		{[]string{"2001:db8:122:344:c0:1:aa00:0"}, "<nil>"},
+	}
+	for _, tt := range tests {
+		var ips []net.IP
+		for _, ip := range tt.ips {
+			ips = append(ips, net.ParseIP(ip))
+		}
+		if got := nat64FromWKA(ips).String(); got != tt.prefix {
+			t.Errorf("%v: %s, want %s", tt.ips, got, tt.prefix)
+		}
+	}
+}
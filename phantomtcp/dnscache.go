@@ -0,0 +1,165 @@
+package phantomtcp
+
+import (
+	"container/list"
+	"hash/maphash"
+	"sync"
+)
+
+// maximum number of resolved names kept by each profile, 0 is unlimited
+var DNSCacheSize = 65536
+
+const dnsCacheShards = 16
+
+type cacheEntry struct {
+	key     string
+	records *DNSRecords
+	elem    *list.Element
+}
+
+type cacheShard struct {
+	lock    sync.Mutex
+	entries map[string]*cacheEntry
+	lru     list.List
+}
+
+// DNSCache is a sharded LRU of resolved names. Entries added by Store
+// come from the rules and hosts files and are never evicted, the ones
+// added by Add are dropped when a shard is full.
+type DNSCache struct {
+	seed   maphash.Seed
+	shards [dnsCacheShards]cacheShard
+	once   sync.Once
+}
+
+func (cache *DNSCache) shard(key string) *cacheShard {
+	cache.once.Do(func() {
+		cache.seed = maphash.MakeSeed()
+		for i := range cache.shards {
+			cache.shards[i].entries = make(map[string]*cacheEntry)
+		}
+	})
+	var h maphash.Hash
+	h.SetSeed(cache.seed)
+	h.WriteString(key)
+	return &cache.shards[h.Sum64()%dnsCacheShards]
+}
+
+func (cache *DNSCache) Load(key string) (*DNSRecords, bool) {
+	shard := cache.shard(key)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+	entry, ok := shard.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if entry.elem != nil {
+		shard.lru.MoveToFront(entry.elem)
+	}
+	return entry.records, true
+}
+
+func (cache *DNSCache) set(key string, records *DNSRecords, pinned bool) {
+	shard := cache.shard(key)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+	entry, ok := shard.entries[key]
+	if ok {
+		entry.records = records
+		if entry.elem != nil {
+			if pinned {
+				shard.lru.Remove(entry.elem)
+				entry.elem = nil
+			} else {
+				shard.lru.MoveToFront(entry.elem)
+			}
+		}
+		return
+	}
+
+	entry = &cacheEntry{key: key, records: records}
+	if !pinned {
+		entry.elem = shard.lru.PushFront(entry)
+		limit := DNSCacheSize / dnsCacheShards
+		if DNSCacheSize > 0 && limit == 0 {
+			limit = 1
+		}
+		for limit > 0 && shard.lru.Len() > limit {
+			oldest := shard.lru.Remove(shard.lru.Back()).(*cacheEntry)
+			delete(shard.entries, oldest.key)
+		}
+	}
+	shard.entries[key] = entry
+}
+
+// Store adds a name that is never evicted
+func (cache *DNSCache) Store(key string, records *DNSRecords) {
+	cache.set(key, records, true)
+}
+
+// Add adds a resolved name, the least recently used one is evicted
+// when the shard is full
+func (cache *DNSCache) Add(key string, records *DNSRecords) {
+	cache.set(key, records, false)
+}
+
+func (cache *DNSCache) Delete(key string) {
+	shard := cache.shard(key)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+	entry, ok := shard.entries[key]
+	if !ok {
+		return
+	}
+	if entry.elem != nil {
+		shard.lru.Remove(entry.elem)
+	}
+	delete(shard.entries, key)
+}
+
+// Range calls f for a snapshot of each shard, f may modify the cache
+func (cache *DNSCache) Range(f func(key string, records *DNSRecords) bool) {
+	for i := range cache.shards {
+		shard := &cache.shards[i]
+		// the records of an entry are replaced under the lock
+		shard.lock.Lock()
+		entries := make([]cacheEntry, 0, len(shard.entries))
+		for key, entry := range shard.entries {
+			entries = append(entries, cacheEntry{key: key, records: entry.records})
+		}
+		shard.lock.Unlock()
+
+		for _, entry := range entries {
+			if !f(entry.key, entry.records) {
+				return
+			}
+		}
+	}
+}
+
+// Pinned returns the names added by Store
+func (cache *DNSCache) Pinned() []string {
+	var names []string
+	for i := range cache.shards {
+		shard := &cache.shards[i]
+		shard.lock.Lock()
+		for key, entry := range shard.entries {
+			if entry.elem == nil {
+				names = append(names, key)
+			}
+		}
+		shard.lock.Unlock()
+	}
+	return names
+}
+
+func (cache *DNSCache) Len() int {
+	count := 0
+	for i := range cache.shards {
+		shard := &cache.shards[i]
+		shard.lock.Lock()
+		count += len(shard.entries)
+		shard.lock.Unlock()
+	}
+	return count
+}
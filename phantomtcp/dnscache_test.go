@@ -0,0 +1,170 @@
+package phantomtcp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecordAddressesExpiry(t *testing.T) {
+	now := time.Now().Unix()
+	tests := []struct {
+		name    string
+		ttl     int64
+		expired bool
+	}{
+		{"static", 0, false},
+		{"live", now + 60, false},
+		{"now", now, true},
+		{"past", now - 60, true},
+	}
+	for _, tt := range tests {
+		rec := &RecordAddresses{tt.ttl, nil}
+		if rec.Expired(now) != tt.expired {
+			t.Errorf("%s: expired %v", tt.name, !tt.expired)
+		}
+	}
+
+	// a set expires with its shortest lived record, static ones never
+	rec := &RecordAddresses{now + 300, nil}
+	rec.lowerTTL(600)
+	rec.lowerTTL(60)
+	if rec.TTL > now+61 || rec.TTL < now+60 {
+		t.Errorf("expiry in %d seconds, want 60", rec.TTL-now)
+	}
+	rec = &RecordAddresses{0, nil}
+	rec.lowerTTL(60)
+	if rec.TTL != 0 {
+		t.Error("a static set expires")
+	}
+}
+
+func TestPackAnswersTTL(t *testing.T) {
+	now := time.Now().Unix()
+	tests := []struct {
+		name   string
+		expiry int64
+		minttl uint32
+		ttl    uint32
+	}{
+		{"live", now + 120, 0, 120},
+		{"minttl", now + 120, 300, 300},
+		{"expired", now - 120, 0, 0},
+		{"expired minttl", now - 120, 60, 60},
+	}
+	for _, tt := range tests {
+		records := &DNSRecords{IPv4Hint: &RecordAddresses{tt.expiry, []net.IP{net.IPv4(192, 0, 2, 1)}}}
+		count, answers := records.PackAnswers(1, tt.minttl)
+		if count != 1 || len(answers) != 16 {
+			t.Errorf("%s: %d answers of %d bytes", tt.name, count, len(answers))
+			continue
+		}
+		// a second may pass between the expiry and the answer
+		if ttl := binary.BigEndian.Uint32(answers[6:]); ttl > tt.ttl || ttl+1 < tt.ttl {
+			t.Errorf("%s: ttl %d, want %d", tt.name, ttl, tt.ttl)
+		}
+	}
+}
+
+// sameShard returns n names that go to one shard of cache
+func sameShard(cache *DNSCache, n int) []string {
+	var names []string
+	shard := cache.shard("n0.example.com")
+	for i := 0; len(names) < n; i++ {
+		name := fmt.Sprintf("n%d.example.com", i)
+		if cache.shard(name) == shard {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func TestDNSCacheEviction(t *testing.T) {
+	saved := DNSCacheSize
+	DNSCacheSize = 2 * dnsCacheShards
+	defer func() { DNSCacheSize = saved }()
+
+	var cache DNSCache
+	names := sameShard(&cache, 5)
+	records := &DNSRecords{}
+
+	cache.Store(names[0], records)
+	cache.Add(names[1], records)
+	cache.Add(names[2], records)
+	cache.Load(names[1])
+	cache.Add(names[3], records)
+	if _, ok := cache.Load(names[2]); ok {
+		t.Error("the least recently used name was kept")
+	}
+	for _, name := range []string{names[0], names[1], names[3]} {
+		if _, ok := cache.Load(name); !ok {
+			t.Errorf("%s evicted", name)
+		}
+	}
+
+	// a pinned name is not evicted and added again stays pinned
+	cache.Add(names[0], records)
+	cache.Store(names[1], records)
+	cache.Add(names[4], records)
+	cache.Add(names[2], records)
+	if pinned := cache.Pinned(); len(pinned) != 2 || cache.Len() != 4 {
+		t.Errorf("pinned %q of %d names", pinned, cache.Len())
+	}
+	if _, ok := cache.Load(names[3]); ok {
+		t.Errorf("%s kept", names[3])
+	}
+
+	cache.Delete(names[0])
+	cache.Delete(names[4])
+	var keys []string
+	cache.Range(func(key string, records *DNSRecords) bool {
+		keys = append(keys, key)
+		return true
+	})
+	want := []string{names[1], names[2]}
+	sort.Strings(keys)
+	sort.Strings(want)
+	if strings.Join(keys, " ") != strings.Join(want, " ") {
+		t.Errorf("names %q, want %q", keys, want)
+	}
+}
+
+func TestDNSCacheUnlimited(t *testing.T) {
+	saved := DNSCacheSize
+	DNSCacheSize = 0
+	defer func() { DNSCacheSize = saved }()
+
+	var cache DNSCache
+	for _, name := range sameShard(&cache, 100) {
+		cache.Add(name, &DNSRecords{})
+	}
+	if cache.Len() != 100 {
+		t.Errorf("%d names kept", cache.Len())
+	}
+}
+
+// Range alongside the replacement of the records of its names
+func TestDNSCacheRangeConcurrent(t *testing.T) {
+	var cache DNSCache
+	names := []string{"a.example.com", "b.example.com", "c.example.com"}
+	for _, name := range names {
+		cache.Add(name, &DNSRecords{})
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			cache.Add(names[i%len(names)], &DNSRecords{Index: uint32(i)})
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		cache.Range(func(key string, records *DNSRecords) bool {
+			return records != nil
+		})
+	}
+	<-done
+}
@@ -0,0 +1,371 @@
+package phantomtcp
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	FILTER_ALLOW    = 0x0
+	FILTER_NXDOMAIN = 0x1
+	FILTER_NODATA   = 0x2
+	FILTER_SINKHOLE = 0x3
+	FILTER_DROP     = 0x4
+)
+
+type DNSFilter struct {
+	Action    byte
+	Addresses []net.IP
+}
+
+// CNAME targets of the policy actions of an RPZ zone
+var rpzActions = map[string]byte{
+	".":             FILTER_NXDOMAIN,
+	"*.":            FILTER_NODATA,
+	"rpz-passthru.": FILTER_ALLOW,
+	"rpz-drop.":     FILTER_DROP,
+}
+
+// names that make browsers and systems turn off their own encrypted DNS,
+// they are answered with NXDOMAIN unless doh-canary=0 is set
+var DoHCanary = true
+var dohCanaries = map[string]bool{
+	"use-application-dns.net": true,
+	"mask.icloud.com":         true,
+	"mask-h2.icloud.com":      true,
+}
+var canaryFilter = &DNSFilter{Action: FILTER_NXDOMAIN}
+
+// lists loaded from http:// or https:// URLs are downloaded again and
+// all lists are reloaded every FilterRefreshInterval
+var FilterRefreshInterval = time.Hour * 24
+
+type filterSource struct {
+	name  string
+	allow bool
+}
+
+// filter of name, an exact entry wins over the nearest *.parent entry
+func (profile *PhantomProfile) GetFilter(name string) *DNSFilter {
+	name = strings.ToLower(name)
+	profile.filterLock.RLock()
+	defer profile.filterLock.RUnlock()
+	if len(profile.FilterMap) > 0 {
+		filter, ok := profile.FilterMap[name]
+		if ok {
+			return filter
+		}
+		for parent := name; ; {
+			dot := strings.IndexByte(parent, '.')
+			if dot == -1 {
+				break
+			}
+			parent = parent[dot+1:]
+			filter, ok = profile.FilterMap["*."+parent]
+			if ok {
+				return filter
+			}
+		}
+	}
+
+	if DoHCanary && dohCanaries[name] {
+		return canaryFilter
+	}
+	return nil
+}
+
+func addFilter(filters map[string]*DNSFilter, name string, action byte, addr net.IP) {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	filter, ok := filters[name]
+	if ok {
+		// allowlists always win, sinkhole addresses of several lines add up
+		if filter.Action == FILTER_ALLOW {
+			return
+		}
+		if filter.Action == FILTER_SINKHOLE && action == FILTER_SINKHOLE {
+			filter.Addresses = append(filter.Addresses, addr)
+			return
+		}
+	}
+
+	filter = &DNSFilter{Action: action}
+	if addr != nil {
+		filter.Addresses = []net.IP{addr}
+	}
+	filters[name] = filter
+}
+
+// response of a filtered query, nil if it is dropped
+func (filter *DNSFilter) BuildResponse(request []byte, qtype int) []byte {
+	var records DNSRecords
+	switch filter.Action {
+	case FILTER_DROP:
+		return nil
+	case FILTER_SINKHOLE:
+		for _, ip := range filter.Addresses {
+			if ip4 := ip.To4(); ip4 != nil {
+				if records.IPv4Hint == nil {
+					records.IPv4Hint = &RecordAddresses{0, nil}
+				}
+				records.IPv4Hint.Addresses = append(records.IPv4Hint.Addresses, ip4)
+			} else {
+				if records.IPv6Hint == nil {
+					records.IPv6Hint = &RecordAddresses{0, nil}
+				}
+				records.IPv6Hint.Addresses = append(records.IPv6Hint.Addresses, ip)
+			}
+		}
+	}
+
+	response := records.BuildResponse(request, qtype, 60)
+	if filter.Action == FILTER_NXDOMAIN {
+		response[3] |= 3
+	}
+	return response
+}
+
+// addresses a filtered name resolves to for qtype
+func (filter *DNSFilter) Lookup(qtype uint16) []net.IP {
+	var addrs []net.IP
+	for _, ip := range filter.Addresses {
+		if (ip.To4() != nil) == (qtype == 1) {
+			addrs = append(addrs, ip)
+		}
+	}
+	return addrs
+}
+
+// the name of an AdGuard or Adblock Plus rule "||name^", exception is
+// set for "@@||name^", rules with modifiers other than $important or
+// with paths and wildcards do not apply to DNS
+func parseAdblock(line string) (name string, exception bool) {
+	if strings.HasPrefix(line, "@@") {
+		exception = true
+		line = line[2:]
+	}
+	if !strings.HasPrefix(line, "||") {
+		return "", false
+	}
+	line = line[2:]
+	if i := strings.IndexByte(line, '$'); i != -1 {
+		for _, modifier := range strings.Split(line[i+1:], ",") {
+			if modifier != "important" {
+				return "", false
+			}
+		}
+		line = line[:i]
+	}
+	line = strings.TrimSuffix(strings.TrimSuffix(line, "|"), "^")
+	if line == "" || strings.ContainsAny(line, "/*^|:") {
+		return "", false
+	}
+	return line, exception
+}
+
+func openFilter(source string) (io.ReadCloser, error) {
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		client := http.Client{Timeout: time.Minute}
+		resp, err := client.Get(source)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, errors.New(source + ": " + resp.Status)
+		}
+		return resp.Body, nil
+	}
+	return os.Open(source)
+}
+
+// LoadFilter reads a blocklist or an allowlist from a file or an URL in
+// hosts format, one name per line, AdGuard/Adblock Plus rules or an RPZ
+// zone. Names in a blocklist are answered with NXDOMAIN, the addresses of
+// a hosts file are returned as a sinkhole. A list that cannot be
+// downloaded is tried again at the next refresh.
+func (profile *PhantomProfile) LoadFilter(source string, allow bool) error {
+	remote := strings.Contains(source, "://")
+	profile.filterLock.Lock()
+	profile.filterSources = append(profile.filterSources, filterSource{source, allow})
+	start := remote && !profile.filterRefresh
+	profile.filterRefresh = profile.filterRefresh || remote
+	profile.filterLock.Unlock()
+	if start {
+		go profile.refreshFilters()
+	}
+
+	filters := make(map[string]*DNSFilter)
+	err := readFilter(source, allow, filters)
+	if err != nil {
+		if remote {
+			logPrintln(1, err)
+			return nil
+		}
+		return err
+	}
+
+	profile.filterLock.Lock()
+	for name, filter := range filters {
+		if current, ok := profile.FilterMap[name]; ok && current.Action == FILTER_ALLOW {
+			continue
+		}
+		if filter.Action == FILTER_SINKHOLE {
+			if current, ok := profile.FilterMap[name]; ok && current.Action == FILTER_SINKHOLE {
+				filter.Addresses = append(current.Addresses, filter.Addresses...)
+			}
+		}
+		profile.FilterMap[name] = filter
+	}
+	profile.filterLock.Unlock()
+	return nil
+}
+
+// reload all lists every FilterRefreshInterval, the current rules are
+// kept if one of them fails
+func (profile *PhantomProfile) refreshFilters() {
+	for {
+		time.Sleep(FilterRefreshInterval)
+
+		profile.filterLock.RLock()
+		sources := append([]filterSource(nil), profile.filterSources...)
+		profile.filterLock.RUnlock()
+
+		filters := make(map[string]*DNSFilter)
+		var err error
+		for _, source := range sources {
+			err = readFilter(source.name, source.allow, filters)
+			if err != nil {
+				break
+			}
+		}
+		if err != nil {
+			logPrintln(1, "filter refresh:", err)
+			continue
+		}
+
+		profile.filterLock.Lock()
+		profile.FilterMap = filters
+		profile.filterLock.Unlock()
+		logPrintln(1, "reloaded", len(filters), "filter rules")
+	}
+}
+
+func readFilter(source string, allow bool, filters map[string]*DNSFilter) error {
+	file, err := openFilter(source)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	origin := ""
+	paren := false
+	count := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "!") || strings.HasPrefix(line, "[") {
+			continue
+		}
+		if strings.Contains(line, "##") || strings.Contains(line, "#@#") || strings.Contains(line, "#?#") || strings.Contains(line, "#$#") {
+			continue
+		}
+		if strings.HasPrefix(line, "||") || strings.HasPrefix(line, "@@") {
+			name, exception := parseAdblock(line)
+			if name == "" {
+				continue
+			}
+			action := byte(FILTER_NXDOMAIN)
+			if allow || exception {
+				action = FILTER_ALLOW
+			}
+			addFilter(filters, name, action, nil)
+			addFilter(filters, "*."+name, action, nil)
+			count++
+			continue
+		}
+		if i := strings.IndexAny(line, "#;"); i != -1 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		// the SOA record of a zone spans several lines
+		if paren {
+			paren = !strings.Contains(line, ")")
+			continue
+		}
+		if strings.Contains(line, "(") && !strings.Contains(line, ")") {
+			paren = true
+			continue
+		}
+
+		if fields[0] == "$ORIGIN" && len(fields) > 1 {
+			origin = strings.TrimSuffix(strings.ToLower(fields[1]), ".")
+			continue
+		} else if fields[0][0] == '$' || fields[0] == "@" {
+			continue
+		}
+
+		if len(fields) == 1 {
+			if allow {
+				addFilter(filters, fields[0], FILTER_ALLOW, nil)
+			} else {
+				addFilter(filters, fields[0], FILTER_NXDOMAIN, nil)
+			}
+			count++
+			continue
+		}
+
+		ip := net.ParseIP(fields[0])
+		if ip != nil {
+			for _, name := range fields[1:] {
+				if allow {
+					addFilter(filters, name, FILTER_ALLOW, nil)
+				} else {
+					addFilter(filters, name, FILTER_SINKHOLE, ip)
+				}
+				count++
+			}
+			continue
+		}
+
+		// owner [ttl] [class] type rdata
+		name := strings.ToLower(fields[0])
+		if origin != "" {
+			name = strings.TrimSuffix(strings.TrimSuffix(name, "."), "."+origin)
+		}
+		for i := 1; i+1 < len(fields); i++ {
+			rtype := strings.ToUpper(fields[i])
+			rdata := strings.ToLower(fields[i+1])
+			if rtype == "CNAME" {
+				action, ok := rpzActions[rdata]
+				if !ok {
+					logPrintln(2, source, name, "unsupported action", rdata)
+					break
+				}
+				addFilter(filters, name, action, nil)
+			} else if rtype == "A" || rtype == "AAAA" {
+				ip := net.ParseIP(rdata)
+				if ip == nil {
+					break
+				}
+				addFilter(filters, name, FILTER_SINKHOLE, ip)
+			} else {
+				continue
+			}
+			count++
+			break
+		}
+	}
+
+	logPrintln(1, "loaded", count, "filter rules from", source)
+	return scanner.Err()
+}
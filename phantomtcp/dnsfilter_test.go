@@ -0,0 +1,125 @@
+package phantomtcp
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseAdblock(t *testing.T) {
+	tests := []struct {
+		line      string
+		name      string
+		exception bool
+	}{
+		{"||ads.example.com^", "ads.example.com", false},
+		{"||ads.example.com", "ads.example.com", false},
+		{"||ads.example.com^|", "ads.example.com", false},
+		{"||ads.example.com^$important", "ads.example.com", false},
+		{"@@||cdn.example.com^", "cdn.example.com", true},
+		{"||ads.example.com^$third-party", "", false},
+		{"||ads.example.com/banner", "", false},
+		{"||ads*.example.com^", "", false},
+		{"||ads.example.com:8080^", "", false},
+		{"|http://ads.example.com", "", false},
+		{"example.com", "", false},
+		{"||^", "", false},
+		{"@@", "", false},
+	}
+	for _, tt := range tests {
+		name, exception := parseAdblock(tt.line)
+		if name != tt.name || (name != "" && exception != tt.exception) {
+			t.Errorf("%q: %q %v, want %q %v", tt.line, name, exception, tt.name, tt.exception)
+		}
+	}
+}
+
+func TestLoadFilter(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, data string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	hosts := write("hosts", "# hosts\n0.0.0.0 tracker.example.com tracker.example.org\n0.0.0.0 sink.example.com\n::1 sink.example.com\nplain.example.com ; a name alone\n")
+	adblock := write("adblock.txt", "! Title: list\n[Adblock Plus 2.0]\n||ads.example.net^\n@@||good.ads.example.net^\n##.banner\n||ads.example.net/path\n")
+	rpz := write("rpz.zone", "$TTL 300\n$ORIGIN rpz.local.\n@ IN SOA localhost. root.localhost. (\n 1 3600\n 600 86400 60 )\nnx.example.com CNAME .\nnodata.example.com 300 IN CNAME *.\npass.example.com CNAME rpz-passthru.\ndrop.example.com CNAME rpz-drop.\nwalled.example.com A 10.0.0.1\n")
+	allow := write("allow.txt", "tracker.example.org\n")
+
+	profile, _, err := NewProfile(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, source := range []struct {
+		path  string
+		allow bool
+	}{{allow, true}, {hosts, false}, {adblock, false}, {rpz, false}} {
+		if err := profile.LoadFilter(source.path, source.allow); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := profile.LoadFilter(filepath.Join(dir, "missing"), false); err == nil {
+		t.Error("a missing local list loaded")
+	}
+
+	tests := []struct {
+		name   string
+		action byte
+		addrs  int
+	}{
+		{"tracker.example.com", FILTER_SINKHOLE, 1},
+		{"Tracker.Example.com", FILTER_SINKHOLE, 1},
+		{"tracker.example.org", FILTER_ALLOW, 0}, //the allowlist wins
+		{"sink.example.com", FILTER_SINKHOLE, 2},
+		{"plain.example.com", FILTER_NXDOMAIN, 0},
+		{"ads.example.net", FILTER_NXDOMAIN, 0},
+		{"x.y.ads.example.net", FILTER_NXDOMAIN, 0},
+		{"good.ads.example.net", FILTER_ALLOW, 0},
+		{"nx.example.com", FILTER_NXDOMAIN, 0},
+		{"nodata.example.com", FILTER_NODATA, 0},
+		{"pass.example.com", FILTER_ALLOW, 0},
+		{"drop.example.com", FILTER_DROP, 0},
+		{"walled.example.com", FILTER_SINKHOLE, 1},
+		{"use-application-dns.net", FILTER_NXDOMAIN, 0},
+	}
+	for _, tt := range tests {
+		filter := profile.GetFilter(tt.name)
+		if filter == nil {
+			t.Errorf("%s: not filtered", tt.name)
+			continue
+		}
+		if filter.Action != tt.action || len(filter.Addresses) != tt.addrs {
+			t.Errorf("%s: action %d %v, want %d with %d addresses", tt.name, filter.Action, filter.Addresses, tt.action, tt.addrs)
+		}
+	}
+	for _, name := range []string{"example.com", "www.tracker.example.com", "example.net", "rpz.local"} {
+		if filter := profile.GetFilter(name); filter != nil {
+			t.Errorf("%s: filtered with %d", name, filter.Action)
+		}
+	}
+}
+
+func TestFilterBuildResponse(t *testing.T) {
+	request := dnsQuery([]string{"ads", "example", "com"}, 1)
+	if response := (&DNSFilter{Action: FILTER_NXDOMAIN}).BuildResponse(request, 1); response[3]&0x0f != 3 {
+		t.Errorf("NXDOMAIN: rcode %d", response[3]&0x0f)
+	}
+	if response := (&DNSFilter{Action: FILTER_DROP}).BuildResponse(request, 1); response != nil {
+		t.Errorf("drop: %x", response)
+	}
+
+	sinkhole := &DNSFilter{Action: FILTER_SINKHOLE, Addresses: []net.IP{net.ParseIP("0.0.0.0"), net.ParseIP("::")}}
+	for _, qtype := range []uint16{1, 28} {
+		addrs := sinkhole.Lookup(qtype)
+		if len(addrs) != 1 || (addrs[0].To4() != nil) != (qtype == 1) {
+			t.Errorf("sinkhole type %d: %v", qtype, addrs)
+		}
+	}
+	response := sinkhole.BuildResponse(request, 1)
+	if response[3]&0x0f != 0 || response[6] != 0 || response[7] != 1 {
+		t.Errorf("sinkhole: %x", response)
+	}
+}
@@ -0,0 +1,206 @@
+package phantomtcp
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// connections to TCP and TLS upstreams are kept for DNSPoolIdle and
+// shared by up to DNSPoolSize pipelined queries each
+var DNSPoolIdle = time.Second * 30
+var DNSPoolSize = 16
+
+type dnsConn struct {
+	conn    net.Conn
+	lock    sync.Mutex
+	pending map[uint16]chan []byte
+	closed  bool
+}
+
+type dnsPool struct {
+	lock    sync.Mutex
+	conns   map[string][]*dnsConn
+	dialing map[string]*sync.Mutex
+}
+
+var upstreamPool = dnsPool{
+	conns:   make(map[string][]*dnsConn),
+	dialing: make(map[string]*sync.Mutex),
+}
+
+var errPoolClosed = errors.New("upstream connection closed")
+
+func (pool *dnsPool) leastBusy(address string) *dnsConn {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	var best *dnsConn
+	load := DNSPoolSize
+	for _, c := range pool.conns[address] {
+		c.lock.Lock()
+		if !c.closed && len(c.pending) < load {
+			best = c
+			load = len(c.pending)
+		}
+		c.lock.Unlock()
+	}
+	return best
+}
+
+// the least busy connection to address, a new one is dialed if all
+// of them are full, one dial at a time for each address
+func (pool *dnsPool) get(address string, dial func() (net.Conn, error)) (*dnsConn, error) {
+	if c := pool.leastBusy(address); c != nil {
+		return c, nil
+	}
+
+	pool.lock.Lock()
+	dialing, ok := pool.dialing[address]
+	if !ok {
+		dialing = new(sync.Mutex)
+		pool.dialing[address] = dialing
+	}
+	pool.lock.Unlock()
+
+	dialing.Lock()
+	defer dialing.Unlock()
+	if c := pool.leastBusy(address); c != nil {
+		return c, nil
+	}
+
+	conn, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	c := &dnsConn{conn: conn, pending: make(map[uint16]chan []byte)}
+	pool.lock.Lock()
+	pool.conns[address] = append(pool.conns[address], c)
+	pool.lock.Unlock()
+	go pool.read(address, c)
+	return c, nil
+}
+
+func (pool *dnsPool) remove(address string, c *dnsConn) {
+	pool.lock.Lock()
+	conns := pool.conns[address]
+	for i, conn := range conns {
+		if conn == c {
+			pool.conns[address] = append(conns[:i:i], conns[i+1:]...)
+			break
+		}
+	}
+	if len(pool.conns[address]) == 0 {
+		delete(pool.conns, address)
+	}
+	pool.lock.Unlock()
+
+	c.lock.Lock()
+	c.closed = true
+	for id, ch := range c.pending {
+		close(ch)
+		delete(c.pending, id)
+	}
+	c.lock.Unlock()
+	c.conn.Close()
+}
+
+// dispatch the responses of c by ID until it fails or stays idle
+func (pool *dnsPool) read(address string, c *dnsConn) {
+	defer pool.remove(address, c)
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(DNSPoolIdle))
+		response, err := readTCPResponse(c.conn)
+		if err != nil {
+			if err, ok := err.(net.Error); ok && err.Timeout() {
+				c.lock.Lock()
+				idle := len(c.pending) == 0
+				c.lock.Unlock()
+				if idle {
+					logPrintln(4, "idle upstream closed:", address)
+				}
+			}
+			return
+		}
+		if len(response) < 12 {
+			continue
+		}
+
+		id := binary.BigEndian.Uint16(response[:2])
+		c.lock.Lock()
+		ch, ok := c.pending[id]
+		delete(c.pending, id)
+		c.lock.Unlock()
+		if ok {
+			ch <- response
+		}
+	}
+}
+
+func (c *dnsConn) exchange(request []byte) ([]byte, error) {
+	query := make([]byte, len(request)+2)
+	binary.BigEndian.PutUint16(query[:2], uint16(len(request)))
+	copy(query[2:], request)
+
+	ch := make(chan []byte, 1)
+	c.lock.Lock()
+	if c.closed {
+		c.lock.Unlock()
+		return nil, errPoolClosed
+	}
+	var id uint16
+	for {
+		id = randomID()
+		if _, ok := c.pending[id]; !ok {
+			break
+		}
+	}
+	binary.BigEndian.PutUint16(query[2:4], id)
+	c.pending[id] = ch
+	c.conn.SetWriteDeadline(time.Now().Add(time.Second * 5))
+	_, err := c.conn.Write(query)
+	c.lock.Unlock()
+	if err != nil {
+		c.conn.Close()
+		return nil, errPoolClosed
+	}
+
+	timer := time.NewTimer(time.Second * 5)
+	defer timer.Stop()
+	select {
+	case response, ok := <-ch:
+		if !ok {
+			return nil, errPoolClosed
+		}
+		if !matchResponse(query[2:], response) {
+			return nil, errors.New("mismatched response")
+		}
+		binary.BigEndian.PutUint16(response[:2], binary.BigEndian.Uint16(request[:2]))
+		return response, nil
+	case <-timer.C:
+		c.lock.Lock()
+		delete(c.pending, id)
+		c.lock.Unlock()
+		return nil, errors.New("upstream timeout")
+	}
+}
+
+// pooledLookup sends request over a pooled connection to address, a
+// query on a connection closed by the server is sent again once
+func pooledLookup(address string, request []byte, dial func() (net.Conn, error)) ([]byte, error) {
+	var err error
+	for i := 0; i < 2; i++ {
+		var c *dnsConn
+		c, err = upstreamPool.get(address, dial)
+		if err != nil {
+			return nil, err
+		}
+		var response []byte
+		response, err = c.exchange(request)
+		if err != errPoolClosed {
+			return response, err
+		}
+	}
+	return nil, err
+}
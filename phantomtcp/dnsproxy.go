@@ -0,0 +1,56 @@
+package phantomtcp
+
+import (
+	"crypto/tls"
+	"net"
+	"time"
+)
+
+// proxy=socks5://127.0.0.1:1080 on a DNS server sends its queries through
+// that proxy (http:// and socks4:// work as well), for resolvers that are
+// only reachable through it. The proxies relay streams, so a UDP server
+// is asked over TCP.
+func proxyDial(options ServerOptions, address string) (net.Conn, error) {
+	proxy, err := DefaultProfile.NewUpstream(options.Proxy)
+	if err != nil {
+		return nil, err
+	}
+	host, port := splitHostPort(address)
+	conn, err := net.DialTimeout("tcp", proxy.Address, time.Second*5)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(time.Second * 5))
+	proxyConn, err := proxy.ProxyHandshake(conn, nil, host, port)
+	conn.SetDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return proxyConn, nil
+}
+
+// proxyTLS is tls.Dial through the proxy of options
+func proxyTLS(options ServerOptions, address string, conf *tls.Config) (net.Conn, error) {
+	conn, err := proxyDial(options, address)
+	if err != nil {
+		return nil, err
+	}
+	tlsConn := tls.Client(conn, conf)
+	conn.SetDeadline(time.Now().Add(time.Second * 5))
+	err = tlsConn.Handshake()
+	conn.SetDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// proxyTCPlookup asks the DNS server address over TCP through the proxy
+// of options
+func proxyTCPlookup(request []byte, address string, options ServerOptions) ([]byte, error) {
+	return pooledLookup(options.Proxy+"/tcp://"+address, request, func() (net.Conn, error) {
+		return proxyDial(options, address)
+	})
+}
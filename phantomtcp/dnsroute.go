@@ -0,0 +1,114 @@
+package phantomtcp
+
+import (
+	"fmt"
+	"strings"
+)
+
+// split DNS: dnsroute=*.cn>udp://114.114.114.114 resolves the names under
+// cn with that server whatever rule they match, the route of * resolves
+// the names without a rule. Servers without a scheme are DoH servers.
+func (profile *PhantomProfile) addDNSRoute(route string) error {
+	keys := strings.SplitN(route, ">", 2)
+	if len(keys) != 2 || keys[0] == "" || keys[1] == "" {
+		return fmt.Errorf("bad dnsroute %s", route)
+	}
+	pattern := strings.TrimPrefix(keys[0], "*")
+	if pattern == "" {
+		pattern = "*"
+	}
+
+	var servers []string
+	for _, server := range strings.Split(keys[1], ",") {
+		server = strings.TrimSpace(server)
+		if !strings.Contains(server, "://") {
+			server = "https://" + server
+		}
+		servers = append(servers, server)
+	}
+	dns := strings.Join(servers, ",")
+	if _, err := ParseServers(dns); err != nil {
+		return err
+	}
+
+	profile.DNSRouteMap[pattern] = &PhantomInterface{DNS: dns, profile: profile}
+	return nil
+}
+
+// dnsRoute returns the route of name, the most specific one first, the
+// route of * is left to the callers
+func (rules *RuleSet) dnsRoute(name string) *PhantomInterface {
+	if len(rules.DNSRouteMap) == 0 {
+		return nil
+	}
+	if route, ok := rules.DNSRouteMap[name]; ok {
+		return route
+	}
+	for offset := strings.Index(name, "."); offset != -1; {
+		if route, ok := rules.DNSRouteMap[name[offset:]]; ok {
+			return route
+		}
+		next := strings.Index(name[offset+1:], ".")
+		if next == -1 {
+			break
+		}
+		offset += next + 1
+	}
+	return nil
+}
+
+type routedKey struct {
+	pface *PhantomInterface
+	route *PhantomInterface
+}
+
+// routeDNS returns the interface that resolves name: pface itself, or a
+// copy of it with the servers of the route of name. Rules without DNS
+// servers only give fake addresses and are not routed, names without a
+// rule get the route itself or the route of *.
+func (profile *PhantomProfile) routeDNS(name string, pface *PhantomInterface) *PhantomInterface {
+	rules := profile.Rules()
+	route := rules.dnsRoute(name)
+	if pface == nil {
+		if route == nil {
+			return rules.DNSRouteMap["*"]
+		}
+		return route
+	}
+	if route == nil {
+		return pface
+	}
+	if pface.DNS == "" || pface.DNS == route.DNS {
+		return pface
+	}
+
+	key := routedKey{pface, route}
+	if routed, ok := profile.dnsRouted.Load(key); ok {
+		return routed.(*PhantomInterface)
+	}
+	routed := *pface
+	routed.DNS = route.DNS
+	actual, _ := profile.dnsRouted.LoadOrStore(key, &routed)
+	return actual.(*PhantomInterface)
+}
+
+// routeServer returns the servers of the route of name for the lookups
+// of a rule with the DNS servers server
+func (profile *PhantomProfile) routeServer(name string, server string) string {
+	if server == "" {
+		return server
+	}
+	route := profile.Rules().dnsRoute(name)
+	if route == nil {
+		return server
+	}
+	servers, err := ParseServers(server)
+	if err != nil {
+		return server
+	}
+	switch servers[0].Scheme {
+	case "udp", "tcp", "tls", "https", "tfo", "mock":
+		return route.DNS
+	}
+	return server
+}
@@ -0,0 +1,1128 @@
+package phantomtcp
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DS records of the root key signing keys, KSK-2017 and KSK-2024
+var DNSSECAnchors = []string{
+	"20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+	"38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
+const (
+	typeSOA    = 6
+	typeCNAME  = 5
+	typeDNAME  = 39
+	typeDS     = 43
+	typeRRSIG  = 46
+	typeNSEC   = 47
+	typeDNSKEY = 48
+	typeNSEC3  = 50
+)
+
+// a record with its name in lowercase without the trailing dot and the
+// names in its data uncompressed, as they are signed
+type dnsRR struct {
+	name  string
+	rtype uint16
+	class uint16
+	ttl   uint32
+	rdata []byte
+}
+
+type dnsMsg struct {
+	rcode     int
+	qname     string
+	qtype     uint16
+	answer    []dnsRR
+	authority []dnsRR
+}
+
+func asciiLower(b []byte) []byte {
+	l := make([]byte, len(b))
+	for i, c := range b {
+		if c >= 'A' && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+		l[i] = c
+	}
+	return l
+}
+
+// readName reads the possibly compressed name at off of msg and returns
+// it in lowercase with the offset after it
+func readName(msg []byte, off int) (string, int, bool) {
+	var labels []string
+	end := -1
+	for jumps := 0; ; {
+		if off >= len(msg) {
+			return "", 0, false
+		}
+		l := int(msg[off])
+		switch {
+		case l == 0:
+			if end == -1 {
+				end = off + 1
+			}
+			return strings.Join(labels, "."), end, true
+		case l&0xc0 == 0xc0:
+			if off+1 >= len(msg) || jumps > 32 {
+				return "", 0, false
+			}
+			if end == -1 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+			jumps++
+		case l&0xc0 != 0:
+			return "", 0, false
+		default:
+			if off+1+l > len(msg) {
+				return "", 0, false
+			}
+			labels = append(labels, string(asciiLower(msg[off+1:off+1+l])))
+			off += 1 + l
+		}
+	}
+}
+
+func wireName(name string) []byte {
+	if name == "" {
+		return []byte{0}
+	}
+	var b []byte
+	for _, label := range strings.Split(name, ".") {
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+func labelCount(name string) int {
+	if name == "" {
+		return 0
+	}
+	return strings.Count(name, ".") + 1
+}
+
+// name is zone or below it
+func inZone(name, zone string) bool {
+	return zone == "" || name == zone || strings.HasSuffix(name, "."+zone)
+}
+
+// the data of a record in canonical form, RFC 4034 6.2
+func canonicalRdata(msg []byte, rtype uint16, off, end int) ([]byte, bool) {
+	prefix := 0
+	switch rtype {
+	case 2, typeCNAME, 12, typeDNAME:
+	case 15:
+		prefix = 2
+	case 33:
+		prefix = 6
+	case typeSOA:
+		mname, next, ok := readName(msg, off)
+		if !ok {
+			return nil, false
+		}
+		rname, next, ok := readName(msg, next)
+		if !ok || next+20 > end {
+			return nil, false
+		}
+		rdata := append(wireName(mname), wireName(rname)...)
+		return append(rdata, msg[next:next+20]...), true
+	default:
+		return append([]byte(nil), msg[off:end]...), true
+	}
+	if off+prefix > end {
+		return nil, false
+	}
+	name, _, ok := readName(msg, off+prefix)
+	if !ok {
+		return nil, false
+	}
+	return append(append([]byte(nil), msg[off:off+prefix]...), wireName(name)...), true
+}
+
+func parseMsg(msg []byte) (*dnsMsg, error) {
+	bogus := errors.New("dnssec: malformed response")
+	if len(msg) < 12 {
+		return nil, bogus
+	}
+	m := &dnsMsg{rcode: int(msg[3] & 0x0f)}
+	qdcount := int(binary.BigEndian.Uint16(msg[4:]))
+	ancount := int(binary.BigEndian.Uint16(msg[6:]))
+	nscount := int(binary.BigEndian.Uint16(msg[8:]))
+
+	off := 12
+	for i := 0; i < qdcount; i++ {
+		name, next, ok := readName(msg, off)
+		if !ok || next+4 > len(msg) {
+			return nil, bogus
+		}
+		if i == 0 {
+			m.qname = name
+			m.qtype = binary.BigEndian.Uint16(msg[next:])
+		}
+		off = next + 4
+	}
+	for i := 0; i < ancount+nscount; i++ {
+		name, next, ok := readName(msg, off)
+		if !ok || next+10 > len(msg) {
+			return nil, bogus
+		}
+		rr := dnsRR{
+			name:  name,
+			rtype: binary.BigEndian.Uint16(msg[next:]),
+			class: binary.BigEndian.Uint16(msg[next+2:]),
+			ttl:   binary.BigEndian.Uint32(msg[next+4:]),
+		}
+		end := next + 10 + int(binary.BigEndian.Uint16(msg[next+8:]))
+		if end > len(msg) {
+			return nil, bogus
+		}
+		rr.rdata, ok = canonicalRdata(msg, rr.rtype, next+10, end)
+		if !ok {
+			return nil, bogus
+		}
+		off = end
+		if i < ancount {
+			m.answer = append(m.answer, rr)
+		} else {
+			m.authority = append(m.authority, rr)
+		}
+	}
+	return m, nil
+}
+
+type rrsig struct {
+	covered    uint16
+	alg        uint8
+	labels     uint8
+	origTTL    uint32
+	expiration uint32
+	inception  uint32
+	tag        uint16
+	signer     string
+	header     []byte //the data up to the signature with the signer in lowercase
+	signature  []byte
+}
+
+func parseRRSIG(rdata []byte) (*rrsig, bool) {
+	if len(rdata) < 19 {
+		return nil, false
+	}
+	signer, off, ok := readName(rdata, 18)
+	if !ok {
+		return nil, false
+	}
+	return &rrsig{
+		covered:    binary.BigEndian.Uint16(rdata),
+		alg:        rdata[2],
+		labels:     rdata[3],
+		origTTL:    binary.BigEndian.Uint32(rdata[4:]),
+		expiration: binary.BigEndian.Uint32(rdata[8:]),
+		inception:  binary.BigEndian.Uint32(rdata[12:]),
+		tag:        binary.BigEndian.Uint16(rdata[16:]),
+		signer:     signer,
+		header:     append(append([]byte(nil), rdata[:18]...), wireName(signer)...),
+		signature:  rdata[off:],
+	}, true
+}
+
+// the records of rtype owned by name and their signatures
+func rrset(records []dnsRR, name string, rtype uint16) ([]dnsRR, []*rrsig) {
+	var set []dnsRR
+	var sigs []*rrsig
+	for _, rr := range records {
+		if rr.name != name {
+			continue
+		}
+		if rr.rtype == rtype {
+			set = append(set, rr)
+		} else if rr.rtype == typeRRSIG {
+			if sig, ok := parseRRSIG(rr.rdata); ok && sig.covered == rtype {
+				sigs = append(sigs, sig)
+			}
+		}
+	}
+	return set, sigs
+}
+
+// RFC 4034 appendix B
+func keyTag(rdata []byte) uint16 {
+	var ac uint32
+	for i, b := range rdata {
+		if i&1 == 0 {
+			ac += uint32(b) << 8
+		} else {
+			ac += uint32(b)
+		}
+	}
+	ac += ac >> 16 & 0xffff
+	return uint16(ac)
+}
+
+func verifySignature(alg uint8, pub, data, sig []byte) error {
+	switch alg {
+	case 5, 7, 8, 10:
+		hash := crypto.SHA1
+		if alg == 8 {
+			hash = crypto.SHA256
+		} else if alg == 10 {
+			hash = crypto.SHA512
+		}
+		if len(pub) < 3 {
+			return errors.New("dnssec: bad RSA key")
+		}
+		elen, off := int(pub[0]), 1
+		if elen == 0 {
+			elen, off = int(binary.BigEndian.Uint16(pub[1:])), 3
+		}
+		if elen > 4 || off+elen >= len(pub) {
+			return errors.New("dnssec: bad RSA key")
+		}
+		e := 0
+		for _, b := range pub[off : off+elen] {
+			e = e<<8 | int(b)
+		}
+		key := &rsa.PublicKey{N: new(big.Int).SetBytes(pub[off+elen:]), E: e}
+		h := hash.New()
+		h.Write(data)
+		return rsa.VerifyPKCS1v15(key, hash, h.Sum(nil), sig)
+	case 13, 14:
+		curve, digest := elliptic.P256(), sha256.Sum256(data)
+		hashed := digest[:]
+		if alg == 14 {
+			curve = elliptic.P384()
+			digest := sha512.Sum384(data)
+			hashed = digest[:]
+		}
+		size := curve.Params().BitSize / 8
+		if len(pub) != size*2 || len(sig) != size*2 {
+			return errors.New("dnssec: bad ECDSA key")
+		}
+		key := &ecdsa.PublicKey{
+			Curve: curve,
+			X:     new(big.Int).SetBytes(pub[:size]),
+			Y:     new(big.Int).SetBytes(pub[size:]),
+		}
+		r, s := new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(key, hashed, r, s) {
+			return errors.New("dnssec: bad signature")
+		}
+		return nil
+	case 15:
+		if len(pub) != ed25519.PublicKeySize || !ed25519.Verify(ed25519.PublicKey(pub), data, sig) {
+			return errors.New("dnssec: bad signature")
+		}
+		return nil
+	}
+	return errors.New("dnssec: unsupported algorithm")
+}
+
+// the data sig signs for set, RFC 4034 3.1.8.1
+func (sig *rrsig) signedData(set []dnsRR) []byte {
+	owner := set[0].name
+	if n := labelCount(owner); int(sig.labels) < n {
+		// expanded from a wildcard
+		labels := strings.Split(owner, ".")
+		owner = strings.Join(append([]string{"*"}, labels[n-int(sig.labels):]...), ".")
+	}
+
+	rdatas := make([][]byte, 0, len(set))
+	for _, rr := range set {
+		rdatas = append(rdatas, rr.rdata)
+	}
+	sort.Slice(rdatas, func(i, j int) bool { return bytes.Compare(rdatas[i], rdatas[j]) < 0 })
+	data := append([]byte(nil), sig.header...)
+	name := wireName(owner)
+	for i, rdata := range rdatas {
+		if i > 0 && bytes.Equal(rdata, rdatas[i-1]) {
+			continue
+		}
+		var rrhead [10]byte
+		binary.BigEndian.PutUint16(rrhead[:], set[0].rtype)
+		binary.BigEndian.PutUint16(rrhead[2:], set[0].class)
+		binary.BigEndian.PutUint32(rrhead[4:], sig.origTTL)
+		binary.BigEndian.PutUint16(rrhead[8:], uint16(len(rdata)))
+		data = append(data, name...)
+		data = append(data, rrhead[:]...)
+		data = append(data, rdata...)
+	}
+	return data
+}
+
+// verify checks sig of set with one of keys, RFC 4035 5.3
+func (sig *rrsig) verify(set []dnsRR, keys []dnsRR) error {
+	now := uint32(time.Now().Unix())
+	if int32(now-sig.inception) < 0 || int32(sig.expiration-now) < 0 {
+		return errors.New("dnssec: signature of " + set[0].name + " is not valid now")
+	}
+	if !inZone(set[0].name, sig.signer) {
+		return errors.New("dnssec: " + set[0].name + " signed by " + sig.signer)
+	}
+	data := sig.signedData(set)
+
+	err := errors.New("dnssec: no key for the signature of " + set[0].name)
+	for _, key := range keys {
+		k := key.rdata
+		if len(k) < 4 || k[0]&0x01 == 0 || k[2] != 3 || k[3] != sig.alg || keyTag(k) != sig.tag {
+			continue
+		}
+		err = verifySignature(sig.alg, k[4:], data, sig.signature)
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// verifySet checks that one of sigs by zone signs set with keys and
+// returns that one
+func verifySet(set []dnsRR, sigs []*rrsig, zone string, keys []dnsRR) (*rrsig, error) {
+	if len(set) == 0 {
+		return nil, errors.New("dnssec: empty record set")
+	}
+	err := errors.New("dnssec: " + set[0].name + " is not signed")
+	for _, sig := range sigs {
+		if sig.signer != zone {
+			continue
+		}
+		err = sig.verify(set, keys)
+		if err == nil {
+			return sig, nil
+		}
+	}
+	return nil, err
+}
+
+// the DNSKEY of zone a DS record is made of
+func matchDS(zone string, key, ds []byte) bool {
+	if len(ds) < 5 || len(key) < 4 || binary.BigEndian.Uint16(ds) != keyTag(key) || ds[2] != key[3] {
+		return false
+	}
+	data := append(wireName(zone), key...)
+	var digest []byte
+	switch ds[3] {
+	case 1:
+		sum := sha1.Sum(data)
+		digest = sum[:]
+	case 2:
+		sum := sha256.Sum256(data)
+		digest = sum[:]
+	case 4:
+		sum := sha512.Sum384(data)
+		digest = sum[:]
+	default:
+		return false
+	}
+	return bytes.Equal(ds[4:], digest)
+}
+
+// "20326 8 2 E06D..." to the data of a DS record
+func anchorDS(anchor string) []byte {
+	var tag, alg, dtype int
+	var digest string
+	_, err := fmt.Sscan(anchor, &tag, &alg, &dtype, &digest)
+	if err != nil {
+		return nil
+	}
+	d, err := hex.DecodeString(digest)
+	if err != nil {
+		return nil
+	}
+	return append([]byte{byte(tag >> 8), byte(tag), byte(alg), byte(dtype)}, d...)
+}
+
+// the bitmap of an NSEC or NSEC3 record has rtype
+func hasType(bitmap []byte, rtype uint16) bool {
+	window, bit := byte(rtype>>8), int(rtype&0xff)
+	for len(bitmap) >= 2 {
+		length := int(bitmap[1])
+		if len(bitmap) < 2+length {
+			return false
+		}
+		if bitmap[0] == window {
+			return bit/8 < length && bitmap[2+bit/8]&(0x80>>(bit%8)) != 0
+		}
+		bitmap = bitmap[2+length:]
+	}
+	return false
+}
+
+var nsec3Encoding = base32.HexEncoding.WithPadding(base32.NoPadding)
+
+func nsec3Hash(name string, iterations uint16, salt []byte) string {
+	h := sha1.Sum(append(wireName(name), salt...))
+	for i := 0; i < int(iterations); i++ {
+		h = sha1.Sum(append(h[:], salt...))
+	}
+	return strings.ToLower(nsec3Encoding.EncodeToString(h[:]))
+}
+
+func splitName(name string) []string {
+	if name == "" {
+		return nil
+	}
+	return strings.Split(name, ".")
+}
+
+func parentName(name string) string {
+	if i := strings.IndexByte(name, '.'); i >= 0 {
+		return name[i+1:]
+	}
+	return ""
+}
+
+func wildcardName(name string) string {
+	if name == "" {
+		return "*"
+	}
+	return "*." + name
+}
+
+// compareNames orders names canonically, label by label from the right,
+// RFC 4034 6.1
+func compareNames(a, b string) int {
+	la, lb := splitName(a), splitName(b)
+	for i := 1; i <= len(la) && i <= len(lb); i++ {
+		if c := strings.Compare(la[len(la)-i], lb[len(lb)-i]); c != 0 {
+			return c
+		}
+	}
+	return len(la) - len(lb)
+}
+
+// the longest name a and b are both in
+func commonAncestor(a, b string) string {
+	la, lb := splitName(a), splitName(b)
+	n := 0
+	for n < len(la) && n < len(lb) && la[len(la)-1-n] == lb[len(lb)-1-n] {
+		n++
+	}
+	return strings.Join(la[len(la)-n:], ".")
+}
+
+type nsecRecord struct {
+	owner, next string
+	bitmap      []byte
+}
+
+type nsec3Record struct {
+	hash, next string //in lowercase base32hex
+	optOut     bool
+	iterations uint16
+	salt       []byte
+	bitmap     []byte
+}
+
+func parseNSEC(rr dnsRR) (nsecRecord, bool) {
+	next, off, ok := readName(rr.rdata, 0)
+	if !ok {
+		return nsecRecord{}, false
+	}
+	return nsecRecord{owner: rr.name, next: next, bitmap: rr.rdata[off:]}, true
+}
+
+func parseNSEC3(rr dnsRR) (nsec3Record, bool) {
+	rdata := rr.rdata
+	if len(rdata) < 5 || rdata[0] != 1 || len(rdata) < 6+int(rdata[4]) {
+		return nsec3Record{}, false
+	}
+	salt := rdata[5 : 5+int(rdata[4])]
+	off := 5 + len(salt)
+	hashLen := int(rdata[off])
+	if len(rdata) < off+1+hashLen {
+		return nsec3Record{}, false
+	}
+	return nsec3Record{
+		hash:       strings.SplitN(rr.name, ".", 2)[0],
+		next:       strings.ToLower(nsec3Encoding.EncodeToString(rdata[off+1 : off+1+hashLen])),
+		optOut:     rdata[1]&0x01 != 0,
+		iterations: binary.BigEndian.Uint16(rdata[2:]),
+		salt:       salt,
+		bitmap:     rdata[off+1+hashLen:],
+	}, true
+}
+
+// names below a delegation or a DNAME are not in the zone of its NSEC
+// or NSEC3 record
+func cutBitmap(bitmap []byte) bool {
+	return hasType(bitmap, typeDNAME) || (hasType(bitmap, 2) && !hasType(bitmap, typeSOA))
+}
+
+// the bitmap of the record of a name denies qtype there, a DS from the
+// child side of a zone cut or anything else from the parent side do not
+func absentType(bitmap []byte, qtype uint16) bool {
+	if hasType(bitmap, qtype) || hasType(bitmap, typeCNAME) {
+		return false
+	}
+	if qtype == typeDS {
+		return !hasType(bitmap, typeSOA)
+	}
+	return !hasType(bitmap, 2) || hasType(bitmap, typeSOA)
+}
+
+// the NSEC and NSEC3 records of a response signed by zone
+type denial struct {
+	zone  string
+	nsec  []nsecRecord
+	nsec3 []nsec3Record
+}
+
+// signedDenial checks the SOA, NSEC and NSEC3 records of zone in records
+// are signed by it and not expanded from a wildcard
+func signedDenial(records []dnsRR, zone string, keys []dnsRR) (*denial, error) {
+	d := &denial{zone: zone}
+	checked := make(map[string]bool)
+	for _, rr := range records {
+		if rr.rtype != typeSOA && rr.rtype != typeNSEC && rr.rtype != typeNSEC3 {
+			continue
+		}
+		if !inZone(rr.name, zone) {
+			continue
+		}
+		key := fmt.Sprint(rr.name, " ", rr.rtype)
+		if checked[key] {
+			continue
+		}
+		checked[key] = true
+		set, sigs := rrset(records, rr.name, rr.rtype)
+		sig, err := verifySet(set, sigs, zone, keys)
+		if err != nil {
+			return nil, err
+		}
+		if int(sig.labels) != labelCount(rr.name) {
+			return nil, errors.New("dnssec: " + rr.name + " expanded from a wildcard")
+		}
+		for _, rr := range set {
+			switch rr.rtype {
+			case typeNSEC:
+				if n, ok := parseNSEC(rr); ok {
+					d.nsec = append(d.nsec, n)
+				}
+			case typeNSEC3:
+				if n, ok := parseNSEC3(rr); ok && parentName(rr.name) == zone {
+					d.nsec3 = append(d.nsec3, n)
+				}
+			}
+		}
+	}
+	return d, nil
+}
+
+func (d *denial) matchNSEC(name string) *nsecRecord {
+	for i := range d.nsec {
+		if d.nsec[i].owner == name {
+			return &d.nsec[i]
+		}
+	}
+	return nil
+}
+
+// the NSEC record between the names before and after name
+func (d *denial) coverNSEC(name string) *nsecRecord {
+	if !inZone(name, d.zone) {
+		return nil
+	}
+	for i := range d.nsec {
+		n := &d.nsec[i]
+		if compareNames(n.owner, name) >= 0 {
+			continue
+		}
+		// the last one points back to the apex
+		if compareNames(name, n.next) >= 0 && compareNames(n.next, n.owner) > 0 {
+			continue
+		}
+		if inZone(name, n.owner) && cutBitmap(n.bitmap) {
+			continue
+		}
+		return n
+	}
+	return nil
+}
+
+func (d *denial) matchNSEC3(name string) *nsec3Record {
+	for i := range d.nsec3 {
+		n := &d.nsec3[i]
+		if nsec3Hash(name, n.iterations, n.salt) == n.hash {
+			return n
+		}
+	}
+	return nil
+}
+
+// the NSEC3 record between the hashes before and after the hash of name
+func (d *denial) coverNSEC3(name string) *nsec3Record {
+	for i := range d.nsec3 {
+		n := &d.nsec3[i]
+		hash := nsec3Hash(name, n.iterations, n.salt)
+		if (n.hash < n.next && n.hash < hash && hash < n.next) ||
+			(n.hash >= n.next && (hash > n.hash || hash < n.next)) {
+			return n
+		}
+	}
+	return nil
+}
+
+// closestEncloser proves with NSEC3 records the closest ancestor of name
+// that exists and returns it with the record covering the next closer
+// name below it, RFC 5155 8.3
+func (d *denial) closestEncloser(name string) (string, *nsec3Record, bool) {
+	if name == d.zone || !inZone(name, d.zone) {
+		return "", nil, false
+	}
+	for next := name; next != d.zone; next = parentName(next) {
+		ce := parentName(next)
+		if n := d.matchNSEC3(ce); n != nil {
+			if cutBitmap(n.bitmap) {
+				return "", nil, false
+			}
+			if c := d.coverNSEC3(next); c != nil {
+				return ce, c, true
+			}
+			return "", nil, false
+		}
+	}
+	return "", nil, false
+}
+
+// nameError proves name does not exist and no wildcard stands in for it
+func (d *denial) nameError(name string) bool {
+	if n := d.coverNSEC(name); n != nil && !inZone(n.next, name) {
+		ce := commonAncestor(name, n.owner)
+		if a := commonAncestor(name, n.next); labelCount(a) > labelCount(ce) {
+			ce = a
+		}
+		if d.coverNSEC(wildcardName(ce)) != nil {
+			return true
+		}
+	}
+	ce, _, ok := d.closestEncloser(name)
+	return ok && d.coverNSEC3(wildcardName(ce)) != nil
+}
+
+// noData proves name has no record of qtype, itself or the wildcard that
+// stands in for it
+func (d *denial) noData(name string, qtype uint16) bool {
+	if n := d.matchNSEC(name); n != nil {
+		return absentType(n.bitmap, qtype)
+	}
+	if n := d.matchNSEC3(name); n != nil {
+		return absentType(n.bitmap, qtype)
+	}
+	if n := d.coverNSEC(name); n != nil {
+		if inZone(n.next, name) {
+			// an empty non-terminal
+			return true
+		}
+		ce := commonAncestor(name, n.owner)
+		if a := commonAncestor(name, n.next); labelCount(a) > labelCount(ce) {
+			ce = a
+		}
+		w := d.matchNSEC(wildcardName(ce))
+		return w != nil && absentType(w.bitmap, qtype)
+	}
+	ce, c, ok := d.closestEncloser(name)
+	if !ok {
+		return false
+	}
+	if qtype == typeDS && c.optOut {
+		// an unsigned delegation in an opt-out span
+		return true
+	}
+	w := d.matchNSEC3(wildcardName(ce))
+	return w != nil && absentType(w.bitmap, qtype)
+}
+
+// expanded proves name, answered from the wildcard of its ancestor with
+// labels labels, does not exist itself, RFC 4035 5.3.4 and RFC 5155 8.8
+func (d *denial) expanded(name string, labels int) bool {
+	if d.coverNSEC(name) != nil {
+		return true
+	}
+	l := splitName(name)
+	if labels >= len(l) {
+		return false
+	}
+	return d.coverNSEC3(strings.Join(l[len(l)-labels-1:], ".")) != nil
+}
+
+// insecure tells whether the proven denial of the DS of name shows an
+// unsigned delegation: its NSEC or NSEC3 record has NS but no SOA, or an
+// opt-out NSEC3 record covers it
+func (d *denial) insecure(name string) bool {
+	cut := func(bitmap []byte) bool {
+		return hasType(bitmap, 2) && !hasType(bitmap, typeSOA) && !hasType(bitmap, typeDS)
+	}
+	if n := d.matchNSEC(name); n != nil {
+		return cut(n.bitmap)
+	}
+	if n := d.matchNSEC3(name); n != nil {
+		return cut(n.bitmap)
+	}
+	_, c, ok := d.closestEncloser(name)
+	return ok && c.optOut
+}
+
+type dnssecZone struct {
+	keys     []dnsRR //DNSKEYs of a signed zone cut
+	insecure bool    //an unsigned delegation
+	expiry   time.Time
+}
+
+var dnssecLock sync.Mutex
+var dnssecZones = make(map[string]dnssecZone)
+
+type dnssecValidator struct {
+	u       *url.URL
+	options ServerOptions
+}
+
+func (v *dnssecValidator) query(name string, qtype uint16) (*dnsMsg, error) {
+	request := make([]byte, 12, 64)
+	binary.BigEndian.PutUint16(request, randomID())
+	binary.BigEndian.PutUint16(request[2:], 0x0100)
+	binary.BigEndian.PutUint16(request[4:], 1)
+	binary.BigEndian.PutUint16(request[10:], 1)
+	request = append(request, wireName(name)...)
+	request = append(request, byte(qtype>>8), byte(qtype), 0, 1)
+	request = append(request, 0, 0, 41, byte(EDNSBufferSize>>8), byte(EDNSBufferSize), 0, 0, 0x80, 0, 0, 0)
+	response, err := Exchange(v.u, request, v.options)
+	if err != nil {
+		return nil, err
+	}
+	msg, err := parseMsg(response)
+	if err != nil {
+		return nil, err
+	}
+	if msg.rcode != 0 && msg.rcode != 3 {
+		return nil, errors.New("dnssec: rcode of " + name)
+	}
+	return msg, nil
+}
+
+func minTTL(set []dnsRR) time.Duration {
+	ttl := uint32(3600)
+	for _, rr := range set {
+		if rr.ttl < ttl {
+			ttl = rr.ttl
+		}
+	}
+	if ttl < 60 {
+		ttl = 60
+	}
+	return time.Duration(ttl) * time.Second
+}
+
+func (v *dnssecValidator) load(name string) (dnssecZone, bool) {
+	dnssecLock.Lock()
+	defer dnssecLock.Unlock()
+	zone, ok := dnssecZones[v.u.String()+" "+name]
+	if ok && time.Now().After(zone.expiry) {
+		delete(dnssecZones, v.u.String()+" "+name)
+		return zone, false
+	}
+	return zone, ok
+}
+
+func (v *dnssecValidator) store(name string, zone dnssecZone) {
+	dnssecLock.Lock()
+	dnssecZones[v.u.String()+" "+name] = zone
+	dnssecLock.Unlock()
+}
+
+// zoneKeys fetches the DNSKEYs of name and keeps those the DS records of
+// name (or the trust anchors for the root) vouch for when they sign them
+func (v *dnssecValidator) zoneKeys(name string, ds []dnsRR) ([]dnsRR, time.Duration, error) {
+	msg, err := v.query(name, typeDNSKEY)
+	if err != nil {
+		return nil, 0, err
+	}
+	keys, sigs := rrset(msg.answer, name, typeDNSKEY)
+	var trusted []dnsRR
+	for _, key := range keys {
+		for _, d := range ds {
+			if matchDS(name, key.rdata, d.rdata) {
+				trusted = append(trusted, key)
+				break
+			}
+		}
+	}
+	if len(trusted) == 0 {
+		return nil, 0, errors.New("dnssec: no DNSKEY of " + name + " matches its DS")
+	}
+	_, err = verifySet(keys, sigs, name, trusted)
+	if err != nil {
+		return nil, 0, err
+	}
+	return keys, minTTL(keys), nil
+}
+
+func (v *dnssecValidator) rootKeys() ([]dnsRR, error) {
+	if zone, ok := v.load(""); ok {
+		return zone.keys, nil
+	}
+	var anchors []dnsRR
+	for _, anchor := range DNSSECAnchors {
+		if ds := anchorDS(anchor); ds != nil {
+			anchors = append(anchors, dnsRR{rtype: typeDS, class: 1, rdata: ds})
+		}
+	}
+	keys, ttl, err := v.zoneKeys("", anchors)
+	if err != nil {
+		return nil, err
+	}
+	v.store("", dnssecZone{keys: keys, expiry: time.Now().Add(ttl)})
+	return keys, nil
+}
+
+// verifyDenial checks the SOA, NSEC and NSEC3 records of the negative
+// answer msg are signed by zone and prove that its name or type does not
+// exist, RFC 4035 5.4 and RFC 5155 8
+func verifyDenial(msg *dnsMsg, zone string, keys []dnsRR) (*denial, error) {
+	d, err := signedDenial(msg.authority, zone, keys)
+	if err != nil {
+		return nil, err
+	}
+	var proven bool
+	if msg.rcode == 3 {
+		proven = d.nameError(msg.qname)
+	} else {
+		proven = d.noData(msg.qname, msg.qtype)
+	}
+	if !proven {
+		return nil, errors.New("dnssec: unproven denial of " + msg.qname)
+	}
+	return d, nil
+}
+
+// signedAnswer checks the record sets of name in answer are signed by zone
+func signedAnswer(answer []dnsRR, name, zone string, keys []dnsRR) error {
+	err := errors.New("dnssec: no answer for " + name)
+	for _, rr := range answer {
+		if rr.name != name || rr.rtype == typeRRSIG {
+			continue
+		}
+		set, sigs := rrset(answer, name, rr.rtype)
+		if _, err = verifySet(set, sigs, zone, keys); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// delegation finds whether name, below the signed zone with keys, is a
+// signed zone cut, an unsigned one or not a zone cut at all
+func (v *dnssecValidator) delegation(zone string, keys []dnsRR, name string) (dnssecZone, error) {
+	if cached, ok := v.load(name); ok {
+		return cached, nil
+	}
+
+	msg, err := v.query(name, typeDS)
+	if err != nil {
+		return dnssecZone{}, err
+	}
+	msg.qname, msg.qtype = name, typeDS
+	var result dnssecZone
+	ds, sigs := rrset(msg.answer, name, typeDS)
+	switch {
+	case len(ds) > 0:
+		_, err = verifySet(ds, sigs, zone, keys)
+		if err != nil {
+			return result, err
+		}
+		var ttl time.Duration
+		result.keys, ttl, err = v.zoneKeys(name, ds)
+		if err != nil {
+			return result, err
+		}
+		result.expiry = time.Now().Add(ttl)
+	case len(msg.answer) > 0:
+		// a CNAME signed by zone is not a zone cut, anything else needs
+		// a proof that the DS does not exist
+		err = signedAnswer(msg.answer, name, zone, keys)
+		if err != nil {
+			msg.rcode = 0
+			d, derr := verifyDenial(msg, zone, keys)
+			if derr != nil {
+				return result, err
+			}
+			result.insecure = d.insecure(name)
+		}
+		result.expiry = time.Now().Add(minTTL(msg.answer))
+	default:
+		d, err := verifyDenial(msg, zone, keys)
+		if err != nil {
+			return result, err
+		}
+		result.insecure = d.insecure(name)
+		result.expiry = time.Now().Add(minTTL(msg.authority))
+	}
+	logPrintln(4, "dnssec:", name, len(result.keys), result.insecure)
+	v.store(name, result)
+	return result, nil
+}
+
+// secureZone walks the delegations from the root to name and returns the
+// closest signed zone above it with its keys, no keys when an unsigned
+// delegation is on the way
+func (v *dnssecValidator) secureZone(name string) (string, []dnsRR, error) {
+	keys, err := v.rootKeys()
+	if err != nil {
+		return "", nil, err
+	}
+	zone := ""
+	if name == "" {
+		return zone, keys, nil
+	}
+	labels := strings.Split(name, ".")
+	for i := len(labels) - 1; i >= 0; i-- {
+		sub := strings.Join(labels[i:], ".")
+		result, err := v.delegation(zone, keys, sub)
+		if err != nil {
+			return "", nil, err
+		}
+		if result.insecure {
+			return sub, nil, nil
+		}
+		if result.keys != nil {
+			zone, keys = sub, result.keys
+		}
+	}
+	return zone, keys, nil
+}
+
+// validateDNSSEC checks every record set of the answer of response is
+// signed by the zone it belongs to or is in an unsigned zone, and that
+// a negative answer from a signed zone is signed
+func validateDNSSEC(u *url.URL, response []byte, options ServerOptions) error {
+	msg, err := parseMsg(response)
+	if err != nil {
+		return err
+	}
+	v := &dnssecValidator{u: u, options: options}
+
+	type setKey struct {
+		name  string
+		rtype uint16
+	}
+	var sets []setKey
+	seen := make(map[setKey]bool)
+	dname := false
+	for _, rr := range msg.answer {
+		k := setKey{rr.name, rr.rtype}
+		if rr.rtype != typeRRSIG && !seen[k] {
+			seen[k] = true
+			sets = append(sets, k)
+		}
+	}
+
+	for _, k := range sets {
+		// CNAMEs synthesized from a signed DNAME are not signed
+		if k.rtype == typeCNAME && dname {
+			continue
+		}
+		zone, keys, err := v.secureZone(k.name)
+		if err != nil {
+			return err
+		}
+		if keys == nil {
+			continue
+		}
+		set, sigs := rrset(msg.answer, k.name, k.rtype)
+		sig, err := verifySet(set, sigs, zone, keys)
+		if err != nil {
+			return err
+		}
+		if int(sig.labels) < labelCount(k.name) {
+			// expanded from a wildcard, the name itself must not exist
+			d, err := signedDenial(msg.authority, zone, keys)
+			if err != nil {
+				return err
+			}
+			if !d.expanded(k.name, int(sig.labels)) {
+				return errors.New("dnssec: unproven wildcard answer " + k.name)
+			}
+		}
+		if k.rtype == typeDNAME {
+			dname = true
+		}
+	}
+
+	if len(sets) == 0 {
+		zone, keys, err := v.secureZone(msg.qname)
+		if err != nil {
+			return err
+		}
+		if keys != nil {
+			_, err = verifyDenial(msg, zone, keys)
+			return err
+		}
+	}
+	return nil
+}
+
+// withDO sets the DNSSEC OK bit in the OPT record of request, adding one
+// when it has none
+func withDO(request []byte) []byte {
+	_, _, end := GetQName(request)
+	if end == 0 {
+		return request
+	}
+	request = append([]byte(nil), request...)
+	count := int(binary.BigEndian.Uint16(request[6:])) +
+		int(binary.BigEndian.Uint16(request[8:])) +
+		int(binary.BigEndian.Uint16(request[10:]))
+	off := end
+	for i := 0; i < count; i++ {
+		off = GetNameOffset(request, off)
+		if off == 0 || off+10 > len(request) {
+			return request
+		}
+		if binary.BigEndian.Uint16(request[off:]) == 41 {
+			request[off+6] |= 0x80
+			return request
+		}
+		off += 10 + int(binary.BigEndian.Uint16(request[off+8:]))
+	}
+	binary.BigEndian.PutUint16(request[10:], binary.BigEndian.Uint16(request[10:])+1)
+	return append(request, 0, 0, 41, byte(EDNSBufferSize>>8), byte(EDNSBufferSize), 0, 0, 0x80, 0, 0, 0)
+}
+
+// exchangeDNSSEC sends request with the DO bit to u and drops answers
+// that fail validation as forged
+func exchangeDNSSEC(u *url.URL, request []byte, options ServerOptions) ([]byte, error) {
+	options.DNSSEC = false
+	response, err := Exchange(u, withDO(request), options)
+	if err != nil {
+		return nil, err
+	}
+	err = validateDNSSEC(u, response, options)
+	if err != nil {
+		name, qtype, _ := GetQName(request)
+		logPrintln(1, "dnssec:", u.Host, name, qtype, err)
+		return nil, err
+	}
+	return response, nil
+}
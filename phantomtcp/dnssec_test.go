@@ -0,0 +1,261 @@
+package phantomtcp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"os"
+	"strings"
+	"testing"
+)
+
+// dnssecFixtures reads testdata/dnssec.txt, lines of a name and hex
+func dnssecFixtures(t *testing.T) map[string][]byte {
+	t.Helper()
+	f, err := os.Open("testdata/dnssec.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fixtures := make(map[string][]byte)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		name, data, _ := strings.Cut(line, " ")
+		b, err := hex.DecodeString(data)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		fixtures[name] = b
+	}
+	return fixtures
+}
+
+func fixtureMsg(t *testing.T, fixtures map[string][]byte, name string) *dnsMsg {
+	t.Helper()
+	msg, err := parseMsg(fixtures[name])
+	if err != nil {
+		t.Fatal(name, err)
+	}
+	return msg
+}
+
+func TestVerifySetCanonical(t *testing.T) {
+	fixtures := dnssecFixtures(t)
+	keys := []dnsRR{{rtype: typeDNSKEY, class: 1, rdata: fixtures["dnskey"]}}
+
+	tests := []struct {
+		fixture string
+		name    string
+		rtype   uint16
+		labels  uint8
+	}{
+		{"a", "www.example", 1, 2},           //out of order with a mixed case owner
+		{"txt", "example", 16, 1},            //of different lengths
+		{"mx", "mail.example", 15, 2},        //compressed and upper case names in the data
+		{"wildcard", "any.example", 1, 1},    //expanded from *.example
+		{"nsec3-wildcard", "x.w.test", 1, 2}, //expanded from *.w.test
+	}
+	for _, tt := range tests {
+		msg := fixtureMsg(t, fixtures, tt.fixture)
+		zone := "example"
+		if strings.HasSuffix(tt.name, "test") {
+			zone = "test"
+		}
+		set, sigs := rrset(msg.answer, tt.name, tt.rtype)
+		sig, err := verifySet(set, sigs, zone, keys)
+		if err != nil {
+			t.Errorf("%s: %v", tt.fixture, err)
+			continue
+		}
+		if sig.labels != tt.labels {
+			t.Errorf("%s: labels %d, want %d", tt.fixture, sig.labels, tt.labels)
+		}
+
+		set[len(set)-1].rdata = append([]byte(nil), set[len(set)-1].rdata...)
+		set[len(set)-1].rdata[len(set[len(set)-1].rdata)-1] ^= 1
+		if _, err := verifySet(set, sigs, zone, keys); err == nil {
+			t.Errorf("%s: altered set verified", tt.fixture)
+		}
+		if _, err := verifySet(set[:0], sigs, zone, keys); err == nil {
+			t.Errorf("%s: empty set verified", tt.fixture)
+		}
+	}
+}
+
+func TestCompareNames(t *testing.T) {
+	// RFC 4034 6.1
+	names := []string{
+		"example",
+		"a.example",
+		"yljkjljk.a.example",
+		"z.a.example",
+		"zabc.a.example",
+		"z.example",
+		"\x01.z.example",
+		"*.z.example",
+		"\x80.z.example",
+	}
+	for i := 1; i < len(names); i++ {
+		if compareNames(names[i-1], names[i]) >= 0 || compareNames(names[i], names[i-1]) <= 0 {
+			t.Errorf("%q sorts after %q", names[i-1], names[i])
+		}
+	}
+	if compareNames("", "example") >= 0 || compareNames("example", "example") != 0 {
+		t.Error("root or equal names out of order")
+	}
+}
+
+func TestMatchDS(t *testing.T) {
+	fixtures := dnssecFixtures(t)
+	key := fixtures["dnskey"]
+	tests := []struct {
+		zone string
+		key  []byte
+		ds   string
+		want bool
+	}{
+		{"example", key, "d1400f016503ef8d95de06a1bfc0a695bb3b2bad42cca7f8", true},
+		{"example", key, "d1400f02ec95989fb4e756e3af046cca81effa6203c6be9f0fd3e7e24f1edc0cd4cb3741", true},
+		{"example", key, "d1400f04ae844f9c6f2f1345b4cf993150d3a4927fd773cd79aa8a325b08eab58edcceb93aa608942c787af0faa47363d4a880f4", true},
+		{"example.com", key, "d1400f02ec95989fb4e756e3af046cca81effa6203c6be9f0fd3e7e24f1edc0cd4cb3741", false},
+		{"example", key, "d1400f02ec95989fb4e756e3af046cca81effa6203c6be9f0fd3e7e24f1edc0cd4cb3740", false},
+		{"example", key, "d1410f02ec95989fb4e756e3af046cca81effa6203c6be9f0fd3e7e24f1edc0cd4cb3741", false},
+		{"example", key, "d1400d02ec95989fb4e756e3af046cca81effa6203c6be9f0fd3e7e24f1edc0cd4cb3741", false},
+		{"example", key, "d1400f03ec95989fb4e756e3af046cca81effa6203c6be9f0fd3e7e24f1edc0cd4cb3741", false},
+		{"example", key, "d140", false},
+	}
+	for _, tt := range tests {
+		ds, _ := hex.DecodeString(tt.ds)
+		if got := matchDS(tt.zone, tt.key, ds); got != tt.want {
+			t.Errorf("matchDS(%q, %s) = %v", tt.zone, tt.ds, got)
+		}
+	}
+
+	for _, anchor := range DNSSECAnchors {
+		if ds := anchorDS(anchor); len(ds) != 4+32 {
+			t.Errorf("anchor %q: %x", anchor, ds)
+		}
+	}
+}
+
+func TestNSEC3Hash(t *testing.T) {
+	// RFC 5155 appendix A
+	salt := []byte{0xaa, 0xbb, 0xcc, 0xdd}
+	tests := []struct {
+		name, hash string
+	}{
+		{"example", "0p9mhaveqvm6t7vbl5lop2u3t2rp3tom"},
+		{"a.example", "35mthgpgcu1qg68fab165klnsnk3dpvl"},
+		{"ai.example", "gjeqe526plbf1g8mklp59enfd789njgi"},
+		{"ns1.example", "2t7b4g4vsa5smi47k61mv5bv1a22bojr"},
+		{"w.example", "k8udemvp1j2f7eg6jebps17vp3n8i58h"},
+		{"*.w.example", "r53bq7cc2uvmubfu5ocmm6pers9tk9en"},
+		{"x.w.example", "b4um86eghhds6nea196smvmlo4ors995"},
+	}
+	for _, tt := range tests {
+		if got := nsec3Hash(tt.name, 12, salt); got != tt.hash {
+			t.Errorf("nsec3Hash(%q) = %s, want %s", tt.name, got, tt.hash)
+		}
+	}
+}
+
+func TestVerifyDenial(t *testing.T) {
+	fixtures := dnssecFixtures(t)
+	keys := []dnsRR{{rtype: typeDNSKEY, class: 1, rdata: fixtures["dnskey"]}}
+
+	tests := []struct {
+		fixture  string
+		qname    string //replaces the name of the question
+		qtype    uint16 //replaces the type of the question
+		ok       bool
+		insecure bool
+	}{
+		{"nsec-nxdomain", "", 0, true, false},
+		{"nsec-nxdomain", "zzz.example", 0, false, false},
+		{"nsec-nxdomain-nowildcard", "", 0, false, false},
+		{"nsec-nodata", "", 0, true, false},
+		{"nsec-nodata", "", 1, false, false},
+		{"nsec-nodata", "", typeNSEC, false, false},
+		{"nsec-ds", "", 0, true, true},
+		{"nsec-ds", "", 1, false, false},
+		{"nsec-delegation", "", 0, false, false},
+		{"nsec-last", "", 0, true, false},
+		{"soa", "", 0, false, false},
+		{"nsec3-nxdomain", "", 0, true, false},
+		{"nsec3-nxdomain", "w.test", 0, false, false},
+		{"nsec3-nxdomain-nowildcard", "", 0, false, false},
+		{"nsec3-nodata", "", 0, true, false},
+		{"nsec3-nodata", "", 1, false, false},
+		{"nsec3-ds", "", 0, true, true},
+		{"nsec3-ds", "", 1, false, false},
+		{"nsec3-delegation", "", 0, false, false},
+	}
+	for _, tt := range tests {
+		msg := fixtureMsg(t, fixtures, tt.fixture)
+		if tt.qname != "" {
+			msg.qname = tt.qname
+		}
+		if tt.qtype != 0 {
+			msg.qtype = tt.qtype
+		}
+		zone := "example"
+		if strings.HasPrefix(tt.fixture, "nsec3") {
+			zone = "test"
+		}
+		d, err := verifyDenial(msg, zone, keys)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s %s %d: %v", tt.fixture, msg.qname, msg.qtype, err)
+			continue
+		}
+		if err == nil && d.insecure(msg.qname) != tt.insecure {
+			t.Errorf("%s: insecure %v", tt.fixture, !tt.insecure)
+		}
+	}
+}
+
+func TestWildcardDenial(t *testing.T) {
+	fixtures := dnssecFixtures(t)
+	keys := []dnsRR{{rtype: typeDNSKEY, class: 1, rdata: fixtures["dnskey"]}}
+
+	tests := []struct {
+		fixture, zone, name string
+		labels              int
+		want                bool
+	}{
+		{"nsec3-wildcard", "test", "x.w.test", 2, true},
+		{"nsec3-wildcard", "test", "x.w.test", 1, false},
+		{"nsec-nxdomain", "example", "any.example", 1, true},
+		{"nsec-nxdomain", "example", "www.example", 1, false},
+		{"soa", "example", "any.example", 1, false},
+	}
+	for _, tt := range tests {
+		msg := fixtureMsg(t, fixtures, tt.fixture)
+		d, err := signedDenial(msg.authority, tt.zone, keys)
+		if err != nil {
+			t.Errorf("%s: %v", tt.fixture, err)
+			continue
+		}
+		if got := d.expanded(tt.name, tt.labels); got != tt.want {
+			t.Errorf("%s: expanded(%q, %d) = %v", tt.fixture, tt.name, tt.labels, got)
+		}
+	}
+}
+
+func TestWithDO(t *testing.T) {
+	// the flags of the OPT record are the last two bytes of its TTL
+	request := PackRequest("example.com", 1, 0, "")
+	_, _, end := GetQName(request)
+	flags := end + 7
+	if binary.BigEndian.Uint16(request[end+1:]) != 41 || binary.BigEndian.Uint16(request[flags:]) != 0 {
+		t.Fatalf("OPT of a request: %x", request[end:])
+	}
+	request = withDO(request)
+	if binary.BigEndian.Uint16(request[flags:]) != 0x8000 || binary.BigEndian.Uint16(request[10:]) != 1 {
+		t.Errorf("OPT with DO: %x", request[end:])
+	}
+}
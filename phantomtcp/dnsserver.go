@@ -0,0 +1,188 @@
+package phantomtcp
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// DNSServer answers DNS queries with the rules, the cache and the fake
+// addresses of Profile, for programs that embed the resolver:
+//
+//	profile, _, err := phantomtcp.NewProfile(interfaces)
+//	if err != nil {
+//		return err
+//	}
+//	server := &phantomtcp.DNSServer{Profile: profile}
+//	go server.ServeUDP(udpConn)
+//	go server.ServeTCP(tcpListener)
+//
+// The hooks are optional and called from the goroutine of the query.
+type DNSServer struct {
+	Profile *PhantomProfile
+
+	// PreResolve is called before a query is resolved, a response it
+	// returns answers the query instead of the profile
+	PreResolve func(query *DNSQuery) []byte
+	// PostResolve is called with the answer of the profile, fake tells if
+	// it holds fake addresses, response is nil when the query is dropped
+	PostResolve func(query *DNSQuery, fake bool, response []byte)
+	// Rewrite returns the response sent to the client, nil drops it
+	Rewrite func(query *DNSQuery, response []byte) []byte
+}
+
+// DNSQuery is a query given to the hooks of a DNSServer
+type DNSQuery struct {
+	Name    string
+	Type    int
+	Client  net.IP
+	Request []byte //as received, not to be modified
+}
+
+// Resolve answers request from client, nil when it is not answered; a
+// malformed question is answered with FORMERR
+func (server *DNSServer) Resolve(request []byte, client net.IP) []byte {
+	if len(request) < 12 {
+		return nil
+	}
+	name, qtype, end := GetQName(request)
+	if end == 0 {
+		return formatError(request)
+	}
+	query := &DNSQuery{Name: name, Type: qtype, Client: client, Request: request}
+
+	var response []byte
+	if server.PreResolve != nil {
+		response = server.PreResolve(query)
+	}
+	if response == nil {
+		// NSRequest trims the request it is given
+		index, answer := server.Profile.NSRequest(append([]byte(nil), request...), true, client)
+		if server.PostResolve != nil {
+			server.PostResolve(query, index > 0, answer)
+		}
+		response = answer
+	}
+	if server.Rewrite != nil && response != nil {
+		response = server.Rewrite(query, response)
+	}
+	return response
+}
+
+// formatError is the FORMERR response of request, its header without
+// any record
+func formatError(request []byte) []byte {
+	response := make([]byte, 12)
+	copy(response, request[:4])
+	response[2] = 0x80 | request[2]&0x79 //QR, the opcode and RD
+	response[3] = 1
+	return response
+}
+
+// ServeUDP answers the queries sent to conn until it is closed
+func (server *DNSServer) ServeUDP(conn *net.UDPConn) {
+	server.ServePacket(conn)
+}
+
+// ServePacket answers the queries sent to conn until it is closed, the
+// responses larger than the client accepts are truncated
+func (server *DNSServer) ServePacket(conn net.PacketConn) {
+	data := make([]byte, 65535)
+	for {
+		n, addr, err := conn.ReadFrom(data)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		if n < 12 {
+			continue
+		}
+
+		request := make([]byte, n)
+		copy(request, data[:n])
+		go func(addr net.Addr, request []byte) {
+			var client net.IP
+			if udpAddr, ok := addr.(*net.UDPAddr); ok {
+				client = udpAddr.IP
+			}
+			size := UDPPayloadSize(request)
+			response := server.Resolve(request, client)
+			if response == nil {
+				return
+			}
+			conn.WriteTo(TruncateResponse(response, size), addr)
+		}(addr, request)
+	}
+}
+
+// ServeTCP answers the DNS over TCP clients of l until it is closed
+func (server *DNSServer) ServeTCP(l net.Listener) {
+	for {
+		client, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			logPrintln(1, err)
+			continue
+		}
+		go server.ServeConn(client)
+	}
+}
+
+// ServeConn answers the length prefixed queries of a DNS over TCP or
+// TLS client until it goes idle, pipelined queries are answered as their
+// answers come (RFC 7766)
+func (server *DNSServer) ServeConn(client net.Conn) {
+	defer client.Close()
+
+	var clientIP net.IP
+	if addr, ok := client.RemoteAddr().(*net.TCPAddr); ok {
+		clientIP = addr.IP
+	}
+
+	var writeLock sync.Mutex
+	writeResponse := func(response []byte) {
+		data := make([]byte, 2, len(response)+2)
+		binary.BigEndian.PutUint16(data, uint16(len(response)))
+		data = append(data, response...)
+		writeLock.Lock()
+		client.Write(data)
+		writeLock.Unlock()
+	}
+
+	var pending sync.WaitGroup
+	defer pending.Wait()
+	var length [2]byte
+	for {
+		client.SetReadDeadline(time.Now().Add(DNSTCPIdleTimeout))
+		_, err := io.ReadFull(client, length[:])
+		if err != nil {
+			return
+		}
+		request := make([]byte, binary.BigEndian.Uint16(length[:]))
+		_, err = io.ReadFull(client, request)
+		if err != nil || len(request) < 12 {
+			return
+		}
+
+		//a malformed question is answered before the pipelined lookups
+		if _, _, end := GetQName(request); end == 0 {
+			writeResponse(formatError(request))
+			continue
+		}
+
+		pending.Add(1)
+		go func() {
+			defer pending.Done()
+			if response := server.Resolve(request, clientIP); response != nil {
+				writeResponse(response)
+			}
+		}()
+	}
+}
@@ -0,0 +1,175 @@
+package phantomtcp
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// dnsQuery packs a query of name with labels of any length
+func dnsQuery(labels []string, qtype byte) []byte {
+	request := []byte{0x12, 0x34, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0}
+	for _, label := range labels {
+		request = append(request, byte(len(label)))
+		request = append(request, label...)
+	}
+	return append(request, 0, 0, qtype, 0, 1)
+}
+
+func TestGetQNameMalformed(t *testing.T) {
+	label := strings.Repeat("a", 63)
+	tests := []struct {
+		name    string
+		request []byte
+		qname   string
+		ok      bool
+	}{
+		{"name", dnsQuery([]string{"www", "example", "com"}, 1), "www.example.com", true},
+		{"255 bytes", dnsQuery([]string{label, label, label, strings.Repeat("a", 61)}, 1), strings.Repeat(label+".", 3) + strings.Repeat("a", 61), true},
+		{"root", dnsQuery(nil, 2), "", true},
+		{"256 bytes", dnsQuery([]string{label, label, label, strings.Repeat("a", 62)}, 1), "", false},
+		{"long name", dnsQuery(strings.Split(strings.Repeat("a.", 1000)+"com", "."), 1), "", false},
+		{"long label", dnsQuery([]string{strings.Repeat("a", 64)}, 1), "", false},
+		{"past the end", append(dnsQuery([]string{"example"}, 1)[:13], 'e'), "", false},
+		{"first label past the end", []byte{0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 200, 'a'}, "", false},
+	}
+	for _, tt := range tests {
+		qname, _, end := GetQName(tt.request)
+		if qname != tt.qname || (end != 0) != tt.ok {
+			t.Errorf("%s: %q end %d", tt.name, qname, end)
+		}
+	}
+}
+
+func TestBuildResponseSize(t *testing.T) {
+	label := strings.Repeat("a", 63)
+	request := dnsQuery([]string{label, label, label, strings.Repeat("a", 61)}, 65)
+	records := DNSRecords{Index: 1, ALPN: HINT_HTTPS | HINT_HTTP3, Ech: make([]byte, 511)}
+	for _, qtype := range []int{1, 28, 65} {
+		if response := records.BuildResponse(request, qtype, 0); len(response) < len(request) {
+			t.Errorf("type %d: %d bytes", qtype, len(response))
+		}
+	}
+
+	name := strings.Repeat(label+".", 3) + strings.Repeat("a", 61)
+	request = PackRequest(name, 1, 0, "2001:db8::/56")
+	if qname, _, end := GetQName(request); qname != name || end == 0 {
+		t.Errorf("PackRequest: %q", qname)
+	}
+}
+
+func TestServePacketOversized(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	profile, _, err := NewProfile(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &DNSServer{Profile: profile}
+	go server.ServePacket(conn)
+
+	client, err := net.DialUDP("udp", nil, conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	request := dnsQuery(strings.Split(strings.Repeat("abcdefgh.", 150)+"com", "."), 1)
+	if _, err := client.Write(request); err != nil {
+		t.Fatal(err)
+	}
+	client.SetReadDeadline(time.Now().Add(time.Second * 5))
+	response := make([]byte, 512)
+	n, err := client.Read(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 12 || response[0] != 0x12 || response[1] != 0x34 || response[2]&0x80 == 0 || response[3]&0x0f != 1 {
+		t.Errorf("response %x", response[:n])
+	}
+}
+
+func TestServeConnOversized(t *testing.T) {
+	profile, _, err := NewProfile(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &DNSServer{Profile: profile}
+	conn, client := net.Pipe()
+	go server.ServeConn(conn)
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(time.Second * 5))
+
+	label := strings.Repeat("a", 63)
+	requests := [][]byte{
+		dnsQuery(strings.Split(strings.Repeat("abcdefgh.", 150)+"com", "."), 1),
+		dnsQuery([]string{label, label, label, label}, 28),
+		dnsQuery([]string{strings.Repeat("a", 64)}, 1),
+	}
+	go func() {
+		for i, request := range requests {
+			request[1] = byte(i)
+			data := make([]byte, 2, len(request)+2)
+			binary.BigEndian.PutUint16(data, uint16(len(request)))
+			client.Write(append(data, request...))
+		}
+	}()
+
+	for i := range requests {
+		var length [2]byte
+		if _, err := io.ReadFull(client, length[:]); err != nil {
+			t.Fatal(err)
+		}
+		response := make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(client, response); err != nil {
+			t.Fatal(err)
+		}
+		if len(response) != 12 || response[1] != byte(i) || response[2]&0x80 == 0 || response[3]&0x0f != 1 {
+			t.Errorf("response %d: %x", i, response)
+		}
+	}
+}
+
+func TestClientSubnet(t *testing.T) {
+	request := dnsQuery([]string{"example", "com"}, 1)
+	_, _, end := GetQName(request)
+	tests := []struct {
+		client string
+		ecs    string
+		want   string
+	}{
+		{"203.0.113.45", "client", "203.0.113.0/24"},
+		{"192.168.1.20", "client", "192.168.1.0/24"},
+		{"2001:db8:1:2::5", "client", "2001:db8:1::/56"},
+		{"203.0.113.45", "client/20", "203.0.112.0/20"},
+		{"203.0.113.45", "client/28", "203.0.113.0/24"},
+		{"127.0.0.1", "client", ""},
+		{"", "client", ""},
+	}
+	for _, tt := range tests {
+		bits, ok := clientECSBits(tt.ecs)
+		if !ok {
+			t.Fatalf("%s: not a client subnet", tt.ecs)
+		}
+		got := ""
+		if subnet := clientSubnet(request, end, net.ParseIP(tt.client)); subnet != nil {
+			got = truncateSubnet(subnet, bits).String()
+		}
+		if got != tt.want {
+			t.Errorf("%s %s: %q, want %q", tt.client, tt.ecs, got, tt.want)
+		}
+	}
+
+	// client alone is never the subnet of this network
+	if ip, _ := parseECS("client"); ip != nil {
+		t.Errorf("parseECS(client) = %v", ip)
+	}
+	if _, ok := clientECSBits("auto"); ok {
+		t.Error("auto is a client subnet")
+	}
+}
@@ -0,0 +1,194 @@
+package phantomtcp
+
+import (
+	"regexp"
+	"strings"
+)
+
+// the wildcard and regex entries of the rules and hosts files:
+// *.example.com covers the subdomains of example.com at any depth and
+// ~^ads[0-9]+\. the names the regular expression matches. They are keys
+// of DomainMap and of the DNS cache like the names, a name that has no
+// entry of its own gets the most specific wildcard, then the first regex.
+type domainMatcher struct {
+	root    suffixNode
+	regexps []*regexp.Regexp
+	keys    []string //of regexps
+}
+
+// a node of the labels of the wildcards or of the .name rules, the last
+// label first
+type suffixNode struct {
+	children map[string]*suffixNode
+	key      string //the wildcard or the rule that ends here
+}
+
+func isDomainPattern(key string) bool {
+	return strings.HasPrefix(key, "*.") || strings.HasPrefix(key, "~")
+}
+
+// add adds the pattern key
+func (m *domainMatcher) add(key string) error {
+	if strings.HasPrefix(key, "~") {
+		re, err := regexp.Compile(key[1:])
+		if err != nil {
+			return err
+		}
+		for _, k := range m.keys {
+			if k == key {
+				return nil
+			}
+		}
+		m.regexps = append(m.regexps, re)
+		m.keys = append(m.keys, key)
+		return nil
+	}
+
+	m.root.insert(strings.TrimPrefix(key, "*."), key)
+	return nil
+}
+
+// match returns the pattern of name, "" when none matches
+func (m *domainMatcher) match(name string) string {
+	if key := m.root.longest(name, 0, nil); key != "" {
+		return key
+	}
+	for i, re := range m.regexps {
+		if re.MatchString(name) {
+			return m.keys[i]
+		}
+	}
+	return ""
+}
+
+// remove removes the wildcard key, the regex entries stay
+func (m *domainMatcher) remove(key string) {
+	labels := strings.Split(strings.ToLower(strings.TrimPrefix(key, "*.")), ".")
+	node := &m.root
+	for i := len(labels) - 1; i >= 0 && node != nil; i-- {
+		node = node.children[labels[i]]
+	}
+	if node != nil && node.key == key {
+		node.key = ""
+	}
+}
+
+// clone returns a copy that can be changed without changing m
+func (m *domainMatcher) clone() domainMatcher {
+	return domainMatcher{
+		root:    m.root.clone(),
+		regexps: append([]*regexp.Regexp(nil), m.regexps...),
+		keys:    append([]string(nil), m.keys...),
+	}
+}
+
+// insert adds key at the node of the labels of suffix
+func (n *suffixNode) insert(suffix string, key string) {
+	labels := strings.Split(strings.ToLower(suffix), ".")
+	node := n
+	for i := len(labels) - 1; i >= 0; i-- {
+		if node.children == nil {
+			node.children = make(map[string]*suffixNode)
+		}
+		child, ok := node.children[labels[i]]
+		if !ok {
+			child = &suffixNode{}
+			node.children[labels[i]] = child
+		}
+		node = child
+	}
+	node.key = key
+}
+
+// longest returns the key of the longest suffix of name that has a label
+// of name before it, at most depth labels when depth > 0, and a key that
+// ok accepts, "" when there is none
+func (n *suffixNode) longest(name string, depth int, ok func(key string) bool) string {
+	return n.below(name, len(name), depth, ok)
+}
+
+// the labels of name[:end] are walked from the last, the deepest node
+// that matches is tried first
+func (n *suffixNode) below(name string, end int, depth int, ok func(key string) bool) string {
+	if end <= 0 || n.children == nil {
+		return ""
+	}
+	start := strings.LastIndexByte(name[:end], '.') + 1
+	child, found := n.children[name[start:end]]
+	if !found {
+		return ""
+	}
+	if key := child.below(name, start-1, depth, ok); key != "" {
+		return key
+	}
+	if start == 0 || child.key == "" {
+		return ""
+	}
+	if depth > 0 && strings.Count(name[:start], ".") > depth {
+		return ""
+	}
+	if ok != nil && !ok(child.key) {
+		return ""
+	}
+	return child.key
+}
+
+func (n *suffixNode) clone() suffixNode {
+	c := suffixNode{key: n.key}
+	if n.children != nil {
+		c.children = make(map[string]*suffixNode, len(n.children))
+		for label, child := range n.children {
+			childCopy := child.clone()
+			c.children[label] = &childCopy
+		}
+	}
+	return c
+}
+
+// addPattern adds a wildcard or regex entry of a rules or hosts file
+func (profile *PhantomProfile) addPattern(key string) error {
+	return profile.patterns.add(key)
+}
+
+// addParent adds the .name rule key of a rules or hosts file, it covers
+// the subdomains of name at any depth, or up to subdomain= levels
+func (profile *PhantomProfile) addParent(key string) {
+	profile.parents.insert(key[1:], key)
+}
+
+// parentRule returns the nearest .parent rule of name, "" without one
+func (rules *RuleSet) parentRule(name string) string {
+	return rules.parents.longest(name, SubdomainDepth, func(key string) bool {
+		_, ok := rules.DomainMap[key]
+		return ok
+	})
+}
+
+// parentRecords returns the records of the nearest .parent of name that
+// has a cache entry, nil without one
+func (profile *PhantomProfile) parentRecords(rules *RuleSet, name string) *DNSRecords {
+	var records *DNSRecords
+	rules.parents.longest(name, SubdomainDepth, func(key string) bool {
+		records = profile.LoadDNSCache(key)
+		return records != nil
+	})
+	return records
+}
+
+// patternRecords returns a copy of the records of the pattern of name in
+// rules for its cache entry, nil when no pattern matches
+func (profile *PhantomProfile) patternRecords(rules *RuleSet, name string) *DNSRecords {
+	key := rules.patterns.match(name)
+	if key == "" {
+		return nil
+	}
+	top := profile.LoadDNSCache(key)
+	if top == nil {
+		return nil
+	}
+	records := *top
+	// the fake address of a name stands for the name, not the pattern
+	records.Index = 0
+	records.hits, records.prefetching = 0, 0
+	return &records
+}
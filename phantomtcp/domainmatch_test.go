@@ -0,0 +1,67 @@
+package phantomtcp
+
+import "testing"
+
+func TestSuffixNodeLongest(t *testing.T) {
+	var parents suffixNode
+	for _, key := range []string{".example.com", ".a.b.example.com", ".Upper.org", ".com.cn"} {
+		parents.insert(key[1:], key)
+	}
+	tests := []struct {
+		name  string
+		depth int
+		want  string
+	}{
+		{"www.example.com", 0, ".example.com"},
+		{"example.com", 0, ""},
+		{"a.b.c.d.e.f.example.com", 0, ".example.com"},
+		{"x.a.b.example.com", 0, ".a.b.example.com"},
+		{"a.b.example.com", 0, ".example.com"},
+		{"b.example.com", 0, ".example.com"},
+		{"www.upper.org", 0, ".Upper.org"},
+		{"notexample.com", 0, ""},
+		{"www.example.org", 0, ""},
+		{"example.com.cn", 0, ".com.cn"},
+		{"", 0, ""},
+		{".", 0, ""},
+		// subdomain= limits the levels below the rule
+		{"www.example.com", 2, ".example.com"},
+		{"a.www.example.com", 2, ".example.com"},
+		{"b.a.www.example.com", 2, ""},
+		{"y.x.a.b.example.com", 2, ".a.b.example.com"},
+	}
+	for _, tt := range tests {
+		if got := parents.longest(tt.name, tt.depth, nil); got != tt.want {
+			t.Errorf("%q depth %d: %q, want %q", tt.name, tt.depth, got, tt.want)
+		}
+	}
+
+	// a rule that ok refuses, as one missing from DomainMap, falls back
+	// to a shorter suffix
+	refuse := func(key string) bool { return key != ".a.b.example.com" }
+	if got := parents.longest("x.a.b.example.com", 0, refuse); got != ".example.com" {
+		t.Errorf("refused: %q", got)
+	}
+}
+
+func TestParentRule(t *testing.T) {
+	pface := &PhantomInterface{Device: "eth0"}
+	rules := &RuleSet{DomainMap: map[string]*PhantomInterface{".example.com": pface, "www.example.com": nil}}
+	rules.parents.insert("example.com", ".example.com")
+	rules.parents.insert("removed.com", ".removed.com")
+
+	tests := []struct {
+		name string
+		want *PhantomInterface
+	}{
+		{"deep.sub.domain.example.com", pface},
+		{"www.example.com", nil}, //its own rule
+		{"example.com", nil},
+		{"www.removed.com", nil}, //no longer in DomainMap
+	}
+	for _, tt := range tests {
+		if got := rules.GetInterface(tt.name); got != tt.want {
+			t.Errorf("%s: %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
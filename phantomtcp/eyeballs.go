@@ -0,0 +1,134 @@
+package phantomtcp
+
+import (
+	"net"
+	"time"
+)
+
+// with happy-eyeballs=1 the lookups of the interfaces that prefer no
+// address family resolve both A and AAAA and dial the addresses in the
+// order of RFC 8305: IPv6 first, then alternating families
+var HappyEyeballs = false
+
+// how long the AAAA answer is waited for after the A answer (RFC 8305
+// Resolution Delay) and how long an attempt runs before the next address
+// is tried (Connection Attempt Delay)
+var ResolutionDelay = time.Millisecond * 50
+var ConnectionAttemptDelay = time.Millisecond * 250
+
+// interleave orders the addresses of both families, the first of v6
+// first and then one of each family in turn
+func interleave(v6, v4 []net.IP) []net.IP {
+	addrs := make([]net.IP, 0, len(v6)+len(v4))
+	for i := 0; i < len(v6) || i < len(v4); i++ {
+		if i < len(v6) {
+			addrs = append(addrs, v6[i])
+		}
+		if i < len(v4) {
+			addrs = append(addrs, v4[i])
+		}
+	}
+	return addrs
+}
+
+type familyAnswer struct {
+	index uint32
+	addrs []net.IP
+}
+
+// happyLookup resolves name for both families at once, an A answer waits
+// ResolutionDelay for the AAAA answer before it is used alone
+func (profile *PhantomProfile) happyLookup(name string, hint uint32, server string) (uint32, []net.IP) {
+	v6 := make(chan familyAnswer, 1)
+	v4 := make(chan familyAnswer, 1)
+	go func() {
+		index, addrs := profile.NSLookup(name, hint|HINT_IPV6, server)
+		v6 <- familyAnswer{index, addrs}
+	}()
+	go func() {
+		index, addrs := profile.NSLookup(name, hint|HINT_IPV4, server)
+		v4 <- familyAnswer{index, addrs}
+	}()
+
+	var a, aaaa familyAnswer
+	select {
+	case aaaa = <-v6:
+		a = <-v4
+	case a = <-v4:
+		select {
+		case aaaa = <-v6:
+		case <-time.After(ResolutionDelay):
+			logPrintln(4, "happy eyeballs:", name, "no AAAA answer in", ResolutionDelay)
+		}
+	}
+
+	index := aaaa.index
+	if index == 0 {
+		index = a.index
+	}
+	return index, interleave(aaaa.addrs, a.addrs)
+}
+
+// dialHappy connects to the first of raddrs that answers, a new attempt
+// starts every ConnectionAttemptDelay or when the last one failed
+func dialHappy(device string, raddrs []*net.TCPAddr) (*net.TCPConn, error) {
+	type attempt struct {
+		conn *net.TCPConn
+		err  error
+	}
+	results := make(chan attempt, len(raddrs))
+	dial := func(raddr *net.TCPAddr) {
+		var laddr *net.TCPAddr
+		if device != "" {
+			var err error
+			laddr, err = GetLocalAddr(device, raddr.IP.To4() == nil)
+			if err != nil {
+				results <- attempt{nil, err}
+				return
+			}
+		}
+		conn, err := net.DialTCP("tcp", laddr, raddr)
+		results <- attempt{conn, err}
+	}
+
+	next := 0
+	running := 0
+	var lastErr error
+	var delay <-chan time.Time
+	start := func() {
+		go dial(raddrs[next])
+		next++
+		running++
+		delay = time.After(ConnectionAttemptDelay)
+	}
+	for {
+		if running == 0 {
+			if next == len(raddrs) {
+				return nil, lastErr
+			}
+			start()
+		}
+
+		select {
+		case r := <-results:
+			running--
+			if r.err == nil {
+				// the attempts still running are closed when they connect
+				go func(n int) {
+					for ; n > 0; n-- {
+						if r := <-results; r.conn != nil {
+							r.conn.Close()
+						}
+					}
+				}(running)
+				return r.conn, nil
+			}
+			lastErr = r.err
+			logPrintln(4, "happy eyeballs:", r.err)
+		case <-delay:
+			if next < len(raddrs) {
+				start()
+			}
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package phantomtcp
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// FailOpen is the policy for traffic that needs a subsystem which is
+// unavailable: the packet capture, the DNS servers of its rule or its
+// outbound proxy. Open passes it through untouched to the addresses the
+// system resolves, closed (the default) fails it.
+var FailOpen = false
+
+var captureDown int32
+
+// the capture could not be started, connections that need it get the
+// fail policy without trying
+func setCaptureDown(down bool) {
+	if down {
+		atomic.StoreInt32(&captureDown, 1)
+	} else {
+		atomic.StoreInt32(&captureDown, 0)
+	}
+}
+
+func captureAvailable() bool {
+	return atomic.LoadInt32(&captureDown) == 0
+}
+
+// an outbound proxy, its failures are failures of a subsystem and not
+// of the destination
+func (pface *PhantomInterface) isProxy() bool {
+	return pface.Protocol >= HTTP
+}
+
+// a proxy the payload goes to encrypted, it cannot be desynced
+func (pface *PhantomInterface) encrypted() bool {
+	return pface.Protocol == HTTPS || pface.Protocol == SS
+}
+
+// failOpen connects to host without the treatment of its rule when
+// FailOpen is set, cause is returned otherwise
+func failOpen(host string, port int, b []byte, cause error) (net.Conn, *ConnectionInfo, error) {
+	if !FailOpen {
+		return nil, nil, cause
+	}
+	logPrintln(2, "fail-open:", host, port, cause)
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, strconv.Itoa(port)), time.Second*10)
+	if err != nil {
+		return nil, nil, err
+	}
+	if b != nil {
+		_, err = conn.Write(b)
+		if err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+	}
+	return conn, nil, nil
+}
+
+// systemAnswer answers request from the system resolver when the DNS
+// servers of the rule of name do not, the answer is not cached
+func systemAnswer(request []byte, name string, qtype int) []byte {
+	var records DNSRecords
+	if qtype == 1 || qtype == 28 {
+		network := "ip4"
+		if qtype == 28 {
+			network = "ip6"
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		ips, err := net.DefaultResolver.LookupIP(ctx, network, name)
+		cancel()
+		logPrintln(2, "fail-open:", name, qtype, ips, err)
+		if len(ips) > 0 {
+			rec := &RecordAddresses{time.Now().Unix() + int64(DNSNegativeTTL), ips}
+			if qtype == 1 {
+				records.IPv4Hint = rec
+			} else {
+				records.IPv6Hint = rec
+			}
+		}
+	}
+	return records.BuildResponse(request, qtype, 0)
+}
@@ -0,0 +1,183 @@
+package phantomtcp
+
+import (
+	"hash/fnv"
+	"net"
+	"strings"
+)
+
+// with HashedFakeAddresses the fake address of a name comes from a hash
+// of the name instead of the order the names come in, so it is the same
+// across restarts, instances and machines with the same fake range. A
+// name whose slot is taken gets one of the next free ones, and takes the
+// slot over when they are all taken.
+var HashedFakeAddresses = false
+
+// the slots probed after the slot of the hash of a name
+const hashProbes = 64
+
+var noseHashed = make(map[uint32]string) //guarded by NoseLock
+
+// the index of each name in Nose, so a name resolved again keeps its
+// fake address; guarded by NoseLock
+var noseIndex = make(map[string]uint32)
+
+var noseFull = false
+
+// fakeRange is the number of host parts the fake ranges have in common,
+// the index of a name is below it and is neither 0 nor all ones
+func fakeRange() uint64 {
+	size := hostCount(VirtualNet)
+	if VirtualNet6 != nil {
+		if n := hostCount(VirtualNet6); n < size {
+			size = n
+		}
+	}
+	return size
+}
+
+func hostCount(ipnet *net.IPNet) uint64 {
+	ones, bits := ipnet.Mask.Size()
+	if bits-ones >= 32 {
+		return 1 << 32
+	}
+	return 1 << uint(bits-ones)
+}
+
+// newIndex gives name an index in the fake ranges, NoseLock is held. In
+// order a full range gives no more, the names without one are answered
+// with their real addresses.
+func newIndex(name string) uint32 {
+	size := fakeRange()
+	if !HashedFakeAddresses {
+		if index, ok := noseIndex[name]; ok && int(index) < len(Nose) && Nose[index] == name {
+			return index
+		}
+		index := uint32(len(Nose))
+		if uint64(index) >= size-1 {
+			if !noseFull {
+				noseFull = true
+				logPrintln(1, "fake range full,", len(Nose)-1, "names have a fake address")
+			}
+			return 0
+		}
+		Nose = append(Nose, name)
+		noseIndex[name] = index
+		return index
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(strings.ToLower(name)))
+	home := uint32(uint64(h.Sum32()) % size)
+	if home == 0 || uint64(home) == size-1 {
+		home = 1
+	}
+
+	index := home
+	for i := 0; i < hashProbes; i++ {
+		// 0 and all ones are not host addresses
+		if index != 0 && uint64(index) != size-1 {
+			if current, ok := noseHashed[index]; !ok || current == name {
+				noseHashed[index] = name
+				return index
+			}
+		}
+		index = uint32((uint64(index) + 1) % size)
+	}
+	logPrintln(2, "fake address of", noseHashed[home], "taken over by", name)
+	noseHashed[home] = name
+	return home
+}
+
+// restoreNose takes the fake addresses of a saved state, NoseLock is held
+func restoreNose(nose []string, hashed map[uint32]string) {
+	if len(Nose) == 1 && len(nose) > 0 && nose[0] == Nose[0] {
+		Nose = nose
+		for i, name := range Nose[1:] {
+			noseIndex[name] = uint32(i + 1)
+		}
+	}
+	if len(noseHashed) == 0 && hashed != nil {
+		noseHashed = hashed
+	}
+	trimNose()
+}
+
+// trimNose drops the indexes that do not fit the fake ranges, whose
+// addresses would be those of other names; NoseLock is held
+func trimNose() {
+	size := fakeRange()
+	if uint64(len(Nose)) > size-1 {
+		for _, name := range Nose[size-1:] {
+			if noseIndex[name] >= uint32(size-1) {
+				delete(noseIndex, name)
+			}
+		}
+		Nose = Nose[:size-1]
+	}
+	for index := range noseHashed {
+		if uint64(index) >= size-1 {
+			delete(noseHashed, index)
+		}
+	}
+	noseFull = false
+}
+
+// noseName is the name of the fake address index, "" when it has none;
+// NoseLock is held
+func noseName(index int) string {
+	if index <= 0 {
+		return ""
+	}
+	if HashedFakeAddresses {
+		return noseHashed[uint32(index)]
+	}
+	if index >= len(Nose) {
+		return ""
+	}
+	return Nose[index]
+}
+
+// NoseName is the name of the fake address index, "" when it has none
+func NoseName(index int) string {
+	NoseLock.Lock()
+	defer NoseLock.Unlock()
+	_, name := splitNoseKey(noseName(index))
+	return name
+}
+
+// the names in Nose are qualified by their instance, so an instance only
+// takes the fake addresses it gave out; those of the unnamed instance
+// are plain, as in the states saved before there were instances
+func (profile *PhantomProfile) noseKey(name string) string {
+	if profile.Instance == "" {
+		return name
+	}
+	return profile.Instance + "\x00" + name
+}
+
+// splitNoseKey returns the instance and the name of a name in Nose
+func splitNoseKey(key string) (string, string) {
+	if i := strings.IndexByte(key, 0); i != -1 {
+		return key[:i], key[i+1:]
+	}
+	return "", key
+}
+
+// fakeName is the name of the fake address index given out by the
+// instance of profile, "" when it has none; NoseLock is held
+func (profile *PhantomProfile) fakeName(index int) string {
+	instance, name := splitNoseKey(noseName(index))
+	if instance != profile.Instance {
+		return ""
+	}
+	return name
+}
+
+// FakeName is the name of the fake address index given out by the
+// instance of profile, "" when it has none
+func (profile *PhantomProfile) FakeName(index int) string {
+	NoseLock.Lock()
+	defer NoseLock.Unlock()
+	return profile.fakeName(index)
+}
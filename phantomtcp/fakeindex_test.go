@@ -0,0 +1,126 @@
+package phantomtcp
+
+import (
+	"fmt"
+	"net"
+	"testing"
+)
+
+// withFakeRange runs f with cidr as the only fake range and no names
+func withFakeRange(t *testing.T, cidr string, hashed bool, f func()) {
+	t.Helper()
+	NoseLock.Lock()
+	saved := []interface{}{VirtualNet, VirtualNet6, Nose, noseIndex, noseHashed, HashedFakeAddresses}
+	VirtualNet6 = nil
+	Nose = []string{"phantom.socks"}
+	noseIndex = make(map[string]uint32)
+	noseHashed = make(map[uint32]string)
+	HashedFakeAddresses = hashed
+	NoseLock.Unlock()
+	defer func() {
+		NoseLock.Lock()
+		VirtualNet, VirtualNet6 = saved[0].(*net.IPNet), saved[1].(*net.IPNet)
+		Nose, noseIndex = saved[2].([]string), saved[3].(map[string]uint32)
+		noseHashed, HashedFakeAddresses = saved[4].(map[uint32]string), saved[5].(bool)
+		noseFull = false
+		NoseLock.Unlock()
+	}()
+	if err := SetVirtualNet(cidr); err != nil {
+		t.Fatal(err)
+	}
+	f()
+}
+
+func TestNewIndexFullRange(t *testing.T) {
+	for _, hashed := range []bool{false, true} {
+		withFakeRange(t, "198.18.7.0/24", hashed, func() {
+			addrs := make(map[string]string)
+			NoseLock.Lock()
+			defer NoseLock.Unlock()
+			for i := 0; i < 300; i++ {
+				name := fmt.Sprintf("n%d.example.com", i)
+				index := newIndex(name)
+				if index == 0 {
+					if !hashed && i >= 254 {
+						continue
+					}
+					t.Fatalf("hashed %v: no index for %s", hashed, name)
+				}
+				if again := newIndex(name); again != index {
+					t.Errorf("hashed %v: %s resolved again got %d, had %d", hashed, name, again, index)
+				}
+				ip := VirtualAddress(index, false)
+				if ip[3] == 0 || ip[3] == 255 || !VirtualNet.Contains(ip) {
+					t.Errorf("hashed %v: %s got %v", hashed, name, ip)
+				}
+				if owner, ok := addrs[ip.String()]; ok && !hashed {
+					t.Errorf("%s and %s share %v", owner, name, ip)
+				}
+				addrs[ip.String()] = name
+				if VirtualIndex(ip) != int(index) {
+					t.Errorf("VirtualIndex(%v) = %d, want %d", ip, VirtualIndex(ip), index)
+				}
+			}
+			if !hashed && len(Nose) != 255 {
+				t.Errorf("%d indexes in a /24", len(Nose)-1)
+			}
+		})
+	}
+}
+
+func TestSetVirtualNetTrims(t *testing.T) {
+	withFakeRange(t, "198.18.0.0/16", false, func() {
+		NoseLock.Lock()
+		for i := 0; i < 300; i++ {
+			newIndex(fmt.Sprintf("n%d.example.com", i))
+		}
+		NoseLock.Unlock()
+		if err := SetVirtualNet("198.18.7.0/24"); err != nil {
+			t.Fatal(err)
+		}
+		if len(Nose) != 255 || NoseName(255) != "" || NoseName(254) != "n253.example.com" {
+			t.Errorf("%d indexes left, 254 is %q", len(Nose)-1, NoseName(254))
+		}
+	})
+}
+
+func TestRedirectIndex(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want int
+	}{
+		{"255.0.1.2", 0x0102},
+		{"::1:2", 0x10002},
+		{"::ffff:255.0.0.7", 7},
+		{"::1", -1},
+		{"2001:db8::1:2", -1},
+		{"192.0.2.1", -1},
+	}
+	for _, tt := range tests {
+		if got := redirectIndex(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("redirectIndex(%s) = %d, want %d", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestFakeNameInstances(t *testing.T) {
+	withFakeRange(t, "198.18.0.0/16", false, func() {
+		main, guest := &PhantomProfile{}, &PhantomProfile{Instance: "guest"}
+		NoseLock.Lock()
+		index := newIndex(main.noseKey("example.com"))
+		guestIndex := newIndex(guest.noseKey("example.com"))
+		NoseLock.Unlock()
+		if index == guestIndex {
+			t.Fatalf("both instances got %d", index)
+		}
+		if main.FakeName(int(index)) != "example.com" || guest.FakeName(int(guestIndex)) != "example.com" {
+			t.Errorf("names %q and %q", main.FakeName(int(index)), guest.FakeName(int(guestIndex)))
+		}
+		if main.FakeName(int(guestIndex)) != "" || guest.FakeName(int(index)) != "" {
+			t.Error("an instance took the fake address of another")
+		}
+		if NoseName(int(guestIndex)) != "example.com" {
+			t.Errorf("NoseName(%d) = %q", guestIndex, NoseName(int(guestIndex)))
+		}
+	})
+}
@@ -0,0 +1,502 @@
+package phantomtcp
+
+import (
+	"bytes"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Packet capture only needs to see the handshakes of connections to the
+// targets collected here: the addresses, networks and ports of the rules
+// that modify packets, the answers of their names until their TTL runs out
+// and the addresses being dialed. The backends build their filters from them.
+
+// CaptureTarget is a network to capture, every address when Net is nil,
+// and of one port unless Port is 0; the zero target is every packet
+type CaptureTarget struct {
+	Net  *net.IPNet
+	Port int
+}
+
+// an address without a rule stays that long after its last connection
+const captureConnLinger = 10 * time.Second
+
+// how often the expired addresses are dropped
+const captureSweep = 30 * time.Second
+
+// added answers wait that long for others before the filters are rebuilt,
+// dialing an address they do not have yet rebuilds them at once
+const captureDelay = time.Second
+
+// widths the addresses are widened to in turn until the targets fit the
+// limit of a backend
+var captureWidths = [][2]int{{32, 128}, {24, 64}, {16, 48}, {8, 32}}
+
+type captureEntry struct {
+	target  CaptureTarget
+	rule    bool   //kept until the rules change
+	expires int64  //unix time
+	conns   int    //connections being dialed
+	gen     uint64 //the change that added it
+}
+
+var captureLock sync.Mutex
+var captureEntries = make(map[string]*captureEntry)
+var captureTimer *time.Timer
+var captureSweepOnce sync.Once
+
+// the entries of changes up to captureApplied are in the filters
+var captureGen, captureApplied uint64
+
+// the filters are rebuilt one at a time, from the targets of captureKey
+var captureFlushLock sync.Mutex
+var captureKey string
+
+func hostTarget(ip net.IP, port int) CaptureTarget {
+	bits := 8 * net.IPv6len
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 8*net.IPv4len
+	}
+	return CaptureTarget{Net: &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, Port: port}
+}
+
+func (target CaptureTarget) String() string {
+	var s string
+	if target.Net != nil {
+		s = target.Net.String()
+	}
+	if target.Port != 0 {
+		s += ":" + strconv.Itoa(target.Port)
+	}
+	return s
+}
+
+// Host reports whether the target is a single address
+func (target CaptureTarget) Host() bool {
+	if target.Net == nil {
+		return false
+	}
+	ones, bits := target.Net.Mask.Size()
+	return ones == bits
+}
+
+// Contains reports whether every packet of t is one of the target
+func (target CaptureTarget) Contains(t CaptureTarget) bool {
+	if target.Port != 0 && target.Port != t.Port {
+		return false
+	}
+	if target.Net == nil {
+		return true
+	}
+	if t.Net == nil {
+		return false
+	}
+	ones, bits := target.Net.Mask.Size()
+	tones, tbits := t.Net.Mask.Size()
+	return bits == tbits && ones <= tones && target.Net.Contains(t.Net.IP)
+}
+
+// wider targets first, so that a target follows those containing it
+func (target CaptureTarget) less(t CaptureTarget) bool {
+	if (target.Net == nil) != (t.Net == nil) {
+		return target.Net == nil
+	}
+	if target.Net != nil {
+		ones, bits := target.Net.Mask.Size()
+		tones, tbits := t.Net.Mask.Size()
+		if ones != tones {
+			return ones < tones
+		}
+		if bits != tbits {
+			return bits < tbits
+		}
+		if c := bytes.Compare(target.Net.IP, t.Net.IP); c != 0 {
+			return c < 0
+		}
+	}
+	return target.Port < t.Port
+}
+
+func (target CaptureTarget) widen(width [2]int) CaptureTarget {
+	if target.Net == nil {
+		return target
+	}
+	ones, bits := target.Net.Mask.Size()
+	w := width[0]
+	if bits != 8*net.IPv4len {
+		w = width[1]
+	}
+	if ones <= w {
+		return target
+	}
+	mask := net.CIDRMask(w, bits)
+	return CaptureTarget{Net: &net.IPNet{IP: target.Net.IP.Mask(mask), Mask: mask}, Port: target.Port}
+}
+
+// reduceTargets sorts targets and drops those another one contains
+func reduceTargets(targets []CaptureTarget) []CaptureTarget {
+	sort.Slice(targets, func(i, j int) bool {
+		return targets[i].less(targets[j])
+	})
+
+	var reduced []CaptureTarget
+	nets := make(map[string]bool)
+	lengths := make(map[int]bool)
+	ports := make(map[int]bool)
+	for _, t := range targets {
+		if t.Net == nil {
+			if t.Port == 0 {
+				return []CaptureTarget{{}}
+			}
+			if !ports[t.Port] {
+				ports[t.Port] = true
+				reduced = append(reduced, t)
+			}
+			continue
+		}
+		if ports[t.Port] {
+			continue
+		}
+
+		covered := false
+		ones, bits := t.Net.Mask.Size()
+		for length := range lengths {
+			if length > ones {
+				continue
+			}
+			key := (&net.IPNet{IP: t.Net.IP.Mask(net.CIDRMask(length, bits)), Mask: net.CIDRMask(length, bits)}).String()
+			if nets[key] || (t.Port != 0 && nets[key+":"+strconv.Itoa(t.Port)]) {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			nets[t.String()] = true
+			lengths[ones] = true
+			reduced = append(reduced, t)
+		}
+	}
+	return reduced
+}
+
+// aggregateTargets widens the addresses of targets until there are at
+// most limit of them, every packet is captured past the widest
+func aggregateTargets(targets []CaptureTarget, limit int) []CaptureTarget {
+	for _, width := range captureWidths {
+		widened := make([]CaptureTarget, len(targets))
+		for i, t := range targets {
+			widened[i] = t.widen(width)
+		}
+		widened = reduceTargets(widened)
+		if len(widened) <= limit {
+			return widened
+		}
+	}
+	return []CaptureTarget{{}}
+}
+
+// CaptureTargets returns at most limit targets covering every entry,
+// none when nothing is to be captured
+func CaptureTargets(limit int) []CaptureTarget {
+	captureLock.Lock()
+	targets := make([]CaptureTarget, 0, len(captureEntries))
+	for _, entry := range captureEntries {
+		targets = append(targets, entry.target)
+	}
+	captureLock.Unlock()
+
+	if len(targets) == 0 {
+		return nil
+	}
+	return aggregateTargets(targets, limit)
+}
+
+// addCapture adds target or extends its entry, captureLock is held
+func addCapture(target CaptureTarget, rule bool, expires int64) *captureEntry {
+	key := target.String()
+	entry, ok := captureEntries[key]
+	if !ok {
+		captureGen++
+		entry = &captureEntry{target: target, gen: captureGen}
+		captureEntries[key] = entry
+		if !rule {
+			captureSweepOnce.Do(func() { go sweepCapture() })
+		}
+	}
+	entry.rule = entry.rule || rule
+	if expires > entry.expires {
+		entry.expires = expires
+	}
+	return entry
+}
+
+// covered reports whether the filters built have t, captureLock is held
+func covered(t CaptureTarget) bool {
+	for _, entry := range captureEntries {
+		if entry.gen <= captureApplied && entry.target.Contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// captureAddresses adds the answers expiring at expires, those of the
+// rules when it is 0
+func captureAddresses(expires int64, ips []net.IP) {
+	added := false
+	captureLock.Lock()
+	for _, ip := range ips {
+		if ip == nil || isLocalAddress(ip) {
+			continue
+		}
+		entry := addCapture(hostTarget(ip, 0), expires == 0, expires)
+		added = added || entry.gen > captureApplied
+	}
+	captureLock.Unlock()
+
+	if added {
+		scheduleCapture()
+	}
+}
+
+// CaptureAddress adds the addresses of a rule
+func CaptureAddress(ips ...net.IP) {
+	captureAddresses(0, ips)
+}
+
+// Capture adds the answers of records until their TTL runs out
+func (records *DNSRecords) Capture() {
+	for _, hint := range []*RecordAddresses{records.IPv4Hint, records.IPv6Hint} {
+		if hint != nil {
+			captureAddresses(hint.TTL, hint.Addresses)
+		}
+	}
+}
+
+// captureConn keeps the address of a connection being dialed, the filters
+// are rebuilt before its SYN is sent unless they have it already
+func captureConn(synAddr string) {
+	ip, port := splitSynAddr(synAddr)
+	if ip == nil || isLocalAddress(ip) {
+		return
+	}
+
+	captureLock.Lock()
+	ok := covered(hostTarget(ip, port))
+	addCapture(hostTarget(ip, 0), false, 0).conns++
+	captureLock.Unlock()
+
+	if !ok {
+		flushCapture()
+	}
+}
+
+// releaseConn lets the address of a connection expire once it was dialed
+func releaseConn(synAddr string) {
+	ip, _ := splitSynAddr(synAddr)
+	if ip == nil {
+		return
+	}
+
+	captureLock.Lock()
+	entry, ok := captureEntries[hostTarget(ip, 0).String()]
+	if ok && entry.conns > 0 {
+		entry.conns--
+		linger := time.Now().Add(captureConnLinger).Unix()
+		if entry.expires < linger {
+			entry.expires = linger
+		}
+	}
+	captureLock.Unlock()
+}
+
+func splitSynAddr(synAddr string) (net.IP, int) {
+	host, port, err := net.SplitHostPort(synAddr)
+	if err != nil {
+		return nil, 0
+	}
+	n, _ := strconv.Atoi(port)
+	return net.ParseIP(host), n
+}
+
+func scheduleCapture() {
+	captureLock.Lock()
+	if captureTimer == nil {
+		captureTimer = time.AfterFunc(captureDelay, flushCapture)
+	}
+	captureLock.Unlock()
+}
+
+// expireCapture drops the answers that expired and the addresses no
+// longer dialed
+func expireCapture(now int64) bool {
+	removed := false
+	captureLock.Lock()
+	for key, entry := range captureEntries {
+		if !entry.rule && entry.conns == 0 && entry.expires <= now {
+			delete(captureEntries, key)
+			removed = true
+		}
+	}
+	captureLock.Unlock()
+	return removed
+}
+
+func sweepCapture() {
+	for {
+		time.Sleep(captureSweep)
+		if expireCapture(time.Now().Unix()) {
+			flushCapture()
+		}
+	}
+}
+
+// flushCapture rebuilds the filters of the backends when the targets
+// changed since they were last built
+func flushCapture() {
+	captureFlushLock.Lock()
+	defer captureFlushLock.Unlock()
+
+	captureLock.Lock()
+	if captureTimer != nil {
+		captureTimer.Stop()
+		captureTimer = nil
+	}
+	gen := captureGen
+	keys := make([]string, 0, len(captureEntries))
+	for key := range captureEntries {
+		keys = append(keys, key)
+	}
+	captureLock.Unlock()
+
+	sort.Strings(keys)
+	key := strings.Join(keys, " ")
+	if key != captureKey {
+		err := UpdateCaptureFilter()
+		if err != nil {
+			logPrintln(1, "capture filter:", err)
+			return
+		}
+		captureKey = key
+	}
+
+	captureLock.Lock()
+	if gen > captureApplied {
+		captureApplied = gen
+	}
+	captureLock.Unlock()
+}
+
+// RebuildCapture replaces the targets with those of the rules and cached
+// names of profiles that modify packets, so a reload drops the targets of
+// removed rules; the addresses being dialed are kept
+func RebuildCapture(profiles ...*PhantomProfile) {
+	entries := make(map[string]*captureEntry)
+	add := func(target CaptureTarget, expires int64) {
+		key := target.String()
+		entry, ok := entries[key]
+		if !ok {
+			entry = &captureEntry{target: target}
+			entries[key] = entry
+		}
+		entry.rule = entry.rule || expires == 0
+		if expires > entry.expires {
+			entry.expires = expires
+		}
+	}
+	for _, profile := range profiles {
+		profile.captureTargets(add)
+		for _, block := range profile.Rules().clients {
+			block.profile.captureTargets(add)
+		}
+	}
+
+	captureLock.Lock()
+	for key, entry := range captureEntries {
+		if entry.conns > 0 {
+			if e, ok := entries[key]; ok {
+				e.conns = entry.conns
+			} else {
+				entries[key] = &captureEntry{target: entry.target, expires: entry.expires, conns: entry.conns}
+			}
+		}
+	}
+	captureGen++
+	for _, entry := range entries {
+		entry.gen = captureGen
+	}
+	captureEntries = entries
+	captureLock.Unlock()
+
+	if len(entries) != 0 {
+		captureSweepOnce.Do(func() { go sweepCapture() })
+	}
+	flushCapture()
+}
+
+func (profile *PhantomProfile) captureTargets(add func(CaptureTarget, int64)) {
+	rules := profile.Rules()
+	modify := func(pface *PhantomInterface) bool {
+		return pface != nil && pface.Hint&HINT_MODIFY != 0
+	}
+	addHost := func(ip net.IP, port int, expires int64) {
+		if ip != nil && !isLocalAddress(ip) {
+			add(hostTarget(ip, port), expires)
+		}
+	}
+	for host, pface := range rules.DomainMap {
+		if !modify(pface) {
+			continue
+		}
+		if _, ipnet, err := net.ParseCIDR(host); err == nil {
+			add(CaptureTarget{Net: ipnet}, 0)
+		} else {
+			addHost(net.ParseIP(host), 0, 0)
+		}
+	}
+
+	// the ports of the names of port rules, with the answers of the names
+	var namePorts []int
+	for key, pface := range rules.PortMap {
+		i := strings.LastIndexByte(key, ':')
+		if i < 0 || !modify(pface) {
+			continue
+		}
+		port, _ := strconv.Atoi(key[i+1:])
+		if i == 0 {
+			add(CaptureTarget{Port: port}, 0)
+		} else if ip := net.ParseIP(key[:i]); ip != nil {
+			addHost(ip, port, 0)
+		} else {
+			namePorts = append(namePorts, port)
+		}
+	}
+
+	now := time.Now().Unix()
+	profile.DNSCache.Range(func(name string, records *DNSRecords) bool {
+		var ports []int
+		if modify(rules.GetInterface(name)) {
+			ports = []int{0}
+		}
+		for _, port := range namePorts {
+			if pface, ok := rules.GetPortInterface(name, port); ok && modify(pface) {
+				ports = append(ports, port)
+			}
+		}
+		for _, hint := range []*RecordAddresses{records.IPv4Hint, records.IPv6Hint} {
+			if hint == nil || hint.Expired(now) {
+				continue
+			}
+			for _, ip := range hint.Addresses {
+				for _, port := range ports {
+					addHost(ip, port, hint.TTL)
+				}
+			}
+		}
+		return true
+	})
+}
@@ -0,0 +1,113 @@
+package phantomtcp
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func parseTargets(t *testing.T, list ...string) []CaptureTarget {
+	var targets []CaptureTarget
+	for _, s := range list {
+		var target CaptureTarget
+		host, port, err := net.SplitHostPort(s)
+		if err != nil {
+			host = s
+		} else {
+			fmt.Sscan(port, &target.Port)
+		}
+		if host != "" {
+			_, ipnet, err := net.ParseCIDR(host)
+			if err != nil {
+				t.Fatal(err)
+			}
+			target.Net = ipnet
+		}
+		targets = append(targets, target)
+	}
+	return targets
+}
+
+func TestReduceTargets(t *testing.T) {
+	targets := parseTargets(t, "1.2.3.4/32", "1.2.0.0/16", "[2001:db8::1/128]:443", "2001:db8::/32",
+		"5.6.7.8/32", "[5.6.7.8/32]:443", "[9.9.9.9/32]:25", ":25", "[1.2.9.9/32]:80")
+	got := fmt.Sprint(reduceTargets(targets))
+	want := "[:25 1.2.0.0/16 5.6.7.8/32 2001:db8::/32]"
+	if got != want {
+		t.Errorf("%s, want %s", got, want)
+	}
+
+	if got := reduceTargets(parseTargets(t, "1.2.3.4/32", "")); len(got) != 1 || got[0] != (CaptureTarget{}) {
+		t.Errorf("every packet: %v", got)
+	}
+}
+
+func TestAggregateTargets(t *testing.T) {
+	var targets []CaptureTarget
+	for i := 0; i < 100; i++ {
+		targets = append(targets, hostTarget(net.IPv4(1, 2, byte(i%3), byte(i)), 0))
+		targets = append(targets, hostTarget(net.ParseIP(fmt.Sprintf("2001:db8:%x::%x", i%2, i)), 443))
+	}
+	tests := []struct {
+		limit int
+		want  string
+	}{
+		{200, ""},
+		{5, "[1.2.0.0/24 1.2.1.0/24 1.2.2.0/24 2001:db8::/64:443 2001:db8:1::/64:443]"},
+		{3, "[1.2.0.0/16 2001:db8::/48:443 2001:db8:1::/48:443]"},
+		{1, "[]"},
+	}
+	for _, tt := range tests {
+		got := aggregateTargets(append([]CaptureTarget(nil), targets...), tt.limit)
+		if tt.want == "" {
+			if len(got) != len(targets) {
+				t.Errorf("limit %d: %d targets, want %d", tt.limit, len(got), len(targets))
+			}
+		} else if s := fmt.Sprint(got); s != tt.want {
+			t.Errorf("limit %d: %s, want %s", tt.limit, s, tt.want)
+		}
+	}
+}
+
+func TestCaptureExpiry(t *testing.T) {
+	captureLock.Lock()
+	captureEntries = make(map[string]*captureEntry)
+	captureLock.Unlock()
+	defer RebuildCapture()
+
+	now := time.Now().Unix()
+	CaptureAddress(net.ParseIP("1.2.3.4"))
+	captureAddresses(now+60, []net.IP{net.ParseIP("5.6.7.8"), net.ParseIP("127.0.0.1")})
+	captureConn("9.9.9.9:443")
+	captureConn("[2001:db8::1]:443")
+	releaseConn("[2001:db8::1]:443")
+
+	targets := func() string {
+		return fmt.Sprint(CaptureTargets(10))
+	}
+	if got, want := targets(), "[1.2.3.4/32 5.6.7.8/32 9.9.9.9/32 2001:db8::1/128]"; got != want {
+		t.Fatalf("%s, want %s", got, want)
+	}
+
+	captureLock.Lock()
+	ok := covered(hostTarget(net.ParseIP("9.9.9.9"), 443))
+	captureLock.Unlock()
+	if !ok {
+		t.Error("a dialed address is not in the filters")
+	}
+
+	expireCapture(now + 30)
+	if got, want := targets(), "[1.2.3.4/32 5.6.7.8/32 9.9.9.9/32]"; got != want {
+		t.Errorf("after the connection: %s, want %s", got, want)
+	}
+	expireCapture(now + 60)
+	if got, want := targets(), "[1.2.3.4/32 9.9.9.9/32]"; got != want {
+		t.Errorf("after the TTL: %s, want %s", got, want)
+	}
+	releaseConn("9.9.9.9:443")
+	expireCapture(now + 60)
+	if got, want := targets(), "[1.2.3.4/32]"; got != want {
+		t.Errorf("rule: %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,237 @@
+package phantomtcp
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// a rule needs that many TLS connections through a method before it is
+// shared, so rarely visited names are not given away
+var FindingsMinConnections uint64 = 5
+
+// the DNS of the interfaces made from findings, which carry no server
+var FindingsDNS = "https://1.1.1.1/dns-query"
+
+// Finding tells how the TLS connections of a rule fared with a method:
+// Works counts the connections the server answered, Fails the others
+type Finding struct {
+	Rule   string `json:"rule"`
+	Method string `json:"method"` //the hints of the interface and ttl=N
+	Works  uint64 `json:"works"`
+	Fails  uint64 `json:"fails"`
+}
+
+// FindingBundle is the findings of a network shared with others, signed
+// with the ed25519 key whose public half is Key. It holds no address,
+// interface, device or server of the one who made it.
+type FindingBundle struct {
+	ASN       string    `json:"asn,omitempty"`
+	Date      string    `json:"date"`
+	Findings  []Finding `json:"findings"`
+	Key       string    `json:"key"`
+	Signature string    `json:"signature,omitempty"`
+}
+
+// methodName is the method of the rules of pface, "" when it only
+// proxies or connects directly
+func methodName(pface *PhantomInterface) string {
+	if pface == nil || pface.Protocol != DIRECT || pface.Hint == 0 {
+		return ""
+	}
+	var names []string
+	for name, hint := range HintMap {
+		if hint != 0 && pface.Hint&hint == hint && hint != HINT_TTL {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	if pface.Hint&HINT_TTL != 0 {
+		names = append(names, "ttl="+strconv.Itoa(int(pface.TTL)))
+	}
+	return strings.Join(names, ",")
+}
+
+// Findings returns the findings of the rules of the profile that use a
+// method, no rule of an address and none with few connections
+func (profile *PhantomProfile) Findings() []Finding {
+	rules := profile.Rules()
+	var findings []Finding
+	for _, stats := range profile.ProtocolStats() {
+		if stats.Rule == "" || net.ParseIP(stats.Rule) != nil || strings.Contains(stats.Rule, "/") {
+			continue
+		}
+		method := methodName(rules.DomainMap[stats.Rule])
+		if method == "" {
+			continue
+		}
+		var hellos, works uint64
+		for _, n := range stats.ALPN {
+			hellos += n
+		}
+		for _, n := range stats.TLS {
+			works += n
+		}
+		if hellos < FindingsMinConnections {
+			continue
+		}
+		if works > hellos {
+			works = hellos
+		}
+		findings = append(findings, Finding{stats.Rule, method, works, hellos - works})
+	}
+	sort.Slice(findings, func(i, j int) bool {
+		return findings[i].Rule < findings[j].Rule
+	})
+	return findings
+}
+
+// the signed bytes of a bundle, the bundle without its signature
+func (bundle *FindingBundle) signedData() []byte {
+	b := *bundle
+	b.Signature = ""
+	data, _ := json.Marshal(&b)
+	return data
+}
+
+// NewFindingBundle signs the findings of asn with key
+func NewFindingBundle(asn string, findings []Finding, key ed25519.PrivateKey) *FindingBundle {
+	bundle := &FindingBundle{
+		ASN:      asn,
+		Date:     time.Now().UTC().Format("2006-01-02"),
+		Findings: findings,
+		Key:      base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey)),
+	}
+	bundle.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(key, bundle.signedData()))
+	return bundle
+}
+
+// Verify checks that the bundle is signed by one of the trusted public
+// keys, given in base64
+func (bundle *FindingBundle) Verify(trusted []string) error {
+	trust := false
+	for _, key := range trusted {
+		trust = trust || key == bundle.Key
+	}
+	if !trust {
+		return fmt.Errorf("key %s is not trusted", bundle.Key)
+	}
+	pub, err := base64.StdEncoding.DecodeString(bundle.Key)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return errors.New("bad key")
+	}
+	sig, err := base64.StdEncoding.DecodeString(bundle.Signature)
+	if err != nil || !ed25519.Verify(ed25519.PublicKey(pub), bundle.signedData(), sig) {
+		return errors.New("bad signature")
+	}
+	return nil
+}
+
+// LoadFindingsKey reads the signing key of the findings, the base64 of
+// its seed, a new key is made when the file does not exist
+func LoadFindingsKey(filename string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		seed := base64.StdEncoding.EncodeToString(key.Seed())
+		return key, os.WriteFile(filename, []byte(seed+"\n"), 0600)
+	}
+	if err != nil {
+		return nil, err
+	}
+	seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, errors.New(filename + ": bad key")
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// FindingsConfig turns the findings of bundles into the interfaces of
+// their methods and the rules that use them, for each rule the method
+// that worked for the most of its connections, and only if it worked
+// more than it failed. With asn set the findings of other networks are
+// left out.
+func FindingsConfig(bundles []*FindingBundle, asn string) ([]InterfaceConfig, string) {
+	type score struct{ works, fails uint64 }
+	scores := make(map[string]map[string]*score) //rule, method
+	for _, bundle := range bundles {
+		if asn != "" && !strings.EqualFold(bundle.ASN, asn) {
+			continue
+		}
+		for _, f := range bundle.Findings {
+			if !validRuleName(f.Rule) || f.Method == "" {
+				continue
+			}
+			methods, ok := scores[f.Rule]
+			if !ok {
+				methods = make(map[string]*score)
+				scores[f.Rule] = methods
+			}
+			s, ok := methods[f.Method]
+			if !ok {
+				s = &score{}
+				methods[f.Method] = s
+			}
+			s.works += f.Works
+			s.fails += f.Fails
+		}
+	}
+
+	rulesOf := make(map[string][]string) //method
+	for rule, methods := range scores {
+		best, ratio := "", 0.5
+		for method, s := range methods {
+			r := float64(s.works) / float64(s.works+s.fails+1)
+			if r > ratio || (r == ratio && method < best) {
+				best, ratio = method, r
+			}
+		}
+		if best != "" {
+			rulesOf[best] = append(rulesOf[best], rule)
+		}
+	}
+
+	var methods []string
+	for method := range rulesOf {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+
+	var interfaces []InterfaceConfig
+	var conf strings.Builder
+	for i, method := range methods {
+		pface := InterfaceConfig{Name: "shared" + strconv.Itoa(i+1), DNS: FindingsDNS}
+		var hints []string
+		for _, h := range strings.Split(method, ",") {
+			if strings.HasPrefix(h, "ttl=") {
+				pface.TTL, _ = strconv.Atoi(h[4:])
+				h = "ttl"
+			}
+			if _, ok := HintMap[h]; ok {
+				hints = append(hints, h)
+			}
+		}
+		pface.Hint = strings.Join(hints, ",")
+		interfaces = append(interfaces, pface)
+
+		rules := rulesOf[method]
+		sort.Strings(rules)
+		conf.WriteString("[" + pface.Name + "]\n")
+		for _, rule := range rules {
+			conf.WriteString(rule + "\n")
+		}
+	}
+	return interfaces, conf.String()
+}
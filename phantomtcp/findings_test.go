@@ -0,0 +1,86 @@
+package phantomtcp
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"testing"
+)
+
+func TestFindingBundle(t *testing.T) {
+	key := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+	other := ed25519.NewKeyFromSeed(append(make([]byte, ed25519.SeedSize-1), 1))
+	findings := []Finding{{"example.com", "https,mss", 9, 1}}
+	bundle := NewFindingBundle("AS64496", findings, key)
+
+	// as read from a file
+	data, err := json.Marshal(bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var read FindingBundle
+	if err := json.Unmarshal(data, &read); err != nil {
+		t.Fatal(err)
+	}
+	if err := read.Verify([]string{NewFindingBundle("", nil, other).Key, bundle.Key}); err != nil {
+		t.Errorf("verify: %v", err)
+	}
+	if err := read.Verify([]string{NewFindingBundle("", nil, other).Key}); err == nil {
+		t.Error("a bundle of an untrusted key verified")
+	}
+
+	altered := read
+	altered.Findings = []Finding{{"example.com", "https,mss", 10, 0}}
+	if err := altered.Verify([]string{bundle.Key}); err == nil {
+		t.Error("altered findings verified")
+	}
+	altered = read
+	altered.ASN = "AS64497"
+	if err := altered.Verify([]string{bundle.Key}); err == nil {
+		t.Error("altered ASN verified")
+	}
+	altered = read
+	altered.Signature = "bad"
+	if err := altered.Verify([]string{bundle.Key}); err == nil {
+		t.Error("bad signature verified")
+	}
+}
+
+func TestFindingsConfig(t *testing.T) {
+	bundles := []*FindingBundle{
+		{ASN: "AS64496", Findings: []Finding{
+			{"a.com", "https,mss", 8, 2},
+			{"a.com", "https,ttl=8", 3, 7},
+			{"b.com", "https,mss", 1, 9},
+			{"bad name.com", "https", 9, 0},
+		}},
+		{ASN: "AS64497", Findings: []Finding{
+			{"b.com", "https,mss", 20, 0},
+			{"c.com", "https,ttl=8", 5, 0},
+		}},
+	}
+
+	// hints a build does not have are left out
+	ttlHint := "https"
+	if _, ok := HintMap["ttl"]; ok {
+		ttlHint += ",ttl"
+	}
+
+	tests := []struct {
+		asn        string
+		interfaces []InterfaceConfig
+		conf       string
+	}{
+		{"as64496", []InterfaceConfig{{Name: "shared1", DNS: FindingsDNS, Hint: "https,mss"}},
+			"[shared1]\na.com\n"},
+		{"", []InterfaceConfig{{Name: "shared1", DNS: FindingsDNS, Hint: "https,mss"}, {Name: "shared2", DNS: FindingsDNS, Hint: ttlHint, TTL: 8}},
+			"[shared1]\na.com\nb.com\n[shared2]\nc.com\n"},
+	}
+	for _, tt := range tests {
+		interfaces, conf := FindingsConfig(bundles, tt.asn)
+		got, _ := json.Marshal(interfaces)
+		want, _ := json.Marshal(tt.interfaces)
+		if string(got) != string(want) || conf != tt.conf {
+			t.Errorf("asn %q: %s\n%q, want %s\n%q", tt.asn, got, conf, want, tt.conf)
+		}
+	}
+}
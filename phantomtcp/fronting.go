@@ -0,0 +1,155 @@
+package phantomtcp
+
+import (
+	"crypto/tls"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// fronting=*.example.com>cdn1.com,cdn2.com gives the strip connections of
+// the names under example.com one of the fronts as SNI in turn; a front
+// whose handshakes fail FrontFailures times in a row is skipped for
+// FrontDownTime, so blocking one front does not break the name
+var FrontFailures = 2
+var FrontDownTime = time.Minute * 5
+
+type FrontStats struct {
+	Pattern   string `json:"pattern"`
+	Front     string `json:"front"`
+	Conns     uint64 `json:"conns"`
+	Errors    uint64 `json:"errors"`
+	DownUntil int64  `json:"down_until,omitempty"`
+}
+
+type front struct {
+	lock     sync.Mutex
+	stats    FrontStats
+	failures int
+}
+
+type frontPool struct {
+	fronts []*front
+	next   uint32
+}
+
+func (profile *PhantomProfile) addFronting(rule string) error {
+	keys := strings.SplitN(rule, ">", 2)
+	if len(keys) != 2 || keys[0] == "" || keys[1] == "" {
+		return fmt.Errorf("bad fronting %s", rule)
+	}
+	pattern := strings.TrimPrefix(keys[0], "*")
+	pool := &frontPool{}
+	for _, name := range strings.Split(keys[1], ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		pool.fronts = append(pool.fronts, &front{stats: FrontStats{Pattern: keys[0], Front: name}})
+	}
+	if len(pool.fronts) == 0 {
+		return fmt.Errorf("bad fronting %s", rule)
+	}
+	profile.FrontingMap[pattern] = pool
+	return nil
+}
+
+// the pool of fronts of name, the most specific one
+func (rules *RuleSet) frontingPool(name string) *frontPool {
+	if len(rules.FrontingMap) == 0 {
+		return nil
+	}
+	if pool, ok := rules.FrontingMap[name]; ok {
+		return pool
+	}
+	for offset := strings.Index(name, "."); offset != -1; {
+		if pool, ok := rules.FrontingMap[name[offset:]]; ok {
+			return pool
+		}
+		next := strings.Index(name[offset+1:], ".")
+		if next == -1 {
+			break
+		}
+		offset += next + 1
+	}
+	return nil
+}
+
+func (f *front) up(now int64) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.stats.DownUntil <= now
+}
+
+func (f *front) record(err error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.stats.Conns++
+	if err == nil {
+		f.failures = 0
+		f.stats.DownUntil = 0
+		return
+	}
+	f.stats.Errors++
+	f.failures++
+	if f.failures >= FrontFailures {
+		f.stats.DownUntil = time.Now().Add(FrontDownTime).Unix()
+		logPrintln(1, "fronting:", f.stats.Front, "down", err)
+	}
+}
+
+// order returns the fronts of the pool starting at the next one, the
+// fronts that are down last
+func (pool *frontPool) order() []*front {
+	start := int(atomic.AddUint32(&pool.next, 1) - 1)
+	now := time.Now().Unix()
+	var up, down []*front
+	for i := range pool.fronts {
+		f := pool.fronts[(start+i)%len(pool.fronts)]
+		if f.up(now) {
+			up = append(up, f)
+		} else {
+			down = append(down, f)
+		}
+	}
+	return append(up, down...)
+}
+
+// dialFronting is DialStrip with the fronts of the pool of host, the
+// next front is tried when a handshake fails
+func (pface *PhantomInterface) dialFronting(host string, pool *frontPool) (*tls.Conn, error) {
+	var err error
+	for _, f := range pool.order() {
+		var conn *tls.Conn
+		conn, err = pface.DialStrip(host, f.stats.Front)
+		f.record(err)
+		if err == nil {
+			logPrintln(3, "fronting:", host, f.stats.Front)
+			return conn, nil
+		}
+		logPrintln(2, "fronting:", host, f.stats.Front, err)
+	}
+	return nil, err
+}
+
+// FrontingStats returns the connections and health of each front
+func (profile *PhantomProfile) FrontingStats() []FrontStats {
+	var list []FrontStats
+	for _, pool := range profile.Rules().FrontingMap {
+		for _, f := range pool.fronts {
+			f.lock.Lock()
+			list = append(list, f.stats)
+			f.lock.Unlock()
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Pattern != list[j].Pattern {
+			return list[i].Pattern < list[j].Pattern
+		}
+		return list[i].Front < list[j].Front
+	})
+	return list
+}
@@ -0,0 +1,131 @@
+package phantomtcp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// NewUpstream parses the proxy of another local tool that a gateway
+// sends the domains without an interface to, "http://127.0.0.1:7890"
+// or "socks5://127.0.0.1:7891"
+func (profile *PhantomProfile) NewUpstream(upstream string) (*PhantomInterface, error) {
+	u, err := url.Parse(upstream)
+	if err != nil {
+		return nil, err
+	}
+
+	pface := &PhantomInterface{Address: u.Host, profile: profile}
+	switch u.Scheme {
+	case "http":
+		pface.Protocol = HTTP
+	case "https":
+		pface.Protocol = HTTPS
+		query := u.Query()
+		pface.tlsOptions = proxyTLSOptions(query.Get("verify"), query.Get("spki"))
+	case "ss":
+		pface.Protocol = SS
+		pface.ss, err = newSSCipher(ssUserinfo(u.User))
+		if err != nil {
+			return nil, err
+		}
+	case "socks", "socks5":
+		pface.Protocol = SOCKS5
+	case "socks4":
+		pface.Protocol = SOCKS4
+	default:
+		return nil, errors.New("unsupported upstream: " + upstream)
+	}
+	return pface, nil
+}
+
+// proxyTLSOptions checks the certificate of an HTTPS proxy unless verify
+// is "0" or "false", spki pins it like the spki= of a DoT server
+func proxyTLSOptions(verify, spki string) *ServerOptions {
+	return &ServerOptions{
+		Verify: verify != "0" && verify != "false",
+		SPKI:   spki,
+	}
+}
+
+func dialUpstream(upstream *PhantomInterface, host string, port int) (net.Conn, error) {
+	if upstream == nil {
+		return net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	}
+	conn, _, err := upstream.Dial(host, port, nil)
+	return conn, err
+}
+
+// SocksGateway serves SOCKS, the domains of the rules are desynced and
+// the others are sent through upstream
+func (profile *PhantomProfile) SocksGateway(upstream *PhantomInterface) func(net.Conn) {
+	return func(client net.Conn) {
+		profile.socksProxy(client, upstream)
+	}
+}
+
+// HTTPGateway serves an HTTP proxy like SocksGateway, upstream may be nil
+func (profile *PhantomProfile) HTTPGateway(upstream *PhantomInterface) func(net.Conn) {
+	return func(client net.Conn) {
+		profile.httpProxy(client, upstream)
+	}
+}
+
+func (profile *PhantomProfile) httpProxy(client net.Conn, upstream *PhantomInterface) {
+	br := bufio.NewReader(client)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		logPrintln(3, client.RemoteAddr(), err)
+		client.Close()
+		return
+	}
+
+	host, port := splitHostPort(req.Host)
+	if host == "" {
+		client.Write([]byte("HTTP/1.1 400 Bad Request\r\n\r\n"))
+		client.Close()
+		return
+	}
+
+	// the reply waits for the connection to the server, failures get
+	// the status of their kind
+	var header []byte
+	var reply *replyConn
+	if req.Method == "CONNECT" {
+		if port == 0 {
+			port = 443
+		}
+		reply = httpReply(client, []byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+	} else {
+		reply = httpReply(client, nil)
+		if port == 0 {
+			port = 80
+		}
+		// origin form, the connection is closed after the response as the
+		// next request may be for another host
+		req.Header.Del("Proxy-Connection")
+		req.Header.Del("Proxy-Authorization")
+		req.Header.Set("Connection", "close")
+		var buf bytes.Buffer
+		buf.WriteString(req.Method + " " + req.URL.RequestURI() + " " + req.Proto + "\r\n")
+		buf.WriteString("Host: " + req.Host + "\r\n")
+		req.Header.Write(&buf)
+		buf.WriteString("\r\n")
+		header = buf.Bytes()
+	}
+	if n := br.Buffered(); n > 0 {
+		b, _ := br.Peek(n)
+		header = append(header, b...)
+	}
+
+	addr := &net.TCPAddr{Port: port}
+	if ip := net.ParseIP(host); ip != nil {
+		addr.IP = ip
+		host = ""
+	}
+	profile.tcp_redirect(reply, addr, host, header, upstream)
+}
@@ -0,0 +1,319 @@
+package phantomtcp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// the User-Agent of the normalize-ua header rule
+var NormalUserAgent = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36"
+
+// the longest request head that is rewritten, longer ones pass unchanged
+const httpMaxHead = 65536
+
+const (
+	HTTP_DEL = iota
+	HTTP_SET
+	HTTP_UA
+	HTTP_REFERER
+)
+
+// a step of the header rules of an interface, applied in order to the
+// plain HTTP requests of the connections of its rules:
+//
+//	-Name         removes the header
+//	Name: value   sets the header, replacing it
+//	normalize-ua  sets the User-Agent to NormalUserAgent
+//	strip-referer removes the Referer to another host than the request
+type httpRule struct {
+	action int
+	name   string //canonical
+	line   string //the header set, as written
+}
+
+type httpRules []httpRule
+
+func parseHTTPRules(lines []string) (*httpRules, error) {
+	if len(lines) == 0 {
+		return nil, nil
+	}
+	var rules httpRules
+	for _, line := range lines {
+		switch {
+		case line == "normalize-ua":
+			rules = append(rules, httpRule{action: HTTP_UA, name: "User-Agent"})
+		case line == "strip-referer":
+			rules = append(rules, httpRule{action: HTTP_REFERER, name: "Referer"})
+		case strings.HasPrefix(line, "-"):
+			name := strings.TrimSpace(line[1:])
+			if name == "" || strings.ContainsAny(name, ": \t") {
+				return nil, errors.New("bad header rule: " + line)
+			}
+			rules = append(rules, httpRule{action: HTTP_DEL, name: textproto.CanonicalMIMEHeaderKey(name)})
+		default:
+			colon := strings.IndexByte(line, ':')
+			if colon <= 0 || strings.ContainsAny(line[:colon], " \t") || strings.ContainsAny(line, "\r\n") {
+				return nil, errors.New("bad header rule: " + line)
+			}
+			rules = append(rules, httpRule{
+				action: HTTP_SET,
+				name:   textproto.CanonicalMIMEHeaderKey(line[:colon]),
+				line:   line[:colon] + ": " + strings.TrimSpace(line[colon+1:]),
+			})
+		}
+	}
+	return &rules, nil
+}
+
+// rewrite applies the rules to the head of a request, its request line
+// and header lines up to the empty line; the lines that are kept keep
+// their order and case
+func (rules httpRules) rewrite(head []byte) []byte {
+	lines := strings.SplitAfter(string(head), "\n")
+	// the request line, the headers and the empty line that ends them
+	request, end := lines[0], lines[len(lines)-1]
+	if end == "" && len(lines) > 1 {
+		end = lines[len(lines)-2]
+		lines = lines[:len(lines)-1]
+	}
+	headers := lines[1 : len(lines)-1]
+
+	host := ""
+	for _, line := range headers {
+		if name, value := headerLine(line); name == "Host" {
+			host, _ = splitHostPort(value)
+		}
+	}
+
+	for _, rule := range rules {
+		var kept []string
+		for i := 0; i < len(headers); i++ {
+			name, value := headerLine(headers[i])
+			drop := false
+			switch rule.action {
+			case HTTP_DEL, HTTP_SET, HTTP_UA:
+				drop = name == rule.name
+			case HTTP_REFERER:
+				drop = name == rule.name && !sameHost(value, host)
+			}
+			if drop {
+				// and the lines folded into it
+				for i+1 < len(headers) && (headers[i+1][0] == ' ' || headers[i+1][0] == '\t') {
+					i++
+				}
+				continue
+			}
+			kept = append(kept, headers[i])
+		}
+		headers = kept
+
+		switch rule.action {
+		case HTTP_SET:
+			headers = append(headers, rule.line+"\r\n")
+		case HTTP_UA:
+			headers = append(headers, "User-Agent: "+NormalUserAgent+"\r\n")
+		}
+	}
+
+	var b bytes.Buffer
+	b.WriteString(request)
+	for _, line := range headers {
+		b.WriteString(line)
+	}
+	b.WriteString(end)
+	return b.Bytes()
+}
+
+// the canonical name and the value of a header line, "" for a folded line
+func headerLine(line string) (string, string) {
+	if line == "" || line[0] == ' ' || line[0] == '\t' {
+		return "", ""
+	}
+	colon := strings.IndexByte(line, ':')
+	if colon <= 0 {
+		return "", ""
+	}
+	return textproto.CanonicalMIMEHeaderKey(line[:colon]), strings.TrimSpace(line[colon+1:])
+}
+
+// a referer URL is of host or one of its subdomains
+func sameHost(referer string, host string) bool {
+	start := strings.Index(referer, "://")
+	if start == -1 || host == "" {
+		return false
+	}
+	name := referer[start+3:]
+	if end := strings.IndexAny(name, "/?#"); end != -1 {
+		name = name[:end]
+	}
+	name, _ = splitHostPort(name)
+	name, host = strings.ToLower(name), strings.ToLower(host)
+	return name == host || strings.HasSuffix(name, "."+host)
+}
+
+// httpConn rewrites the heads of the requests read from a client with
+// the header rules of its interface, the bodies, chunked or not, and
+// the stream after an upgrade pass unchanged
+type httpConn struct {
+	net.Conn
+	rules  *httpRules
+	reader *bufio.Reader
+
+	out     []byte //rewritten bytes not read yet
+	remain  int64  //bytes of the body that pass unchanged
+	chunked bool
+	raw     bool //the rest of the stream passes unchanged
+}
+
+// newHTTPConn reads the requests of client, header is what was already
+// read from it
+func newHTTPConn(client net.Conn, header []byte, rules *httpRules) *httpConn {
+	return &httpConn{
+		Conn:   client,
+		rules:  rules,
+		reader: bufio.NewReader(io.MultiReader(bytes.NewReader(header), client)),
+	}
+}
+
+// head returns the rewritten head of the first request
+func (c *httpConn) head() ([]byte, error) {
+	if len(c.out) == 0 {
+		err := c.nextRequest()
+		if err != nil {
+			return nil, err
+		}
+	}
+	head := c.out
+	c.out = nil
+	return head, nil
+}
+
+func (c *httpConn) Read(b []byte) (int, error) {
+	for len(c.out) == 0 {
+		if c.raw {
+			return c.reader.Read(b)
+		}
+		if c.remain > 0 {
+			if int64(len(b)) > c.remain {
+				b = b[:c.remain]
+			}
+			n, err := c.reader.Read(b)
+			c.remain -= int64(n)
+			return n, err
+		}
+		var err error
+		if c.chunked {
+			err = c.nextChunk()
+		} else {
+			err = c.nextRequest()
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, c.out)
+	c.out = c.out[n:]
+	return n, nil
+}
+
+// readLine returns the next line with its end, a line that does not fit
+// in the buffer switches to raw
+func (c *httpConn) readLine() ([]byte, error) {
+	line, err := c.reader.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		c.raw = true
+		return append([]byte(nil), line...), nil
+	}
+	return append([]byte(nil), line...), err
+}
+
+func emptyLine(line []byte) bool {
+	return string(line) == "\r\n" || string(line) == "\n"
+}
+
+func (c *httpConn) nextRequest() error {
+	var head []byte
+	for {
+		line, err := c.readLine()
+		if len(head) == 0 && emptyLine(line) {
+			continue //between requests
+		}
+		head = append(head, line...)
+		if err != nil || c.raw || len(head) > httpMaxHead {
+			if len(head) == 0 {
+				return err
+			}
+			c.out, c.raw = head, true
+			return nil
+		}
+		if emptyLine(line) {
+			break
+		}
+	}
+	if DetectProtocol(head) != "http" {
+		c.out, c.raw = head, true
+		return nil
+	}
+
+	c.out = c.rules.rewrite(head)
+
+	// the body of the request
+	if bytes.HasPrefix(head, []byte("CONNECT ")) {
+		c.raw = true
+	}
+	for _, line := range strings.Split(string(c.out), "\n") {
+		name, value := headerLine(line)
+		switch name {
+		case "Upgrade":
+			c.raw = true
+		case "Transfer-Encoding":
+			c.chunked = strings.HasSuffix(strings.ToLower(value), "chunked")
+		case "Content-Length":
+			c.remain, _ = strconv.ParseInt(value, 10, 64)
+		}
+	}
+	if c.chunked {
+		c.remain = 0
+	}
+	return nil
+}
+
+func (c *httpConn) nextChunk() error {
+	line, err := c.readLine()
+	c.out = line
+	if err != nil || c.raw {
+		if len(line) == 0 {
+			return err
+		}
+		c.raw = true
+		return nil
+	}
+	size := strings.TrimSpace(strings.SplitN(string(line), ";", 2)[0])
+	n, err := strconv.ParseInt(size, 16, 64)
+	if err != nil || n < 0 {
+		c.raw = true
+		return nil
+	}
+	if n > 0 {
+		c.remain = n + 2 //and its CRLF
+		return nil
+	}
+
+	// the trailers up to the empty line
+	c.chunked = false
+	for !emptyLine(line) {
+		line, err = c.readLine()
+		c.out = append(c.out, line...)
+		if err != nil || c.raw {
+			c.raw = true
+			return nil
+		}
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package phantomtcp
+
+import (
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseHTTPRules(t *testing.T) {
+	tests := []struct {
+		lines []string
+		rules httpRules
+		ok    bool
+	}{
+		{nil, nil, true},
+		{[]string{"-x-forwarded-for"}, httpRules{{action: HTTP_DEL, name: "X-Forwarded-For"}}, true},
+		{[]string{"DNT:1", "normalize-ua", "strip-referer"}, httpRules{
+			{action: HTTP_SET, name: "Dnt", line: "DNT: 1"},
+			{action: HTTP_UA, name: "User-Agent"},
+			{action: HTTP_REFERER, name: "Referer"},
+		}, true},
+		{[]string{"-"}, nil, false},
+		{[]string{"-X Header"}, nil, false},
+		{[]string{"-Via: 1"}, nil, false},
+		{[]string{": value"}, nil, false},
+		{[]string{"Bad Name: value"}, nil, false},
+		{[]string{"no colon"}, nil, false},
+	}
+	for _, tt := range tests {
+		rules, err := parseHTTPRules(tt.lines)
+		if (err == nil) != tt.ok {
+			t.Errorf("%q: %v", tt.lines, err)
+			continue
+		}
+		if !tt.ok {
+			continue
+		}
+		if (rules == nil) != (tt.rules == nil) || (rules != nil && !reflect.DeepEqual(*rules, tt.rules)) {
+			t.Errorf("%q: %v, want %v", tt.lines, rules, tt.rules)
+		}
+	}
+}
+
+func TestHTTPRulesRewrite(t *testing.T) {
+	head := "GET /a HTTP/1.1\r\nHost: www.example.com:8080\r\nuser-agent: curl/8.0\r\nX-Long: a\r\n b\r\nReferer: https://other.com/page\r\nAccept: */*\r\n\r\n"
+	tests := []struct {
+		lines []string
+		want  string
+	}{
+		{[]string{"-x-long"}, "GET /a HTTP/1.1\r\nHost: www.example.com:8080\r\nuser-agent: curl/8.0\r\nReferer: https://other.com/page\r\nAccept: */*\r\n\r\n"},
+		{[]string{"Accept: text/html"}, "GET /a HTTP/1.1\r\nHost: www.example.com:8080\r\nuser-agent: curl/8.0\r\nX-Long: a\r\n b\r\nReferer: https://other.com/page\r\nAccept: text/html\r\n\r\n"},
+		{[]string{"normalize-ua", "strip-referer"}, "GET /a HTTP/1.1\r\nHost: www.example.com:8080\r\nX-Long: a\r\n b\r\nAccept: */*\r\nUser-Agent: " + NormalUserAgent + "\r\n\r\n"},
+		{[]string{"-Missing"}, head},
+	}
+	for _, tt := range tests {
+		rules, err := parseHTTPRules(tt.lines)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(rules.rewrite([]byte(head))); got != tt.want {
+			t.Errorf("%q:\n%q, want\n%q", tt.lines, got, tt.want)
+		}
+	}
+}
+
+func TestSameHost(t *testing.T) {
+	tests := []struct {
+		referer string
+		host    string
+		same    bool
+	}{
+		{"https://example.com/", "example.com", true},
+		{"http://WWW.example.com:8080/a?b", "example.com", true},
+		{"https://example.com.evil.net/", "example.com", false},
+		{"https://notexample.com/", "example.com", false},
+		{"example.com", "example.com", false},
+		{"https://example.com/", "", false},
+	}
+	for _, tt := range tests {
+		if same := sameHost(tt.referer, tt.host); same != tt.same {
+			t.Errorf("%q %q: %v", tt.referer, tt.host, same)
+		}
+	}
+}
+
+// the requests of a keep-alive connection are rewritten, their bodies
+// pass unchanged
+func TestHTTPConnRequests(t *testing.T) {
+	rules, err := parseHTTPRules([]string{"-Cookie"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream := "POST /a HTTP/1.1\r\nHost: a.com\r\nCookie: x\r\nContent-Length: 21\r\n\r\nCookie: in the body\r\n" +
+		"POST /b HTTP/1.1\r\nHost: a.com\r\nTransfer-Encoding: chunked\r\n\r\n9\r\nCookie: y\r\n0\r\nCookie: trailer\r\n\r\n" +
+		"\r\nGET /c HTTP/1.1\r\nHost: a.com\r\nCookie: z\r\nUpgrade: websocket\r\n\r\nCookie: raw\r\n"
+	want := "POST /a HTTP/1.1\r\nHost: a.com\r\nContent-Length: 21\r\n\r\nCookie: in the body\r\n" +
+		"POST /b HTTP/1.1\r\nHost: a.com\r\nTransfer-Encoding: chunked\r\n\r\n9\r\nCookie: y\r\n0\r\nCookie: trailer\r\n\r\n" +
+		"GET /c HTTP/1.1\r\nHost: a.com\r\nUpgrade: websocket\r\n\r\nCookie: raw\r\n"
+
+	client, peer := net.Pipe()
+	peer.Close()
+	conn := newHTTPConn(client, []byte(stream), rules)
+	head, err := conn.head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rest, err := io.ReadAll(conn)
+	if err != nil && err != io.ErrClosedPipe {
+		t.Fatal(err)
+	}
+	if got := string(head) + string(rest); got != want {
+		t.Errorf("\n%q, want\n%q", got, want)
+	}
+
+	// other protocols pass unchanged
+	client, peer = net.Pipe()
+	peer.Close()
+	conn = newHTTPConn(client, []byte("SSH-2.0-OpenSSH\r\nCookie: x\r\n\r\n"), rules)
+	head, _ = conn.head()
+	if !strings.HasPrefix(string(head), "SSH-2.0") || !conn.raw {
+		t.Errorf("not HTTP: %q", head)
+	}
+}
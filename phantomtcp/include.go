@@ -0,0 +1,269 @@
+package phantomtcp
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// the verified copies of the fragments of include= lines are kept in
+// IncludeCacheDir, they are downloaded again when older than
+// IncludeRefreshInterval and used as they are while the source fails
+var IncludeCacheDir = "include"
+var IncludeRefreshInterval = time.Hour * 24
+
+// fragments may include others up to that depth
+const includeMaxDepth = 4
+
+// a rule fragment of an include= line, a file, or an URL with the
+// SHA256 of its content or the minisign public key that signs it
+type include struct {
+	source   string
+	sha256   string //hex
+	minisign string //base64 public key
+}
+
+var includeLock sync.Mutex
+var includes = make(map[string]include) //by the file read, its cache file for an URL
+var includeRefresh sync.Once
+
+// include=source[,sha256=hex|,minisign=key]
+func parseInclude(value string) (include, error) {
+	fields := strings.Split(value, ",")
+	inc := include{source: fields[0]}
+	for _, field := range fields[1:] {
+		kv := strings.SplitN(field, "=", 2)
+		switch {
+		case len(kv) == 2 && kv[0] == "sha256":
+			inc.sha256 = strings.ToLower(kv[1])
+		case len(kv) == 2 && kv[0] == "minisign":
+			inc.minisign = kv[1]
+		default:
+			return inc, fmt.Errorf("bad include option %s", field)
+		}
+	}
+	if inc.source == "" {
+		return inc, errors.New("include without a source")
+	}
+	if inc.remote() && inc.sha256 == "" && inc.minisign == "" {
+		return inc, errors.New("include of an URL needs sha256= or minisign=")
+	}
+	return inc, nil
+}
+
+func (inc include) remote() bool {
+	return strings.Contains(inc.source, "://")
+}
+
+// the cache file of the fragment, another hash or key gets another file
+func (inc include) cacheFile() string {
+	sum := sha256.Sum256([]byte(inc.source + "," + inc.sha256 + "," + inc.minisign))
+	return filepath.Join(IncludeCacheDir, hex.EncodeToString(sum[:8])+".conf")
+}
+
+// verify checks data against the hash or the signature of the include
+func (inc include) verify(data []byte) error {
+	if inc.sha256 != "" {
+		sum := sha256.Sum256(data)
+		if hex.EncodeToString(sum[:]) != inc.sha256 {
+			return errors.New(inc.source + ": sha256 mismatch")
+		}
+	}
+	if inc.minisign != "" {
+		sig, err := readAll(inc.source + ".minisig")
+		if err != nil {
+			return err
+		}
+		err = verifyMinisign(data, sig, inc.minisign)
+		if err != nil {
+			return errors.New(inc.source + ": " + err.Error())
+		}
+	}
+	return nil
+}
+
+// fetch downloads the fragment and writes it to its cache file once it
+// is verified, changed tells if the cache file was changed
+func (inc include) fetch() (changed bool, err error) {
+	data, err := readAll(inc.source)
+	if err != nil {
+		return false, err
+	}
+	err = inc.verify(data)
+	if err != nil {
+		return false, err
+	}
+
+	path := inc.cacheFile()
+	current, err := os.ReadFile(path)
+	if err == nil && bytes.Equal(current, data) {
+		// only touched, so it is not downloaded again before it is due
+		now := time.Now()
+		return false, os.Chtimes(path, now, now)
+	}
+	err = os.MkdirAll(IncludeCacheDir, 0755)
+	if err != nil {
+		return false, err
+	}
+	tmp := path + ".tmp"
+	err = os.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return false, err
+	}
+	return true, os.Rename(tmp, path)
+}
+
+func readAll(source string) ([]byte, error) {
+	file, err := openFilter(source)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(file)
+}
+
+// LoadInclude reads the rules of an include= line: a file, or a
+// fragment downloaded from an URL, verified with its SHA256 or minisign
+// signature (source.minisig) and cached. A fragment that cannot be
+// downloaded or verified is read from the cache, and skipped until the
+// next refresh without one.
+func (profile *PhantomProfile) LoadInclude(value string) error {
+	inc, err := parseInclude(value)
+	if err != nil {
+		return err
+	}
+	if profile.includeDepth >= includeMaxDepth {
+		return errors.New(inc.source + ": includes nested too deep")
+	}
+
+	var data []byte
+	if !inc.remote() {
+		includeLock.Lock()
+		includes[inc.source] = inc
+		includeLock.Unlock()
+		data, err = os.ReadFile(inc.source)
+		if err == nil {
+			err = inc.verify(data)
+		}
+		if err != nil {
+			return err
+		}
+	} else {
+		path := inc.cacheFile()
+		includeLock.Lock()
+		includes[path] = inc
+		includeLock.Unlock()
+		includeRefresh.Do(func() {
+			go refreshIncludes()
+		})
+
+		info, err := os.Stat(path)
+		if err != nil || time.Since(info.ModTime()) > IncludeRefreshInterval {
+			if _, err := inc.fetch(); err != nil {
+				logPrintln(1, "include:", err)
+			}
+		}
+		data, err = os.ReadFile(path)
+		if err != nil {
+			logPrintln(1, "include:", inc.source, "has no verified copy, it is skipped")
+			return nil
+		}
+	}
+
+	profile.includeDepth++
+	defer func() { profile.includeDepth-- }()
+	return profile.ReadProfile(bytes.NewReader(data), inc.source)
+}
+
+// IncludeFiles returns the included files and the cache files of the
+// fragments from URLs, a refresh that changes one is applied like a
+// changed rules file
+func IncludeFiles() []string {
+	includeLock.Lock()
+	defer includeLock.Unlock()
+	files := make([]string, 0, len(includes))
+	for path := range includes {
+		files = append(files, path)
+	}
+	return files
+}
+
+// download the fragments again every IncludeRefreshInterval, a fragment
+// that fails keeps its cache file
+func refreshIncludes() {
+	for {
+		time.Sleep(IncludeRefreshInterval)
+
+		includeLock.Lock()
+		list := make([]include, 0, len(includes))
+		for _, inc := range includes {
+			if inc.remote() {
+				list = append(list, inc)
+			}
+		}
+		includeLock.Unlock()
+
+		for _, inc := range list {
+			changed, err := inc.fetch()
+			if err != nil {
+				logPrintln(1, "include refresh:", err)
+			} else if changed {
+				logPrintln(1, "include refresh:", inc.source, "changed")
+			}
+		}
+	}
+}
+
+// verifyMinisign checks a minisign signature file of data, key is the
+// base64 public key of minisign.pub; legacy and prehashed signatures and
+// their trusted comment are verified
+func verifyMinisign(data []byte, sig []byte, key string) error {
+	pub, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(pub) != 42 || string(pub[:2]) != "Ed" {
+		return errors.New("bad minisign key")
+	}
+	lines := strings.Split(strings.ReplaceAll(string(sig), "\r", ""), "\n")
+	if len(lines) < 4 || !strings.HasPrefix(lines[2], "trusted comment: ") {
+		return errors.New("bad minisign signature")
+	}
+	s, err := base64.StdEncoding.DecodeString(lines[1])
+	if err != nil || len(s) != 74 {
+		return errors.New("bad minisign signature")
+	}
+	if !bytes.Equal(s[2:10], pub[2:10]) {
+		return errors.New("minisign signature of another key")
+	}
+
+	message := data
+	switch string(s[:2]) {
+	case "Ed":
+	case "ED":
+		hash := blake2b.Sum512(data)
+		message = hash[:]
+	default:
+		return errors.New("unknown minisign algorithm")
+	}
+	publicKey := ed25519.PublicKey(pub[10:])
+	if !ed25519.Verify(publicKey, message, s[10:]) {
+		return errors.New("bad minisign signature")
+	}
+
+	global, err := base64.StdEncoding.DecodeString(lines[3])
+	comment := strings.TrimPrefix(lines[2], "trusted comment: ")
+	if err != nil || !ed25519.Verify(publicKey, append(append([]byte(nil), s[10:]...), comment...), global) {
+		return errors.New("bad minisign trusted comment")
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package phantomtcp
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// minisignFixture signs data as minisign does, legacy with "Ed" and
+// prehashed with "ED", and returns the public key and the signature file
+func minisignFixture(data []byte, algorithm, comment string) (string, string) {
+	key := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+	keyID := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	pub := append(append([]byte("Ed"), keyID...), key.Public().(ed25519.PublicKey)...)
+
+	message := data
+	if algorithm == "ED" {
+		hash := blake2b.Sum512(data)
+		message = hash[:]
+	}
+	sig := ed25519.Sign(key, message)
+	global := ed25519.Sign(key, append(append([]byte(nil), sig...), comment...))
+	file := "untrusted comment: signature from minisign secret key\n" +
+		base64.StdEncoding.EncodeToString(append(append([]byte(algorithm), keyID...), sig...)) + "\n" +
+		"trusted comment: " + comment + "\n" +
+		base64.StdEncoding.EncodeToString(global) + "\n"
+	return base64.StdEncoding.EncodeToString(pub), file
+}
+
+func TestVerifyMinisign(t *testing.T) {
+	data := []byte("example.com\n")
+	key, legacy := minisignFixture(data, "Ed", "timestamp:1700000000")
+	_, prehashed := minisignFixture(data, "ED", "timestamp:1700000000\tfile:rules.conf")
+	_, unknown := minisignFixture(data, "Ex", "timestamp:1700000000")
+
+	otherKey, _ := base64.StdEncoding.DecodeString(key)
+	otherKey[2] ^= 1
+	lines := strings.Split(legacy, "\n")
+
+	tests := []struct {
+		name string
+		data []byte
+		sig  string
+		key  string
+		ok   bool
+	}{
+		{"legacy", data, legacy, key, true},
+		{"prehashed", data, prehashed, key, true},
+		{"crlf", data, strings.ReplaceAll(prehashed, "\n", "\r\n"), key, true},
+		{"altered data", []byte("example.org\n"), prehashed, key, false},
+		{"another key", data, legacy, base64.StdEncoding.EncodeToString(otherKey), false},
+		{"bad key", data, legacy, "RWQ=", false},
+		{"altered trusted comment", data, strings.Replace(legacy, "timestamp:1", "timestamp:2", 1), key, false},
+		{"no trusted comment", data, strings.Join([]string{lines[0], lines[1], lines[3], ""}, "\n"), key, false},
+		{"truncated", data, strings.Join(lines[:2], "\n"), key, false},
+		{"unknown algorithm", data, unknown, key, false},
+	}
+	for _, tt := range tests {
+		if err := verifyMinisign(tt.data, []byte(tt.sig), tt.key); (err == nil) != tt.ok {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+	}
+}
+
+func TestParseInclude(t *testing.T) {
+	tests := []struct {
+		value string
+		want  include
+		ok    bool
+	}{
+		{"rules.conf", include{source: "rules.conf"}, true},
+		{"https://example.com/a.conf,sha256=ABCD", include{source: "https://example.com/a.conf", sha256: "abcd"}, true},
+		{"https://example.com/a.conf,minisign=RWQ=", include{source: "https://example.com/a.conf", minisign: "RWQ="}, true},
+		{"https://example.com/a.conf", include{}, false},
+		{"rules.conf,md5=abcd", include{}, false},
+		{",sha256=abcd", include{}, false},
+	}
+	for _, tt := range tests {
+		inc, err := parseInclude(tt.value)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: %v", tt.value, err)
+			continue
+		}
+		if tt.ok && inc != tt.want {
+			t.Errorf("%s: %+v, want %+v", tt.value, inc, tt.want)
+		}
+	}
+}
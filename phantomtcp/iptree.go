@@ -0,0 +1,71 @@
+package phantomtcp
+
+import (
+	"net"
+)
+
+// the CIDR entries of the rules: 1.0.0.0/8 covers the addresses of the
+// range, an address without an entry of its own gets the longest prefix
+// that contains it. IPv4 and IPv4-mapped IPv6 addresses share a tree.
+type ipTree struct {
+	v4, v6 ipNode
+	size   int
+}
+
+// a node of the bits of the prefixes, the first bit first
+type ipNode struct {
+	children [2]*ipNode
+	key      string //the network that ends here
+}
+
+// add adds the network ipnet as key
+func (t *ipTree) add(ipnet *net.IPNet, key string) {
+	ones, _ := ipnet.Mask.Size()
+	ip := ipnet.IP
+	node := &t.v6
+	if ip4 := ip.To4(); ip4 != nil {
+		if len(ipnet.Mask) == net.IPv6len {
+			ones -= 96 //::ffff:0:0/96
+		}
+		ip, node = ip4, &t.v4
+	}
+	for i := 0; i < ones; i++ {
+		bit := ip[i/8] >> (7 - i%8) & 1
+		if node.children[bit] == nil {
+			node.children[bit] = &ipNode{}
+		}
+		node = node.children[bit]
+	}
+	if node.key == "" {
+		t.size++
+	}
+	node.key = key
+}
+
+// match returns the key of the longest network that contains the address
+// name, "" when name is not an address or no network contains it
+func (t *ipTree) match(name string) string {
+	if t.size == 0 {
+		return ""
+	}
+	ip := net.ParseIP(name)
+	if ip == nil {
+		return ""
+	}
+	node := &t.v6
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, node = ip4, &t.v4
+	}
+
+	key := node.key
+	for i := 0; i < len(ip)*8; i++ {
+		node = node.children[ip[i/8]>>(7-i%8)&1]
+		if node == nil {
+			break
+		}
+		if node.key != "" {
+			key = node.key
+		}
+	}
+	return key
+}
@@ -0,0 +1,76 @@
+package phantomtcp
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestIPTreeMatch(t *testing.T) {
+	var tree ipTree
+	for _, cidr := range []string{"1.0.0.0/8", "1.2.3.0/24", "1.2.3.4/32", "0.0.0.0/0", "2001:db8::/32", "2001:db8:1::/48", "::ffff:9.9.0.0/112"} {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tree.add(ipnet, ipnet.String())
+	}
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"1.2.3.4", "1.2.3.4/32"},
+		{"1.2.3.5", "1.2.3.0/24"},
+		{"1.2.4.1", "1.0.0.0/8"},
+		{"8.8.8.8", "0.0.0.0/0"},
+		{"::ffff:1.2.3.9", "1.2.3.0/24"},
+		{"9.9.1.1", "9.9.0.0/16"},
+		{"2001:db8:1::1", "2001:db8:1::/48"},
+		{"2001:db8:2::1", "2001:db8::/32"},
+		{"2001:db9::1", ""},
+		{"example.com", ""},
+		{"1.2.3", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := tree.match(tt.name); got != tt.want {
+			t.Errorf("%q: %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	var empty ipTree
+	if got := empty.match("1.2.3.4"); got != "" {
+		t.Errorf("empty tree: %q", got)
+	}
+}
+
+func TestReadProfileNetworks(t *testing.T) {
+	profile, _, err := NewProfile([]InterfaceConfig{{Name: "wide", DNS: "udp://8.8.8.8:53"}, {Name: "narrow", DNS: "udp://1.1.1.1:53"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules := "[wide]\n1.0.0.0/8\n2001:db8::/32\n[narrow]\n1.2.3.0/24\n1.2.3.99/16\n"
+	if err := profile.ReadProfile(strings.NewReader(rules), "networks"); err != nil {
+		t.Fatal(err)
+	}
+	wide, narrow := profile.Rules().DomainMap["1.0.0.0/8"], profile.Rules().DomainMap["1.2.3.0/24"]
+	if wide == nil || narrow == nil || wide == narrow {
+		t.Fatalf("ranges not loaded: %v", profile.Rules().DomainMap)
+	}
+
+	tests := []struct {
+		addr string
+		want *PhantomInterface
+	}{
+		{"1.2.3.4", narrow},
+		{"1.9.9.9", wide},
+		{"1.2.200.1", narrow}, //1.2.3.99/16 is 1.2.0.0/16
+		{"2001:db8::1", wide},
+		{"2.2.2.2", nil},
+	}
+	for _, tt := range tests {
+		if got := profile.Rules().GetInterface(tt.addr); got != tt.want {
+			t.Errorf("%s: %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+}
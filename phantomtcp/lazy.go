@@ -0,0 +1,56 @@
+package phantomtcp
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// the lazy hint connects without modifying the payload first, a server
+// that does not answer it in LazyTimeout or whose connection is reset or
+// closed is dialed with the methods of the interface, and so are its
+// connections for LazyMemory
+var LazyTimeout = time.Second * 3
+var LazyMemory = time.Hour
+
+var lazyHosts sync.Map
+
+func lazyKey(host string, port int) string {
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+func lazyBlocked(host string, port int) bool {
+	key := lazyKey(host, port)
+	until, ok := lazyHosts.Load(key)
+	if !ok {
+		return false
+	}
+	if time.Now().Unix() < until.(int64) {
+		return true
+	}
+	lazyHosts.Delete(key)
+	return false
+}
+
+// dialLazy sends b on a plain connection and waits for the first answer
+// of the server, the answer is read again from the connection returned
+func (pface *PhantomInterface) dialLazy(host string, port int, b []byte) (net.Conn, error) {
+	conn, err := pface.DialPlain(host, port, b)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(LazyTimeout))
+	_, err = reader.Peek(1)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		lazyHosts.Store(lazyKey(host, port), time.Now().Add(LazyMemory).Unix())
+		return nil, err
+	}
+	logPrintln(3, "lazy:", host, port, "plain")
+	return &bufferedConn{conn, reader}, nil
+}
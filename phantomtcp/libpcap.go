@@ -0,0 +1,151 @@
+//go:build pcap
+// +build pcap
+
+package phantomtcp
+
+import (
+	"fmt"
+	"log"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+// above that many targets their addresses are widened to networks
+const pcapFilterMaxTargets = 256
+const pcapSynFilter = "(ip6[6]==6 and ip6[53]&2==2) or (tcp[13]&2==2)"
+
+// SYNs inside 802.1Q and PPPoE session frames, matched by raw link offsets
+// so that the vlan and pppoes keywords do not shift the rest of the filter
+const pcapEncapSynFilter = "(ether[12:2]==0x8100 and ((ether[16:2]==0x0800 and ether[27]==6 and ether[18+((ether[18]&0xf)<<2)+13]&2==2) or (ether[16:2]==0x86dd and ether[24]==6 and ether[71]&2==2)))" +
+	" or (ether[12:2]==0x8864 and ((ether[20:2]==0x0021 and ether[31]==6 and ether[22+((ether[22]&0xf)<<2)+13]&2==2) or (ether[20:2]==0x0057 and ether[28]==6 and ether[75]&2==2)))"
+
+func pcapTargetFilter(target CaptureTarget) string {
+	var filter string
+	if target.Host() {
+		filter = "host " + target.Net.IP.String()
+	} else if target.Net != nil {
+		filter = "net " + target.Net.String()
+	}
+	if target.Port != 0 {
+		if filter != "" {
+			filter += " and "
+		}
+		filter += "port " + strconv.Itoa(target.Port)
+	}
+	return filter
+}
+
+// getBPFFilter matches the SYNs of targets, of every address without them;
+// encapsulated SYNs are matched without the targets
+func getBPFFilter(linkType layers.LinkType, targets []CaptureTarget) string {
+	var filter strings.Builder
+	if len(targets) == 0 || (len(targets) == 1 && targets[0] == (CaptureTarget{})) {
+		filter.WriteString("(" + pcapSynFilter + ")")
+	} else {
+		filter.WriteString("((" + pcapSynFilter + ") and (")
+		for i, target := range targets {
+			if i > 0 {
+				filter.WriteString(" or ")
+			}
+			filter.WriteString("(" + pcapTargetFilter(target) + ")")
+		}
+		filter.WriteString("))")
+	}
+	if linkType == layers.LinkTypeEthernet {
+		filter.WriteString(" or " + pcapEncapSynFilter)
+	}
+
+	return filter.String()
+}
+
+// a live capture read with a timeout, Close waits for the reader and
+// a handle blocking until the next packet could not be closed
+type liveHandle struct {
+	*pcap.Handle
+}
+
+func (handle liveHandle) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	for {
+		data, ci, err := handle.Handle.ReadPacketData()
+		if err != pcap.NextErrorTimeoutExpired {
+			return data, ci, err
+		}
+	}
+}
+
+// a new handle captures every SYN until there are addresses to narrow
+// its filter to
+func openCaptureHandle(device string) (captureHandle, error) {
+	snapLen := int32(65535)
+	handle, err := pcap.OpenLive(device, snapLen, true, time.Second)
+	if err != nil {
+		return nil, err
+	}
+	err = handle.SetBPFFilter(getBPFFilter(handle.LinkType(), nil))
+	if err != nil {
+		handle.Close()
+		return nil, err
+	}
+	return liveHandle{handle}, nil
+}
+
+// setCaptureFilter leaves the filter as it is when nothing is to be
+// captured, rules removed by a reload do not stop the capture
+func setCaptureFilter(handle captureHandle) error {
+	targets := CaptureTargets(pcapFilterMaxTargets)
+	if len(targets) == 0 {
+		return nil
+	}
+	filter := getBPFFilter(handle.LinkType(), targets)
+	err := handle.(liveHandle).SetBPFFilter(filter)
+	if err != nil {
+		return err
+	}
+	logPrintln(2, "bpf filter:", filter)
+	return nil
+}
+
+func DevicePrint() {
+	devices, err := pcap.FindAllDevs()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Println("Devices found:")
+	for _, device := range devices {
+		fmt.Println("\nName: ", device.Name)
+		fmt.Println("Description: ", device.Description)
+		fmt.Println("Devices addresses: ", device.Description)
+		for _, address := range device.Addresses {
+			fmt.Println("- IP address: ", address.IP)
+			fmt.Println("- Subnet mask: ", address.Netmask)
+		}
+	}
+}
+
+// every device is opened once as the capture will
+func captureCheck(devices []string) []PreflightCheck {
+	fix := "run as root or setcap cap_net_raw,cap_net_admin+ep phantomsocks"
+	switch runtime.GOOS {
+	case "windows":
+		fix = "install Npcap and run as administrator"
+	case "darwin", "freebsd", "openbsd", "netbsd":
+		fix = "run as root or make /dev/bpf* readable"
+	}
+
+	var checks []PreflightCheck
+	for _, device := range devices {
+		handle, err := pcap.OpenLive(device, 64, false, time.Second)
+		if err == nil {
+			handle.Close()
+		}
+		checks = append(checks, newCheck("pcap "+device, err, fix))
+	}
+	return checks
+}
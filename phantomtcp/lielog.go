@@ -0,0 +1,114 @@
+package phantomtcp
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maximum number of client and name pairs kept in the lie log
+var LieLogSize = 4096
+
+// fake answers sent to a client for a name and the connections it made
+// to them, a client that gets lies but never connects resolves the name
+// elsewhere (DoH in the browser) or routes around the proxy
+type LieRecord struct {
+	Client         string `json:"client"`
+	Domain         string `json:"domain"`
+	Lies           int    `json:"lies"`
+	Connections    int    `json:"connections"`
+	LastLie        int64  `json:"lastlie,omitempty"`
+	LastConnection int64  `json:"lastconnection,omitempty"`
+}
+
+type lieLog struct {
+	lock    sync.Mutex
+	records map[string]*LieRecord
+}
+
+func (lies *lieLog) record(client net.IP, name string) *LieRecord {
+	key := client.String() + " " + name
+	if lies.records == nil {
+		lies.records = make(map[string]*LieRecord)
+	}
+	record, ok := lies.records[key]
+	if ok {
+		return record
+	}
+
+	if len(lies.records) >= LieLogSize {
+		var oldest string
+		var last int64 = 0
+		for k, r := range lies.records {
+			t := r.LastLie
+			if r.LastConnection > t {
+				t = r.LastConnection
+			}
+			if oldest == "" || t < last {
+				oldest, last = k, t
+			}
+		}
+		delete(lies.records, oldest)
+	}
+	record = &LieRecord{Client: client.String(), Domain: name}
+	lies.records[key] = record
+	return record
+}
+
+// logLie is called when a fake address of name is answered to client
+func (profile *PhantomProfile) logLie(client net.IP, name string, qtype int) {
+	if client == nil || LieLogSize <= 0 {
+		return
+	}
+	if qtype != 1 && qtype != 65 && (qtype != 28 || VirtualAddress(0, true) == nil) {
+		return
+	}
+
+	logPrintln(3, "lie:", client, name, qtype)
+	profile.lies.lock.Lock()
+	record := profile.lies.record(client, name)
+	record.Lies++
+	record.LastLie = time.Now().Unix()
+	profile.lies.lock.Unlock()
+}
+
+// logConnection is called when client connects to a fake address of name
+func (profile *PhantomProfile) logConnection(client net.Addr, name string) {
+	if LieLogSize <= 0 {
+		return
+	}
+	addr, ok := client.(*net.TCPAddr)
+	if !ok {
+		return
+	}
+
+	profile.lies.lock.Lock()
+	record := profile.lies.record(addr.IP, name)
+	if record.Lies == 0 {
+		logPrintln(4, "connection without lie:", addr.IP, name)
+	}
+	record.Connections++
+	record.LastConnection = time.Now().Unix()
+	profile.lies.lock.Unlock()
+}
+
+// LieLog returns the lies of client, or of all clients if it is empty
+func (profile *PhantomProfile) LieLog(client string) []LieRecord {
+	profile.lies.lock.Lock()
+	records := make([]LieRecord, 0, len(profile.lies.records))
+	for _, record := range profile.lies.records {
+		if client == "" || record.Client == client {
+			records = append(records, *record)
+		}
+	}
+	profile.lies.lock.Unlock()
+
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].Client != records[j].Client {
+			return records[i].Client < records[j].Client
+		}
+		return records[i].Domain < records[j].Domain
+	})
+	return records
+}
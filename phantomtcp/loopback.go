@@ -0,0 +1,90 @@
+package phantomtcp
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// connections to localhost and to the addresses of this machine go
+// straight to the local service in every mode: no rule, alias, fake
+// address or desync applies to them and they are never captured.
+// local-bypass=0 turns it off.
+var LocalBypass = true
+
+var ownAddresses atomic.Value //map[string]bool of localAddresses
+
+func refreshOwnAddresses(addrs map[string]bool) {
+	ownAddresses.Store(addrs)
+}
+
+// isLocalAddress tells if ip is a loopback, unspecified or own address
+func isLocalAddress(ip net.IP) bool {
+	if !LocalBypass || ip == nil {
+		return false
+	}
+	if ip.IsLoopback() || ip.IsUnspecified() {
+		return true
+	}
+	addrs, _ := ownAddresses.Load().(map[string]bool)
+	return addrs[ip.String()]
+}
+
+// isLocalHost tells if name is localhost (RFC 6761) or a local address
+func isLocalHost(name string) bool {
+	if !LocalBypass || name == "" {
+		return false
+	}
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if name == "localhost" || strings.HasSuffix(name, ".localhost") {
+		return true
+	}
+	return isLocalAddress(net.ParseIP(name))
+}
+
+// relayLocal connects client to the local service at host or addr
+func relayLocal(client net.Conn, addr *net.TCPAddr, host string, header []byte) {
+	if host == "" {
+		host = addr.IP.String()
+	} else if net.ParseIP(host) == nil {
+		host = "localhost"
+	}
+	logPrintln(2, "Redirect:", client.RemoteAddr(), "->", host, addr.Port, "local")
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, strconv.Itoa(addr.Port)), time.Second*5)
+	if err != nil {
+		logPrintln(1, host, err)
+		failReply(client, err)
+		return
+	}
+	defer conn.Close()
+	if len(header) > 0 {
+		_, err = conn.Write(header)
+		if err != nil {
+			logPrintln(1, host, err)
+			failReply(client, err)
+			return
+		}
+	}
+
+	client, err = unwrapReply(client)
+	if err != nil {
+		logPrintln(1, err)
+		return
+	}
+	relay(client, conn)
+}
+
+// localResponse answers the A and AAAA queries of localhost names with
+// the loopback addresses
+func localResponse(request []byte, name string, qtype int) []byte {
+	if (qtype != 1 && qtype != 28) || !isLocalHost(name) || net.ParseIP(name) != nil {
+		return nil
+	}
+	records := DNSRecords{
+		IPv4Hint: &RecordAddresses{0, []net.IP{net.IPv4(127, 0, 0, 1).To4()}},
+		IPv6Hint: &RecordAddresses{0, []net.IP{net.IPv6loopback}},
+	}
+	return records.BuildResponse(request, qtype, 60)
+}
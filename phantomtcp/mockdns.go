@@ -0,0 +1,229 @@
+package phantomtcp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// a zone of the mock: scheme, one record per line:
+//
+//	example.com A 1.2.3.4
+//	example.com 60 AAAA 2001:db8::1
+//	*.example.com CNAME example.com
+//	txt.example.com TXT "hello"
+//	gone.example.com NXDOMAIN
+//	down.example.com SERVFAIL
+//
+// *.name covers the subdomains of name that are not in the zone, other
+// names are NXDOMAIN. The TTL is 300 seconds unless it is given.
+type mockZone struct {
+	modTime time.Time
+	names   map[string][]mockRecord
+}
+
+type mockRecord struct {
+	rtype uint16
+	ttl   uint32
+	data  []byte //rdata, or the rcode of an error
+	name  string //the target of a CNAME
+}
+
+var mockZones = make(map[string]*mockZone)
+var mockLock sync.Mutex
+
+var mockTypes = map[string]uint16{"A": 1, "CNAME": 5, "TXT": 16, "AAAA": 28}
+var mockRcodes = map[string]byte{"SERVFAIL": 2, "NXDOMAIN": 3, "REFUSED": 5}
+
+func parseMockZone(r io.Reader) (*mockZone, error) {
+	zone := &mockZone{names: make(map[string][]mockRecord)}
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(strings.SplitN(scanner.Text(), "#", 2)[0])
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("mock: line %d: no record", line)
+		}
+		name := strings.ToLower(strings.TrimSuffix(fields[0], "."))
+		record := mockRecord{ttl: 300}
+		fields = fields[1:]
+		if ttl, err := strconv.ParseUint(fields[0], 10, 32); err == nil && len(fields) > 1 {
+			record.ttl = uint32(ttl)
+			fields = fields[1:]
+		}
+
+		rtype := strings.ToUpper(fields[0])
+		if rcode, ok := mockRcodes[rtype]; ok {
+			record.data = []byte{rcode}
+			zone.names[name] = append(zone.names[name], record)
+			continue
+		}
+		var ok bool
+		record.rtype, ok = mockTypes[rtype]
+		if !ok || len(fields) < 2 {
+			return nil, fmt.Errorf("mock: line %d: bad record", line)
+		}
+		value := strings.Join(fields[1:], " ")
+		switch record.rtype {
+		case 1, 28:
+			ip := net.ParseIP(value)
+			if ip == nil || (ip.To4() != nil) != (record.rtype == 1) {
+				return nil, fmt.Errorf("mock: line %d: bad address %s", line, value)
+			}
+			if record.rtype == 1 {
+				record.data = ip.To4()
+			} else {
+				record.data = ip.To16()
+			}
+		case 5:
+			record.name = strings.ToLower(strings.TrimSuffix(value, "."))
+			record.data = wireName(record.name)
+		case 16:
+			text := strings.Trim(value, "\"")
+			for len(text) > 0 {
+				n := len(text)
+				if n > 255 {
+					n = 255
+				}
+				record.data = append(record.data, byte(n))
+				record.data = append(record.data, text[:n]...)
+				text = text[n:]
+			}
+		}
+		zone.names[name] = append(zone.names[name], record)
+	}
+	return zone, scanner.Err()
+}
+
+// LoadMockZone serves zone as the answers of mock://name, zones that are
+// not loaded are read from the file name and read again when it changes
+func LoadMockZone(name string, zone io.Reader) error {
+	z, err := parseMockZone(zone)
+	if err != nil {
+		return err
+	}
+	mockLock.Lock()
+	mockZones[name] = z
+	mockLock.Unlock()
+	return nil
+}
+
+func getMockZone(name string) (*mockZone, error) {
+	mockLock.Lock()
+	defer mockLock.Unlock()
+	zone, ok := mockZones[name]
+	if ok && zone.modTime.IsZero() {
+		return zone, nil
+	}
+
+	info, err := os.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if ok && info.ModTime().Equal(zone.modTime) {
+		return zone, nil
+	}
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	zone, err = parseMockZone(file)
+	if err != nil {
+		return nil, err
+	}
+	zone.modTime = info.ModTime()
+	mockZones[name] = zone
+	logPrintln(2, "mock:", name, len(zone.names), "names")
+	return zone, nil
+}
+
+// the records of name, from the wildcards of its parents when it has none
+func (zone *mockZone) lookup(name string) ([]mockRecord, bool) {
+	if records, ok := zone.names[name]; ok {
+		return records, true
+	}
+	for offset := strings.Index(name, "."); offset != -1; {
+		if records, ok := zone.names["*"+name[offset:]]; ok {
+			return records, true
+		}
+		next := strings.Index(name[offset+1:], ".")
+		if next == -1 {
+			break
+		}
+		offset += next + 1
+	}
+	return nil, false
+}
+
+// MockLookup answers request from the zone of mock://host/path, the
+// zone is the file host/path, or mock:///path for an absolute path
+func MockLookup(request []byte, u *url.URL) ([]byte, error) {
+	zone, err := getMockZone(u.Host + u.Path)
+	if err != nil {
+		return nil, err
+	}
+	qname, qtype, end := GetQName(request)
+	if qname == "" {
+		return nil, errors.New("mock: bad request")
+	}
+
+	response := make([]byte, end, 512)
+	copy(response, request[:end])
+	binary.BigEndian.PutUint16(response[2:], 0x8180)
+	binary.BigEndian.PutUint16(response[6:], 0)
+	binary.BigEndian.PutUint16(response[8:], 0)
+	binary.BigEndian.PutUint16(response[10:], 0)
+
+	name := strings.ToLower(qname)
+	var rcode byte
+	count := 0
+	for hops := 0; hops < 8; hops++ {
+		records, ok := zone.lookup(name)
+		if !ok {
+			rcode = 3
+			break
+		}
+		cname := ""
+		for _, record := range records {
+			if record.rtype == 0 {
+				rcode = record.data[0]
+				break
+			}
+			if record.rtype != uint16(qtype) && record.rtype != 5 {
+				continue
+			}
+			response = append(response, wireName(name)...)
+			var header [10]byte
+			binary.BigEndian.PutUint16(header[0:], record.rtype)
+			binary.BigEndian.PutUint16(header[2:], 1)
+			binary.BigEndian.PutUint32(header[4:], record.ttl)
+			binary.BigEndian.PutUint16(header[8:], uint16(len(record.data)))
+			response = append(response, header[:]...)
+			response = append(response, record.data...)
+			count++
+			if record.rtype == 5 {
+				cname = record.name
+			}
+		}
+		if rcode != 0 || cname == "" || qtype == 5 {
+			break
+		}
+		name = cname
+	}
+	response[3] |= rcode
+	binary.BigEndian.PutUint16(response[6:], uint16(count))
+	logPrintln(4, "mock:", qname, qtype, count, rcode)
+	return response, nil
+}
@@ -0,0 +1,154 @@
+package phantomtcp
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"sync/atomic"
+	"time"
+)
+
+var AddressCheckInterval = time.Second * 10
+
+// script run after the WAN address, default route or IPv6 prefix changed
+var AddressHook string
+
+var autoECS atomic.Value
+var autoNAT64 atomic.Value
+
+func localAddresses() map[string]bool {
+	addrs := make(map[string]bool)
+	ifaddrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return addrs
+	}
+	for _, addr := range ifaddrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if ok {
+			addrs[ipnet.IP.String()] = true
+		}
+	}
+	return addrs
+}
+
+// source address of the default route, no packet is sent
+func routeSource(address string) net.IP {
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP
+}
+
+func GetAutoECS() string {
+	ecs, _ := autoECS.Load().(string)
+	return ecs
+}
+
+func GetNAT64Prefix() string {
+	prefix, _ := autoNAT64.Load().(string)
+	return prefix
+}
+
+// RFC 7050, the well-known name only has A records, a DNS64 server
+// synthesizes its AAAA record with the prefix, as 64:ff9b::/96
+func discoverNAT64Prefix() string {
+	ips, err := net.LookupIP("ipv4only.arpa")
+	if err != nil {
+		return ""
+	}
+	if prefix := nat64FromWKA(ips); prefix != nil {
+		return prefix.String()
+	}
+	return ""
+}
+
+// re-evaluate the state derived from the local network: ECS auto mode
+// and the DNS64 prefix, then run the hook
+func refreshAddressState() {
+	ecs := ""
+	if ip := routeSource("8.8.8.8:53"); ip != nil && !ip.IsPrivate() && !ip.IsLoopback() {
+		ecs = ip.String()
+	} else if ip := routeSource("[2001:4860:4860::8888]:53"); ip != nil && !ip.IsPrivate() {
+		ecs = ip.String()
+	}
+	autoECS.Store(ecs)
+	autoNAT64.Store(discoverNAT64Prefix())
+	refreshCLAT()
+	logPrintln(2, "ECS:", GetAutoECS(), "NAT64:", GetNAT64Prefix())
+
+	if AddressHook != "" {
+		cmd := exec.Command(AddressHook)
+		cmd.Env = append(os.Environ(), "PHANTOM_ECS="+GetAutoECS(), "PHANTOM_NAT64="+GetNAT64Prefix())
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			logPrintln(1, AddressHook, err)
+		}
+		logPrintln(3, string(out))
+	}
+}
+
+// watch the local addresses and default routes, when an address disappears
+// (DHCP renew, LTE handover) the relays bound to it are closed so that
+// clients reconnect at once, and the capture sockets are rebound
+func AddressMonitor() {
+	addrs := localAddresses()
+	refreshOwnAddresses(addrs)
+	route4 := routeSource("8.8.8.8:53")
+	route6 := routeSource("[2001:4860:4860::8888]:53")
+	refreshAddressState()
+	for {
+		time.Sleep(AddressCheckInterval)
+
+		current := localAddresses()
+		refreshOwnAddresses(current)
+		changed := false
+		if ip := routeSource("8.8.8.8:53"); !ip.Equal(route4) {
+			logPrintln(1, "Default route:", route4, "->", ip)
+			route4 = ip
+			changed = true
+		}
+		if ip := routeSource("[2001:4860:4860::8888]:53"); !ip.Equal(route6) {
+			logPrintln(1, "Default route:", route6, "->", ip)
+			route6 = ip
+			changed = true
+		}
+		for addr := range addrs {
+			if !current[addr] {
+				logPrintln(1, "Address removed:", addr)
+				changed = true
+			}
+		}
+		for addr := range current {
+			if !addrs[addr] {
+				logPrintln(1, "Address added:", addr)
+				changed = true
+			}
+		}
+		addrs = current
+
+		if !changed {
+			continue
+		}
+
+		relayConns.Range(func(key, value interface{}) bool {
+			conn := key.(net.Conn)
+			var ip net.IP
+			switch laddr := conn.LocalAddr().(type) {
+			case *net.TCPAddr:
+				ip = laddr.IP
+			case *net.UDPAddr:
+				ip = laddr.IP
+			}
+			if ip != nil && !ip.IsUnspecified() && !current[ip.String()] {
+				logPrintln(2, "Migrate:", conn.LocalAddr(), "->", conn.RemoteAddr())
+				value.(*relayInfo).stop(conn, time.Now())
+			}
+			return true
+		})
+
+		RebindCapture()
+		refreshAddressState()
+	}
+}
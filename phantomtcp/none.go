@@ -1,5 +1,5 @@
-//go:build !pcap && !rawsocket && !windivert
-// +build !pcap,!rawsocket,!windivert
+//go:build !pcap && !rawsocket && !windivert && !afpacket
+// +build !pcap,!rawsocket,!windivert,!afpacket
 
 package phantomtcp
 
@@ -25,6 +25,13 @@ var HintMap = map[string]uint32{
 func DevicePrint() {
 }
 
+func UpdateCaptureFilter() error {
+	return nil
+}
+
+func RebindCapture() {
+}
+
 func ConnectionMonitor(devices []string) bool {
 	return false
 }
@@ -38,3 +45,7 @@ func Redirect(dst string, to_port int, forward bool) {
 
 func RedirectDNS() {
 }
+
+func captureCheck(devices []string) []PreflightCheck {
+	return []PreflightCheck{{Name: "capture", Detail: "this build has no packet capture, build with -tags rawsocket, afpacket or pcap, or windivert on Windows"}}
+}
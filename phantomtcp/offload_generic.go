@@ -0,0 +1,8 @@
+//go:build !linux
+// +build !linux
+
+package phantomtcp
+
+func disableOffload(device string) {
+	logPrintln(1, "Device:", device, "offload is only turned off on Linux")
+}
@@ -0,0 +1,17 @@
+package phantomtcp
+
+import (
+	"os/exec"
+	"strings"
+)
+
+// disableOffload turns off the receive aggregation and segmentation of
+// device, its captured and injected packets are then single segments
+func disableOffload(device string) {
+	for _, feature := range []string{"gro", "lro", "gso", "tso"} {
+		out, err := exec.Command("ethtool", "-K", device, feature, "off").CombinedOutput()
+		if err != nil {
+			logPrintln(1, "Device:", device, feature, "off:", err, strings.TrimSpace(string(out)))
+		}
+	}
+}
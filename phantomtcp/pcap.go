@@ -1,17 +1,19 @@
-//go:build pcap
-// +build pcap
+//go:build pcap || (linux && afpacket)
+// +build pcap linux,afpacket
 
 package phantomtcp
 
 import (
+	"encoding/binary"
+	"errors"
 	"fmt"
-	"log"
+	"io"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
-	"github.com/google/gopacket/pcap"
 )
 
 var HintMap = map[string]uint32{
@@ -40,6 +42,7 @@ var HintMap = map[string]uint32{
 	"udp":    HINT_UDP,
 	"no-tcp": HINT_NOTCP,
 	"delay":  HINT_DELAY,
+	"lazy":   HINT_LAZY,
 
 	"mode2":      HINT_MODE2,
 	"df":         HINT_DF,
@@ -55,58 +58,138 @@ var HintMap = map[string]uint32{
 
 var ConnWait4 [65536]uint32
 var ConnWait6 [65536]uint32
-var pcapHandle *pcap.Handle
+var pcapHandle captureHandle
+var pcapLock sync.Mutex
+var pcapHandles []captureHandle
+var pcapRebind = make(chan struct{})
+
+// a live capture on one device, opened by libpcap or an AF_PACKET socket
+type captureHandle interface {
+	gopacket.PacketDataSource
+	WritePacketData(data []byte) error
+	LinkType() layers.LinkType
+	Close()
+}
 
-func DevicePrint() {
-	devices, err := pcap.FindAllDevs()
-	if err != nil {
-		log.Fatal(err)
+func UpdateCaptureFilter() error {
+	pcapLock.Lock()
+	defer pcapLock.Unlock()
+	for _, handle := range pcapHandles {
+		err := setCaptureFilter(handle)
+		if err != nil {
+			return err
+		}
 	}
 
-	fmt.Println("Devices found:")
-	for _, device := range devices {
-		fmt.Println("\nName: ", device.Name)
-		fmt.Println("Description: ", device.Description)
-		fmt.Println("Devices addresses: ", device.Description)
-		for _, address := range device.Addresses {
-			fmt.Println("- IP address: ", address.IP)
-			fmt.Println("- Subnet mask: ", address.Netmask)
+	return nil
+}
+
+// closeCaptureHandle closes handle and stops injecting packets on it
+func closeCaptureHandle(handle captureHandle) {
+	pcapLock.Lock()
+	for i, h := range pcapHandles {
+		if h == handle {
+			pcapHandles = append(pcapHandles[:i], pcapHandles[i+1:]...)
+			break
+		}
+	}
+	if pcapHandle == handle {
+		pcapHandle = nil
+		if len(pcapHandles) > 0 {
+			pcapHandle = pcapHandles[len(pcapHandles)-1]
 		}
 	}
+	pcapLock.Unlock()
+	handle.Close()
 }
 
-func connectionMonitor(device string) {
-	fmt.Printf("Device: %v\n", device)
+// writePacketData injects data on the handle opened last
+func writePacketData(data []byte) error {
+	pcapLock.Lock()
+	handle := pcapHandle
+	pcapLock.Unlock()
+	if handle == nil {
+		return errors.New("no capture handle is open")
+	}
+	return handle.WritePacketData(data)
+}
 
-	snapLen := int32(65535)
+// layers between the Ethernet header and the IP header, kept so that
+// injected packets carry the same 802.1Q tags and PPPoE session
+func getEncapsulation(packet gopacket.Packet) []gopacket.SerializableLayer {
+	var encap []gopacket.SerializableLayer
+	for _, layer := range packet.Layers() {
+		switch layer := layer.(type) {
+		case *layers.Dot1Q:
+			encap = append(encap, layer)
+		case *layers.PPPoE:
+			encap = append(encap, layer)
+		case *layers.PPP:
+			encap = append(encap, layer)
+		}
+	}
+	return encap
+}
 
-	filter := "(ip6[6]==6 and ip6[53]&2==2) or (tcp[13]&2==2)"
+// with checksum offload the kernel leaves only the pseudo-header sum in
+// captured outgoing packets, fix it in place before the packet is reused
+func fixChecksum(ip gopacket.NetworkLayer, tcp *layers.TCP) bool {
+	tcp.SetNetworkLayerForChecksum(ip)
+	csum, err := tcp.ComputeChecksum()
+	if err != nil || csum == 0 {
+		return false
+	}
 
-	var err error
-	pcapHandle, err = pcap.OpenLive(device, snapLen, true, pcap.BlockForever)
+	tcp.Contents[16] = 0
+	tcp.Contents[17] = 0
+	csum, _ = tcp.ComputeChecksum()
+	binary.BigEndian.PutUint16(tcp.Contents[16:], csum)
+	tcp.Checksum = csum
+	return true
+}
+
+func connectionMonitor(device string) {
+	fmt.Printf("Device: %v\n", device)
+	checksum := DeviceChecksum[device]
+	offload := false
+
+	pcapLock.Lock()
+	handle, err := openCaptureHandle(device)
 	if err != nil {
-		fmt.Printf("pcap open live failed: %v", err)
+		pcapLock.Unlock()
+		fmt.Printf("open capture handle failed: %v", err)
 		return
 	}
 
-	if err = pcapHandle.SetBPFFilter(filter); err != nil {
+	if err = setCaptureFilter(handle); err != nil {
+		pcapLock.Unlock()
 		fmt.Printf("set bpf filter failed: %v", err)
 		return
 	}
-	defer pcapHandle.Close()
-
-	packetSource := gopacket.NewPacketSource(pcapHandle, pcapHandle.LinkType())
-	packetSource.NoCopy = false
+	pcapHandle = handle
+	pcapHandles = append(pcapHandles, handle)
+	pcapLock.Unlock()
+	defer closeCaptureHandle(handle)
+
+	packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
+	// the data of both handles is a copy owned by the packet
+	packetSource.NoCopy = true
 	for {
 		packet, err := packetSource.NextPacket()
-		if err != nil {
+		if err == io.EOF {
+			logPrintln(1, "Device:", device, "capture closed")
+			return
+		} else if err != nil {
 			logPrintln(1, err)
 			continue
 		}
 
 		link := packet.LinkLayer()
 		ip := packet.NetworkLayer()
-		tcp := packet.TransportLayer().(*layers.TCP)
+		tcp, ok := packet.TransportLayer().(*layers.TCP)
+		if !ok {
+			continue
+		}
 		synack := tcp.SYN && tcp.ACK
 
 		switch ip := ip.(type) {
@@ -134,6 +217,11 @@ func connectionMonitor(device string) {
 			}
 
 			if hint != 0 {
+				if !synack && checksum != "hardware" && fixChecksum(ip, tcp) && !offload {
+					offload = true
+					logPrintln(1, "Device:", device, "checksum offload detected")
+				}
+
 				if synack {
 					srcIP := ip.DstIP
 					ip.DstIP = ip.SrcIP
@@ -156,9 +244,9 @@ func connectionMonitor(device string) {
 						link.DstMAC = link.SrcMAC
 						link.SrcMAC = srcMAC
 					}
-					connInfo = &ConnectionInfo{link, ip, *tcp}
+					connInfo = &ConnectionInfo{link, ip, *tcp, getEncapsulation(packet)}
 				default:
-					connInfo = &ConnectionInfo{nil, ip, *tcp}
+					connInfo = &ConnectionInfo{nil, ip, *tcp, nil}
 				}
 
 				if hint&(HINT_TFO|HINT_HTFO|HINT_SYNX2) != 0 {
@@ -229,6 +317,11 @@ func connectionMonitor(device string) {
 				}
 			}
 			if hint != 0 {
+				if !synack && checksum != "hardware" && fixChecksum(ip, tcp) && !offload {
+					offload = true
+					logPrintln(1, "Device:", device, "checksum offload detected")
+				}
+
 				if synack {
 					srcIP := ip.DstIP
 					ip.DstIP = ip.SrcIP
@@ -251,9 +344,9 @@ func connectionMonitor(device string) {
 						link.DstMAC = link.SrcMAC
 						link.SrcMAC = srcMAC
 					}
-					connInfo = &ConnectionInfo{link, ip, *tcp}
+					connInfo = &ConnectionInfo{link, ip, *tcp, getEncapsulation(packet)}
 				default:
-					connInfo = &ConnectionInfo{nil, ip, *tcp}
+					connInfo = &ConnectionInfo{nil, ip, *tcp, nil}
 				}
 
 				if hint&(HINT_TFO|HINT_HTFO|HINT_SYNX2) != 0 {
@@ -279,7 +372,7 @@ func connectionMonitor(device string) {
 								if payload != nil {
 									ip.TrafficClass = 0
 									ModifyAndSendPacket(connInfo, payload, HINT_TFO, 0, count)
-									ConnWait4[srcPort] = hint
+									ConnWait6[srcPort] = hint
 								} else {
 									connInfo = nil
 								}
@@ -305,19 +398,50 @@ func connectionMonitor(device string) {
 	}
 }
 
+// a device that went down and came back with another address is not
+// captured by its old handle, reopen every handle after the change
+func RebindCapture() {
+	pcapLock.Lock()
+	handles := append([]captureHandle(nil), pcapHandles...)
+	close(pcapRebind)
+	pcapRebind = make(chan struct{})
+	pcapLock.Unlock()
+
+	for _, handle := range handles {
+		handle.Close()
+	}
+}
+
+func rebindLoop(device string) {
+	for {
+		pcapLock.Lock()
+		rebind := pcapRebind
+		pcapLock.Unlock()
+
+		connectionMonitor(device)
+		<-rebind
+	}
+}
+
 func ConnectionMonitor(devices []string) bool {
 	if devices == nil {
 		DevicePrint()
 		return false
 	}
 
+	for _, device := range devices {
+		if DeviceOffload[device] == "off" {
+			disableOffload(device)
+		}
+	}
+
 	for i := 0; i < 65536; i++ {
 		ConnInfo4[i] = make(chan *ConnectionInfo)
 		ConnInfo6[i] = make(chan *ConnectionInfo)
 	}
 
 	for i := 0; i < len(devices); i++ {
-		go connectionMonitor(devices[i])
+		go rebindLoop(devices[i])
 	}
 
 	return true
@@ -11,7 +11,7 @@ import (
 )
 
 func SendPacket(packet gopacket.Packet) error {
-	err := pcapHandle.WritePacketData(packet.Data())
+	err := writePacketData(packet.Data())
 	return err
 }
 
@@ -96,26 +96,25 @@ func ModifyAndSendPacket(connInfo *ConnectionInfo, payload []byte, hint uint32,
 
 	if linkLayer != nil {
 		link := linkLayer.(*layers.Ethernet)
+		packetLayers := append([]gopacket.SerializableLayer{link}, connInfo.Encap...)
 		switch ip := ipLayer.(type) {
 		case *layers.IPv4:
 			if hint&HINT_TTL != 0 {
 				ip.TTL = ttl
 			}
-			gopacket.SerializeLayers(buffer, options,
-				link, ip, tcpLayer, gopacket.Payload(payload),
-			)
+			packetLayers = append(packetLayers, ip)
 		case *layers.IPv6:
 			if hint&HINT_TTL != 0 {
 				ip.HopLimit = ttl
 			}
-			gopacket.SerializeLayers(buffer, options,
-				link, ip, tcpLayer, gopacket.Payload(payload),
-			)
+			packetLayers = append(packetLayers, ip)
 		}
+		packetLayers = append(packetLayers, tcpLayer, gopacket.Payload(payload))
+		gopacket.SerializeLayers(buffer, options, packetLayers...)
 		outgoingPacket := buffer.Bytes()
 
 		for i := 0; i < count; i++ {
-			err := pcapHandle.WritePacketData(outgoingPacket)
+			err := writePacketData(outgoingPacket)
 			if err != nil {
 				return err
 			}
@@ -1,5 +1,5 @@
-//go:build pcap
-// +build pcap
+//go:build pcap || afpacket
+// +build pcap afpacket
 
 package phantomtcp
 
@@ -14,10 +14,13 @@ import (
 func SendPacket(packet gopacket.Packet) error {
 	switch link := packet.LinkLayer().(type) {
 	case *layers.Ethernet:
-		err := pcapHandle.WritePacketData(packet.Data())
+		err := writePacketData(packet.Data())
 		return err
 	default:
-		payload := link.LayerPayload()
+		payload := packet.Data()
+		if link != nil {
+			payload = link.LayerPayload()
+		}
 
 		var sa syscall.Sockaddr
 		var lsa syscall.Sockaddr
@@ -73,6 +76,12 @@ func SendPacket(packet gopacket.Packet) error {
 }
 
 func ModifyAndSendPacket(connInfo *ConnectionInfo, payload []byte, hint uint32, ttl uint8, count int) error {
+	if hint&HINT_TFO == 0 && len(payload) > connInfo.MSS() {
+		return segmented(connInfo, payload, func(info *ConnectionInfo, segment []byte) error {
+			return ModifyAndSendPacket(info, segment, hint, ttl, count)
+		})
+	}
+
 	linkLayer := connInfo.Link
 	ipLayer := connInfo.IP
 
@@ -153,26 +162,25 @@ func ModifyAndSendPacket(connInfo *ConnectionInfo, payload []byte, hint uint32,
 
 	if linkLayer != nil {
 		link := linkLayer.(*layers.Ethernet)
+		packetLayers := append([]gopacket.SerializableLayer{link}, connInfo.Encap...)
 		switch ip := ipLayer.(type) {
 		case *layers.IPv4:
 			if hint&HINT_TTL != 0 {
 				ip.TTL = ttl
 			}
-			gopacket.SerializeLayers(buffer, options,
-				link, ip, tcpLayer, gopacket.Payload(payload),
-			)
+			packetLayers = append(packetLayers, ip)
 		case *layers.IPv6:
 			if hint&HINT_TTL != 0 {
 				ip.HopLimit = ttl
 			}
-			gopacket.SerializeLayers(buffer, options,
-				link, ip, tcpLayer, gopacket.Payload(payload),
-			)
+			packetLayers = append(packetLayers, ip)
 		}
+		packetLayers = append(packetLayers, tcpLayer, gopacket.Payload(payload))
+		gopacket.SerializeLayers(buffer, options, packetLayers...)
 		outgoingPacket := buffer.Bytes()
 
 		for i := 0; i < count; i++ {
-			err := pcapHandle.WritePacketData(outgoingPacket)
+			err := writePacketData(outgoingPacket)
 			if err != nil {
 				return err
 			}
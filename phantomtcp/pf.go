@@ -0,0 +1,25 @@
+package phantomtcp
+
+import "net"
+
+// PFProxy proxies the connections pf sent to the listener: to the
+// destination a rdr-to rule rewrote, or the one they keep with divert-to
+func (profile *PhantomProfile) PFProxy(client net.Conn) {
+	conn, ok := client.(*net.TCPConn)
+	if !ok {
+		client.Close()
+		return
+	}
+	addr, err := pfOriginalDST(conn)
+	if err != nil {
+		addr = conn.LocalAddr().(*net.TCPAddr)
+		own, _ := ownAddresses.Load().(map[string]bool)
+		if addr.IP.IsLoopback() || own[addr.IP.String()] {
+			// neither redirected nor diverted
+			logPrintln(2, "pf:", client.RemoteAddr(), err)
+			client.Close()
+			return
+		}
+	}
+	profile.tcp_redirect(client, addr, "", nil, nil)
+}
@@ -0,0 +1,68 @@
+//go:build darwin || freebsd
+// +build darwin freebsd
+
+package phantomtcp
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// /dev/pf, opened on the first lookup
+var pfDevice struct {
+	sync.Mutex
+	file *os.File
+}
+
+// pfOriginalDST asks pf the destination a connection had before a
+// rdr-to rule rewrote it to the listener
+func pfOriginalDST(conn *net.TCPConn) (*net.TCPAddr, error) {
+	laddr := conn.LocalAddr().(*net.TCPAddr)
+	raddr := conn.RemoteAddr().(*net.TCPAddr)
+
+	var nl [pfNatlookSize]byte
+	af, size := byte(unix.AF_INET), net.IPv4len
+	if laddr.IP.To4() == nil {
+		af, size = byte(unix.AF_INET6), net.IPv6len
+	}
+	copy(nl[0:], ipOfLen(raddr.IP, size))
+	copy(nl[16:], ipOfLen(laddr.IP, size))
+	binary.BigEndian.PutUint16(nl[pfNatlookPorts:], uint16(raddr.Port))
+	binary.BigEndian.PutUint16(nl[pfNatlookPorts+pfNatlookPortSize:], uint16(laddr.Port))
+	nl[pfNatlookAF] = af
+	nl[pfNatlookAF+1] = syscall.IPPROTO_TCP
+	nl[pfNatlookDirection] = pfOut
+
+	pfDevice.Lock()
+	if pfDevice.file == nil {
+		file, err := os.OpenFile("/dev/pf", os.O_RDONLY, 0)
+		if err != nil {
+			pfDevice.Unlock()
+			return nil, err
+		}
+		pfDevice.file = file
+	}
+	fd := pfDevice.file.Fd()
+	pfDevice.Unlock()
+
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, fd, pfDIOCNATLOOK, uintptr(unsafe.Pointer(&nl[0])))
+	if errno != 0 {
+		return nil, errno
+	}
+	ip := append(net.IP(nil), nl[48:48+size]...)
+	port := binary.BigEndian.Uint16(nl[pfNatlookPorts+3*pfNatlookPortSize:])
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func ipOfLen(ip net.IP, size int) net.IP {
+	if size == net.IPv4len {
+		return ip.To4()
+	}
+	return ip.To16()
+}
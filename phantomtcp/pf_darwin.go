@@ -0,0 +1,14 @@
+package phantomtcp
+
+// struct pfioc_natlook of xnu: 4 pf_addr, 4 union pf_state_xport, af,
+// proto, proto_variant and direction
+const (
+	pfNatlookSize      = 84
+	pfNatlookPorts     = 64
+	pfNatlookPortSize  = 4
+	pfNatlookAF        = 80
+	pfNatlookDirection = 83
+	pfOut              = 2
+
+	pfDIOCNATLOOK = 0xc0000000 | pfNatlookSize<<16 | 'D'<<8 | 23
+)
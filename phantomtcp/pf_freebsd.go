@@ -0,0 +1,14 @@
+package phantomtcp
+
+// struct pfioc_natlook of FreeBSD: 4 pf_addr, 4 ports, af, proto and
+// direction
+const (
+	pfNatlookSize      = 76
+	pfNatlookPorts     = 64
+	pfNatlookPortSize  = 2
+	pfNatlookAF        = 72
+	pfNatlookDirection = 74
+	pfOut              = 2
+
+	pfDIOCNATLOOK = 0xc0000000 | pfNatlookSize<<16 | 'D'<<8 | 23
+)
@@ -0,0 +1,13 @@
+//go:build !darwin && !freebsd
+// +build !darwin,!freebsd
+
+package phantomtcp
+
+import (
+	"errors"
+	"net"
+)
+
+func pfOriginalDST(conn *net.TCPConn) (*net.TCPAddr, error) {
+	return nil, errors.New("pf is not supported on this platform")
+}
@@ -9,9 +9,12 @@ import (
 	"io"
 	"log"
 	"net"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 type ServiceConfig struct {
@@ -22,8 +25,13 @@ type ServiceConfig struct {
 	Address    string `json:"address,omitempty"`
 	PrivateKey string `json:"privatekey,omitempty"`
 	Profile    string `json:"profile,omitempty"`
+	Upstream   string `json:"upstream,omitempty"`
+	ACME       string `json:"acme,omitempty"`
+	PAC        string `json:"pac,omitempty"`
+	Ports      string `json:"ports,omitempty"`
 
-	Peers []Peer `json:"peers,omitempty"`
+	Processes []string `json:"processes,omitempty"`
+	Peers     []Peer   `json:"peers,omitempty"`
 }
 
 type InterfaceConfig struct {
@@ -34,10 +42,24 @@ type InterfaceConfig struct {
 	MTU    int    `json:"mtu,omitempty"`
 	TTL    int    `json:"ttl,omitempty"`
 	MAXTTL int    `json:"maxttl,omitempty"`
+	InTTL  int    `json:"inttl,omitempty"`
+
+	Checksum string `json:"checksum,omitempty"`
+	Offload  string `json:"offload,omitempty"`
+	NonTLS   string `json:"nontls,omitempty"`
+	Upgrade  string `json:"upgrade,omitempty"`
+	Strategy string `json:"strategy,omitempty"`
+	ALPN     string `json:"alpn,omitempty"`
+
+	Headers []string `json:"headers,omitempty"`
 
 	Protocol   string `json:"protocol,omitempty"`
 	Address    string `json:"address,omitempty"`
 	PrivateKey string `json:"privatekey,omitempty"`
+	Method     string `json:"method,omitempty"`
+	Password   string `json:"password,omitempty"`
+	Verify     string `json:"verify,omitempty"`
+	SPKI       string `json:"spki,omitempty"`
 
 	Peers []Peer `json:"peers,omitempty"`
 }
@@ -58,6 +80,7 @@ const (
 	HTTPS    = 0x4
 	SOCKS4   = 0x5
 	SOCKS5   = 0x6
+	SS       = 0x7
 )
 
 type PhantomInterface struct {
@@ -67,28 +90,89 @@ type PhantomInterface struct {
 	MTU    uint16
 	TTL    byte
 	MAXTTL byte
+	InTTL  byte //drop the inbound segments with a higher TTL or hop limit
 
 	Protocol byte
 	Address  string
+
+	NonTLS  string //"passthrough", "segment" or the interface for port 443 traffic that is not TLS
+	Upgrade string //"hsts" redirects plain HTTP to https permanently, "hsts,h3" adds Alt-Svc
+	ALPN    string //"none" or the protocols the fake ClientHellos offer
+
+	headers    *httpRules     //rewrite the plain HTTP requests
+	ss         *ssCipher      //of a Shadowsocks server
+	tlsOptions *ServerOptions //of an HTTPS proxy
+	profile    *PhantomProfile
 }
 
-type PhantomProfile struct {
-	DomainMap map[string]*PhantomInterface
+// the rules of a profile, they are not modified once loaded: a reload
+// replaces them as a whole, so a connection that took them at accept
+// time sees the same rules until it is done
+type RuleSet struct {
+	DomainMap   map[string]*PhantomInterface
+	AliasMap    map[string]string
+	NoECSMap    map[string]bool
+	DNSRouteMap map[string]*PhantomInterface
+	FrontingMap map[string]*frontPool
+	PortMap     map[string]*PhantomInterface //name:port, :port
+	Default     *PhantomInterface            //the interface of the names without a rule
+
+	patterns  domainMatcher
+	parents   suffixNode //the .name rules
+	networks  ipTree
+	autoproxy []*autoproxyList
+	clients   []*clientBlock
 }
-var DefaultProfile *PhantomProfile = nil
-var DefaultInterface *PhantomInterface = nil
 
-var default_config = Config{}
+func newRuleSet() *RuleSet {
+	return &RuleSet{
+		DomainMap:   make(map[string]*PhantomInterface),
+		AliasMap:    make(map[string]string),
+		NoECSMap:    make(map[string]bool),
+		DNSRouteMap: make(map[string]*PhantomInterface),
+		FrontingMap: make(map[string]*frontPool),
+		PortMap:     make(map[string]*PhantomInterface),
+	}
+}
+
+// rules, outbounds and DNS cache of one instance
+type PhantomProfile struct {
+	*RuleSet
+	Instance     string //the name of the instance, "" for the unnamed one
+	InterfaceMap map[string]PhantomInterface
+	FilterMap    map[string]*DNSFilter
+	DNSCache     DNSCache
+
+	lies      lieLog
+	hits      ruleHits
+	protocols protocolStats
+
+	dnsRouted sync.Map //routedKey to *PhantomInterface
+
+	rulesLock  sync.RWMutex    //guards RuleSet while it is replaced
+	reloadLock sync.Mutex      //one reload or list refresh at a time
+	reloading  *PhantomProfile //the profile whose rules are read again into this one
+
+	filterLock    sync.RWMutex
+	filterSources []filterSource
+	filterRefresh bool
+
+	autoproxyRefresh sync.Once
+	includeDepth     int
+
+	coalesce map[coalesceKey]uint32 //guarded by NoseLock
+}
 
-var DomainMap map[string]Config
+var DefaultProfile *PhantomProfile = nil
 
-var SubdomainDepth = 2
+var SubdomainDepth = 0 //the levels .name covers, 0 any
 var LogLevel = 0
 var Forward bool = false
 var PassiveMode = false
 
 const (
 	HINT_NONE = 0x0
+	HINT_LAZY = 0x1 << 0
 
 	HINT_ALPN  = 0x1 << 1
 	HINT_HTTP  = 0x1 << 2
@@ -140,43 +224,61 @@ func logPrintln(level int, v ...interface{}) {
 	}
 }
 
+// Rules returns the current rules of the profile
+func (profile *PhantomProfile) Rules() *RuleSet {
+	profile.rulesLock.RLock()
+	defer profile.rulesLock.RUnlock()
+	return profile.RuleSet
+}
+
 func (profile *PhantomProfile) GetInterface(name string) *PhantomInterface {
-	config, ok := profile.DomainMap[name]
+	return profile.Rules().GetInterface(name)
+}
+
+func (rules *RuleSet) GetInterface(name string) *PhantomInterface {
+	config, ok := rules.DomainMap[name]
 	if ok {
 		return config
 	}
-
-	offset := 0
-	for i := 0; i < SubdomainDepth; i++ {
-		off := strings.Index(name[offset:], ".")
-		if off == -1 {
-			break
-		}
-		offset += off
-		config, ok = profile.DomainMap[name[offset:]]
-		if ok {
+	if key := rules.parentRule(name); key != "" {
+		return rules.DomainMap[key]
+	}
+	if key := rules.networks.match(name); key != "" {
+		return rules.DomainMap[key]
+	}
+	if key := rules.patterns.match(name); key != "" {
+		if config, ok := rules.DomainMap[key]; ok {
 			return config
 		}
-		offset++
 	}
 
-	// allow resolution of domains that are not present in default.conf
-	if default_config.Option != 0{
-		return default_config, true
+	// names without a rule, not addresses, use the default interface
+	if rules.Default != nil && name != "" && net.ParseIP(name) == nil {
+		return rules.Default
 	}
-	return Config{0, 0, 0, 0, "", ""}, false
+	return nil
 }
 
-/*
-func (profile *PhantomProfile) GetInterface(name string) *PhantomInterface {
-	config, ok := profile.DomainMap[name]
+// host that name is rewritten to by an alias rule, or name itself
+func (profile *PhantomProfile) GetAlias(name string) string {
+	return profile.Rules().GetAlias(name)
+}
+
+func (rules *RuleSet) GetAlias(name string) string {
+	alias, ok := rules.AliasMap[name]
 	if ok {
-		return config
+		return alias
 	}
+	return name
+}
 
-	return DefaultInterface
+// profile the interface belongs to, interfaces created elsewhere use the default
+func (pface *PhantomInterface) Profile() *PhantomProfile {
+	if pface.profile == nil {
+		return DefaultProfile
+	}
+	return pface.profile
 }
-*/
 
 func GetHost(b []byte) (offset int, length int) {
 	offset = bytes.Index(b, []byte("Host: "))
@@ -247,6 +349,79 @@ func GetSNI(b []byte) (offset int, length int) {
 	return 0, 0
 }
 
+// replace the server name of a ClientHello and adjust the lengths around it
+func SetSNI(b []byte, name string) []byte {
+	offset, length := GetSNI(b)
+	if length == 0 {
+		return b
+	}
+
+	hello := make([]byte, 0, len(b)+len(name)-length)
+	hello = append(hello, b[:offset]...)
+	hello = append(hello, name...)
+	hello = append(hello, b[offset+length:]...)
+
+	diff := len(name) - length
+	grow := func(off int) {
+		binary.BigEndian.PutUint16(hello[off:], uint16(int(binary.BigEndian.Uint16(hello[off:]))+diff))
+	}
+	grow(3)
+	handshakeLength := (int(hello[6])<<16 | int(binary.BigEndian.Uint16(hello[7:9]))) + diff
+	hello[6] = byte(handshakeLength >> 16)
+	binary.BigEndian.PutUint16(hello[7:], uint16(handshakeLength))
+
+	extensions := 11 + 32
+	extensions += 1 + int(hello[extensions])
+	extensions += 2 + int(binary.BigEndian.Uint16(hello[extensions:]))
+	extensions += 1 + int(hello[extensions])
+	grow(extensions)
+	grow(offset - 7) // extension length
+	grow(offset - 5) // server name list length
+	grow(offset - 2) // server name length
+
+	return hello
+}
+
+// replace the host of an HTTP request, the port is kept
+func SetHost(b []byte, name string) []byte {
+	offset, length := GetHost(b)
+	if length == 0 {
+		return b
+	}
+	host := string(b[offset : offset+length])
+	if colon := strings.LastIndexByte(host, ':'); colon != -1 {
+		length = colon
+	}
+
+	request := make([]byte, 0, len(b)+len(name)-length)
+	request = append(request, b[:offset]...)
+	request = append(request, name...)
+	return append(request, b[offset+length:]...)
+}
+
+// rewrite the host of a ClientHello or HTTP request that matches an alias rule
+func (profile *PhantomProfile) rewriteHeader(header []byte) []byte {
+	if header[0] == 0x16 {
+		offset, length := GetSNI(header)
+		if length > 0 {
+			name := string(header[offset : offset+length])
+			if alias := profile.GetAlias(name); alias != name {
+				return SetSNI(header, alias)
+			}
+		}
+		return header
+	}
+
+	offset, length := GetHost(header)
+	if length > 0 {
+		name, _ := splitHostPort(string(header[offset : offset+length]))
+		if alias := profile.GetAlias(name); alias != name {
+			return SetHost(header, alias)
+		}
+	}
+	return header
+}
+
 func GetQUICSNI(b []byte) string {
 	if b[0] == 0x0d {
 		if !(len(b) > 23 && string(b[9:13]) == "Q043") {
@@ -395,6 +570,35 @@ func HttpMove(conn net.Conn, host string, b []byte) bool {
 	return true
 }
 
+// HttpUpgrade answers a plain HTTP request with a permanent redirect to
+// https that browsers cache, "h3" in mode also advertises HTTP/3
+func HttpUpgrade(conn net.Conn, mode string, b []byte) bool {
+	offset, length := GetHost(b)
+	if length == 0 {
+		return false
+	}
+	host := string(b[offset : offset+length])
+
+	header := string(b)
+	start := strings.IndexByte(header, ' ') + 1
+	end := strings.IndexByte(header[start:], ' ')
+	if start == 0 || end < 0 {
+		return false
+	}
+	path := header[start : start+end]
+
+	response := "HTTP/1.1 308 Permanent Redirect\r\nLocation: https://" + host + path
+	response += "\r\nCache-Control: max-age=31536000"
+	for _, m := range strings.Split(mode, ",") {
+		if m == "h3" {
+			response += "\r\nAlt-Svc: h3=\":443\"; ma=2592000"
+		}
+	}
+	response += "\r\nContent-Length: 0\r\n\r\n"
+	_, err := conn.Write([]byte(response))
+	return err == nil
+}
+
 func (pface *PhantomInterface) DialStrip(host string, fronting string) (*tls.Conn, error) {
 	addr, err := pface.ResolveTCPAddr(host, 443)
 	if err != nil {
@@ -413,7 +617,7 @@ func (pface *PhantomInterface) DialStrip(host string, fronting string) (*tls.Con
 		}
 	}
 
-	return tls.Dial("tcp", addr.String(), conf)
+	return tls.DialWithDialer(&net.Dialer{Timeout: time.Second * 10}, "tcp", addr.String(), conf)
 }
 
 func getMyIPv6() net.IP {
@@ -434,20 +638,25 @@ func getMyIPv6() net.IP {
 	return nil
 }
 
-func LoadProfile(filename string) error {
+func (profile *PhantomProfile) LoadProfile(filename string) error {
 	conf, err := os.Open(filename)
 	if err != nil {
 		return err
 	}
 	defer conf.Close()
 
+	if strings.HasSuffix(filename, ".json") {
+		return profile.ReadProfileJSON(conf, filename)
+	}
+	return profile.ReadProfile(conf, filename)
+}
+
+// ReadProfile loads the rules of conf, name is only logged
+func (profile *PhantomProfile) ReadProfile(conf io.Reader, name string) error {
 	br := bufio.NewReader(conf)
 
-	default_interface, ok := InterfaceMap["default"]
-	if ok {
-		DefaultInterface = &default_interface
-	}
-	var CurrentInterface *PhantomInterface = &PhantomInterface{}
+	var CurrentInterface *PhantomInterface = &PhantomInterface{profile: profile}
+	skip := false //the rules of an unknown interface
 
 	for {
 		line, _, err := br.ReadLine()
@@ -468,6 +677,193 @@ func LoadProfile(filename string) error {
 							return err
 						}
 						DNSMinTTL = uint32(ttl)
+					} else if keys[0] == "dns-negative-ttl" {
+						logPrintln(2, string(line))
+						ttl, err := strconv.Atoi(keys[1])
+						if err != nil {
+							log.Println(string(line), err)
+							return err
+						}
+						DNSNegativeTTL = uint32(ttl)
+					} else if keys[0] == "dns-failures" {
+						logPrintln(2, string(line))
+						failures, err := strconv.Atoi(keys[1])
+						if err != nil {
+							log.Println(string(line), err)
+							return err
+						}
+						UnhealthyFailures = failures
+					} else if keys[0] == "doh-canary" {
+						logPrintln(2, string(line))
+						DoHCanary = keys[1] != "0" && keys[1] != "false"
+					} else if keys[0] == "dns-order" {
+						logPrintln(2, string(line))
+						switch keys[1] {
+						case "rotate", "shuffle", "fixed":
+							AnswerOrder = keys[1]
+						default:
+							err := fmt.Errorf("dns-order %s is not rotate, shuffle or fixed", keys[1])
+							log.Println(string(line), err)
+							return err
+						}
+					} else if keys[0] == "clat" {
+						logPrintln(2, string(line))
+						CLATMode = keys[1]
+						refreshCLAT()
+					} else if keys[0] == "happy-eyeballs" {
+						logPrintln(2, string(line))
+						HappyEyeballs = keys[1] != "0" && keys[1] != "false"
+					} else if keys[0] == "coalesce" {
+						logPrintln(2, string(line))
+						CoalesceNames = keys[1] != "0" && keys[1] != "false"
+					} else if keys[0] == "no-ecs" {
+						logPrintln(2, string(line))
+						for _, domain := range strings.Split(keys[1], ",") {
+							if domain = strings.TrimSpace(domain); domain != "" {
+								profile.NoECSMap[domain] = true
+							}
+						}
+					} else if keys[0] == "dnsroute" {
+						logPrintln(2, string(line))
+						err := profile.addDNSRoute(keys[1])
+						if err != nil {
+							log.Println(string(line), err)
+							return err
+						}
+					} else if keys[0] == "fronting" {
+						logPrintln(2, string(line))
+						err := profile.addFronting(keys[1])
+						if err != nil {
+							log.Println(string(line), err)
+							return err
+						}
+					} else if keys[0] == "dns-prefetch" {
+						logPrintln(2, string(line))
+						hits, err := strconv.Atoi(keys[1])
+						if err != nil {
+							log.Println(string(line), err)
+							return err
+						}
+						PrefetchHits = uint32(hits)
+					} else if keys[0] == "dns-cache-size" {
+						logPrintln(2, string(line))
+						DNSCacheSize, err = strconv.Atoi(keys[1])
+						if err != nil {
+							log.Println(string(line), err)
+							return err
+						}
+					} else if keys[0] == "vaddr-prefix" || keys[0] == "vaddr6-prefix" {
+						logPrintln(2, string(line))
+						prefix := keys[1]
+						if keys[0] == "vaddr6-prefix" && prefix == "auto" {
+							prefix = localULA()
+						}
+						err := SetVirtualNet(prefix)
+						if err != nil {
+							log.Println(string(line), err)
+							return err
+						}
+					} else if keys[0] == "vaddr6-route" {
+						logPrintln(2, string(line))
+						VirtualRoute = keys[1] != "0" && keys[1] != "false"
+					} else if keys[0] == "blocklist" || keys[0] == "allowlist" {
+						logPrintln(2, string(line))
+						err := profile.LoadFilter(keys[1], keys[0] == "allowlist")
+						if err != nil {
+							log.Println(string(line), err)
+							return err
+						}
+					} else if keys[0] == "blocklist-refresh" {
+						logPrintln(2, string(line))
+						hours, err := strconv.Atoi(keys[1])
+						if err != nil {
+							log.Println(string(line), err)
+							return err
+						}
+						if hours > 0 {
+							FilterRefreshInterval = time.Duration(hours) * time.Hour
+						}
+					} else if keys[0] == "autoproxy" {
+						logPrintln(2, string(line))
+						list := strings.SplitN(keys[1], ",", 2)
+						if len(list) < 2 {
+							err := fmt.Errorf("autoproxy %s is not interface,source", keys[1])
+							log.Println(string(line), err)
+							return err
+						}
+						face, ok := profile.InterfaceMap[list[0]]
+						if !ok {
+							logPrintln(1, string(line), "unknown interface, the list is skipped")
+							continue
+						}
+						err := profile.LoadAutoProxy(list[1], &face)
+						if err != nil {
+							log.Println(string(line), err)
+							return err
+						}
+					} else if keys[0] == "client" {
+						logPrintln(2, string(line))
+						spec := keys[1]
+						for spec != "" {
+							spec, err = profile.readClientBlock(spec, br, name)
+							if err != nil {
+								log.Println(string(line), err)
+								return err
+							}
+						}
+					} else if keys[0] == "include" {
+						logPrintln(2, string(line))
+						err := profile.LoadInclude(keys[1])
+						if err != nil {
+							log.Println(string(line), err)
+							return err
+						}
+					} else if keys[0] == "include-refresh" {
+						logPrintln(2, string(line))
+						hours, err := strconv.Atoi(keys[1])
+						if err != nil {
+							log.Println(string(line), err)
+							return err
+						}
+						if hours > 0 {
+							IncludeRefreshInterval = time.Duration(hours) * time.Hour
+						}
+					} else if keys[0] == "autoproxy-refresh" {
+						logPrintln(2, string(line))
+						hours, err := strconv.Atoi(keys[1])
+						if err != nil {
+							log.Println(string(line), err)
+							return err
+						}
+						if hours > 0 {
+							AutoProxyRefreshInterval = time.Duration(hours) * time.Hour
+						}
+					} else if keys[0] == "querylog" {
+						logPrintln(2, string(line))
+						err := OpenQueryLog(keys[1])
+						if err != nil {
+							log.Println(string(line), err)
+							return err
+						}
+					} else if keys[0] == "querylog-size" {
+						logPrintln(2, string(line))
+						size, err := strconv.Atoi(keys[1])
+						if err != nil {
+							log.Println(string(line), err)
+							return err
+						}
+						QueryLogSize = int64(size) << 20
+					} else if keys[0] == "local-bypass" {
+						logPrintln(2, string(line))
+						LocalBypass = keys[1] != "0" && keys[1] != "false"
+					} else if keys[0] == "rules-watch" {
+						logPrintln(2, string(line))
+						seconds, err := strconv.Atoi(keys[1])
+						if err != nil {
+							log.Println(string(line), err)
+							return err
+						}
+						RulesWatchInterval = time.Duration(seconds) * time.Second
 					} else if keys[0] == "subdomain" {
 						SubdomainDepth, err = strconv.Atoi(keys[1])
 						if err != nil {
@@ -476,37 +872,71 @@ func LoadProfile(filename string) error {
 						}
 					} else if keys[0] == "udpmapping" {
 						mapping := strings.SplitN(keys[1], ">", 2)
-						go UDPMapping(mapping[0], mapping[1])
+						// the mappings keep running over a reload
+						if profile.reloading == nil {
+							go UDPMapping(mapping[0], mapping[1])
+						}
+					} else if keys[0] == "default" {
+						logPrintln(2, string(line))
+						if keys[1] == "" {
+							profile.Default = nil
+							continue
+						}
+						face, ok := profile.InterfaceMap[keys[1]]
+						if !ok {
+							err := fmt.Errorf("unknown interface %s", keys[1])
+							log.Println(string(line), err)
+							return err
+						}
+						profile.Default = &face
+					} else if skip {
+						continue
 					} else {
 						if strings.HasPrefix(keys[1], "[") {
 							quote := keys[1][1 : len(keys[1])-1]
-							result, hasCache := DNSCache.Load(quote)
+							records, hasCache := profile.DNSCache.Load(quote)
 							if hasCache {
-								records := result.(*DNSRecords)
-								DNSCache.Store(keys[0], records)
+								profile.DNSCache.Store(keys[0], records)
 							}
-							s, ok := DefaultProfile.DomainMap[quote]
+							s, ok := profile.DomainMap[quote]
 							if ok {
-								DefaultProfile.DomainMap[keys[0]] = s
+								profile.DomainMap[keys[0]] = s
+							}
+							if isDomainPattern(keys[0]) {
+								if err := profile.addPattern(keys[0]); err != nil {
+									log.Println(string(line), err)
+									return err
+								}
+							} else if strings.HasPrefix(keys[0], ".") {
+								profile.addParent(keys[0])
 							}
 							continue
+						} else if strings.HasPrefix(keys[1], ">") {
+							profile.AliasMap[keys[0]] = keys[1][1:]
+							continue
 						} else {
 							ip := net.ParseIP(keys[0])
 							var records *DNSRecords
 							records = new(DNSRecords)
-							if CurrentInterface.Hint&HINT_MODIFY != 0 || CurrentInterface.Protocol != 0 {
-								records.Index = uint32(len(Nose))
+							if isDomainPattern(keys[0]) {
+								if err := profile.addPattern(keys[0]); err != nil {
+									log.Println(string(line), err)
+									return err
+								}
+							} else if CurrentInterface.Hint&HINT_MODIFY != 0 || CurrentInterface.Protocol != 0 {
+								records.Index = profile.nameIndex(keys[0])
 								records.ALPN = CurrentInterface.Hint & HINT_DNS
-								Nose = append(Nose, keys[0])
+							}
+							if strings.HasPrefix(keys[0], ".") {
+								profile.addParent(keys[0])
 							}
 
 							addrs := strings.Split(keys[1], ",")
 							for i := 0; i < len(addrs); i++ {
 								ip := net.ParseIP(addrs[i])
 								if ip == nil {
-									result, hasCache := DNSCache.Load(addrs[i])
+									r, hasCache := profile.DNSCache.Load(addrs[i])
 									if hasCache {
-										r := result.(*DNSRecords)
 										if r.IPv4Hint != nil {
 											if records.IPv4Hint == nil {
 												records.IPv4Hint = new(RecordAddresses)
@@ -538,48 +968,70 @@ func LoadProfile(filename string) error {
 								}
 							}
 
-							if ip == nil {
-								DefaultProfile.DomainMap[keys[0]] = CurrentInterface
-								DNSCache.Store(keys[0], records)
+							if CurrentInterface.Hint&HINT_MODIFY != 0 {
+								records.Capture()
+							}
+
+							if _, ipnet, err := net.ParseCIDR(keys[0]); err == nil {
+								profile.DomainMap[ipnet.String()] = CurrentInterface
+								profile.DNSCache.Store(ipnet.String(), records)
+								profile.networks.add(ipnet, ipnet.String())
+							} else if ip == nil {
+								profile.DomainMap[keys[0]] = CurrentInterface
+								profile.DNSCache.Store(keys[0], records)
 							} else {
-								DefaultProfile.DomainMap[ip.String()] = CurrentInterface
-								DNSCache.Store(ip.String(), records)
+								profile.DomainMap[ip.String()] = CurrentInterface
+								profile.DNSCache.Store(ip.String(), records)
 							}
 						}
 					}
 				} else {
 					if keys[0][0] == '[' {
-						face, ok := InterfaceMap[keys[0][1:len(keys[0])-1]]
+						face, ok := profile.InterfaceMap[keys[0][1:len(keys[0])-1]]
 						if ok {
 							CurrentInterface = &face
 							logPrintln(1, keys[0], CurrentInterface)
 						} else {
-							DomainMap[keys[0]] = Config{option, minTTL, maxTTL, syncMSS, server, device}
-							// allow resolution of domains that are not present in default.conf
-							if keys[0]=="default.config.com" {
-								fmt.Println(keys[0], "used as default_config. ")
-								default_config = DomainMap[keys[0]]
-							}
+							logPrintln(1, keys[0], "unknown interface, its rules are skipped")
 						}
+						skip = !ok
+					} else if skip {
+						continue
 					} else {
-						addr, err := net.ResolveTCPAddr("tcp", keys[0])
+						host, port, err := net.SplitHostPort(keys[0])
 						if err == nil {
-							DefaultProfile.DomainMap[addr.String()] = CurrentInterface
+							err := profile.addPortRule(host, port, CurrentInterface)
+							if err != nil {
+								log.Println(string(line), err)
+								return err
+							}
 						} else {
 							_, ipnet, err := net.ParseCIDR(keys[0])
 							if err == nil {
-								DefaultProfile.DomainMap[ipnet.String()] = CurrentInterface
+								profile.DomainMap[ipnet.String()] = CurrentInterface
+								profile.networks.add(ipnet, ipnet.String())
 							} else {
 								ip := net.ParseIP(keys[0])
 								if ip != nil {
-									DefaultProfile.DomainMap[ip.String()] = CurrentInterface
+									profile.DomainMap[ip.String()] = CurrentInterface
+									if CurrentInterface.Hint&HINT_MODIFY != 0 {
+										CaptureAddress(ip)
+									}
 								} else {
+									if isDomainPattern(keys[0]) {
+										if err := profile.addPattern(keys[0]); err != nil {
+											log.Println(string(line), err)
+											return err
+										}
+									} else if strings.HasPrefix(keys[0], ".") {
+										profile.addParent(keys[0])
+									}
 									if CurrentInterface.DNS != "" || CurrentInterface.Protocol != 0 {
-										DefaultProfile.DomainMap[keys[0]] = CurrentInterface
+										profile.DomainMap[keys[0]] = CurrentInterface
 										records := new(DNSRecords)
-										DNSCache.Store(keys[0], records)
+										profile.DNSCache.Store(keys[0], records)
 									} else {
-										DefaultProfile.DomainMap[keys[0]] = nil
+										profile.DomainMap[keys[0]] = nil
 									}
 								}
 							}
@@ -590,85 +1042,143 @@ func LoadProfile(filename string) error {
 		}
 	}
 
-	logPrintln(1, filename)
+	logPrintln(1, name)
 
 	return nil
 }
 
-func LoadHosts(filename string) error {
+// the addresses of a hosts file never expire
+const hostsTTL = 0x7FFFFFFFFFFFFFFF
+
+// LoadHosts answers the names of a hosts file (/etc/hosts or a dnsmasq
+// addn-hosts file) with its addresses: "ip name [alias...]" separated by
+// any whitespace, several lines of a name add up, # starts a comment.
+// The names may be wildcards or regular expressions as in the rules.
+func (profile *PhantomProfile) LoadHosts(filename string) error {
 	hosts, err := os.Open(filename)
 	if err != nil {
 		return err
 	}
 	defer hosts.Close()
 
-	br := bufio.NewReader(hosts)
-
-	for {
-		line, _, err := br.ReadLine()
-		if err == io.EOF {
-			break
+	scanner := bufio.NewScanner(hosts)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i != -1 {
+			line = line[:i]
 		}
-		if err != nil {
-			logPrintln(1, err)
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
 		}
-
-		if len(line) == 0 || line[0] == '#' {
+		ip := net.ParseIP(fields[0])
+		if ip == nil {
+			logPrintln(1, filename, fields[0], "bad ip address")
 			continue
 		}
 
-		k := strings.SplitN(string(line), "\t", 2)
-		if len(k) == 2 {
-			var records *DNSRecords
-
-			name := k[1]
-			_, ok := DNSCache.Load(name)
-			if ok {
-				continue
-			}
-			offset := 0
-			for i := 0; i < SubdomainDepth; i++ {
-				off := strings.Index(name[offset:], ".")
-				if off == -1 {
-					break
-				}
-				offset += off
-				result, ok := DNSCache.Load(name[offset:])
-				if ok {
-					records = new(DNSRecords)
-					*records = *result.(*DNSRecords)
-					DNSCache.Store(name, records)
+		for _, name := range fields[1:] {
+			name = strings.ToLower(strings.TrimSuffix(name, "."))
+			if isDomainPattern(name) {
+				if err := profile.addPattern(name); err != nil {
+					logPrintln(1, filename, name, err)
 					continue
 				}
-				offset++
-			}
-
-			server := DefaultProfile.GetInterface(name)
-			if ok && server.Hint != 0 {
-				records.Index = uint32(len(Nose))
-				records.ALPN = server.Hint & HINT_DNS
-				Nose = append(Nose, name)
+			} else if strings.HasPrefix(name, ".") {
+				profile.addParent(name)
 			}
-			ip := net.ParseIP(k[0])
-			if ip == nil {
-				fmt.Println(ip, "bad ip address")
-				continue
+			records, ok := profile.DNSCache.Load(name)
+			if !ok {
+				records = new(DNSRecords)
+				if server := profile.GetInterface(name); server != nil && server.Hint != 0 && !isDomainPattern(name) {
+					records.Index = profile.nameIndex(name)
+					records.ALPN = server.Hint & HINT_DNS
+				}
+				profile.DNSCache.Store(name, records)
 			}
-			ip4 := ip.To4()
-			if ip4 != nil {
-				records.IPv4Hint = &RecordAddresses{0x7FFFFFFFFFFFFFFF, []net.IP{ip4}}
+
+			if ip4 := ip.To4(); ip4 != nil {
+				if records.IPv4Hint == nil || records.IPv4Hint.TTL != hostsTTL {
+					records.IPv4Hint = &RecordAddresses{hostsTTL, nil}
+				}
+				records.IPv4Hint.Addresses = append(records.IPv4Hint.Addresses, ip4)
 			} else {
-				records.IPv6Hint = &RecordAddresses{0x7FFFFFFFFFFFFFFF, []net.IP{ip}}
+				if records.IPv6Hint == nil || records.IPv6Hint.TTL != hostsTTL {
+					records.IPv6Hint = &RecordAddresses{hostsTTL, nil}
+				}
+				records.IPv6Hint.Addresses = append(records.IPv6Hint.Addresses, ip)
 			}
 		}
 	}
 
-	return nil
+	return scanner.Err()
+}
+
+// hostname of a line from a browser history export or a popularity list,
+// either a bare name, a URL or "rank,name"
+func preloadName(line string) string {
+	line = strings.TrimSpace(line)
+	if len(line) == 0 || line[0] == '#' {
+		return ""
+	}
+
+	if strings.Contains(line, "://") {
+		u, err := url.Parse(line)
+		if err != nil {
+			return ""
+		}
+		line = u.Hostname()
+	} else {
+		fields := strings.Split(line, ",")
+		line = strings.Trim(fields[len(fields)-1], "\" ")
+	}
+
+	name := strings.TrimSuffix(strings.ToLower(line), ".")
+	if net.ParseIP(name) != nil || !strings.Contains(name, ".") {
+		return ""
+	}
+	return name
 }
 
-func GetPAC(address string) string {
+func (profile *PhantomProfile) Preload(filename string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	names := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for name := range names {
+				profile.NSRequest(PackRequest(name, 1, 0, ""), true, nil)
+				profile.NSRequest(PackRequest(name, 28, 0, ""), true, nil)
+			}
+		}()
+	}
+
+	count := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		name := preloadName(scanner.Text())
+		if name != "" {
+			names <- name
+			count++
+		}
+	}
+	close(names)
+	wg.Wait()
+
+	logPrintln(1, "preloaded", count, "names from", filename)
+	return scanner.Err()
+}
+
+func (profile *PhantomProfile) GetPAC(address string) string {
 	rule := ""
-	for host := range DefaultProfile.DomainMap {
+	for host := range profile.Rules().DomainMap {
 		rule += fmt.Sprintf("\"%s\":1,\n", host)
 	}
 	Context := `var proxy = 'SOCKS %s';
@@ -688,14 +1198,27 @@ function FindProxyForURL(url, host) {
 	return 'DIRECT';
 }
 `
-	return fmt.Sprintf(Context, address, rule, SubdomainDepth)
+	depth := SubdomainDepth
+	if depth <= 0 {
+		depth = 127 //the labels of a name at most
+	}
+	return fmt.Sprintf(Context, address, rule, depth)
 }
 
-var InterfaceMap map[string]PhantomInterface
+var DeviceChecksum = make(map[string]string)
 
-func CreateInterfaces(Interfaces []InterfaceConfig) []string {
-	DefaultProfile = &PhantomProfile{make(map[string]*PhantomInterface)}
-	InterfaceMap = make(map[string]PhantomInterface)
+// devices of interfaces with "offload": "off"
+var DeviceOffload = make(map[string]string)
+
+// NewProfile creates a profile with its own outbounds, the returned
+// devices need to be passed to StartMonitor
+func NewProfile(Interfaces []InterfaceConfig) (*PhantomProfile, []string, error) {
+	profile := &PhantomProfile{
+		RuleSet:      newRuleSet(),
+		InterfaceMap: make(map[string]PhantomInterface),
+		FilterMap:    make(map[string]*DNSFilter),
+	}
+	profile.hits.start = time.Now().Unix()
 
 	contains := func(a []string, x string) bool {
 		for _, n := range a {
@@ -719,6 +1242,23 @@ func CreateInterfaces(Interfaces []InterfaceConfig) []string {
 				}
 			}
 		}
+		if pface.Strategy != "" {
+			hints, ttl, unsupported := TranslateStrategy(pface.Strategy)
+			for _, h := range hints {
+				hint, ok := HintMap[h]
+				if ok {
+					Hint |= hint
+				} else {
+					logPrintln(1, "unsupported hint: "+h)
+				}
+			}
+			if pface.TTL == 0 {
+				pface.TTL = ttl
+			}
+			if len(unsupported) > 0 {
+				logPrintln(1, pface.Name, "strategy ignored:", strings.Join(unsupported, " "))
+			}
+		}
 
 		var protocol byte
 		switch pface.Protocol {
@@ -738,29 +1278,81 @@ func CreateInterfaces(Interfaces []InterfaceConfig) []string {
 			protocol = SOCKS5
 		case "socks":
 			protocol = SOCKS5
+		case "ss":
+			protocol = SS
+		}
+		var ss *ssCipher
+		if protocol == SS {
+			var err error
+			ss, err = newSSCipher(pface.Method, pface.Password)
+			if err != nil {
+				return nil, nil, fmt.Errorf("%s: %v", pface.Name, err)
+			}
 		}
 
-		_, ok := InterfaceMap[pface.Device]
+		headers, err := parseHTTPRules(pface.Headers)
+		if err != nil {
+			logPrintln(1, pface.Name, err)
+		}
+
+		if pface.Device != "" && pface.Checksum != "" {
+			DeviceChecksum[pface.Device] = pface.Checksum
+		}
+		if pface.Device != "" && pface.Offload != "" {
+			DeviceOffload[pface.Device] = pface.Offload
+		}
+
+		_, ok := profile.InterfaceMap[pface.Device]
 		if !ok {
 			if pface.Device != "" && Hint != 0 && !contains(devices, pface.Device) {
 				devices = append(devices, pface.Device)
 			}
 		}
 
-		InterfaceMap[pface.Name] = PhantomInterface{
+		profile.InterfaceMap[pface.Name] = PhantomInterface{
 			Device: pface.Device,
 			DNS:    pface.DNS,
 			Hint:   Hint,
 			MTU:    uint16(pface.MTU),
 			TTL:    byte(pface.TTL),
 			MAXTTL: byte(pface.MAXTTL),
+			InTTL:  byte(pface.InTTL),
 
 			Protocol: protocol,
 			Address:  pface.Address,
+
+			NonTLS:  pface.NonTLS,
+			Upgrade: pface.Upgrade,
+			ALPN:    pface.ALPN,
+
+			headers:    headers,
+			ss:         ss,
+			tlsOptions: proxyTLSOptions(pface.Verify, pface.SPKI),
+			profile:    profile,
 		}
 	}
-	logPrintln(1, InterfaceMap)
+	logPrintln(1, profile.InterfaceMap)
+	go profile.ExpireDNSCache()
 
-	go ConnectionMonitor(devices)
-	return devices
+	return profile, devices, nil
+}
+
+func CreateInterfaces(Interfaces []InterfaceConfig) ([]string, error) {
+	profile, devices, err := NewProfile(Interfaces)
+	if err != nil {
+		return nil, err
+	}
+	DefaultProfile = profile
+	return devices, nil
+}
+
+// StartMonitor captures the devices of all profiles, it is called once
+func StartMonitor(devices []string) {
+	go func() {
+		if !ConnectionMonitor(devices) && devices != nil {
+			setCaptureDown(true)
+		}
+	}()
+	go AddressMonitor()
+	go RelayMonitor()
 }
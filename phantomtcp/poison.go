@@ -0,0 +1,187 @@
+package phantomtcp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the addresses of the files of bogus=, answers with one of them are
+// injected by a middlebox
+var bogusLists = make(map[string][]*net.IPNet)
+var bogusLock sync.Mutex
+
+func loadBogus(filename string) ([]*net.IPNet, error) {
+	bogusLock.Lock()
+	defer bogusLock.Unlock()
+	if list, ok := bogusLists[filename]; ok {
+		return list, nil
+	}
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var list []*net.IPNet
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(strings.SplitN(scanner.Text(), "#", 2)[0])
+		if line == "" {
+			continue
+		}
+		if !strings.Contains(line, "/") {
+			if strings.Contains(line, ":") {
+				line += "/128"
+			} else {
+				line += "/32"
+			}
+		}
+		_, ipnet, err := net.ParseCIDR(line)
+		if err != nil {
+			logPrintln(1, "bogus:", filename, line, err)
+			continue
+		}
+		list = append(list, ipnet)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	logPrintln(2, "bogus:", filename, len(list), "addresses")
+	bogusLists[filename] = list
+	return list, nil
+}
+
+// the addresses of the answer section of response, sorted, and whether
+// one of them is bogus
+func answerAddresses(response []byte, bogus []*net.IPNet) ([]string, bool) {
+	msg, err := parseMsg(response)
+	if err != nil {
+		return nil, false
+	}
+	var addrs []string
+	for _, rr := range msg.answer {
+		if rr.rtype != 1 && rr.rtype != 28 {
+			continue
+		}
+		ip := net.IP(rr.rdata)
+		for _, ipnet := range bogus {
+			if ipnet.Contains(ip) {
+				return nil, true
+			}
+		}
+		addrs = append(addrs, ip.String())
+	}
+	sort.Strings(addrs)
+	return addrs, false
+}
+
+// holdLookup sends request to the UDP server address and keeps reading
+// the answers for the hold window of options after the first one.
+// Answers faster than minrtt, without the EDNS record that was sent or
+// with a bogus address are injected and dropped; when only injected or
+// differing answers arrived the query is asked again over TCP.
+func holdLookup(request []byte, address string, options ServerOptions) ([]byte, error) {
+	var bogus []*net.IPNet
+	if options.Bogus != "" {
+		var err error
+		bogus, err = loadBogus(options.Bogus)
+		if err != nil {
+			logPrintln(1, err)
+		}
+	}
+
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	id := binary.BigEndian.Uint16(request[:2])
+	query := make([]byte, len(request))
+	copy(query, request)
+	binary.BigEndian.PutUint16(query[:2], randomID())
+	start := time.Now()
+	_, err = conn.Write(query)
+	if err != nil {
+		return nil, err
+	}
+	deadline := start.Add(time.Second * 5)
+	conn.SetReadDeadline(deadline)
+
+	var answer []byte
+	var addrs []string
+	poisoned := false
+	conflict := false
+	held := false
+	buf := make([]byte, EDNSBufferSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			var nerr net.Error
+			if errors.As(err, &nerr) && nerr.Timeout() && held {
+				break
+			}
+			if poisoned {
+				break
+			}
+			return nil, err
+		}
+		response := buf[:n]
+		if !matchResponse(query, response) {
+			logPrintln(3, "mismatched response from", address)
+			continue
+		}
+		if !held && options.Hold > 0 {
+			held = true
+			if hold := time.Now().Add(options.Hold); hold.Before(deadline) {
+				conn.SetReadDeadline(hold)
+			}
+		}
+
+		rtt := time.Since(start)
+		a, isBogus := answerAddresses(response, bogus)
+		if rtt < options.MinRTT || (query[11] > 0 && response[11] == 0) || isBogus {
+			logPrintln(2, "poisoned answer from", address, rtt, a)
+			poisoned = true
+			// the real answer follows the injected one closely
+			if !held {
+				held = true
+				if hold := time.Now().Add(time.Second); hold.Before(deadline) {
+					conn.SetReadDeadline(hold)
+				}
+			}
+			continue
+		}
+		if response[2]&0x02 != 0 {
+			logPrintln(4, "truncated response from", address)
+			return TCPlookup(request, address, nil)
+		}
+
+		if answer == nil {
+			answer = append([]byte(nil), response...)
+			addrs = a
+		} else if strings.Join(a, ",") != strings.Join(addrs, ",") {
+			conflict = true
+		}
+		if options.Hold == 0 {
+			break
+		}
+	}
+
+	if conflict || (poisoned && answer == nil) {
+		logPrintln(2, "poisoned answers from", address, "retry over tcp")
+		return TCPlookup(request, address, nil)
+	}
+	if answer == nil {
+		return nil, errors.New(address + ": no answer")
+	}
+	binary.BigEndian.PutUint16(answer[:2], id)
+	return answer, nil
+}
@@ -1,6 +1,7 @@
 package phantomtcp
 
 import (
+	"errors"
 	"io"
 	"log"
 	"math/rand"
@@ -8,7 +9,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
-	"time"
+	"sync/atomic"
 )
 
 func IsIPv6(addr string) bool {
@@ -118,114 +119,134 @@ func DialUDP(address string) (net.Conn, error) {
 	}
 }
 
+func ListenUDPMapping(Address string) (*net.UDPConn, error) {
+	localPort, err := strconv.Atoi(Address)
+	if err == nil {
+		return net.ListenUDP("udp", &net.UDPAddr{IP: net.IP{127, 0, 0, 1}, Port: localPort})
+	}
+	return ListenUDP(Address)
+}
+
 func UDPMapping(Address string, Target string) error {
 	if len(Target) == 0 {
 		return nil
 	}
 
-	logPrintln(1, "UDPMapping:", Address, Target)
+	localConn, err := ListenUDPMapping(Address)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	defer localConn.Close()
 
-	localPort, err := strconv.Atoi(Address)
-	if err == nil {
-		localConn, err := net.ListenUDP("udp", &net.UDPAddr{net.IP{127, 0, 0, 1}, localPort, ""})
-		if err != nil {
-			return err
-		}
+	return ServeUDPMapping(localConn, Address, Target)
+}
+
+// ServeUDPMapping relays the datagrams of localConn, listening at
+// Address, to Target: a flow for each client, or one flow whose answers
+// go to the last client when Address is a port
+func ServeUDPMapping(localConn *net.UDPConn, Address string, Target string) error {
+	logPrintln(1, "UDPMapping:", localConn.LocalAddr(), Target)
+	if _, err := strconv.Atoi(Address); err == nil {
+		return serveUDPForward(localConn, Target)
+	}
+
+	var UDPLock sync.Mutex
+	var UDPMap map[string]net.Conn = make(map[string]net.Conn)
+	data := make([]byte, 1500)
 
-		var SrcAddr *net.UDPAddr = nil
-		conn, err := DialUDP(Target)
+	for {
+		n, clientAddr, err := localConn.ReadFromUDP(data)
 		if err != nil {
-			return err
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			log.Println(err)
+			continue
 		}
 
-		go func(raddr **net.UDPAddr, conn net.Conn) {
-			data := make([]byte, 1500)
-			for {
-				n, err := conn.Read(data)
-				if err != nil {
-					log.Println(err)
-					continue
-				}
-				if *raddr != nil {
-					localConn.WriteToUDP(data[:n], *raddr)
-				}
-			}
-		}(&SrcAddr, conn)
+		UDPLock.Lock()
+		udpConn, ok := UDPMap[clientAddr.String()]
 
-		data := make([]byte, 1500)
-		for {
-			var n int
-			n, SrcAddr, err = localConn.ReadFromUDP(data)
+		if ok {
+			udpConn.Write(data[:n])
+			UDPLock.Unlock()
+		} else {
+			logPrintln(1, "[UDP]", clientAddr.String(), Target)
+			UDPLock.Unlock()
+			remoteConn, err := DialUDP(Target)
 			if err != nil {
-				SrcAddr = nil
 				log.Println(err)
 				continue
 			}
-			conn.Write(data[:n])
-		}
-	} else {
-		localConn, err := ListenUDP(Address)
-		if err != nil {
-			log.Println(err)
-			return err
+			UDPLock.Lock()
+			UDPMap[clientAddr.String()] = remoteConn
+			_, err = remoteConn.Write(data[:n])
+			UDPLock.Unlock()
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+
+			go func(clientAddr net.UDPAddr, remoteConn net.Conn) {
+				data := make([]byte, 1500)
+				info := trackFlow(&clientAddr, remoteConn)
+				for {
+					n, err := info.readFlow(remoteConn, data)
+					if err != nil {
+						untrackRelay(remoteConn)
+						UDPLock.Lock()
+						delete(UDPMap, clientAddr.String())
+						UDPLock.Unlock()
+						remoteConn.Close()
+						return
+					}
+					localConn.WriteToUDP(data[:n], &clientAddr)
+				}
+			}(*clientAddr, remoteConn)
 		}
-		defer localConn.Close()
+	}
+}
 
-		var UDPLock sync.Mutex
-		var UDPMap map[string]net.Conn = make(map[string]net.Conn)
-		data := make([]byte, 1500)
+func serveUDPForward(localConn *net.UDPConn, Target string) error {
+	conn, err := DialUDP(Target)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	defer conn.Close()
 
+	var srcAddr atomic.Value
+	go func() {
+		data := make([]byte, 1500)
 		for {
-			n, clientAddr, err := localConn.ReadFromUDP(data)
+			n, err := conn.Read(data)
 			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
 				log.Println(err)
 				continue
 			}
+			if raddr, _ := srcAddr.Load().(*net.UDPAddr); raddr != nil {
+				localConn.WriteToUDP(data[:n], raddr)
+			}
+		}
+	}()
 
-			UDPLock.Lock()
-			udpConn, ok := UDPMap[clientAddr.String()]
-
-			if ok {
-				udpConn.Write(data[:n])
-				UDPLock.Unlock()
-			} else {
-				logPrintln(1, "[UDP]", clientAddr.String(), Target)
-				UDPLock.Unlock()
-				remoteConn, err := DialUDP(Target)
-				if err != nil {
-					log.Println(err)
-					continue
-				}
-				UDPLock.Lock()
-				UDPMap[clientAddr.String()] = remoteConn
-				_, err = remoteConn.Write(data[:n])
-				UDPLock.Unlock()
-				if err != nil {
-					log.Println(err)
-					continue
-				}
-
-				go func(clientAddr net.UDPAddr, remoteConn net.Conn) {
-					data := make([]byte, 1500)
-					remoteConn.SetReadDeadline(time.Now().Add(time.Minute * 2))
-					for {
-						n, err := remoteConn.Read(data)
-						if err != nil {
-							UDPLock.Lock()
-							delete(UDPMap, clientAddr.String())
-							UDPLock.Unlock()
-							remoteConn.Close()
-							return
-						}
-						remoteConn.SetReadDeadline(time.Now().Add(time.Minute * 2))
-						localConn.WriteToUDP(data[:n], &clientAddr)
-					}
-				}(*clientAddr, remoteConn)
+	data := make([]byte, 1500)
+	for {
+		n, raddr, err := localConn.ReadFromUDP(data)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
 			}
+			log.Println(err)
+			continue
 		}
+		srcAddr.Store(raddr)
+		conn.Write(data[:n])
 	}
-
-	return nil
 }
 
 func TCPMapping(Listener net.Listener, Hosts string) error {
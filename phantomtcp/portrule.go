@@ -0,0 +1,58 @@
+package phantomtcp
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// rules of the connections to one port: example.com:853 and
+// .example.com:80 under a section give the connections to that port of
+// the name or of its subdomains the interface of the section instead of
+// the rule of the name, 1.2.3.4:443 those of an address and :25 those of
+// any destination. They are keys of PortMap.
+func (profile *PhantomProfile) addPortRule(host string, port string, pface *PhantomInterface) error {
+	n, err := strconv.Atoi(port)
+	if err != nil || n <= 0 || n > 65535 {
+		return fmt.Errorf("bad port %s", port)
+	}
+	if isDomainPattern(host) || strings.Contains(host, "/") {
+		return fmt.Errorf("a port rule is of a name, .name, an address or any destination, not %s", host)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		host = ip.String()
+	} else if host != "" && pface.DNS == "" && pface.Protocol == 0 {
+		// as a name listed under an interface without DNS
+		pface = nil
+	}
+	profile.PortMap[strings.ToLower(host)+":"+strconv.Itoa(n)] = pface
+	return nil
+}
+
+// GetPortInterface returns the port rule of the connections to port of
+// name, the rule of the name or of the nearest .parent first, then the
+// rule of the port; ok is false without one
+func (rules *RuleSet) GetPortInterface(name string, port int) (pface *PhantomInterface, ok bool) {
+	if len(rules.PortMap) == 0 {
+		return nil, false
+	}
+	suffix := ":" + strconv.Itoa(port)
+	if name != "" {
+		if pface, ok = rules.PortMap[name+suffix]; ok {
+			return pface, true
+		}
+		for offset := strings.Index(name, "."); offset != -1 && net.ParseIP(name) == nil; {
+			if pface, ok = rules.PortMap[name[offset:]+suffix]; ok {
+				return pface, true
+			}
+			next := strings.Index(name[offset+1:], ".")
+			if next == -1 {
+				break
+			}
+			offset += next + 1
+		}
+	}
+	pface, ok = rules.PortMap[suffix]
+	return pface, ok
+}
@@ -0,0 +1,91 @@
+package phantomtcp
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// names answered from the cache PrefetchHits times are resolved again
+// when less than PrefetchWindow seconds of their TTL are left, 0 hits
+// turns it off
+var PrefetchHits uint32 = 3
+var PrefetchWindow int64 = 10
+
+// prefetch counts a cache hit of rec, the addresses of qtype in records,
+// and refreshes them in the background when name is hot and rec is
+// about to expire
+func (profile *PhantomProfile) prefetch(name string, qtype uint16, pface *PhantomInterface, records *DNSRecords, rec *RecordAddresses, now int64) {
+	if PrefetchHits == 0 || pface == nil || pface.DNS == "" || rec.TTL == 0 {
+		return
+	}
+	hits := atomic.AddUint32(&records.hits, 1)
+	if hits < PrefetchHits || rec.TTL-now > PrefetchWindow {
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&records.prefetching, 0, 1) {
+		return
+	}
+	go func() {
+		defer atomic.StoreInt32(&records.prefetching, 0)
+		profile.refresh(name, qtype, pface, records)
+		atomic.StoreUint32(&records.hits, 0)
+	}()
+}
+
+// refresh resolves the addresses of qtype of name into new records and
+// replaces the cached ones with them
+func (profile *PhantomProfile) refresh(name string, qtype uint16, pface *PhantomInterface, records *DNSRecords) {
+	servers, err := ParseServers(pface.DNS)
+	if err != nil {
+		return
+	}
+	var options ServerOptions
+	if servers[0].RawQuery != "" {
+		// answers of the other type are cached under this one
+		if pface.Hint&HINT_IPV6 != 0 {
+			return
+		}
+		options = ParseOptions(servers[0].RawQuery)
+	}
+	if _, ok := pface.clientECS(); ok {
+		return
+	}
+	if profile.noECS(name) {
+		options.ECS = ""
+	}
+
+	ecs := options.ECS
+	key := fmt.Sprint(name, " ", qtype, " ", pface.DNS, " ", ecs)
+	start := time.Now()
+	response, err := RaceOnce(key, servers, PackRequest(name, qtype, 0, ecs), options)
+	if err != nil {
+		logPrintln(2, "prefetch:", name, err)
+		return
+	}
+
+	var fresh DNSRecords
+	cname := fresh.GetAnswers(response, options)
+	fresh.followCNAME(name, cname, qtype, servers, ecs, options)
+	if qtype == 28 {
+		fresh.synthesizeDNS64(name, servers, ecs, options)
+	}
+	if pface.Hint&HINT_MODIFY != 0 {
+		fresh.Capture()
+	}
+
+	switch qtype {
+	case 1:
+		if fresh.IPv4Hint == nil {
+			return
+		}
+		records.IPv4Hint = fresh.IPv4Hint
+		logPrintln(3, "prefetch:", name, qtype, fresh.IPv4Hint.Addresses, time.Since(start))
+	case 28:
+		if fresh.IPv6Hint == nil {
+			return
+		}
+		records.IPv6Hint = fresh.IPv6Hint
+		logPrintln(3, "prefetch:", name, qtype, fresh.IPv6Hint.Addresses, time.Since(start))
+	}
+}
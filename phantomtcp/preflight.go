@@ -0,0 +1,57 @@
+package phantomtcp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// a requirement of the configured backends, Detail tells what failed and
+// how to fix it
+type PreflightCheck struct {
+	Name   string
+	OK     bool
+	Detail string
+}
+
+func newCheck(name string, err error, fix string) PreflightCheck {
+	if err == nil {
+		return PreflightCheck{Name: name, OK: true}
+	}
+	detail := err.Error()
+	if fix != "" {
+		detail += ", " + fix
+	}
+	return PreflightCheck{Name: name, Detail: detail}
+}
+
+// Preflight checks the privileges and kernel features needed to capture
+// devices and to serve tproxy, before the first connection needs them
+func Preflight(devices []string, tproxy bool) []PreflightCheck {
+	var checks []PreflightCheck
+	if len(devices) > 0 {
+		checks = append(checks, captureCheck(devices)...)
+	}
+	if tproxy {
+		err := tproxyCheck()
+		fix := ""
+		if errors.Is(err, syscall.EPERM) {
+			fix = "run as root or grant CAP_NET_ADMIN"
+		} else if errors.Is(err, syscall.ENOPROTOOPT) {
+			fix = "the kernel has no IP_TRANSPARENT"
+		}
+		checks = append(checks, newCheck("tproxy", err, fix))
+	}
+	return checks
+}
+
+// the devices to capture exist
+func deviceCheck(devices []string) []PreflightCheck {
+	var checks []PreflightCheck
+	for _, device := range devices {
+		_, err := net.InterfaceByName(device)
+		checks = append(checks, newCheck(fmt.Sprint("device ", device), err, "see the names with ip link"))
+	}
+	return checks
+}
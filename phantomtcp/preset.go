@@ -0,0 +1,80 @@
+package phantomtcp
+
+import (
+	"embed"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+)
+
+// presets/NAME.json holds the interfaces of a preset and presets/NAME.conf
+// the rules that use them
+//
+//go:embed presets
+var presetFS embed.FS
+
+type Preset struct {
+	Interfaces []InterfaceConfig `json:"interfaces"`
+}
+
+// Presets lists the names of the embedded presets
+func Presets() []string {
+	entries, _ := presetFS.ReadDir("presets")
+	var names []string
+	for _, entry := range entries {
+		if name := entry.Name(); strings.HasSuffix(name, ".json") {
+			names = append(names, strings.TrimSuffix(name, ".json"))
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func loadPreset(name string) (*Preset, error) {
+	b, err := presetFS.ReadFile("presets/" + name + ".json")
+	if err != nil {
+		return nil, errors.New("unknown preset " + name + ", available: " + strings.Join(Presets(), ","))
+	}
+	var preset Preset
+	err = json.Unmarshal(b, &preset)
+	if err != nil {
+		return nil, err
+	}
+	return &preset, nil
+}
+
+// PresetInterfaces adds the interfaces of the preset name to interfaces,
+// an interface of the same name in interfaces replaces the one of the preset
+func PresetInterfaces(name string, interfaces []InterfaceConfig) ([]InterfaceConfig, error) {
+	if name == "" {
+		return interfaces, nil
+	}
+	preset, err := loadPreset(name)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, pface := range preset.Interfaces {
+		found := false
+		for _, face := range interfaces {
+			found = found || face.Name == pface.Name
+		}
+		if !found {
+			interfaces = append(interfaces, pface)
+		}
+	}
+	return interfaces, nil
+}
+
+// LoadPreset loads the rules of the preset name, rules loaded after it
+// override them
+func (profile *PhantomProfile) LoadPreset(name string) error {
+	conf, err := presetFS.Open("presets/" + name + ".conf")
+	if err != nil {
+		return errors.New("unknown preset " + name)
+	}
+	defer conf.Close()
+
+	return profile.ReadProfile(conf, "preset "+name)
+}
@@ -0,0 +1,381 @@
+package phantomtcp
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// a profile in JSON, the same rules as a .conf file:
+//
+//	{
+//	    "options": {"dns-min-ttl": 300, "no-ecs": ["example.com"]},
+//	    "rules": [
+//	        {"interface": "proxy", "domains": [".example.com"]},
+//	        {"interface": "proxy", "domains": ["example.net"], "addresses": ["1.2.3.4"]},
+//	        {"domains": ["example.org"], "alias": "example.com"}
+//	    ]
+//	}
+//
+// The client option holds the blocks of client= lines as profiles by
+// their clients: {"client": {"192.168.1.0/24": {"rules": [...]}}}.
+// Unknown fields, options and interfaces and bad values are errors
+// instead of being taken as domains.
+type ProfileConfig struct {
+	Options map[string]json.RawMessage `json:"options,omitempty"`
+	Rules   []RuleConfig               `json:"rules,omitempty"`
+}
+
+type RuleConfig struct {
+	Interface string   `json:"interface,omitempty"`
+	Domains   []string `json:"domains"`
+	Addresses []string `json:"addresses,omitempty"` //domain=ip,ip
+	Alias     string   `json:"alias,omitempty"`     //domain=>alias
+	Same      string   `json:"same,omitempty"`      //domain=[same]
+}
+
+const (
+	optionInt = iota
+	optionBool
+	optionString
+	optionList
+	optionClients //profiles by their clients
+)
+
+// the options of a profile and the type of their values
+var profileOptions = map[string]int{
+	"dns-min-ttl":       optionInt,
+	"dns-negative-ttl":  optionInt,
+	"dns-failures":      optionInt,
+	"dns-prefetch":      optionInt,
+	"dns-cache-size":    optionInt,
+	"blocklist-refresh": optionInt,
+	"autoproxy-refresh": optionInt,
+	"include-refresh":   optionInt,
+	"querylog-size":     optionInt,
+	"rules-watch":       optionInt,
+	"subdomain":         optionInt,
+
+	"doh-canary":     optionBool,
+	"happy-eyeballs": optionBool,
+	"coalesce":       optionBool,
+	"vaddr6-route":   optionBool,
+	"local-bypass":   optionBool,
+
+	"default":       optionString,
+	"dns-order":     optionString,
+	"clat":          optionString,
+	"vaddr-prefix":  optionString,
+	"vaddr6-prefix": optionString,
+	"querylog":      optionString,
+
+	"no-ecs":     optionList,
+	"dnsroute":   optionList,
+	"fronting":   optionList,
+	"blocklist":  optionList,
+	"allowlist":  optionList,
+	"udpmapping": optionList,
+	"autoproxy":  optionList,
+	"include":    optionList,
+
+	"client": optionClients,
+}
+
+// ReadProfileJSON checks the profile conf and loads its rules, name is
+// only logged
+func (profile *PhantomProfile) ReadProfileJSON(conf io.Reader, name string) error {
+	data, err := io.ReadAll(conf)
+	if err != nil {
+		return err
+	}
+	lines, err := profile.profileLines(data)
+	if err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	return profile.ReadProfile(strings.NewReader(lines), name)
+}
+
+// profileLines translates a JSON profile to the lines of a .conf file
+func (profile *PhantomProfile) profileLines(data []byte) (string, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	var config ProfileConfig
+	err := decoder.Decode(&config)
+	if err != nil {
+		var syntax *json.SyntaxError
+		if errors.As(err, &syntax) {
+			line, column := jsonPosition(data, syntax.Offset)
+			return "", fmt.Errorf("line %d column %d: %v", line, column, err)
+		}
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) {
+			line, column := jsonPosition(data, typeErr.Offset)
+			return "", fmt.Errorf("line %d column %d: %s wants a %s, not %s", line, column, typeErr.Field, typeErr.Type, typeErr.Value)
+		}
+		if field := strings.TrimPrefix(err.Error(), "json: unknown field "); field != err.Error() {
+			field, _ = strconv.Unquote(field)
+			return "", fmt.Errorf("unknown field %q%s", field, suggest(field,
+				[]string{"options", "rules", "interface", "domains", "addresses", "alias", "same"}))
+		}
+		return "", err
+	}
+	if decoder.More() {
+		return "", errors.New("data after the profile")
+	}
+
+	var lines []string
+	names := make([]string, 0, len(config.Options))
+	for key := range config.Options {
+		names = append(names, key)
+	}
+	sort.Strings(names)
+	var clients []string
+	for _, key := range names {
+		if profileOptions[key] == optionClients {
+			clients, err = profile.clientLines(config.Options[key])
+			if err != nil {
+				return "", fmt.Errorf("options.%s%v", key, err)
+			}
+			continue
+		}
+		values, err := optionValues(key, config.Options[key])
+		if err != nil {
+			return "", fmt.Errorf("options.%s: %v", key, err)
+		}
+		for _, value := range values {
+			lines = append(lines, key+"="+value)
+		}
+	}
+
+	// the rules without an interface come first, before a section is
+	// opened, and the rules that copy another one last
+	var first, rules, last []string
+	for i, rule := range config.Rules {
+		path := fmt.Sprintf("rules[%d]", i)
+		if rule.Interface != "" {
+			if _, ok := profile.InterfaceMap[rule.Interface]; !ok {
+				var faces []string
+				for name := range profile.InterfaceMap {
+					faces = append(faces, name)
+				}
+				return "", fmt.Errorf("%s.interface: unknown interface %q%s", path, rule.Interface, suggest(rule.Interface, faces))
+			}
+		}
+		value := ""
+		set := 0
+		if len(rule.Addresses) > 0 {
+			for j, addr := range rule.Addresses {
+				if !validRuleName(addr) {
+					return "", fmt.Errorf("%s.addresses[%d]: bad address %q", path, j, addr)
+				}
+			}
+			value = "=" + strings.Join(rule.Addresses, ",")
+			set++
+		}
+		if rule.Alias != "" {
+			value = "=>" + rule.Alias
+			set++
+		}
+		if rule.Same != "" {
+			value = "=[" + rule.Same + "]"
+			set++
+		}
+		if set > 1 {
+			return "", fmt.Errorf("%s: only one of addresses, alias and same can be set", path)
+		}
+		if len(rule.Domains) == 0 {
+			return "", fmt.Errorf("%s.domains: no domain", path)
+		}
+
+		if rule.Same != "" && !validRuleName(rule.Same) {
+			return "", fmt.Errorf("%s.same: bad domain %q", path, rule.Same)
+		}
+		if rule.Alias != "" && !validRuleName(rule.Alias) {
+			return "", fmt.Errorf("%s.alias: bad domain %q", path, rule.Alias)
+		}
+
+		var domains []string
+		for j, domain := range rule.Domains {
+			if !validRuleName(domain) {
+				return "", fmt.Errorf("%s.domains[%d]: bad domain %q", path, j, domain)
+			}
+			domains = append(domains, domain+value)
+		}
+		switch {
+		case rule.Same != "":
+			last = append(last, domains...)
+		case rule.Interface == "":
+			first = append(first, domains...)
+		default:
+			rules = append(rules, "["+rule.Interface+"]")
+			rules = append(rules, domains...)
+		}
+	}
+	lines = append(lines, first...)
+	lines = append(lines, rules...)
+	lines = append(lines, last...)
+	// a block takes the lines up to the next one
+	lines = append(lines, clients...)
+	return strings.Join(lines, "\n") + "\n", nil
+}
+
+// clientLines translates the client option, profiles by their clients,
+// to client= blocks
+func (profile *PhantomProfile) clientLines(raw json.RawMessage) ([]string, error) {
+	var blocks map[string]json.RawMessage
+	if json.Unmarshal(raw, &blocks) != nil {
+		return nil, errors.New(": wants profiles by their clients")
+	}
+	specs := make([]string, 0, len(blocks))
+	for spec := range blocks {
+		specs = append(specs, spec)
+	}
+	sort.Strings(specs)
+
+	var lines []string
+	for _, spec := range specs {
+		if _, err := parseClients(spec); err != nil || strings.ContainsAny(spec, "#\n") {
+			return nil, fmt.Errorf(": bad clients %q", spec)
+		}
+		block, err := profile.profileLines(blocks[spec])
+		if err != nil {
+			return nil, fmt.Errorf("[%q]: %v", spec, err)
+		}
+		for _, line := range strings.Split(strings.TrimSuffix(block, "\n"), "\n") {
+			if strings.HasPrefix(line, "client=") {
+				return nil, fmt.Errorf("[%q]: client blocks do not nest", spec)
+			}
+		}
+		lines = append(lines, "client="+spec)
+		if block != "\n" {
+			lines = append(lines, strings.TrimSuffix(block, "\n"))
+		}
+	}
+	return lines, nil
+}
+
+// the values of the option key as the values of .conf lines
+func optionValues(key string, raw json.RawMessage) ([]string, error) {
+	kind, ok := profileOptions[key]
+	if !ok {
+		options := make([]string, 0, len(profileOptions))
+		for option := range profileOptions {
+			options = append(options, option)
+		}
+		return nil, fmt.Errorf("unknown option%s", suggest(key, options))
+	}
+
+	switch kind {
+	case optionInt:
+		var n json.Number
+		if json.Unmarshal(raw, &n) != nil {
+			return nil, errors.New("wants a number")
+		}
+		if _, err := strconv.Atoi(n.String()); err != nil {
+			return nil, errors.New("wants an integer")
+		}
+		return []string{n.String()}, nil
+	case optionBool:
+		var b bool
+		if json.Unmarshal(raw, &b) != nil {
+			return nil, errors.New("wants true or false")
+		}
+		if b {
+			return []string{"1"}, nil
+		}
+		return []string{"0"}, nil
+	case optionString:
+		var s string
+		if json.Unmarshal(raw, &s) != nil {
+			return nil, errors.New("wants a string")
+		}
+		if strings.ContainsAny(s, "#\n") {
+			return nil, fmt.Errorf("bad value %q", s)
+		}
+		return []string{s}, nil
+	default:
+		var list []string
+		if json.Unmarshal(raw, &list) != nil {
+			var s string
+			if json.Unmarshal(raw, &s) != nil {
+				return nil, errors.New("wants a string or a list of strings")
+			}
+			list = []string{s}
+		}
+		for _, s := range list {
+			if strings.ContainsAny(s, "#\n") {
+				return nil, fmt.Errorf("bad value %q", s)
+			}
+		}
+		return list, nil
+	}
+}
+
+// a domain, pattern or address of a rule fits on its line
+func validRuleName(name string) bool {
+	if name == "" || name[0] == '[' || name[0] == '>' {
+		return false
+	}
+	return !strings.ContainsAny(name, "=#, \t\r\n")
+}
+
+// line and column of offset in data
+func jsonPosition(data []byte, offset int64) (int, int) {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	before := data[:offset]
+	line := bytes.Count(before, []byte{'\n'}) + 1
+	column := int(offset) - bytes.LastIndexByte(before, '\n')
+	return line, column
+}
+
+// ", did you mean x" for the candidate closest to name
+func suggest(name string, candidates []string) string {
+	best, distance := "", 3
+	for _, c := range candidates {
+		if d := editDistance(name, c); d < distance {
+			best, distance = c, d
+		}
+	}
+	if best == "" {
+		return ""
+	}
+	return fmt.Sprintf(", did you mean %q", best)
+}
+
+func editDistance(a, b string) int {
+	row := make([]int, len(b)+1)
+	for j := range row {
+		row[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		prev := row[0]
+		row[0] = i
+		for j := 1; j <= len(b); j++ {
+			current := row[j]
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			row[j] = min3(row[j]+1, row[j-1]+1, prev+cost)
+			prev = current
+		}
+	}
+	return row[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
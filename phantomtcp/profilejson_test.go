@@ -0,0 +1,32 @@
+package phantomtcp
+
+import "testing"
+
+func TestProfileLinesClients(t *testing.T) {
+	profile := &PhantomProfile{InterfaceMap: map[string]PhantomInterface{"proxy": {}}}
+	tests := []struct {
+		json  string
+		lines string
+		ok    bool
+	}{
+		{`{"options": {"client": {"192.168.2.0/24": {"rules": [{"interface": "proxy", "domains": ["b.com"]}]}, "192.168.1.7": {}}, "dns-min-ttl": 60},
+		   "rules": [{"interface": "proxy", "domains": ["a.com"]}]}`,
+			"dns-min-ttl=60\n[proxy]\na.com\nclient=192.168.1.7\nclient=192.168.2.0/24\n[proxy]\nb.com\n", true},
+		{`{"options": {"client": {"192.168.1.0/24": {"options": {"dns-min-ttl": 60}}}}}`,
+			"client=192.168.1.0/24\ndns-min-ttl=60\n", true},
+		{`{"options": {"client": {"lan": {}}}}`, "", false},
+		{`{"options": {"client": ["192.168.1.0/24"]}}`, "", false},
+		{`{"options": {"client": {"192.168.1.0/24": {"rules": [{"interface": "vpn", "domains": ["b.com"]}]}}}}`, "", false},
+		{`{"options": {"client": {"192.168.1.0/24": {"options": {"client": {"10.0.0.1": {}}}}}}}`, "", false},
+	}
+	for _, tt := range tests {
+		lines, err := profile.profileLines([]byte(tt.json))
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: %v", tt.json, err)
+			continue
+		}
+		if lines != tt.lines && tt.ok {
+			t.Errorf("%s:\n%q, want\n%q", tt.json, lines, tt.lines)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package phantomtcp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the protocols of the connections of a rule, "" is the rule of the
+// connections without one
+type ProtocolStats struct {
+	Rule         string            `json:"rule"`
+	Connections  uint64            `json:"connections"`
+	TLS          map[string]uint64 `json:"tls,omitempty"`  //versions the servers chose
+	ALPN         map[string]uint64 `json:"alpn,omitempty"` //protocols the clients offered
+	HTTP         uint64            `json:"http,omitempty"`
+	Other        uint64            `json:"other,omitempty"`
+	HTTP3        uint64            `json:"http3,omitempty"`         //QUIC flows relayed
+	HTTP3Dropped uint64            `json:"http3_dropped,omitempty"` //QUIC flows the rule did not allow
+}
+
+type protocolStats struct {
+	lock  sync.Mutex
+	rules map[string]*ProtocolStats
+}
+
+func (profile *PhantomProfile) protocolRecord(domain string) *ProtocolStats {
+	rule := ""
+	if domain != "" {
+		rule = profile.Rules().matchRule(domain)
+	}
+	stats := &profile.protocols
+	if stats.rules == nil {
+		stats.rules = make(map[string]*ProtocolStats)
+	}
+	record, ok := stats.rules[rule]
+	if !ok {
+		record = &ProtocolStats{Rule: rule, TLS: make(map[string]uint64), ALPN: make(map[string]uint64)}
+		stats.rules[rule] = record
+	}
+	return record
+}
+
+var tlsVersions = map[uint16]string{0x0301: "1.0", 0x0302: "1.1", 0x0303: "1.2", 0x0304: "1.3"}
+
+func tlsVersion(version uint16) string {
+	if name, ok := tlsVersions[version]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%04x", version)
+}
+
+// helloExtensions returns the type of the ClientHello or ServerHello at
+// the start of b and calls f with each of its extensions
+func helloExtensions(b []byte, f func(ext uint16, data []byte)) byte {
+	if len(b) < 44 || b[0] != 0x16 || (b[5] != 1 && b[5] != 2) {
+		return 0
+	}
+	hello := b[5]
+	offset := 44 + int(b[43])
+	if hello == 1 {
+		if offset+2 > len(b) {
+			return hello
+		}
+		offset += 2 + int(binary.BigEndian.Uint16(b[offset:]))
+		if offset >= len(b) {
+			return hello
+		}
+		offset += 1 + int(b[offset])
+	} else {
+		offset += 3
+	}
+	if offset+2 > len(b) {
+		return hello
+	}
+	end := offset + 2 + int(binary.BigEndian.Uint16(b[offset:]))
+	offset += 2
+	if end > len(b) {
+		end = len(b)
+	}
+	for offset+4 <= end {
+		ext := binary.BigEndian.Uint16(b[offset:])
+		length := int(binary.BigEndian.Uint16(b[offset+2:]))
+		offset += 4
+		if offset+length > end {
+			break
+		}
+		f(ext, b[offset:offset+length])
+		offset += length
+	}
+	return hello
+}
+
+// the ALPN protocols in the data of the extension, comma separated
+func alpnList(data []byte) string {
+	var protocols []string
+	for offset := 2; offset < len(data); {
+		l := int(data[offset])
+		if offset+1+l > len(data) {
+			break
+		}
+		protocols = append(protocols, string(data[offset+1:offset+1+l]))
+		offset += 1 + l
+	}
+	return strings.Join(protocols, ",")
+}
+
+// countConnection counts a relayed connection to domain with the first
+// data of the client
+func (profile *PhantomProfile) countConnection(domain string, header []byte) {
+	alpn := ""
+	hello := helloExtensions(header, func(ext uint16, data []byte) {
+		if ext == 16 {
+			alpn = alpnList(data)
+		}
+	})
+
+	profile.protocols.lock.Lock()
+	defer profile.protocols.lock.Unlock()
+	record := profile.protocolRecord(domain)
+	record.Connections++
+	switch {
+	case hello == 1:
+		if alpn == "" {
+			alpn = "none"
+		}
+		record.ALPN[alpn]++
+	case len(header) == 0:
+	case DetectProtocol(header) == "http":
+		record.HTTP++
+	default:
+		record.Other++
+	}
+}
+
+// countServerHello counts the TLS version the server of domain chose,
+// from the supported_versions extension for TLS 1.3
+func (profile *PhantomProfile) countServerHello(domain string, b []byte) {
+	if len(b) < 11 {
+		return
+	}
+	version := binary.BigEndian.Uint16(b[9:11])
+	hello := helloExtensions(b, func(ext uint16, data []byte) {
+		if ext == 43 && len(data) == 2 {
+			version = binary.BigEndian.Uint16(data)
+		}
+	})
+	if hello != 2 {
+		return
+	}
+
+	profile.protocols.lock.Lock()
+	profile.protocolRecord(domain).TLS[tlsVersion(version)]++
+	profile.protocols.lock.Unlock()
+}
+
+// countQUIC counts a QUIC flow to domain, dropped when its rule does not
+// allow it
+func (profile *PhantomProfile) countQUIC(domain string, dropped bool) {
+	profile.protocols.lock.Lock()
+	record := profile.protocolRecord(domain)
+	if dropped {
+		record.HTTP3Dropped++
+	} else {
+		record.HTTP3++
+	}
+	profile.protocols.lock.Unlock()
+}
+
+// relayServerHello passes the first data of the server to the client and
+// counts the TLS version in it, the relay takes over after it
+func (profile *PhantomProfile) relayServerHello(client, conn net.Conn, domain string) (int, error) {
+	b := make([]byte, 1460)
+	conn.SetReadDeadline(time.Now().Add(time.Second * 10))
+	n, err := conn.Read(b)
+	conn.SetReadDeadline(time.Time{})
+	if n > 0 {
+		profile.countServerHello(domain, b[:n])
+		_, werr := client.Write(b[:n])
+		return n, werr
+	}
+	if err, ok := err.(net.Error); ok && err.Timeout() {
+		return 0, nil
+	}
+	return 0, err
+}
+
+// ProtocolStats returns the protocols of the connections of each rule,
+// the rules with the most connections first
+func (profile *PhantomProfile) ProtocolStats() []ProtocolStats {
+	profile.protocols.lock.Lock()
+	var list []ProtocolStats
+	for _, record := range profile.protocols.rules {
+		r := *record
+		r.TLS = make(map[string]uint64)
+		for k, v := range record.TLS {
+			r.TLS[k] = v
+		}
+		r.ALPN = make(map[string]uint64)
+		for k, v := range record.ALPN {
+			r.ALPN[k] = v
+		}
+		list = append(list, r)
+	}
+	profile.protocols.lock.Unlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		a, b := list[i].Connections+list[i].HTTP3+list[i].HTTP3Dropped, list[j].Connections+list[j].HTTP3+list[j].HTTP3Dropped
+		if a != b {
+			return a > b
+		}
+		return list[i].Rule < list[j].Rule
+	})
+	return list
+}
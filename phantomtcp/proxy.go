@@ -3,7 +3,7 @@ package phantomtcp
 import (
 	"bytes"
 	"encoding/binary"
-	"log"
+	"errors"
 	"math/rand"
 	"net"
 	"strconv"
@@ -16,7 +16,41 @@ func ReadAtLeast() {
 
 }
 
-func SocksProxy(client net.Conn) {
+// an intercepted connection that sends nothing for FirstByteTimeout is
+// closed or relayed unmodified ("close" or "direct"), one that is neither
+// TLS nor HTTP gets UnknownAction, "desync" treats it like HTTP
+var FirstByteTimeout = time.Second * 10
+var SilentAction = "direct"
+var UnknownAction = "desync"
+
+var httpMethods = []string{"GET ", "POST ", "HEAD ", "PUT ", "DELETE ", "OPTIONS ", "PATCH ", "CONNECT ", "TRACE "}
+
+// "tls", "http" or "" for the first bytes of a connection
+func DetectProtocol(header []byte) string {
+	if len(header) > 5 && header[0] == 0x16 && header[1] == 3 {
+		return "tls"
+	}
+	for _, method := range httpMethods {
+		if bytes.HasPrefix(header, []byte(method)) {
+			return "http"
+		}
+	}
+	return ""
+}
+
+// DialPlain connects through pface without modifying the payload
+func (pface *PhantomInterface) DialPlain(host string, port int, b []byte) (net.Conn, error) {
+	plain := *pface
+	plain.Hint &^= HINT_MODIFY
+	conn, _, err := plain.Dial(host, port, b)
+	return conn, err
+}
+
+func (profile *PhantomProfile) SocksProxy(client net.Conn) {
+	profile.socksProxy(client, nil)
+}
+
+func (profile *PhantomProfile) socksProxy(client net.Conn, upstream *PhantomInterface) {
 	defer client.Close()
 
 	host := ""
@@ -29,7 +63,7 @@ func SocksProxy(client net.Conn) {
 			return
 		}
 
-		var reply []byte
+		var reply *replyConn
 		if b[0] == 0x05 {
 			client.Write([]byte{0x05, 0x00})
 			n, err = client.Read(b[:4])
@@ -68,55 +102,79 @@ func SocksProxy(client net.Conn) {
 			default:
 				// 0x08: address type not supported
 				logPrintln(3, "address type", b[0], "not supported from", client.RemoteAddr())
-				client.Write([]byte{5, 9, 0, 1, 0, 0, 0, 0, 0, 0})
+				client.Write([]byte{5, 8, 0, 1, 0, 0, 0, 0, 0, 0})
 				return
 			}
-			reply = []byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0}
+			reply = socks5Reply(client)
 		} else if b[0] == 0x04 {
-			if n > 8 && b[1] == 1 {
-				userEnd := 8 + bytes.IndexByte(b[8:n], 0)
-				addr.Port = int(binary.BigEndian.Uint16(b[2:4]))
-				if b[4]|b[5]|b[6] == 0 {
-					hostEnd := bytes.IndexByte(b[userEnd+1:n], 0)
-					if hostEnd > 0 {
-						host = string(b[userEnd+1 : userEnd+1+hostEnd])
-					} else {
-						client.Write([]byte{0, 91, 0, 0, 0, 0, 0, 0})
-						return
-					}
-				} else {
-					if b[4] == VirtualAddrPrefix {
-						index := int(binary.BigEndian.Uint16(b[6:8]))
-						if index >= len(Nose) {
-							return
-						}
-						host = Nose[index]
-					} else {
-						addr.IP = net.IP(b[4:8])
-					}
-				}
-
-				reply = []byte{0, 90, b[2], b[3], b[4], b[5], b[6], b[7]}
-			} else {
+			addr, host, err = readSocks4(client, b[:], n)
+			if err != nil {
+				logPrintln(3, client.RemoteAddr(), err)
 				client.Write([]byte{0, 91, 0, 0, 0, 0, 0, 0})
 				return
 			}
+			reply = socks4Reply(client, []byte{0, 90, b[2], b[3], b[4], b[5], b[6], b[7]})
 		} else {
 			logPrintln(3, "unknow from", client.RemoteAddr())
 			return
 		}
 
-		if err == nil {
-			_, err = client.Write(reply)
-		}
-		
 		if err != nil {
 			logPrintln(1, err)
 			return
 		}
+		// the reply waits for the connection to the server
+		client = reply
 	}
 
-	tcp_redirect(client, &addr, host, nil)
+	profile.tcp_redirect(client, &addr, host, nil, upstream)
+}
+
+// readSocks4 reads the SOCKS4 CONNECT request of which b[:n] is read:
+// VN CD DSTPORT DSTIP USERID 0, and the host and a 0 after it for a
+// SOCKS4a request, whose DSTIP is 0.0.0.x. Legacy clients may send it in
+// more than one segment.
+func readSocks4(client net.Conn, b []byte, n int) (addr net.TCPAddr, host string, err error) {
+	ends := 1
+	for {
+		if n >= 8 {
+			if b[4]|b[5]|b[6] == 0 && b[7] != 0 {
+				ends = 2
+			}
+			if bytes.Count(b[8:n], []byte{0}) >= ends {
+				break
+			}
+		}
+		if n == len(b) {
+			return addr, "", errors.New("socks4 request too long")
+		}
+		m, err := client.Read(b[n:])
+		if err != nil {
+			return addr, "", err
+		}
+		n += m
+	}
+	if b[1] != 1 {
+		return addr, "", errors.New("socks4 command " + strconv.Itoa(int(b[1])) + " not supported")
+	}
+
+	addr.Port = int(binary.BigEndian.Uint16(b[2:4]))
+	if ends == 1 {
+		if b[4]|b[5]|b[6]|b[7] == 0 {
+			return addr, "", errors.New("socks4 request without an address")
+		}
+		addr.IP = net.IPv4(b[4], b[5], b[6], b[7]).To4()
+		return addr, "", nil
+	}
+	start := 8 + bytes.IndexByte(b[8:n], 0) + 1
+	host = string(b[start : start+bytes.IndexByte(b[start:n], 0)])
+	if host == "" {
+		return addr, "", errors.New("socks4a request without a host")
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		addr.IP, host = ip, ""
+	}
+	return addr, host, nil
 }
 
 func validOptionalPort(port string) bool {
@@ -155,13 +213,20 @@ func splitHostPort(hostport string) (host string, port int) {
 	return
 }
 
-func SNIProxy(client net.Conn) {
+// SNIProxy serves the connections of a reverse service, to names that
+// resolve to it: the destination is the SNI of the ClientHello or the Host
+// of the request, looked up and dialed with the rules of the name
+func (profile *PhantomProfile) SNIProxy(client net.Conn) {
 	defer client.Close()
 
-	var b [1460]byte
-	n, err := client.Read(b[:])
+	b := make([]byte, 5+16384)
+	if FirstByteTimeout > 0 {
+		client.SetReadDeadline(time.Now().Add(FirstByteTimeout))
+	}
+	n, err := readHead(client, b)
+	client.SetReadDeadline(time.Time{})
 	if err != nil {
-		log.Println(err)
+		logPrintln(2, "Reverse:", client.RemoteAddr(), err)
 		return
 	}
 
@@ -194,11 +259,37 @@ func SNIProxy(client net.Conn) {
 			return
 		}
 	}
+	if isLocalHost(host) {
+		// not the services of this machine to the clients of the listener
+		logPrintln(2, "Reverse:", client.RemoteAddr(), "->", host, "local")
+		return
+	}
 
-	tcp_redirect(client, &net.TCPAddr{Port: port}, host, b[:n])
+	profile.tcp_redirect(client, &net.TCPAddr{Port: port}, host, b[:n], nil)
 }
 
-func RedirectProxy(client net.Conn) {
+// readHead reads the first TLS record or the header of the HTTP request
+// of a client, which may come in several segments, at most len(b) bytes
+func readHead(client net.Conn, b []byte) (int, error) {
+	n := 0
+	for n < len(b) {
+		m, err := client.Read(b[n:])
+		n += m
+		if err != nil {
+			return n, err
+		}
+		if b[0] == 0x16 {
+			if n >= 5 && n >= 5+int(binary.BigEndian.Uint16(b[3:5])) {
+				break
+			}
+		} else if bytes.Contains(b[:n], []byte("\r\n\r\n")) {
+			break
+		}
+	}
+	return n, nil
+}
+
+func (profile *PhantomProfile) RedirectProxy(client net.Conn) {
 	addr, err := GetOriginalDST(client.(*net.TCPConn))
 	if err != nil {
 		client.Close()
@@ -210,57 +301,199 @@ func RedirectProxy(client net.Conn) {
 		client.Close()
 		return
 	}
-	tcp_redirect(client, addr, "", nil)
+	profile.tcp_redirect(client, addr, "", nil, nil)
+}
+
+// a connection handed over by a frontend that rewrote its addresses,
+// with the address of its client
+type addrConn struct {
+	net.Conn
+	remote net.Addr
 }
 
-func tcp_redirect(client net.Conn, addr *net.TCPAddr, domain string, header []byte) {
+func (conn *addrConn) RemoteAddr() net.Addr {
+	return conn.remote
+}
+
+// connections to domains without an interface go through upstream, or
+// directly if it is nil
+func (profile *PhantomProfile) tcp_redirect(client net.Conn, addr *net.TCPAddr, domain string, header []byte, upstream *PhantomInterface) {
+	// so do the connections
+	if src, ok := client.RemoteAddr().(*net.TCPAddr); ok {
+		if scoped := profile.ForClient(src.IP); scoped != profile {
+			scoped.tcp_redirect(client, addr, domain, header, upstream)
+			return
+		}
+	}
+
 	defer client.Close()
 
+	if isLocalHost(domain) || (domain == "" && isLocalAddress(addr.IP)) {
+		relayLocal(client, addr, domain, header)
+		return
+	}
+
+	if !Chaos.Dial(client) {
+		return
+	}
+
+	// the rules the connection was accepted with, a reload does not
+	// change them halfway
+	rules := profile.Rules()
+
 	var conn net.Conn
 	var err error
+	var headers *httpConn
+	defer func() {
+		if conn == nil || err != nil {
+			failReply(client, err)
+		}
+	}()
 	{
 		var port int
 		if domain == "" {
-			switch addr.IP[0] {
-			case 0x00:
-				index := int(binary.BigEndian.Uint32(addr.IP[12:16]))
-				if index >= len(Nose) {
+			if index := redirectIndex(addr.IP); index != -1 {
+				domain = profile.FakeName(index)
+				if domain == "" {
 					return
 				}
-				domain = Nose[index]
-			case VirtualAddrPrefix:
-				index := int(binary.BigEndian.Uint16(addr.IP[2:4]))
-				if index >= len(Nose) {
-					return
-				}
-				domain = Nose[index]
+				profile.logConnection(client.RemoteAddr(), domain)
 			}
 		}
 		port = addr.Port
 
-		pface := DefaultProfile.GetInterface(domain)
-		if pface != nil && (pface.Protocol != 0 || pface.Hint != 0) {
+		aliased := domain != "" && rules.GetAlias(domain) != domain
+		if aliased {
+			logPrintln(2, "Alias:", domain, "->", rules.GetAlias(domain))
+			domain = rules.GetAlias(domain)
+		}
+
+		pface := rules.GetInterface(domain)
+		// a connection to an address uses the rule of the address or of
+		// the longest CIDR entry that contains it
+		byAddress := false
+		if domain == "" && addr.IP != nil {
+			if pface = rules.GetInterface(addr.IP.String()); pface != nil {
+				domain = addr.IP.String()
+				byAddress = true
+			}
+		}
+		// a rule of the port comes before the rule of the name
+		name := domain
+		if name == "" && addr.IP != nil {
+			name = addr.IP.String()
+		}
+		if face, ok := rules.GetPortInterface(name, port); ok {
+			pface = face
+			if domain == "" {
+				domain = name
+				byAddress = true
+			}
+		}
+		if domain != "" {
+			profile.hitRule(domain)
+		}
+		if pface != nil && (pface.Protocol != 0 || pface.Hint != 0 || pface.headers != nil) {
 			if pface.Hint&HINT_NOTCP != 0 {
+				err = proxyErrorf("blocked", "tcp to %s is blocked", domain)
 				time.Sleep(time.Second)
 				return
 			}
 
+			action := ""
+			if header == nil && domain != "" && (pface.Protocol == DIRECT || pface.Protocol == NAT64) {
+				// resolved before the client is answered so that it learns
+				// about DNS failures, the dial uses the cached answer
+				_, err = pface.GetRemoteAddresses(domain, port)
+				if err != nil && !(FailOpen && classifyError(err).Kind == "dns-timeout") {
+					logPrintln(1, domain, err)
+					return
+				}
+				err = nil
+			}
 			if header == nil {
 				b := make([]byte, 1460)
+				if FirstByteTimeout > 0 {
+					client.SetReadDeadline(time.Now().Add(FirstByteTimeout))
+				}
 				n, err := client.Read(b)
+				client.SetReadDeadline(time.Time{})
 				if err != nil {
-					logPrintln(1, err)
-					return
+					if err, ok := err.(net.Error); !ok || !err.Timeout() {
+						logPrintln(1, err)
+						return
+					}
+					action = "direct"
+					if SilentAction == "close" {
+						action = "close"
+					}
 				}
 				header = b[:n]
 			}
+			if action == "" {
+				header = profile.rewriteHeader(header)
+				protocol := DetectProtocol(header)
+				if port == 443 && protocol != "tls" && pface.NonTLS != "" {
+					action = pface.NonTLS
+				} else if protocol == "" {
+					action = UnknownAction
+				}
+			}
 
-			if header[0] == 0x16 {
+			if action == "close" {
+				logPrintln(2, "Redirect:", client.RemoteAddr(), "->", domain, port, "closed", len(header))
+				return
+			} else if action == "direct" || action == "passthrough" {
+				logPrintln(1, "Redirect:", client.RemoteAddr(), "->", domain, port, "unmodified")
+				if len(header) == 0 {
+					header = nil
+				}
+				conn, err = pface.DialPlain(domain, port, header)
+				if err != nil {
+					logPrintln(1, domain, err)
+					return
+				}
+			} else if action == "segment" {
+				logPrintln(1, "Redirect:", client.RemoteAddr(), "->", domain, port, "segmented")
+				conn, err = pface.DialPlain(domain, port, header[:1])
+				if err != nil {
+					logPrintln(1, domain, err)
+					return
+				}
+				_, err = conn.Write(header[1:])
+				if err != nil {
+					logPrintln(1, domain, err)
+					conn.Close()
+					return
+				}
+			} else if action != "" && action != "desync" {
+				proxy, ok := profile.InterfaceMap[action]
+				if !ok {
+					logPrintln(1, "Redirect:", domain, port, "unknown interface", action)
+					return
+				}
+				logPrintln(1, "Redirect:", client.RemoteAddr(), "->", domain, port, &proxy)
+				var info *ConnectionInfo
+				conn, info, err = proxy.Dial(domain, port, header)
+				if err != nil {
+					logPrintln(1, domain, err)
+					return
+				}
+				if info != nil {
+					proxy.Keep(client, conn, info)
+					return
+				}
+			} else if header[0] == 0x16 {
 				offset, length := GetSNI(header)
-				if length > 0 {
+				// with ECH the SNI is the public name of the server
+				_, ech := profile.HTTPSRecord(domain)
+				if length > 0 && ech == nil && !byAddress {
 					_domain := string(header[offset : offset+length])
 					if domain != _domain {
-						pface = DefaultProfile.GetInterface(domain)
+						pface = rules.GetInterface(domain)
+						if face, ok := rules.GetPortInterface(domain, port); ok {
+							pface = face
+						}
 						if pface == nil {
 							return
 						}
@@ -276,8 +509,30 @@ func tcp_redirect(client net.Conn, addr *net.TCPAddr, domain string, header []by
 					return
 				}
 			} else {
+				// a fake address shared by coalesced names, the Host of the
+				// request tells which of them it is for
+				if offset, length := GetHost(header); length > 0 && !byAddress {
+					host, _ := splitHostPort(string(header[offset : offset+length]))
+					if host != domain && net.ParseIP(host) == nil && rules.GetInterface(host) == pface {
+						domain = host
+					}
+				}
 				logPrintln(1, "Redirect:", client.RemoteAddr(), "->", domain, port, pface)
-				if pface.Hint&HINT_HTTP3 != 0 {
+				if pface.headers != nil && DetectProtocol(header) == "http" {
+					headers = newHTTPConn(client, header, pface.headers)
+					header, err = headers.head()
+					if err != nil {
+						logPrintln(1, domain, err)
+						return
+					}
+				}
+				upgrade := pface.Upgrade
+				if alpn, _ := profile.HTTPSRecord(domain); upgrade != "" && alpn&HINT_HTTP3 != 0 && !strings.Contains(upgrade, "h3") {
+					upgrade += ",h3"
+				}
+				if upgrade != "" && HttpUpgrade(client, upgrade, header) {
+					return
+				} else if pface.Hint&HINT_HTTP3 != 0 {
 					HttpMove(client, "h3", header)
 					return
 				} else if pface.Hint&HINT_HTTPS != 0 {
@@ -287,7 +542,10 @@ func tcp_redirect(client net.Conn, addr *net.TCPAddr, domain string, header []by
 					HttpMove(client, pface.Address, header)
 					return
 				} else if pface.Hint&HINT_STRIP != 0 {
-					if pface.Hint&HINT_FRONTING != 0 {
+					if pool := rules.frontingPool(domain); pool != nil {
+						conn, err = pface.dialFronting(domain, pool)
+						domain = ""
+					} else if pface.Hint&HINT_FRONTING != 0 {
 						conn, err = pface.DialStrip(domain, "")
 						domain = ""
 					} else {
@@ -317,20 +575,42 @@ func tcp_redirect(client net.Conn, addr *net.TCPAddr, domain string, header []by
 					}
 				}
 			}
-		} else if addr.IP != nil {
-			logPrintln(1, "Redirect:", client.RemoteAddr(), "->", addr)
-			conn, err = net.DialTCP("tcp", nil, addr)
-			if err != nil {
-				logPrintln(1, domain, err)
-				return
-			}
 		} else {
-			logPrintln(1, "Redirect:", client.RemoteAddr(), "->", domain, port)
-			conn, err = net.Dial("tcp", domain + ":" + strconv.Itoa(port))
+			host := domain
+			// a fake address stands for the name, which a port rule
+			// without an interface sends directly
+			if addr.IP != nil && VirtualIndex(addr.IP) == -1 {
+				host = addr.IP.String()
+			}
+			if upstream != nil {
+				logPrintln(1, "Redirect:", client.RemoteAddr(), "->", host, port, "via", upstream.Address)
+			} else {
+				logPrintln(1, "Redirect:", client.RemoteAddr(), "->", host, port)
+			}
+			conn, err = dialUpstream(upstream, host, port)
 			if err != nil {
 				logPrintln(1, domain, err)
 				return
 			}
+
+			if aliased && header == nil {
+				b := make([]byte, 1460)
+				n, err := client.Read(b)
+				if err != nil {
+					logPrintln(1, err)
+					conn.Close()
+					return
+				}
+				header = b[:n]
+			}
+			if len(header) > 0 {
+				_, err = conn.Write(profile.rewriteHeader(header))
+				if err != nil {
+					logPrintln(1, domain, err)
+					conn.Close()
+					return
+				}
+			}
 		}
 	}
 
@@ -340,7 +620,32 @@ func tcp_redirect(client net.Conn, addr *net.TCPAddr, domain string, header []by
 
 	defer conn.Close()
 
-	_, _, err = relay(client, conn)
+	client, err = unwrapReply(client)
+	if err != nil {
+		logPrintln(1, err)
+		return
+	}
+	if Chaos.ResetConn(client) {
+		return
+	}
+	if headers != nil {
+		headers.Conn = client
+		client = headers
+	}
+
+	profile.countConnection(domain, header)
+	var hello int
+	if len(header) > 0 && header[0] == 0x16 {
+		hello, err = profile.relayServerHello(client, conn, domain)
+		if err != nil {
+			FinishTrace(conn, int64(hello), err)
+			logPrintln(1, "relay error:", err)
+			return
+		}
+	}
+
+	recv, _, err := relay(client, conn)
+	FinishTrace(conn, recv+int64(hello), err)
 	if err != nil {
 		if err, ok := err.(net.Error); ok && err.Timeout() {
 			return // ignore i/o timeout
@@ -349,14 +654,7 @@ func tcp_redirect(client net.Conn, addr *net.TCPAddr, domain string, header []by
 	}
 }
 
-func QUICProxy(address string) {
-	client, err := ListenUDP(address)
-	if err != nil {
-		logPrintln(1, err)
-		return
-	}
-	defer client.Close()
-
+func (profile *PhantomProfile) QUICProxy(client *net.UDPConn) {
 	var UDPLock sync.Mutex
 	var UDPMap map[string]net.Conn = make(map[string]net.Conn)
 	data := make([]byte, 1500)
@@ -374,19 +672,31 @@ func QUICProxy(address string) {
 			udpConn.Write(data[:n])
 		} else {
 			SNI := GetQUICSNI(data[:n])
-			if SNI != "" {
-				server := DefaultProfile.GetInterface(SNI)
-				if server.Hint&HINT_UDP == 0 {
+			if SNI != "" && !isLocalHost(SNI) {
+				server := profile.GetInterface(SNI)
+				if server == nil {
 					continue
 				}
-				_, ips := NSLookup(SNI, server.Hint, server.DNS)
-				if ips == nil {
+				// a SOCKS5 proxy relays UDP as well
+				blocked := server.Hint&HINT_UDP == 0 && server.Protocol != SOCKS5
+				profile.countQUIC(SNI, blocked)
+				if blocked {
 					continue
 				}
 
-				logPrintln(1, "[QUIC]", clientAddr.String(), SNI, ips)
-
-				udpConn, err = net.DialUDP("udp", nil, &net.UDPAddr{IP: ips[0], Port: 443})
+				var proxyConn net.Conn
+				if server.Protocol != DIRECT {
+					// not around the proxy of the rule
+					logPrintln(1, "[QUIC]", clientAddr.String(), SNI, server)
+					udpConn, proxyConn, err = server.DialUDPProxy(SNI, 443)
+				} else {
+					_, ips := profile.NSLookup(SNI, server.Hint, server.DNS)
+					if ips == nil {
+						continue
+					}
+					logPrintln(1, "[QUIC]", clientAddr.String(), SNI, ips)
+					udpConn, err = net.DialUDP("udp", nil, &net.UDPAddr{IP: ips[0], Port: 443})
+				}
 				if err != nil {
 					logPrintln(1, err)
 					continue
@@ -408,46 +718,40 @@ func QUICProxy(address string) {
 					continue
 				}
 
-				go func(clientAddr net.UDPAddr) {
+				go func(clientAddr net.UDPAddr, udpConn, proxyConn net.Conn) {
 					data := make([]byte, 1500)
-					udpConn.SetReadDeadline(time.Now().Add(time.Minute * 2))
+					info := trackFlow(&clientAddr, udpConn)
 					for {
-						n, err := udpConn.Read(data)
+						n, err := info.readFlow(udpConn, data)
 						if err != nil {
+							untrackRelay(udpConn)
 							UDPLock.Lock()
 							delete(UDPMap, clientAddr.String())
 							UDPLock.Unlock()
 							udpConn.Close()
+							if proxyConn != nil {
+								proxyConn.Close()
+							}
 							return
 						}
-						udpConn.SetReadDeadline(time.Now().Add(time.Minute * 2))
 						client.WriteToUDP(data[:n], &clientAddr)
 					}
-				}(*clientAddr)
+				}(*clientAddr, udpConn, proxyConn)
 			}
 		}
 	}
 }
 
-func SocksUDPProxy(address string) {
-	laddr, err := net.ResolveUDPAddr("udp", address)
-	if err != nil {
-		logPrintln(1, err)
-		return
-	}
-	local, err := net.ListenUDP("udp", laddr)
-	if err != nil {
-		logPrintln(1, err)
-		return
-	}
-	defer local.Close()
-
+func (profile *PhantomProfile) SocksUDPProxy(local *net.UDPConn) {
 	var ConnLock sync.Mutex
 	var ConnMap map[string]net.Conn = make(map[string]net.Conn)
 	data := make([]byte, 1472)
 	for {
 		n, srcAddr, err := local.ReadFromUDP(data)
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
 			logPrintln(1, err)
 			continue
 		}
@@ -472,14 +776,13 @@ func SocksUDPProxy(address string) {
 			ConnLock.Unlock()
 
 			var remoteConn net.Conn = nil
-			if data[4] == VirtualAddrPrefix {
-				index := int(binary.BigEndian.Uint32(data[6:8]))
-				if index >= len(Nose) {
-					return
+			if index := VirtualIndex(net.IP(data[4:8])); index != -1 {
+				host = profile.FakeName(index)
+				if host == "" {
+					continue
 				}
-				host = Nose[index]
-				server := DefaultProfile.GetInterface(host)
-				if server.Protocol != 0 {
+				server := profile.GetInterface(host)
+				if server == nil || server.Protocol != 0 {
 					continue
 				}
 				if server.Hint&(HINT_UDP|HINT_HTTP3) == 0 {
@@ -490,7 +793,7 @@ func SocksUDPProxy(address string) {
 						continue
 					}
 				}
-				_, ips := NSLookup(host, server.Hint, server.DNS)
+				_, ips := profile.NSLookup(host, server.Hint, server.DNS)
 				if ips == nil {
 					continue
 				}
@@ -526,17 +829,17 @@ func SocksUDPProxy(address string) {
 
 			go func(srcAddr net.UDPAddr, remoteConn net.Conn, key string) {
 				data := make([]byte, 1472)
-				remoteConn.SetReadDeadline(time.Now().Add(time.Minute * 2))
+				info := trackFlow(&srcAddr, remoteConn)
 				for {
-					n, err := remoteConn.Read(data)
+					n, err := info.readFlow(remoteConn, data)
 					if err != nil {
+						untrackRelay(remoteConn)
 						ConnLock.Lock()
 						delete(ConnMap, key)
 						ConnLock.Unlock()
 						remoteConn.Close()
 						return
 					}
-					remoteConn.SetReadDeadline(time.Now().Add(time.Minute * 2))
 					local.WriteToUDP(data[:n], &srcAddr)
 				}
 			}(*srcAddr, remoteConn, key)
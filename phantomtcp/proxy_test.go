@@ -0,0 +1,60 @@
+package phantomtcp
+
+import (
+	"net"
+	"testing"
+)
+
+func TestReadSocks4(t *testing.T) {
+	tests := []struct {
+		name    string
+		request string
+		size    int //of the buffer, 64 when 0
+		split   int //the request is read from the conn after that
+		addr    string
+		host    string
+		ok      bool
+	}{
+		{"socks4", "\x04\x01\x01\xbb\xc0\x00\x02\x01user\x00", 0, 0, "192.0.2.1:443", "", true},
+		{"no user", "\x04\x01\x00\x50\xc0\x00\x02\x01\x00", 0, 0, "192.0.2.1:80", "", true},
+		{"split", "\x04\x01\x01\xbb\xc0\x00\x02\x01user\x00", 0, 5, "192.0.2.1:443", "", true},
+		{"socks4a", "\x04\x01\x01\xbb\x00\x00\x00\x01user\x00example.com\x00", 0, 0, ":443", "example.com", true},
+		{"socks4a split", "\x04\x01\x01\xbb\x00\x00\x00\x01\x00example.com\x00", 0, 10, ":443", "example.com", true},
+		{"socks4a address", "\x04\x01\x01\xbb\x00\x00\x00\x01\x00192.0.2.7\x00", 0, 0, "192.0.2.7:443", "", true},
+		{"socks4a without host", "\x04\x01\x01\xbb\x00\x00\x00\x01\x00\x00", 0, 0, "", "", false},
+		{"bind", "\x04\x02\x01\xbb\xc0\x00\x02\x01\x00", 0, 0, "", "", false},
+		{"no address", "\x04\x01\x01\xbb\x00\x00\x00\x00\x00", 0, 0, "", "", false},
+		{"too long", "\x04\x01\x01\xbb\xc0\x00\x02\x01userusername\x00", 12, 12, "", "", false},
+		{"closed", "\x04\x01\x01\xbb\xc0\x00\x02\x01user", 0, 12, "", "", false},
+	}
+	for _, tt := range tests {
+		size := tt.size
+		if size == 0 {
+			size = 64
+		}
+		b := make([]byte, size)
+		n := len(tt.request)
+		if tt.split != 0 {
+			n = tt.split
+		}
+		copy(b, tt.request[:n])
+
+		client, server := net.Pipe()
+		go func(rest string) {
+			if rest != "" {
+				client.Write([]byte(rest))
+			}
+			client.Close()
+		}(tt.request[n:])
+
+		addr, host, err := readSocks4(server, b, n)
+		server.Close()
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if tt.ok && (addr.String() != tt.addr || host != tt.host) {
+			t.Errorf("%s: %s %q, want %s %q", tt.name, addr.String(), host, tt.addr, tt.host)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package phantomtcp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// ProxyError is a failure of a proxied connection, Kind says whether it
+// looks like censorship, a network problem or a misconfiguration
+type ProxyError struct {
+	Kind string
+	Err  error
+}
+
+func (e *ProxyError) Error() string {
+	if e.Err == nil {
+		return e.Kind
+	}
+	return e.Kind + ": " + e.Err.Error()
+}
+
+func (e *ProxyError) Unwrap() error {
+	return e.Err
+}
+
+// SOCKS5 reply code and HTTP status of each kind of failure
+var proxyReplies = map[string]struct {
+	socks  byte
+	status int
+}{
+	"general":       {0x01, 502},
+	"reset":         {0x01, 502}, //RST after the connection was established, as injected by a censor
+	"blocked":       {0x02, 403}, //tcp is blocked by the rule of the domain
+	"upstream-auth": {0x02, 502}, //the upstream proxy wants other credentials
+	"upstream":      {0x01, 502}, //the upstream proxy refused the request
+	"unreachable":   {0x03, 502},
+	"dns":           {0x04, 502}, //the domain has no address
+	"dns-timeout":   {0x04, 504}, //the DNS servers did not answer
+	"refused":       {0x05, 502},
+	"timeout":       {0x06, 504},
+	"capture":       {0x01, 503}, //the packet capture the rule needs is unavailable
+}
+
+func proxyErrorf(kind string, format string, a ...interface{}) error {
+	return &ProxyError{Kind: kind, Err: fmt.Errorf(format, a...)}
+}
+
+// classifyError finds the kind of a failure from the errors of the dialer
+func classifyError(err error) *ProxyError {
+	var perr *ProxyError
+	if errors.As(err, &perr) {
+		return perr
+	}
+
+	kind := "general"
+	var nerr net.Error
+	switch {
+	case err == nil:
+	case errors.Is(err, syscall.ECONNREFUSED):
+		kind = "refused"
+	case errors.Is(err, syscall.ECONNRESET):
+		kind = "reset"
+	case errors.Is(err, syscall.ENETUNREACH), errors.Is(err, syscall.EHOSTUNREACH):
+		kind = "unreachable"
+	case errors.As(err, &nerr) && nerr.Timeout():
+		kind = "timeout"
+	}
+	return &ProxyError{Kind: kind, Err: err}
+}
+
+// the failure of a lookup of host, NSLookup returns nil addrs when the
+// servers did not answer and no addresses for a name that has none
+func (profile *PhantomProfile) dnsError(host string, addrs []net.IP) error {
+	if filter := profile.GetFilter(host); filter != nil && filter.Action != FILTER_ALLOW {
+		return proxyErrorf("blocked", "%s is filtered", host)
+	}
+	if addrs == nil {
+		return proxyErrorf("dns-timeout", "no answer for %s", host)
+	}
+	return proxyErrorf("dns", "no such host")
+}
+
+// failure of a CONNECT request to an upstream SOCKS5 proxy
+func socksError(code byte) error {
+	kind := "upstream"
+	switch code {
+	case 0x03, 0x04:
+		kind = "unreachable"
+	case 0x05:
+		kind = "refused"
+	case 0x06:
+		kind = "timeout"
+	}
+	return proxyErrorf(kind, "upstream socks reply %d", code)
+}
+
+// failure of a CONNECT request to an upstream HTTP proxy
+func httpProxyError(response []byte) error {
+	status := string(response)
+	if i := strings.Index(status, "\r\n"); i != -1 {
+		status = status[:i]
+	}
+	if strings.HasPrefix(status, "HTTP/1.1 407 ") || strings.HasPrefix(status, "HTTP/1.0 407 ") {
+		return proxyErrorf("upstream-auth", "%s", status)
+	}
+	return proxyErrorf("upstream", "%s", status)
+}
+
+// replyConn holds back the reply to a proxy request until the client is
+// read from or written to, a failure before that is answered with the
+// reply of its kind instead of a success followed by a closed connection
+type replyConn struct {
+	net.Conn
+
+	lock    sync.Mutex
+	replied bool
+	success []byte
+	failure func(*ProxyError) []byte
+}
+
+func (c *replyConn) reply(err error) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.replied {
+		return nil
+	}
+	c.replied = true
+	if err != nil {
+		perr := classifyError(err)
+		logPrintln(2, "Reply:", c.RemoteAddr(), perr)
+		_, err = c.Conn.Write(c.failure(perr))
+		return err
+	}
+	if len(c.success) > 0 {
+		_, err = c.Conn.Write(c.success)
+	}
+	return err
+}
+
+func (c *replyConn) Read(b []byte) (int, error) {
+	err := c.reply(nil)
+	if err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *replyConn) Write(b []byte) (int, error) {
+	err := c.reply(nil)
+	if err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(b)
+}
+
+func socks5Reply(client net.Conn) *replyConn {
+	return &replyConn{
+		Conn:    client,
+		success: []byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0},
+		failure: func(perr *ProxyError) []byte {
+			return []byte{5, proxyReplies[perr.Kind].socks, 0, 1, 0, 0, 0, 0, 0, 0}
+		},
+	}
+}
+
+func socks4Reply(client net.Conn, success []byte) *replyConn {
+	return &replyConn{
+		Conn:    client,
+		success: success,
+		failure: func(perr *ProxyError) []byte {
+			return []byte{0, 91, 0, 0, 0, 0, 0, 0}
+		},
+	}
+}
+
+// the status of the kind with the kind in X-Phantom-Error
+func httpReply(client net.Conn, success []byte) *replyConn {
+	return &replyConn{
+		Conn:    client,
+		success: success,
+		failure: func(perr *ProxyError) []byte {
+			status := proxyReplies[perr.Kind].status
+			body := perr.Error() + "\n"
+			return []byte(fmt.Sprintf("HTTP/1.1 %d %s\r\nX-Phantom-Error: %s\r\nContent-Type: text/plain\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s",
+				status, http.StatusText(status), perr.Kind, len(body), body))
+		},
+	}
+}
+
+// failReply answers the pending request of client with err, it does
+// nothing once the client got its reply
+func failReply(client net.Conn, err error) {
+	if c, ok := client.(*replyConn); ok {
+		if err == nil {
+			err = errors.New("connection failed")
+		}
+		c.reply(err)
+	}
+}
+
+// unwrapReply sends the success reply of client if it is pending and
+// returns the connection under it
+func unwrapReply(client net.Conn) (net.Conn, error) {
+	if c, ok := client.(*replyConn); ok {
+		return c.Conn, c.reply(nil)
+	}
+	return client, nil
+}
@@ -0,0 +1,187 @@
+package phantomtcp
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// size in bytes the query log is rotated at and how many rotated files
+// (name.1 the newest) are kept
+var QueryLogSize int64 = 10 << 20
+var QueryLogBackups = 3
+
+type QueryLogEntry struct {
+	Time     string   `json:"time"`
+	Domain   string   `json:"domain"`
+	QType    int      `json:"qtype"`
+	Client   string   `json:"client,omitempty"`
+	Upstream string   `json:"upstream,omitempty"`
+	RTT      float64  `json:"rtt,omitempty"` //milliseconds of the upstream query
+	Answer   []string `json:"answer,omitempty"`
+	Rule     string   `json:"rule,omitempty"` //domain of the rule that matched
+	Action   string   `json:"action"`         //blocked, intercepted, forwarded, local, dropped or fail-open
+	Cached   bool     `json:"cached,omitempty"`
+}
+
+type queryLog struct {
+	lock sync.Mutex
+	name string
+	file *os.File
+	size int64
+}
+
+var queryLogger atomic.Value
+
+func currentQueryLog() *queryLog {
+	logger, _ := queryLogger.Load().(*queryLog)
+	return logger
+}
+
+// OpenQueryLog writes a JSON line for every DNS query to name, an empty
+// name stops logging
+func OpenQueryLog(name string) error {
+	var logger *queryLog
+	if name != "" {
+		file, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return err
+		}
+		logger = &queryLog{name: name, file: file, size: info.Size()}
+	}
+	if old := currentQueryLog(); old != nil {
+		old.lock.Lock()
+		old.file.Close()
+		old.lock.Unlock()
+	}
+	queryLogger.Store(logger)
+	return nil
+}
+
+func (l *queryLog) rotate() error {
+	l.file.Close()
+	for i := QueryLogBackups; i > 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", l.name, i-1), fmt.Sprintf("%s.%d", l.name, i))
+	}
+	if QueryLogBackups > 0 {
+		os.Rename(l.name, l.name+".1")
+	} else {
+		os.Remove(l.name)
+	}
+	file, err := os.OpenFile(l.name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	l.file = file
+	l.size = 0
+	return nil
+}
+
+func (l *queryLog) write(entry *QueryLogEntry) {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.size > 0 && l.size+int64(len(line)) > QueryLogSize {
+		err = l.rotate()
+		if err != nil {
+			logPrintln(1, "querylog:", err)
+			return
+		}
+	}
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		logPrintln(1, "querylog:", err)
+	}
+}
+
+func newQueryLogEntry(name string, qtype int, client net.IP) *QueryLogEntry {
+	if currentQueryLog() == nil {
+		return nil
+	}
+	entry := &QueryLogEntry{Time: time.Now().Format(time.RFC3339Nano), Domain: name, QType: qtype}
+	if client != nil {
+		entry.Client = client.String()
+	}
+	return entry
+}
+
+func (entry *QueryLogEntry) setAction(action string) {
+	if entry != nil {
+		entry.Action = action
+	}
+}
+
+// answered from the cache, records without an expiry come from the rules
+func (entry *QueryLogEntry) setCached(expiry int64) {
+	if entry != nil && expiry != 0 {
+		entry.Cached = true
+		entry.Action = "forwarded"
+	}
+}
+
+func (entry *QueryLogEntry) setUpstream(upstream string, start time.Time) {
+	if entry != nil {
+		entry.Action = "forwarded"
+		entry.Upstream = upstream
+		entry.RTT = float64(time.Since(start).Microseconds()) / 1000
+	}
+}
+
+// finish records the answers of response and writes the entry
+func (entry *QueryLogEntry) finish(response []byte) {
+	logger := currentQueryLog()
+	if entry == nil || logger == nil {
+		return
+	}
+	if response == nil {
+		entry.Action = "dropped"
+	} else {
+		var records DNSRecords
+		cname := records.GetAnswers(response, ServerOptions{})
+		if cname != "" {
+			entry.Answer = append(entry.Answer, cname)
+		}
+		for _, rec := range []*RecordAddresses{records.IPv4Hint, records.IPv6Hint} {
+			if rec != nil {
+				for _, ip := range rec.Addresses {
+					entry.Answer = append(entry.Answer, ip.String())
+				}
+			}
+		}
+	}
+	logger.write(entry)
+}
+
+// domain of the rule GetInterface matches name with
+func (rules *RuleSet) matchRule(name string) string {
+	if _, ok := rules.DomainMap[name]; ok {
+		return name
+	}
+	if key := rules.parentRule(name); key != "" {
+		return key
+	}
+	if key := rules.networks.match(name); key != "" {
+		return key
+	}
+	if key := rules.patterns.match(name); key != "" {
+		if _, ok := rules.DomainMap[key]; ok {
+			return key
+		}
+	}
+	return ""
+}
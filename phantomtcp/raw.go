@@ -4,9 +4,11 @@
 package phantomtcp
 
 import (
+	"errors"
 	"fmt"
 	"net"
 	"strconv"
+	"sync"
 	"syscall"
 	"time"
 
@@ -39,6 +41,7 @@ var HintMap = map[string]uint32{
 	"udp":    HINT_UDP,
 	"no-tcp": HINT_NOTCP,
 	"delay":  HINT_DELAY,
+	"lazy":   HINT_LAZY,
 
 	"mode2":      HINT_MODE2,
 	"df":         HINT_DF,
@@ -55,6 +58,39 @@ var HintMap = map[string]uint32{
 func DevicePrint() {
 }
 
+var rawLock sync.Mutex
+var rawHandles []*net.IPConn
+var rawRebind = make(chan struct{})
+
+func addRawHandle(handle *net.IPConn) {
+	rawLock.Lock()
+	rawHandles = append(rawHandles, handle)
+	rawLock.Unlock()
+}
+
+// the raw sockets are bound to the local address, reopen them after it changed
+func RebindCapture() {
+	rawLock.Lock()
+	for _, handle := range rawHandles {
+		handle.Close()
+	}
+	rawHandles = nil
+	close(rawRebind)
+	rawRebind = make(chan struct{})
+	rawLock.Unlock()
+}
+
+func rebindLoop(monitor func(device string, ipv6 bool), device string, ipv6 bool) {
+	for {
+		rawLock.Lock()
+		rebind := rawRebind
+		rawLock.Unlock()
+
+		monitor(device, ipv6)
+		<-rebind
+	}
+}
+
 func connectionMonitor(device string, ipv6 bool) {
 	var err error
 	localaddr, err := GetLocalAddr(device, ipv6)
@@ -85,11 +121,15 @@ func connectionMonitor(device string, ipv6 bool) {
 		return
 	}
 	defer handle.Close()
+	addRawHandle(handle)
 
 	buf := make([]byte, 1500)
 	for {
 		n, addr, err := handle.ReadFrom(buf)
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
 			logPrintln(1, err)
 			continue
 		}
@@ -122,7 +162,7 @@ func connectionMonitor(device string, ipv6 bool) {
 				tcp.Ack = ack
 
 				ch := ConnInfo6[srcPort]
-				connInfo := ConnectionInfo{nil, &ip, tcp}
+				connInfo := ConnectionInfo{nil, &ip, tcp, nil}
 				go func(info *ConnectionInfo) {
 					select {
 					case ch <- info:
@@ -155,7 +195,7 @@ func connectionMonitor(device string, ipv6 bool) {
 				tcp.Ack = ack
 
 				ch := ConnInfo4[srcPort]
-				connInfo := ConnectionInfo{nil, &ip, tcp}
+				connInfo := ConnectionInfo{nil, &ip, tcp, nil}
 				go func(info *ConnectionInfo) {
 					select {
 					case ch <- info:
@@ -199,6 +239,7 @@ func ICMPMonitor(device string, ipv6 bool) {
 		return
 	}
 	defer handle.Close()
+	addRawHandle(handle)
 
 	var connInfo ConnectionInfo
 	data := make([]byte, 1500)
@@ -207,6 +248,9 @@ func ICMPMonitor(device string, ipv6 bool) {
 	for {
 		n, _, err := handle.ReadFrom(data)
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
 			logPrintln(1, err)
 			continue
 		}
@@ -254,15 +298,25 @@ func ICMPMonitor(device string, ipv6 bool) {
 	}
 }
 
+func UpdateCaptureFilter() error {
+	return nil
+}
+
 func ConnectionMonitor(devices []string) bool {
 	if devices == nil {
 		DevicePrint()
 		return false
 	}
 
+	for _, device := range devices {
+		if DeviceOffload[device] == "off" {
+			disableOffload(device)
+		}
+	}
+
 	if PassiveMode {
 		for i := 0; i < len(devices); i++ {
-			go ICMPMonitor(devices[i], false)
+			go rebindLoop(ICMPMonitor, devices[i], false)
 		}
 	} else {
 		for i := 0; i < 65536; i++ {
@@ -271,8 +325,8 @@ func ConnectionMonitor(devices []string) bool {
 		}
 
 		for i := 0; i < len(devices); i++ {
-			go connectionMonitor(devices[i], false)
-			go connectionMonitor(devices[i], true)
+			go rebindLoop(connectionMonitor, devices[i], false)
+			go rebindLoop(connectionMonitor, devices[i], true)
 		}
 	}
 
@@ -280,6 +334,12 @@ func ConnectionMonitor(devices []string) bool {
 }
 
 func ModifyAndSendPacket(connInfo *ConnectionInfo, payload []byte, hint uint32, ttl uint8, count int) error {
+	if hint&HINT_TFO == 0 && len(payload) > connInfo.MSS() {
+		return segmented(connInfo, payload, func(info *ConnectionInfo, segment []byte) error {
+			return ModifyAndSendPacket(info, segment, hint, ttl, count)
+		})
+	}
+
 	ipLayer := connInfo.IP
 
 	tcpLayer := &layers.TCP{
@@ -374,3 +434,13 @@ func ModifyAndSendPacket(connInfo *ConnectionInfo, payload []byte, hint uint32,
 
 	return nil
 }
+
+// raw sockets receive the segments and send the modified ones
+func captureCheck(devices []string) []PreflightCheck {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_RAW, syscall.IPPROTO_TCP)
+	if err == nil {
+		syscall.Close(fd)
+	}
+	checks := []PreflightCheck{newCheck("raw socket", err, "run as root or setcap cap_net_raw,cap_net_admin+ep phantomsocks")}
+	return append(checks, deviceCheck(devices)...)
+}
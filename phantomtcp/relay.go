@@ -0,0 +1,144 @@
+package phantomtcp
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// relays are closed after relayIdleTimeout without data in either
+// direction or relayMaxLifetime after they started, 0 disables them;
+// durations accessed atomically as they change on reload
+var relayIdleTimeout int64 = 0
+var relayMaxLifetime int64 = 0
+var RelayCheckInterval = time.Second * 30
+
+// SetRelayTimeouts sets the idle timeout and the maximum lifetime of
+// relays, the running ones included
+func SetRelayTimeouts(idle, lifetime time.Duration) {
+	atomic.StoreInt64(&relayIdleTimeout, int64(idle))
+	atomic.StoreInt64(&relayMaxLifetime, int64(lifetime))
+}
+
+func relayTimeouts() (idle, lifetime time.Duration) {
+	return time.Duration(atomic.LoadInt64(&relayIdleTimeout)), time.Duration(atomic.LoadInt64(&relayMaxLifetime))
+}
+
+type relayInfo struct {
+	client  net.Conn //nil for a UDP flow of a shared socket
+	from    net.Addr
+	start   time.Time
+	active  int64 //unix nano of the last data
+	tracked bool  //the data is tracked, so the idle timeout applies
+	stopped int32
+}
+
+// outbound connection -> *relayInfo of every running relay
+var relayConns sync.Map
+
+// UDP flows end after that long without an answer
+const udpFlowTimeout = time.Minute * 2
+
+func trackRelay(client, conn net.Conn) *relayInfo {
+	now := time.Now()
+	info := &relayInfo{
+		client:  client,
+		from:    client.RemoteAddr(),
+		start:   now,
+		active:  now.UnixNano(),
+		tracked: atomic.LoadInt64(&relayIdleTimeout) > 0,
+	}
+	relayConns.Store(conn, info)
+	return info
+}
+
+// trackFlow registers the UDP flow of from through conn, read it with
+// readFlow
+func trackFlow(from net.Addr, conn net.Conn) *relayInfo {
+	now := time.Now()
+	info := &relayInfo{from: from, start: now, active: now.UnixNano(), tracked: true}
+	relayConns.Store(conn, info)
+	return info
+}
+
+func untrackRelay(conn net.Conn) {
+	relayConns.Delete(conn)
+}
+
+func (info *relayInfo) touch() {
+	atomic.StoreInt64(&info.active, time.Now().UnixNano())
+}
+
+// stop ends the relay through conn, the reads of both sides fail
+func (info *relayInfo) stop(conn net.Conn, now time.Time) {
+	atomic.StoreInt32(&info.stopped, 1)
+	conn.SetDeadline(now)
+	if info.client != nil {
+		info.client.SetDeadline(now)
+	}
+}
+
+type activityReader struct {
+	conn net.Conn
+	info *relayInfo
+}
+
+func (r activityReader) Read(b []byte) (int, error) {
+	n, err := r.conn.Read(b)
+	if n > 0 {
+		r.info.touch()
+	}
+	return n, err
+}
+
+// reader of conn that records the activity of the relay. A relay that
+// started without an idle timeout reads conn itself, so io.Copy keeps
+// its splice fast path, and is not closed when a reload sets one.
+func (info *relayInfo) reader(conn net.Conn) io.Reader {
+	if !info.tracked {
+		return conn
+	}
+	return activityReader{conn, info}
+}
+
+// readFlow reads conn of a UDP flow until it has no answer for
+// udpFlowTimeout or is stopped
+func (info *relayInfo) readFlow(conn net.Conn, b []byte) (int, error) {
+	if atomic.LoadInt32(&info.stopped) != 0 {
+		return 0, os.ErrDeadlineExceeded
+	}
+	conn.SetReadDeadline(time.Now().Add(udpFlowTimeout))
+	n, err := conn.Read(b)
+	if n > 0 {
+		info.touch()
+	}
+	return n, err
+}
+
+// RelayMonitor closes the relays that are idle or too old
+func RelayMonitor() {
+	for {
+		time.Sleep(RelayCheckInterval)
+		idleTimeout, maxLifetime := relayTimeouts()
+		if idleTimeout == 0 && maxLifetime == 0 {
+			continue
+		}
+
+		now := time.Now()
+		relayConns.Range(func(key, value interface{}) bool {
+			conn := key.(net.Conn)
+			info := value.(*relayInfo)
+			idle := now.Sub(time.Unix(0, atomic.LoadInt64(&info.active)))
+			if (info.tracked && idleTimeout > 0 && idle > idleTimeout) ||
+				(maxLifetime > 0 && now.Sub(info.start) > maxLifetime) {
+				logPrintln(3, "Timeout:", info.from, "->", conn.RemoteAddr(), idle)
+				info.stop(conn, now)
+				relayConns.Delete(key)
+			}
+			return true
+		})
+	}
+}
@@ -0,0 +1,202 @@
+package phantomtcp
+
+import (
+	"os"
+	"strings"
+	"time"
+)
+
+// the rules and hosts files are checked for changes every
+// RulesWatchInterval, 0 only reloads them on SIGHUP
+var RulesWatchInterval = time.Second * 5
+
+// ReloadRules reads the rules of the profile again with load into new
+// maps and swaps them in at once, the current rules are kept when load
+// fails. The interfaces, the resolved names of the DNS cache, the fake
+// addresses of the names and the established connections are kept, only
+// the names whose rule changed are resolved again.
+func (profile *PhantomProfile) ReloadRules(load func(*PhantomProfile) error) error {
+	next := &PhantomProfile{
+		RuleSet:      newRuleSet(),
+		Instance:     profile.Instance,
+		InterfaceMap: profile.InterfaceMap,
+		FilterMap:    make(map[string]*DNSFilter),
+
+		reloading:     profile,
+		filterRefresh: true, //the lists are refreshed by the profile itself
+	}
+	profile.reloadLock.Lock()
+	defer profile.reloadLock.Unlock()
+	err := load(next)
+	if err != nil {
+		return err
+	}
+	profile.applyReload(next)
+	return nil
+}
+
+// applyReload swaps in the rules, the lists and the client blocks read
+// into next
+func (profile *PhantomProfile) applyReload(next *PhantomProfile) {
+	// the blocks read again go to the profiles of their clients
+	for _, block := range next.clients {
+		if staged := block.profile; staged.reloading != nil {
+			block.profile = staged.reloading
+			block.profile.applyReload(staged)
+		}
+	}
+	stale := profile.replaceRules(next)
+
+	remote := false
+	for _, source := range next.filterSources {
+		remote = remote || strings.Contains(source.name, "://")
+	}
+	profile.filterLock.Lock()
+	profile.FilterMap = next.FilterMap
+	profile.filterSources = next.filterSources
+	start := remote && !profile.filterRefresh
+	profile.filterRefresh = profile.filterRefresh || remote
+	profile.filterLock.Unlock()
+	if start {
+		go profile.refreshFilters()
+	}
+
+	logPrintln(1, "reloaded", len(next.DomainMap), "rules,", stale, "names resolved again")
+}
+
+// replaceRules swaps in the rules of next, read with next.reloading set
+// to the profile, and the entries next stored in its DNS cache; it
+// returns the number of names to resolve again
+func (profile *PhantomProfile) replaceRules(next *PhantomProfile) int {
+	// the rules without an interface point at the profile being read
+	for _, pface := range next.DomainMap {
+		if pface != nil && pface.profile == next {
+			pface.profile = profile
+		}
+	}
+	for _, pface := range next.PortMap {
+		if pface != nil && pface.profile == next {
+			pface.profile = profile
+		}
+	}
+	for _, route := range next.DNSRouteMap {
+		route.profile = profile
+	}
+
+	pinned := make(map[string]*DNSRecords)
+	next.DNSCache.Range(func(name string, records *DNSRecords) bool {
+		pinned[name] = records
+		return true
+	})
+
+	// names whose rule changed are resolved again, the resolved names of
+	// unchanged rules are kept
+	var stale []string
+	profile.DNSCache.Range(func(name string, records *DNSRecords) bool {
+		if _, ok := pinned[name]; ok {
+			return true
+		}
+		if !sameInterface(profile.GetInterface(name), next.GetInterface(name)) {
+			stale = append(stale, name)
+		}
+		return true
+	})
+	for name, records := range pinned {
+		current, ok := profile.DNSCache.Load(name)
+		if ok && records.IPv4Hint == nil && records.IPv6Hint == nil &&
+			sameInterface(profile.GetInterface(name), next.GetInterface(name)) {
+			pinned[name] = current
+		}
+	}
+	for _, name := range profile.DNSCache.Pinned() {
+		if _, ok := pinned[name]; !ok {
+			stale = append(stale, name)
+		}
+	}
+
+	profile.rulesLock.Lock()
+	profile.RuleSet = next.RuleSet
+	for _, name := range stale {
+		profile.DNSCache.Delete(name)
+	}
+	for name, records := range pinned {
+		profile.DNSCache.Store(name, records)
+	}
+	profile.rulesLock.Unlock()
+
+	profile.dnsRouted.Range(func(key, value interface{}) bool {
+		profile.dnsRouted.Delete(key)
+		return true
+	})
+	NoseLock.Lock()
+	profile.coalesce = nil
+	NoseLock.Unlock()
+	return len(stale)
+}
+
+func sameInterface(a, b *PhantomInterface) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// nameIndex returns the index in Nose of a name of the rules or hosts
+// files, a reload keeps the index of the name so its fake address stays
+func (profile *PhantomProfile) nameIndex(name string) uint32 {
+	var index uint32
+	if profile.reloading != nil {
+		if records, ok := profile.reloading.DNSCache.Load(name); ok {
+			index = records.Index
+		}
+	}
+	NoseLock.Lock()
+	defer NoseLock.Unlock()
+	if index != 0 && profile.fakeName(int(index)) == name {
+		return index
+	}
+	return newIndex(profile.noseKey(name))
+}
+
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// FileWatch tells when one of a set of files was changed, created or
+// removed, URLs are skipped
+type FileWatch struct {
+	stamps map[string]fileStamp
+}
+
+func NewFileWatch(files []string) *FileWatch {
+	watch := &FileWatch{stamps: make(map[string]fileStamp)}
+	for _, name := range files {
+		if name == "" || strings.Contains(name, "://") {
+			continue
+		}
+		watch.stamps[name] = stampFile(name)
+	}
+	return watch
+}
+
+func stampFile(name string) fileStamp {
+	info, err := os.Stat(name)
+	if err != nil {
+		return fileStamp{}
+	}
+	return fileStamp{info.ModTime(), info.Size()}
+}
+
+// Changed returns the files changed since the last call
+func (watch *FileWatch) Changed() []string {
+	var changed []string
+	for name, stamp := range watch.stamps {
+		current := stampFile(name)
+		if !current.modTime.Equal(stamp.modTime) || current.size != stamp.size {
+			watch.stamps[name] = current
+			changed = append(changed, name)
+		}
+	}
+	return changed
+}
@@ -0,0 +1,182 @@
+package phantomtcp
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// what the rules do with a name, for dashboards and scripts that audit
+// the rule set without sending connections
+type Resolution struct {
+	Name      string   `json:"name"`
+	Alias     string   `json:"alias,omitempty"`
+	Filter    string   `json:"filter,omitempty"` //the action of a DNS filter
+	Rule      string   `json:"rule,omitempty"`
+	Interface string   `json:"interface,omitempty"`
+	Protocol  string   `json:"protocol,omitempty"`
+	Address   string   `json:"address,omitempty"` //the proxy or redirect target
+	Methods   []string `json:"methods,omitempty"` //the hints of the interface
+	TTL       byte     `json:"ttl,omitempty"`
+	ALPN      string   `json:"alpn,omitempty"` //of the fake ClientHellos
+	DNS       string   `json:"dns,omitempty"`
+	Cached    []string `json:"cached,omitempty"`
+	Addresses []string `json:"addresses,omitempty"`
+	Fake      []string `json:"fake,omitempty"`
+	Error     string   `json:"error,omitempty"`
+}
+
+// how many names Resolve looks up at a time and the most names one call
+// takes
+var ResolveWorkers = 16
+var ResolveLimit = 10000
+
+var protocolNames = map[byte]string{
+	DIRECT:   "direct",
+	REDIRECT: "redirect",
+	NAT64:    "nat64",
+	HTTP:     "http",
+	HTTPS:    "https",
+	SOCKS4:   "socks4",
+	SOCKS5:   "socks5",
+}
+
+var filterNames = map[byte]string{
+	FILTER_NXDOMAIN: "nxdomain",
+	FILTER_NODATA:   "nodata",
+	FILTER_SINKHOLE: "sinkhole",
+	FILTER_DROP:     "drop",
+}
+
+// the names of the hints set in hint, the first name of each
+func hintNames(hint uint32) []string {
+	names := make(map[uint32]string)
+	for name, h := range HintMap {
+		if h == 0 || hint&h != h {
+			continue
+		}
+		if n, ok := names[h]; !ok || name < n {
+			names[h] = name
+		}
+	}
+	var list []string
+	for _, name := range names {
+		list = append(list, name)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// the name of the interface of a rule
+func (profile *PhantomProfile) interfaceName(pface *PhantomInterface) string {
+	for name, face := range profile.InterfaceMap {
+		if face == *pface {
+			return name
+		}
+	}
+	return ""
+}
+
+func cachedAddresses(records *DNSRecords) []string {
+	var addrs []string
+	now := time.Now().Unix()
+	for _, rec := range []*RecordAddresses{records.IPv4Hint, records.IPv6Hint} {
+		if rec == nil || rec.Expired(now) {
+			continue
+		}
+		for _, ip := range rec.Addresses {
+			addrs = append(addrs, ip.String())
+		}
+	}
+	return addrs
+}
+
+// resolve reports the rule of name, with lookup its addresses are
+// resolved as a query would, without it only the cache is read
+func (profile *PhantomProfile) resolve(name string, lookup bool) Resolution {
+	name = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(name), "."))
+	r := Resolution{Name: name}
+	if filter := profile.GetFilter(name); filter != nil && filter.Action != FILTER_ALLOW {
+		r.Filter = filterNames[filter.Action]
+		for _, ip := range filter.Addresses {
+			r.Addresses = append(r.Addresses, ip.String())
+		}
+		return r
+	}
+	if alias := profile.GetAlias(name); alias != name {
+		r.Alias = alias
+		name = alias
+	}
+
+	r.Rule = profile.Rules().matchRule(name)
+	pface := profile.routeDNS(name, profile.GetInterface(name))
+	if pface != nil {
+		if r.Rule != "" {
+			r.Interface = profile.interfaceName(profile.GetInterface(name))
+		}
+		r.Protocol = protocolNames[pface.Protocol]
+		r.Address = pface.Address
+		r.Methods = hintNames(pface.Hint)
+		r.TTL = pface.TTL
+		r.ALPN = pface.ALPN
+		r.DNS = pface.DNS
+	}
+	if records := profile.LoadDNSCache(name); records != nil {
+		r.Cached = cachedAddresses(records)
+	}
+	if !lookup || pface == nil || pface.DNS == "" {
+		return r
+	}
+
+	index, addrs := profile.NSLookup(name, pface.Hint, pface.DNS)
+	if index > 0 {
+		r.Fake = append(r.Fake, VirtualAddress(index, false).String())
+		if ip := VirtualAddress(index, true); ip != nil {
+			r.Fake = append(r.Fake, ip.String())
+		}
+	}
+	for _, ip := range addrs {
+		r.Addresses = append(r.Addresses, ip.String())
+	}
+	if len(addrs) == 0 && index == 0 {
+		r.Error = profile.dnsError(name, addrs).Error()
+	}
+	return r
+}
+
+// Resolve reports what the rules do with each of names
+func (profile *PhantomProfile) Resolve(names []string, lookup bool) []Resolution {
+	results := make([]Resolution, len(names))
+	workers := make(chan struct{}, ResolveWorkers)
+	var wg sync.WaitGroup
+	for i, name := range names {
+		wg.Add(1)
+		workers <- struct{}{}
+		go func(i int, name string) {
+			defer wg.Done()
+			results[i] = profile.resolve(name, lookup)
+			<-workers
+		}(i, name)
+	}
+	wg.Wait()
+	return results
+}
+
+// ParseNames splits a list of names on commas, spaces and new lines,
+// the comments after # are dropped
+func ParseNames(text string) []string {
+	var names []string
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.SplitN(line, "#", 2)[0]
+		for _, name := range strings.FieldsFunc(line, func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t' || r == '\r'
+		}) {
+			if net.ParseIP(name) == nil {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
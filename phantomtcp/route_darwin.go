@@ -0,0 +1,24 @@
+package phantomtcp
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+)
+
+func addLocalRoute(ipnet *net.IPNet) error {
+	out, err := exec.Command("route", "-q", "-n", "add", "-inet6", ipnet.String(), "::1").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func deleteLocalRoute(ipnet *net.IPNet) error {
+	out, err := exec.Command("route", "-q", "-n", "delete", "-inet6", ipnet.String(), "::1").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
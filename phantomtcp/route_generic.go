@@ -0,0 +1,17 @@
+//go:build !linux && !darwin && !windows
+// +build !linux,!darwin,!windows
+
+package phantomtcp
+
+import (
+	"errors"
+	"net"
+)
+
+func addLocalRoute(ipnet *net.IPNet) error {
+	return errors.New("not supported on this platform")
+}
+
+func deleteLocalRoute(ipnet *net.IPNet) error {
+	return errors.New("not supported on this platform")
+}
@@ -0,0 +1,26 @@
+package phantomtcp
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+)
+
+// a local route accepts the whole prefix on this host like the address
+// of an interface
+func addLocalRoute(ipnet *net.IPNet) error {
+	out, err := exec.Command("ip", "-6", "route", "replace", "local", ipnet.String(), "dev", "lo", "table", "local").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func deleteLocalRoute(ipnet *net.IPNet) error {
+	out, err := exec.Command("ip", "-6", "route", "del", "local", ipnet.String(), "dev", "lo", "table", "local").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
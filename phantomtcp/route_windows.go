@@ -0,0 +1,25 @@
+package phantomtcp
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+)
+
+// the prefix is routed to the loopback interface
+func addLocalRoute(ipnet *net.IPNet) error {
+	out, err := exec.Command("netsh", "interface", "ipv6", "add", "route", ipnet.String(), "interface=1", "store=active").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func deleteLocalRoute(ipnet *net.IPNet) error {
+	out, err := exec.Command("netsh", "interface", "ipv6", "delete", "route", ipnet.String(), "interface=1").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
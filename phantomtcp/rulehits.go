@@ -0,0 +1,151 @@
+package phantomtcp
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how often a rule matched a name and when it last did, rules that never
+// match only make the lists bigger and the matching slower
+type RuleStats struct {
+	Rule  string `json:"rule"`
+	Hits  uint64 `json:"hits"`
+	Last  int64  `json:"last,omitempty"`
+	Since int64  `json:"since"` //the rule is counted since
+}
+
+type ruleHits struct {
+	lock  sync.Mutex
+	stats map[string]*RuleStats
+	start int64
+}
+
+// hitRule counts a match of the rule of name and returns the rule, it
+// is "" when no rule matches
+func (profile *PhantomProfile) hitRule(name string) string {
+	rule := profile.Rules().matchRule(name)
+	if rule == "" {
+		return ""
+	}
+	hits := &profile.hits
+	hits.lock.Lock()
+	if hits.stats == nil {
+		hits.stats = make(map[string]*RuleStats)
+	}
+	stats, ok := hits.stats[rule]
+	if !ok {
+		stats = &RuleStats{Rule: rule, Since: hits.start}
+		hits.stats[rule] = stats
+	}
+	stats.Hits++
+	stats.Last = time.Now().Unix()
+	hits.lock.Unlock()
+	return rule
+}
+
+// the domain rules, the rules of addresses are matched by connections
+// and not counted
+func (profile *PhantomProfile) domainRules() []string {
+	var rules []string
+	for rule := range profile.Rules().DomainMap {
+		if strings.Contains(rule, "/") || net.ParseIP(rule) != nil {
+			continue
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// RuleHits returns the stats of the domain rules, with days > 0 only
+// the rules that did not match in the last days days, least recently
+// used first
+func (profile *PhantomProfile) RuleHits(days int) []RuleStats {
+	idle := time.Now().Unix() - int64(days)*86400
+	hits := &profile.hits
+	var list []RuleStats
+	hits.lock.Lock()
+	for _, rule := range profile.domainRules() {
+		stats := RuleStats{Rule: rule, Since: hits.start}
+		if s, ok := hits.stats[rule]; ok {
+			stats = *s
+		}
+		if days > 0 && (stats.Last > idle || stats.Since > idle) {
+			continue
+		}
+		list = append(list, stats)
+	}
+	hits.lock.Unlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Last != list[j].Last {
+			return list[i].Last < list[j].Last
+		}
+		return list[i].Rule < list[j].Rule
+	})
+	return list
+}
+
+// DisableIdleRules removes the domain rules that did not match in the
+// last days days, it is called after the rules are loaded and before
+// they are used
+func (profile *PhantomProfile) DisableIdleRules(days int) []string {
+	var disabled []string
+	for _, stats := range profile.RuleHits(days) {
+		disabled = append(disabled, stats.Rule)
+	}
+	if len(disabled) == 0 {
+		return nil
+	}
+
+	// the rules in use are not modified, the profile gets a copy
+	profile.rulesLock.Lock()
+	rules := *profile.RuleSet
+	rules.DomainMap = make(map[string]*PhantomInterface, len(profile.DomainMap))
+	for rule, pface := range profile.DomainMap {
+		rules.DomainMap[rule] = pface
+	}
+	for _, rule := range disabled {
+		delete(rules.DomainMap, rule)
+	}
+	profile.RuleSet = &rules
+	profile.rulesLock.Unlock()
+	logPrintln(1, "rules:", len(disabled), "rules not matched in", days, "days disabled")
+	return disabled
+}
+
+// the stats of all domain rules are saved, so that a rule keeps the time
+// it is counted since
+func (profile *PhantomProfile) saveRuleHits() map[string]RuleStats {
+	saved := make(map[string]RuleStats)
+	for _, stats := range profile.RuleHits(0) {
+		saved[stats.Rule] = stats
+	}
+	return saved
+}
+
+// RestoreRuleHits restores the saved stats of the profile name, the new
+// rules are counted from now
+func (profile *PhantomProfile) RestoreRuleHits(name string) {
+	saved, ok := savedRules[name]
+	if !ok {
+		return
+	}
+	hits := &profile.hits
+	hits.lock.Lock()
+	defer hits.lock.Unlock()
+	if hits.stats == nil {
+		hits.stats = make(map[string]*RuleStats)
+	}
+	rules := profile.Rules()
+	for rule, stats := range saved {
+		if _, ok := rules.DomainMap[rule]; !ok {
+			continue
+		}
+		s := stats
+		s.Rule = rule
+		hits.stats[rule] = &s
+	}
+}
@@ -0,0 +1,210 @@
+package phantomtcp
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// a Shadowsocks server with an AEAD method: an interface with "protocol":
+// "ss", "method" and "password", or an upstream ss://method:password@host:port
+type ssCipher struct {
+	key  []byte
+	aead func(key []byte) (cipher.AEAD, error)
+}
+
+// the payload of a chunk is at most that long
+const ssMaxPayload = 0x3fff
+
+func newSSCipher(method, password string) (*ssCipher, error) {
+	var size int
+	c := &ssCipher{aead: aesGCM}
+	switch strings.ToLower(method) {
+	case "aes-128-gcm":
+		size = 16
+	case "aes-256-gcm":
+		size = 32
+	case "chacha20-ietf-poly1305", "chacha20-poly1305":
+		size = chacha20poly1305.KeySize
+		c.aead = chacha20poly1305.New
+	default:
+		return nil, errors.New("unsupported ss method " + method)
+	}
+	if password == "" {
+		return nil, errors.New("ss without password")
+	}
+
+	// EVP_BytesToKey with MD5
+	var prev []byte
+	for len(c.key) < size {
+		h := md5.New()
+		h.Write(prev)
+		h.Write([]byte(password))
+		prev = h.Sum(nil)
+		c.key = append(c.key, prev...)
+	}
+	c.key = c.key[:size]
+	return c, nil
+}
+
+// ssUserinfo returns the method and password of the userinfo of a
+// ss:// URL, plain or in base64 as SIP002 writes it
+func ssUserinfo(user *url.Userinfo) (string, string) {
+	if user == nil {
+		return "", ""
+	}
+	if password, ok := user.Password(); ok {
+		return user.Username(), password
+	}
+	name := strings.TrimRight(user.Username(), "=")
+	b, err := base64.RawURLEncoding.DecodeString(name)
+	if err != nil {
+		b, err = base64.RawStdEncoding.DecodeString(name)
+	}
+	if err != nil {
+		return "", ""
+	}
+	method, password, _ := strings.Cut(string(b), ":")
+	return method, password
+}
+
+func aesGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (c *ssCipher) session(salt []byte) (cipher.AEAD, error) {
+	subkey := make([]byte, len(c.key))
+	_, err := io.ReadFull(hkdf.New(sha1.New, c.key, salt, []byte("ss-subkey")), subkey)
+	if err != nil {
+		return nil, err
+	}
+	return c.aead(subkey)
+}
+
+// ssHandshake wraps conn in the stream of the server and sends it the
+// destination, the server answers with the data of the destination
+func (server *PhantomInterface) ssHandshake(conn net.Conn, host string, port int) (net.Conn, error) {
+	if server.ss == nil {
+		return nil, proxyErrorf("upstream", "ss without method and password")
+	}
+	ss := &ssConn{Conn: conn, cipher: server.ss}
+	if _, err := ss.Write(socks5Address(host, port)); err != nil {
+		return nil, err
+	}
+	return ss, nil
+}
+
+// the encrypted stream of a connection to a Shadowsocks server
+type ssConn struct {
+	net.Conn
+	cipher *ssCipher
+
+	enc, dec           cipher.AEAD
+	encNonce, decNonce []byte
+	buf                []byte //of the chunk being read
+	pending            []byte //decrypted, not read yet
+}
+
+func ssIncrement(nonce []byte) {
+	for i := range nonce {
+		nonce[i]++
+		if nonce[i] != 0 {
+			return
+		}
+	}
+}
+
+func (conn *ssConn) Write(b []byte) (int, error) {
+	var out []byte
+	if conn.enc == nil {
+		salt := make([]byte, len(conn.cipher.key))
+		if _, err := rand.Read(salt); err != nil {
+			return 0, err
+		}
+		aead, err := conn.cipher.session(salt)
+		if err != nil {
+			return 0, err
+		}
+		conn.enc = aead
+		conn.encNonce = make([]byte, aead.NonceSize())
+		out = salt
+	}
+
+	n := len(b)
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > ssMaxPayload {
+			chunk = chunk[:ssMaxPayload]
+		}
+		var size [2]byte
+		binary.BigEndian.PutUint16(size[:], uint16(len(chunk)))
+		out = conn.enc.Seal(out, conn.encNonce, size[:], nil)
+		ssIncrement(conn.encNonce)
+		out = conn.enc.Seal(out, conn.encNonce, chunk, nil)
+		ssIncrement(conn.encNonce)
+		b = b[len(chunk):]
+	}
+	if len(out) == 0 {
+		return 0, nil
+	}
+	if _, err := conn.Conn.Write(out); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+func (conn *ssConn) Read(b []byte) (int, error) {
+	if len(conn.pending) == 0 {
+		if conn.dec == nil {
+			salt := make([]byte, len(conn.cipher.key))
+			if _, err := io.ReadFull(conn.Conn, salt); err != nil {
+				return 0, err
+			}
+			aead, err := conn.cipher.session(salt)
+			if err != nil {
+				return 0, err
+			}
+			conn.dec = aead
+			conn.decNonce = make([]byte, aead.NonceSize())
+			conn.buf = make([]byte, ssMaxPayload+aead.Overhead())
+		}
+
+		overhead := conn.dec.Overhead()
+		if _, err := io.ReadFull(conn.Conn, conn.buf[:2+overhead]); err != nil {
+			return 0, err
+		}
+		size, err := conn.dec.Open(conn.buf[:0], conn.decNonce, conn.buf[:2+overhead], nil)
+		if err != nil {
+			return 0, proxyErrorf("upstream", "ss: %v", err)
+		}
+		ssIncrement(conn.decNonce)
+		length := int(binary.BigEndian.Uint16(size)) & ssMaxPayload
+		if _, err := io.ReadFull(conn.Conn, conn.buf[:length+overhead]); err != nil {
+			return 0, err
+		}
+		conn.pending, err = conn.dec.Open(conn.buf[:0], conn.decNonce, conn.buf[:length+overhead], nil)
+		if err != nil {
+			return 0, proxyErrorf("upstream", "ss: %v", err)
+		}
+		ssIncrement(conn.decNonce)
+	}
+	n := copy(b, conn.pending)
+	conn.pending = conn.pending[n:]
+	return n, nil
+}
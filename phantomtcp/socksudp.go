@@ -0,0 +1,180 @@
+package phantomtcp
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"net"
+)
+
+// the UDP flows of a rule through a SOCKS5 proxy go to the relay of a
+// UDP ASSOCIATE, which lasts as long as the TCP connection that asked
+// for it. Each datagram carries its destination: RSV RSV FRAG ATYP
+// DST.ADDR DST.PORT DATA, fragments are not supported.
+type socks5UDPConn struct {
+	*net.UDPConn
+	header []byte //of the datagrams to the destination
+	buf    []byte
+}
+
+func socks5Address(host string, port int) []byte {
+	var addr []byte
+	if ip := net.ParseIP(host); ip == nil {
+		addr = append([]byte{0x03, byte(len(host))}, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		addr = append([]byte{0x01}, ip4...)
+	} else {
+		addr = append([]byte{0x04}, ip.To16()...)
+	}
+	return append(addr, byte(port>>8), byte(port))
+}
+
+func (conn *socks5UDPConn) Write(b []byte) (int, error) {
+	packet := make([]byte, 0, len(conn.header)+len(b))
+	packet = append(packet, conn.header...)
+	packet = append(packet, b...)
+	if _, err := conn.UDPConn.Write(packet); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (conn *socks5UDPConn) Read(b []byte) (int, error) {
+	for {
+		n, err := conn.UDPConn.Read(conn.buf)
+		if err != nil {
+			return 0, err
+		}
+		if n < 4 || conn.buf[2] != 0 {
+			continue
+		}
+		offset := 4
+		switch conn.buf[3] {
+		case 0x01:
+			offset += net.IPv4len + 2
+		case 0x03:
+			if n < 5 {
+				continue
+			}
+			offset += 1 + int(conn.buf[4]) + 2
+		case 0x04:
+			offset += net.IPv6len + 2
+		default:
+			continue
+		}
+		if offset > n {
+			continue
+		}
+		return copy(b, conn.buf[offset:n]), nil
+	}
+}
+
+// dialSocks5UDP asks the SOCKS5 proxy of pface at raddr for a UDP
+// association, it returns the conn of the flow to host and the TCP
+// connection that keeps the association
+func (pface *PhantomInterface) dialSocks5UDP(raddr *net.TCPAddr, host string, port int) (net.Conn, net.Conn, error) {
+	proxy_err := errors.New("invalid proxy")
+	var synpacket *ConnectionInfo
+	var tcpConn net.Conn
+
+	laddr, err := GetLocalAddr(pface.Device, raddr.IP.To4() == nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	hint := pface.Hint & HINT_MODIFY
+	if hint != 0 {
+		tcpConn, synpacket, err = DialConnInfo(laddr, raddr, pface, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if synpacket == nil {
+			if tcpConn != nil {
+				tcpConn.Close()
+			}
+			return nil, nil, errors.New("connection does not exist")
+		}
+		synpacket.TCP.Seq++
+	} else {
+		tcpConn, err = net.DialTCP("tcp", laddr, raddr)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var b [264]byte
+	if hint != 0 {
+		err := ModifyAndSendPacket(synpacket, b[:], hint, pface.TTL, 2)
+		if err != nil {
+			tcpConn.Close()
+			return nil, nil, err
+		}
+	}
+
+	if _, err := socks5Greeting(tcpConn, b[:]); err != nil {
+		tcpConn.Close()
+		return nil, nil, err
+	}
+
+	// the datagrams come from an address not known yet
+	_, err = tcpConn.Write([]byte{0x05, 0x03, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+	if err != nil {
+		tcpConn.Close()
+		return nil, nil, err
+	}
+	n, err := tcpConn.Read(b[:])
+	if err != nil {
+		tcpConn.Close()
+		return nil, nil, err
+	}
+	if n < 2 || b[0] != 0x05 {
+		tcpConn.Close()
+		return nil, nil, proxy_err
+	}
+	if b[1] != 0x00 {
+		tcpConn.Close()
+		return nil, nil, socksError(b[1])
+	}
+	var relay net.UDPAddr
+	switch {
+	case n >= 10 && b[3] == 0x01:
+		relay = net.UDPAddr{IP: append(net.IP(nil), b[4:8]...), Port: int(binary.BigEndian.Uint16(b[8:10]))}
+	case n >= 22 && b[3] == 0x04:
+		relay = net.UDPAddr{IP: append(net.IP(nil), b[4:20]...), Port: int(binary.BigEndian.Uint16(b[20:22]))}
+	case n >= 5 && b[3] == 0x03 && n >= 7+int(b[4]):
+		relayPort := int(binary.BigEndian.Uint16(b[5+int(b[4]):]))
+		relayAddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(string(b[5:5+int(b[4])]), "0"))
+		if err != nil {
+			tcpConn.Close()
+			return nil, nil, err
+		}
+		relay = net.UDPAddr{IP: relayAddr.IP, Port: relayPort}
+	default:
+		tcpConn.Close()
+		return nil, nil, proxy_err
+	}
+	if relay.IP.IsUnspecified() {
+		// the relay is on the address of the proxy
+		relay.IP = raddr.IP
+	}
+
+	if pface.DNS != "" && net.ParseIP(host) == nil {
+		_, ips := pface.Profile().NSLookup(host, pface.Hint, pface.DNS)
+		if ips != nil {
+			host = ips[rand.Intn(len(ips))].String()
+		}
+	}
+
+	udpConn, err := net.DialUDP("udp", nil, &relay)
+	if err != nil {
+		tcpConn.Close()
+		return nil, nil, err
+	}
+	conn := &socks5UDPConn{
+		UDPConn: udpConn,
+		header:  append([]byte{0, 0, 0}, socks5Address(host, port)...),
+		buf:     make([]byte, 65535),
+	}
+	return conn, tcpConn, nil
+}
@@ -0,0 +1,226 @@
+package phantomtcp
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// how often the state is written to its file when it changed, the file
+// is what survives a crash or an OOM kill
+var StateInterval = time.Minute
+
+const stateVersion = 2
+
+type dns64State struct {
+	Prefix string `json:"prefix"`
+	Expiry int64  `json:"expiry"`
+}
+
+// the state learned at runtime: the names of the fake addresses and the
+// cache of each profile, so that the fake addresses clients cached still
+// work, the TFO cookies of servers, the discovered DNS64 prefixes and the
+// hits of the rules
+type runtimeState struct {
+	Version    int                              `json:"version"`
+	Time       int64                            `json:"time"`
+	Nose       []string                         `json:"nose"`
+	NoseHashed map[uint32]string                `json:"nose_hashed,omitempty"`
+	Profiles   map[string]map[string]DNSRecords `json:"profiles"`
+	TFOCookies map[string][]byte                `json:"tfo_cookies,omitempty"`
+	DNS64      map[string]dns64State            `json:"dns64,omitempty"`
+	Rules      map[string]map[string]RuleStats  `json:"rules,omitempty"`
+}
+
+var savedProfiles map[string]map[string]DNSRecords
+var savedRules map[string]map[string]RuleStats
+
+var stateLock sync.Mutex
+var lastState []byte
+
+func readState(filename string) (*runtimeState, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var state runtimeState
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+// LoadState restores the state saved in filename, or in its backup when
+// a crash left it damaged. It is called before any rule is loaded, the
+// caches are restored later by RestoreDNSCache
+func LoadState(filename string) error {
+	state, err := readState(filename)
+	if err != nil && !os.IsNotExist(err) {
+		logPrintln(1, "state:", filename, err)
+	}
+	if err != nil {
+		var berr error
+		state, berr = readState(filename + ".bak")
+		if berr != nil {
+			return err
+		}
+		logPrintln(1, "state:", filename+".bak", "restored")
+	}
+
+	NoseLock.Lock()
+	restoreNose(state.Nose, state.NoseHashed)
+	NoseLock.Unlock()
+	savedProfiles = state.Profiles
+	savedRules = state.Rules
+
+	for addr, cookie := range state.TFOCookies {
+		TFOCookies.Store(addr, cookie)
+	}
+	now := time.Now()
+	dns64Lock.Lock()
+	for server, prefix := range state.DNS64 {
+		expiry := time.Unix(prefix.Expiry, 0)
+		if expiry.After(now) {
+			dns64Prefixes[server] = dns64Prefix{parseNAT64(prefix.Prefix), expiry}
+		}
+	}
+	dns64Lock.Unlock()
+
+	logPrintln(1, "state:", filename, len(state.Nose), "fake addresses,", len(state.TFOCookies), "tfo cookies")
+	return nil
+}
+
+// RestoreDNSCache adds the saved names of the profile name, the names of
+// the rules keep their rules and get their old fake addresses back
+func (profile *PhantomProfile) RestoreDNSCache(name string) {
+	saved, ok := savedProfiles[name]
+	if !ok {
+		return
+	}
+
+	now := time.Now().Unix()
+	NoseLock.Lock()
+	defer NoseLock.Unlock()
+	for key, records := range saved {
+		// coalesced names share the fake address of a name of their rule
+		if owner := profile.fakeName(int(records.Index)); records.Index > 0 && (owner == "" ||
+			(owner != key && profile.GetInterface(owner) != profile.GetInterface(key))) {
+			records.Index = 0
+		}
+		if cached := profile.LoadDNSCache(key); cached != nil {
+			if records.Index > 0 && cached.Index > 0 {
+				cached.Index = records.Index
+			}
+			continue
+		}
+		// the rule of the name no longer gives it a fake address
+		if pface := profile.GetInterface(key); pface == nil || (pface.Hint&HINT_MODIFY == 0 && pface.Protocol == 0) {
+			records.Index = 0
+		}
+
+		if records.IPv4Hint != nil && records.IPv4Hint.Expired(now) {
+			records.IPv4Hint = nil
+		}
+		if records.IPv6Hint != nil && records.IPv6Hint.Expired(now) {
+			records.IPv6Hint = nil
+		}
+		if records.HTTPSTTL <= now {
+			records.HTTPSTTL = 0
+			records.Ech = nil
+		}
+		if records.Index == 0 && records.IPv4Hint == nil && records.IPv6Hint == nil {
+			continue
+		}
+		r := records
+		profile.StoreDNSCache(key, &r)
+	}
+}
+
+// SaveState writes the state with the caches of profiles to filename
+// when it changed since the last save, the previous file is kept as
+// filename.bak
+func SaveState(filename string, profiles map[string]*PhantomProfile) error {
+	state := runtimeState{
+		Version:    stateVersion,
+		Profiles:   make(map[string]map[string]DNSRecords),
+		TFOCookies: make(map[string][]byte),
+		DNS64:      make(map[string]dns64State),
+		Rules:      make(map[string]map[string]RuleStats),
+	}
+	NoseLock.Lock()
+	state.Nose = append([]string(nil), Nose...)
+	if len(noseHashed) > 0 {
+		state.NoseHashed = make(map[uint32]string, len(noseHashed))
+		for index, name := range noseHashed {
+			state.NoseHashed[index] = name
+		}
+	}
+	NoseLock.Unlock()
+
+	for name, profile := range profiles {
+		cache := make(map[string]DNSRecords)
+		profile.DNSCache.Range(func(key string, records *DNSRecords) bool {
+			cache[key] = *records
+			return true
+		})
+		state.Profiles[name] = cache
+		state.Rules[name] = profile.saveRuleHits()
+	}
+	TFOCookies.Range(func(key, value interface{}) bool {
+		addr, ok := key.(string)
+		cookie, _ := value.([]byte)
+		if ok && len(cookie) > 0 {
+			state.TFOCookies[addr] = cookie
+		}
+		return true
+	})
+	dns64Lock.Lock()
+	for server, prefix := range dns64Prefixes {
+		if prefix.prefix != nil {
+			state.DNS64[server] = dns64State{prefix.prefix.String(), prefix.expiry.Unix()}
+		}
+	}
+	dns64Lock.Unlock()
+
+	data, err := json.Marshal(&state)
+	if err != nil {
+		return err
+	}
+
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	if bytes.Equal(data, lastState) {
+		return nil
+	}
+	// the time is left out of the comparison so an unchanged state is not
+	// written again
+	lastState = data
+	state.Time = time.Now().Unix()
+	data, err = json.Marshal(&state)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(filename+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		lastState = nil
+		return err
+	}
+	if _, err := os.Stat(filename); err == nil {
+		os.Rename(filename, filename+".bak")
+	}
+	return os.Rename(filename+".tmp", filename)
+}
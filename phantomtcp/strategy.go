@@ -0,0 +1,110 @@
+package phantomtcp
+
+import (
+	"strconv"
+	"strings"
+)
+
+// fooling methods of zapret, byedpi and GoodbyeDPI and their hints
+var strategyFooling = map[string]string{
+	"md5sig":       "w-md5",
+	"badsum":       "w-csum",
+	"badseq":       "w-seq",
+	"ts":           "w-time",
+	"datanoack":    "n-ack",
+	"md5":          "w-md5",
+	"wrong-chksum": "w-csum",
+	"wrong-seq":    "w-seq",
+}
+
+// options that take a value when it is not given with =
+var strategyValues = map[string]bool{
+	"--dpi-desync": true, "--dpi-desync-ttl": true, "--dpi-desync-fooling": true,
+	"--dpi-desync-split-pos": true, "--dpi-desync-repeats": true,
+	"--set-ttl": true, "--auto-ttl": true, "-e": true,
+	"-t": true, "--ttl": true, "-s": true, "--split": true, "-d": true, "--disorder": true,
+	"-f": true, "--fake": true,
+}
+
+// TranslateStrategy maps a strategy of zapret (nfqws), byedpi (ciadpi)
+// or GoodbyeDPI onto hints and a TTL, the options that have no
+// equivalent are returned as unsupported
+func TranslateStrategy(strategy string) (hints []string, ttl int, unsupported []string) {
+	add := func(hint string) {
+		for _, h := range hints {
+			if h == hint {
+				return
+			}
+		}
+		hints = append(hints, hint)
+	}
+
+	fields := strings.Fields(strategy)
+	for i := 0; i < len(fields); i++ {
+		option := fields[i]
+		value := ""
+		if eq := strings.IndexByte(option, '='); eq != -1 && strings.HasPrefix(option, "--") {
+			option, value = option[:eq], option[eq+1:]
+		} else if len(option) > 2 && option[0] == '-' && option[1] != '-' {
+			option, value = option[:2], option[2:]
+		}
+		if value == "" && strategyValues[option] && i+1 < len(fields) && !strings.HasPrefix(fields[i+1], "--") {
+			i++
+			value = fields[i]
+		}
+
+		switch option {
+		case "--dpi-desync":
+			for _, mode := range strings.Split(value, ",") {
+				switch mode {
+				case "fake", "split", "split2", "fakedsplit", "multisplit":
+				case "disorder", "disorder2", "fakeddisorder", "multidisorder":
+					add("mode2")
+				case "syndata":
+					add("tfo")
+				default:
+					unsupported = append(unsupported, option+"="+mode)
+				}
+			}
+		case "--dpi-desync-ttl", "--set-ttl", "-t", "--ttl":
+			n, err := strconv.Atoi(value)
+			if err != nil || n <= 0 {
+				unsupported = append(unsupported, option+"="+value)
+				continue
+			}
+			ttl = n
+			add("ttl")
+		case "--dpi-desync-fooling":
+			for _, fooling := range strings.Split(value, ",") {
+				hint, ok := strategyFooling[fooling]
+				if ok {
+					add(hint)
+				} else {
+					unsupported = append(unsupported, option+"="+fooling)
+				}
+			}
+		case "--dpi-desync-split-pos", "-s", "--split", "-e":
+			if value == "1" || strings.HasPrefix(value, "1+") {
+				add("1-seg")
+			} else if value != "" && value[0] >= '2' && value[0] <= '4' && len(value) == 1 {
+				add("s-seg")
+			}
+		case "-d", "--disorder", "--reverse-frag":
+			add("mode2")
+		case "-S", "--md5sig":
+			add("w-md5")
+		case "--wrong-chksum", "--wrong-seq":
+			add(strategyFooling[option[2:]])
+		case "-f", "--fake", "--native-frag", "--dpi-desync-repeats", "--dpi-desync-any-protocol":
+		default:
+			option = fields[i]
+			if i+1 < len(fields) && !strings.HasPrefix(fields[i+1], "-") {
+				i++
+				option += " " + fields[i]
+			}
+			unsupported = append(unsupported, option)
+		}
+	}
+
+	return hints, ttl, unsupported
+}
@@ -0,0 +1,37 @@
+package phantomtcp
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTranslateStrategy(t *testing.T) {
+	tests := []struct {
+		strategy    string
+		hints       []string
+		ttl         int
+		unsupported []string
+	}{
+		// zapret
+		{"--dpi-desync=fake,disorder2 --dpi-desync-ttl=5 --dpi-desync-fooling=md5sig,badsum",
+			[]string{"mode2", "ttl", "w-md5", "w-csum"}, 5, nil},
+		{"--dpi-desync fakedsplit --dpi-desync-split-pos 1 --dpi-desync-repeats 6",
+			[]string{"1-seg"}, 0, nil},
+		{"--dpi-desync=syndata,hopbyhop --dpi-desync-fooling=datanoack,hopbyhop --dpi-desync-ttl=0",
+			[]string{"tfo", "n-ack"}, 0, []string{"--dpi-desync=hopbyhop", "--dpi-desync-fooling=hopbyhop", "--dpi-desync-ttl=0"}},
+		// byedpi
+		{"-d 1 -t 8 -s 1+s", []string{"mode2", "ttl", "1-seg"}, 8, nil},
+		{"-t5 -S --md5sig", []string{"ttl", "w-md5"}, 5, nil},
+		// GoodbyeDPI
+		{"-e 2 --wrong-chksum --wrong-seq --set-ttl 3", []string{"s-seg", "w-csum", "w-seq", "ttl"}, 3, nil},
+		{"-f 2 --native-frag --reverse-frag", []string{"mode2"}, 0, nil},
+		{"--hostcase --blacklist list.txt -q", nil, 0, []string{"--hostcase", "--blacklist list.txt", "-q"}},
+		{"", nil, 0, nil},
+	}
+	for _, tt := range tests {
+		hints, ttl, unsupported := TranslateStrategy(tt.strategy)
+		if !reflect.DeepEqual(hints, tt.hints) || ttl != tt.ttl || !reflect.DeepEqual(unsupported, tt.unsupported) {
+			t.Errorf("%q: %q ttl %d %q, want %q ttl %d %q", tt.strategy, hints, ttl, unsupported, tt.hints, tt.ttl, tt.unsupported)
+		}
+	}
+}
@@ -20,9 +20,37 @@ import (
 )
 
 type ConnectionInfo struct {
-	Link gopacket.LinkLayer
-	IP   gopacket.NetworkLayer
-	TCP  layers.TCP
+	Link  gopacket.LinkLayer
+	IP    gopacket.NetworkLayer
+	TCP   layers.TCP
+	Encap []gopacket.SerializableLayer
+}
+
+// MSS announced in the captured handshake packet
+func (connInfo *ConnectionInfo) MSS() int {
+	for _, op := range connInfo.TCP.Options {
+		if op.OptionType == layers.TCPOptionKindMSS && len(op.OptionData) == 2 {
+			return int(binary.BigEndian.Uint16(op.OptionData))
+		}
+	}
+	return 1220
+}
+
+// segmented sends payload in segments of at most the MSS of connInfo,
+// segmentation offload does not apply to injected packets and a payload
+// larger than the MSS would be sent as an oversized packet
+func segmented(connInfo *ConnectionInfo, payload []byte, send func(info *ConnectionInfo, segment []byte) error) error {
+	mss := connInfo.MSS()
+	info := *connInfo
+	for len(payload) > mss {
+		err := send(&info, payload[:mss])
+		if err != nil {
+			return err
+		}
+		info.TCP.Seq += uint32(mss)
+		payload = payload[mss:]
+	}
+	return send(&info, payload)
 }
 
 type SynInfo struct {
@@ -85,6 +113,8 @@ func IsNormalError(err error) bool {
 }
 
 func AddConn(synAddr string, option uint32) {
+	captureConn(synAddr)
+
 	result, ok := ConnSyn.LoadOrStore(synAddr, SynInfo{1, option})
 	if ok {
 		info := result.(SynInfo)
@@ -95,6 +125,7 @@ func AddConn(synAddr string, option uint32) {
 }
 
 func DelConn(synAddr string) {
+	releaseConn(synAddr)
 	result, ok := ConnSyn.Load(synAddr)
 	if ok {
 		info := result.(SynInfo)
@@ -148,6 +179,9 @@ func GetLocalAddr(name string, ipv6 bool) (*net.TCPAddr, error) {
 func (pface *PhantomInterface) Dial(host string, port int, b []byte) (net.Conn, *ConnectionInfo, error) {
 	raddrs, err := pface.GetRemoteAddresses(host, port)
 	if err != nil || raddrs == nil {
+		if pface.isProxy() || classifyError(err).Kind == "dns-timeout" {
+			return failOpen(host, port, b, err)
+		}
 		return nil, nil, err
 	}
 
@@ -170,28 +204,41 @@ func (pface *PhantomInterface) Dial(host string, port int, b []byte) (net.Conn,
 		}
 	}
 
+	if isLocalAddress(raddrs[0].IP) || pface.encrypted() {
+		length = 0
+	}
+
 	if PassiveMode || length == 0 {
-		raddr := raddrs[rand.Intn(len(raddrs))]
+		if HappyEyeballs {
+			conn, err = dialHappy(device, raddrs)
+		} else {
+			raddr := raddrs[rand.Intn(len(raddrs))]
 
-		var laddr *net.TCPAddr = nil
-		if device != "" {
-			laddr, err = GetLocalAddr(device, raddr.IP.To4() == nil)
-			if err != nil {
-				return nil, nil, err
+			var laddr *net.TCPAddr = nil
+			if device != "" {
+				laddr, err = GetLocalAddr(device, raddr.IP.To4() == nil)
+				if err != nil {
+					return nil, nil, err
+				}
 			}
-		}
 
-		conn, err = net.DialTCP("tcp", laddr, raddr)
+			conn, err = net.DialTCP("tcp", laddr, raddr)
+		}
 		if err != nil {
+			if pface.isProxy() {
+				return failOpen(host, port, b, err)
+			}
 			return nil, nil, err
 		}
 
 		if pface.Protocol != 0 {
-			pface.ProxyHandshake(conn, nil, host, port)
+			var proxyConn net.Conn
+			proxyConn, err = pface.ProxyHandshake(conn, nil, host, port)
 			if err != nil {
 				conn.Close()
-				return nil, nil, err
+				return failOpen(host, port, b, err)
 			}
+			conn = proxyConn
 		}
 
 		if b != nil {
@@ -219,53 +266,26 @@ func (pface *PhantomInterface) Dial(host string, port int, b []byte) (net.Conn,
 
 		return conn, nil, err
 	} else {
-		rand.Seed(time.Now().UnixNano())
-
-		fakepaylen := 1280
-		if len(b) < fakepaylen {
-			fakepaylen = len(b)
-		}
-		fakepayload := make([]byte, fakepaylen)
-		copy(fakepayload, b[:fakepaylen])
-
-		cut := offset + length/2
-		var tfo_payload []byte = nil
-		if (pface.Hint & (HINT_TFO | HINT_HTFO)) != 0 {
-			if (pface.Hint & HINT_TFO) != 0 {
-				tfo_payload = b
-			} else {
-				tfo_payload = b[:cut]
-			}
-		} else if pface.Hint&HINT_RAND != 0 {
-			_, err = rand.Read(fakepayload)
-			if err != nil {
-				logPrintln(1, err)
-			}
-		} else {
-			min_dot := offset + length
-			max_dot := offset
-			for i := offset; i < offset+length; i++ {
-				if fakepayload[i] == '.' {
-					if i < min_dot {
-						min_dot = i
-					}
-					if i > max_dot {
-						max_dot = i
-					}
-				} else {
-					fakepayload[i] = domainBytes[rand.Intn(len(domainBytes))]
-				}
-			}
-			if min_dot == max_dot {
-				min_dot = offset
+		if pface.Hint&HINT_LAZY != 0 && !lazyBlocked(host, port) {
+			conn, err := pface.dialLazy(host, port, b)
+			if err == nil {
+				return conn, nil, nil
 			}
-
-			cut = (min_dot + max_dot) / 2
+			logPrintln(2, "lazy:", host, port, err)
 		}
+		if !captureAvailable() {
+			return failOpen(host, port, b, proxyErrorf("capture", "packet capture is unavailable"))
+		}
+
+		seed := time.Now().UnixNano()
+		fakepayload, cut, tfo_payload := pface.fakePayload(b, offset, length, seed)
 
 		var synpacket *ConnectionInfo
 		for i := 0; i < 5; i++ {
 			raddr := raddrs[rand.Intn(len(raddrs))]
+			if HappyEyeballs {
+				raddr = raddrs[i%len(raddrs)]
+			}
 
 			laddr, err := GetLocalAddr(device, raddr.IP.To4() == nil)
 			if err != nil {
@@ -277,6 +297,9 @@ func (pface *PhantomInterface) Dial(host string, port int, b []byte) (net.Conn,
 				if IsNormalError(err) {
 					continue
 				}
+				if pface.isProxy() {
+					return failOpen(host, port, b, err)
+				}
 				return nil, nil, err
 			}
 
@@ -287,7 +310,7 @@ func (pface *PhantomInterface) Dial(host string, port int, b []byte) (net.Conn,
 			if conn != nil {
 				conn.Close()
 			}
-			return nil, nil, errors.New("connection does not exist")
+			return failOpen(host, port, b, proxyErrorf("capture", "connection does not exist"))
 		}
 
 		logPrintln(3, host, conn.RemoteAddr(), "connected")
@@ -299,89 +322,157 @@ func (pface *PhantomInterface) Dial(host string, port int, b []byte) (net.Conn,
 		synpacket.TCP.Seq++
 
 		if pface.Protocol != 0 {
-			err = pface.ProxyHandshake(conn, synpacket, host, port)
+			var proxyConn net.Conn
+			proxyConn, err = pface.ProxyHandshake(conn, synpacket, host, port)
 			if err != nil {
 				conn.Close()
-				return nil, nil, err
+				return failOpen(host, port, b, err)
 			}
-			if pface.Protocol == HTTPS {
-				conn.Write(b)
-				return conn, synpacket, nil
-			}
-		}
-
-		count := 1
-		if (pface.Hint & (HINT_TFO | HINT_HTFO)) != 0 {
-			if (pface.Hint & HINT_HTFO) != 0 {
-				_, err = conn.Write(b[cut:])
-				if err != nil {
-					conn.Close()
-					return nil, nil, err
+			if pface.encrypted() {
+				// the payload is not seen on the wire, nothing to desync
+				if b != nil {
+					_, err = proxyConn.Write(b)
 				}
-			}
-			synpacket.TCP.Seq += uint32(len(b))
-		} else {
-			if pface.Hint&HINT_MODE2 != 0 {
-				synpacket.TCP.Seq += uint32(cut)
-				fakepayload = fakepayload[cut:]
-				count = 2
-			} else {
-				err = ModifyAndSendPacket(synpacket, fakepayload, pface.Hint, pface.TTL, count)
 				if err != nil {
-					conn.Close()
+					proxyConn.Close()
 					return nil, nil, err
 				}
+				return proxyConn, nil, nil
 			}
+		}
 
-			SegOffset := 0
-			if pface.Hint&(HINT_SSEG|HINT_1SEG) != 0 {
-				if pface.Hint&HINT_1SEG != 0 {
-					SegOffset = 1
-				} else {
-					SegOffset = 4
+		trace := NewTrace(host, port, pface, seed, b, offset, length)
+		err = pface.sendPayload(conn, synpacket, b, fakepayload, cut, trace)
+		if err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+		trace.Attach(conn)
+
+		return conn, synpacket, err
+	}
+}
+
+// the fake payload and the cut of the real one, deterministic for a seed
+// so that a recorded trace can be replayed
+func (pface *PhantomInterface) fakePayload(b []byte, offset, length int, seed int64) ([]byte, int, []byte) {
+	r := rand.New(rand.NewSource(seed))
+
+	fakepaylen := 1280
+	if len(b) < fakepaylen {
+		fakepaylen = len(b)
+	}
+	fakepayload := make([]byte, fakepaylen)
+	copy(fakepayload, b[:fakepaylen])
+
+	cut := offset + length/2
+	var tfo_payload []byte = nil
+	if (pface.Hint & (HINT_TFO | HINT_HTFO)) != 0 {
+		if (pface.Hint & HINT_TFO) != 0 {
+			tfo_payload = b
+		} else {
+			tfo_payload = b[:cut]
+		}
+	} else if pface.Hint&HINT_RAND != 0 {
+		r.Read(fakepayload)
+	} else {
+		min_dot := offset + length
+		max_dot := offset
+		for i := offset; i < offset+length; i++ {
+			if fakepayload[i] == '.' {
+				if i < min_dot {
+					min_dot = i
 				}
-				_, err = conn.Write(b[:SegOffset])
-				if err != nil {
-					conn.Close()
-					return nil, nil, err
+				if i > max_dot {
+					max_dot = i
 				}
+			} else {
+				fakepayload[i] = domainBytes[r.Intn(len(domainBytes))]
 			}
+		}
+		if min_dot == max_dot {
+			min_dot = offset
+		}
+
+		cut = (min_dot + max_dot) / 2
+		if pface.ALPN != "" {
+			rewriteALPN(fakepayload, pface.ALPN)
+		}
+	}
+
+	return fakepayload, cut, tfo_payload
+}
+
+func (pface *PhantomInterface) sendPayload(conn net.Conn, synpacket *ConnectionInfo, b, fakepayload []byte, cut int, trace *Trace) error {
+	var err error
+	trace.Syn(synpacket)
 
-			_, err = conn.Write(b[SegOffset:cut])
+	count := 1
+	if (pface.Hint & (HINT_TFO | HINT_HTFO)) != 0 {
+		if (pface.Hint & HINT_HTFO) != 0 {
+			_, err = trace.Write(conn, b[cut:])
 			if err != nil {
-				conn.Close()
-				return nil, nil, err
+				return err
 			}
-
-			err = ModifyAndSendPacket(synpacket, fakepayload, pface.Hint, pface.TTL, count)
+		}
+		synpacket.TCP.Seq += uint32(len(b))
+	} else {
+		if pface.Hint&HINT_MODE2 != 0 {
+			synpacket.TCP.Seq += uint32(cut)
+			fakepayload = fakepayload[cut:]
+			count = 2
+		} else {
+			err = trace.SendFake(synpacket, fakepayload, pface.Hint, pface.TTL, count)
 			if err != nil {
-				conn.Close()
-				return nil, nil, err
+				return err
 			}
+		}
 
-			_, err = conn.Write(b[cut:])
+		SegOffset := 0
+		if pface.Hint&(HINT_SSEG|HINT_1SEG) != 0 {
+			if pface.Hint&HINT_1SEG != 0 {
+				SegOffset = 1
+			} else {
+				SegOffset = 4
+			}
+			_, err = trace.Write(conn, b[:SegOffset])
 			if err != nil {
-				conn.Close()
-				return nil, nil, err
+				return err
 			}
+		}
 
-			synpacket.TCP.Seq += uint32(len(b))
-			if pface.Hint&HINT_SAT != 0 {
-				_, err = rand.Read(fakepayload)
-				if err != nil {
-					conn.Close()
-					return nil, nil, err
-				}
-				err = ModifyAndSendPacket(synpacket, fakepayload, pface.Hint, pface.TTL, 2)
-			}
+		_, err = trace.Write(conn, b[SegOffset:cut])
+		if err != nil {
+			return err
 		}
 
-		return conn, synpacket, err
+		err = trace.SendFake(synpacket, fakepayload, pface.Hint, pface.TTL, count)
+		if err != nil {
+			return err
+		}
+
+		_, err = trace.Write(conn, b[cut:])
+		if err != nil {
+			return err
+		}
+
+		synpacket.TCP.Seq += uint32(len(b))
+		if pface.Hint&HINT_SAT != 0 {
+			_, err = rand.Read(fakepayload)
+			if err != nil {
+				return err
+			}
+			err = trace.SendFake(synpacket, fakepayload, pface.Hint, pface.TTL, 2)
+		}
 	}
+
+	return err
 }
 
 func (server *PhantomInterface) Keep(client, conn net.Conn, connInfo *ConnectionInfo) {
 	fakepayload := make([]byte, 1500)
+	info := trackRelay(client, conn)
+	defer untrackRelay(conn)
 
 	go func() {
 		var b [1460]byte
@@ -391,6 +482,7 @@ func (server *PhantomInterface) Keep(client, conn net.Conn, connInfo *Connection
 				conn.Close()
 				return
 			}
+			info.touch()
 
 			err = ModifyAndSendPacket(connInfo, fakepayload, server.Hint, server.TTL, 2)
 			if err != nil {
@@ -406,13 +498,18 @@ func (server *PhantomInterface) Keep(client, conn net.Conn, connInfo *Connection
 		}
 	}()
 
-	io.Copy(client, conn)
+	recv, err := io.Copy(client, info.reader(conn))
+	FinishTrace(conn, recv, err)
 }
 
 func (server *PhantomInterface) GetRemoteAddresses(host string, port int) ([]*net.TCPAddr, error) {
 	switch server.Protocol {
 	case DIRECT:
-		return server.ResolveTCPAddrs(host, port)
+		addrs, err := server.ResolveTCPAddrs(host, port)
+		if err != nil {
+			return nil, err
+		}
+		return server.clatAddresses(addrs), nil
 	case REDIRECT:
 		if server.Address != "" {
 			var str_port string
@@ -426,16 +523,33 @@ func (server *PhantomInterface) GetRemoteAddresses(host string, port int) ([]*ne
 				return nil, err
 			}
 		}
-		return server.ResolveTCPAddrs(host, port)
+		addrs, err := server.ResolveTCPAddrs(host, port)
+		if err != nil {
+			return nil, err
+		}
+		return server.clatAddresses(addrs), nil
 	case NAT64:
 		addrs, err := server.ResolveTCPAddrs(host, port)
 		if err != nil {
 			return nil, err
 		}
-		tcpAddrs := make([]*net.TCPAddr, len(addrs))
-		for i, addr := range addrs {
-			proxy := server.Address + addr.IP.String()
-			tcpAddrs[i] = &net.TCPAddr{IP: net.ParseIP(proxy), Port: port}
+		address := server.Address
+		if address == "auto" {
+			address = GetNAT64Prefix()
+		}
+		prefix := parseNAT64(address)
+		if prefix == nil {
+			return nil, errors.New("bad NAT64 prefix " + address)
+		}
+		tcpAddrs := make([]*net.TCPAddr, 0, len(addrs))
+		for _, addr := range addrs {
+			if addr.IP.To4() == nil {
+				continue
+			}
+			tcpAddrs = append(tcpAddrs, &net.TCPAddr{IP: nat64Embed(prefix, addr.IP), Port: port})
+		}
+		if len(tcpAddrs) == 0 {
+			return nil, errors.New(host + ": no IPv4 address for NAT64")
 		}
 		return tcpAddrs, nil
 	default:
@@ -451,7 +565,27 @@ func (server *PhantomInterface) GetRemoteAddresses(host string, port int) ([]*ne
 	}
 }
 
-func (server *PhantomInterface) ProxyHandshake(conn net.Conn, synpacket *ConnectionInfo, host string, port int) error {
+// socks5Greeting offers an upstream SOCKS5 proxy no authentication and
+// reads its choice into b, it returns the length of the greeting
+func socks5Greeting(conn net.Conn, b []byte) (int, error) {
+	n, err := conn.Write([]byte{0x05, 0x01, 0x00})
+	if err != nil {
+		return n, err
+	}
+	m, err := conn.Read(b)
+	if err != nil {
+		return n, err
+	}
+	if m < 2 || b[0] != 0x05 {
+		return n, errors.New("invalid proxy")
+	}
+	if b[1] != 0x00 {
+		return n, proxyErrorf("upstream-auth", "no authentication method accepted by the upstream proxy")
+	}
+	return n, nil
+}
+
+func (server *PhantomInterface) ProxyHandshake(conn net.Conn, synpacket *ConnectionInfo, host string, port int) (net.Conn, error) {
 	var err error
 	proxy_err := errors.New("invalid proxy")
 
@@ -462,26 +596,26 @@ func (server *PhantomInterface) ProxyHandshake(conn net.Conn, synpacket *Connect
 	case NAT64:
 	case HTTP:
 		{
-			request := []byte(fmt.Sprintf("CONNECT %s HTTP/1.1\r\n\r\n", net.JoinHostPort(host, string(port))))
+			request := []byte(fmt.Sprintf("CONNECT %s HTTP/1.1\r\n\r\n", net.JoinHostPort(host, strconv.Itoa(port))))
 			fakepayload := make([]byte, len(request))
 			var n int = 0
 			if synpacket != nil {
 				if hint&HINT_SSEG != 0 {
 					n, err = conn.Write(request[:4])
 					if err != nil {
-						return err
+						return nil, err
 					}
 				} else if hint&HINT_MODE2 != 0 {
 					n, err = conn.Write(request[:10])
 					if err != nil {
-						return err
+						return nil, err
 					}
 				}
 
 				proxy_seq += uint32(n)
 				err = ModifyAndSendPacket(synpacket, fakepayload, hint, server.TTL, 2)
 				if err != nil {
-					return err
+					return nil, err
 				}
 
 				if hint&HINT_SSEG != 0 {
@@ -492,19 +626,22 @@ func (server *PhantomInterface) ProxyHandshake(conn net.Conn, synpacket *Connect
 					n, err = conn.Write(request)
 				}
 				if err != nil {
-					return err
+					return nil, err
 				}
 				proxy_seq += uint32(n)
 			} else {
 				n, err = conn.Write(request)
-				if err != nil || n == 0 {
-					return err
+				if err != nil {
+					return nil, err
 				}
 			}
 			var response [128]byte
 			n, err = conn.Read(response[:])
-			if err != nil || !strings.HasPrefix(string(response[:n]), "HTTP/1.1 200 ") {
-				return errors.New("failed to connect to proxy")
+			if err != nil {
+				return nil, err
+			}
+			if !strings.HasPrefix(string(response[:n]), "HTTP/1.1 200 ") {
+				return nil, httpProxyError(response[:n])
 			}
 		}
 	case HTTPS:
@@ -513,23 +650,28 @@ func (server *PhantomInterface) ProxyHandshake(conn net.Conn, synpacket *Connect
 			if synpacket != nil {
 				err := ModifyAndSendPacket(synpacket, b[:], hint, server.TTL, 2)
 				if err != nil {
-					return err
+					return nil, err
 				}
 			}
-			conf := &tls.Config{
-				InsecureSkipVerify: true,
+			options := server.tlsOptions
+			if options == nil {
+				options = proxyTLSOptions("", "")
 			}
-			conn = tls.Client(conn, conf)
+			serverName, _, _ := net.SplitHostPort(server.Address)
+			conn = tls.Client(conn, options.TLSConfig(serverName))
 			request := []byte(fmt.Sprintf("CONNECT %s HTTP/1.1\r\n\r\n",
-				net.JoinHostPort(host, string(port))))
+				net.JoinHostPort(host, strconv.Itoa(port))))
 			n, err := conn.Write(request)
-			if err != nil || n == 0 {
-				return err
+			if err != nil {
+				return nil, err
 			}
 			var response [128]byte
 			n, err = conn.Read(response[:])
-			if err != nil || !strings.HasPrefix(string(response[:n]), "HTTP/1.1 200 ") {
-				return errors.New("failed to connect to proxy")
+			if err != nil {
+				return nil, err
+			}
+			if !strings.HasPrefix(string(response[:n]), "HTTP/1.1 200 ") {
+				return nil, httpProxyError(response[:n])
 			}
 		}
 	case SOCKS4:
@@ -538,7 +680,7 @@ func (server *PhantomInterface) ProxyHandshake(conn net.Conn, synpacket *Connect
 			if synpacket != nil {
 				err := ModifyAndSendPacket(synpacket, b[:], hint, server.TTL, 2)
 				if err != nil {
-					return err
+					return nil, err
 				}
 			}
 
@@ -560,15 +702,18 @@ func (server *PhantomInterface) ProxyHandshake(conn net.Conn, synpacket *Connect
 			}
 			n, err := conn.Write(b[:requestLen])
 			if err != nil {
-				return err
+				return nil, err
 			}
 			proxy_seq += uint32(n)
 			n, err = conn.Read(b[:8])
 			if err != nil {
-				return err
+				return nil, err
+			}
+			if n < 8 || b[0] != 0 {
+				return nil, proxy_err
 			}
-			if n < 8 || b[0] != 0 || b[1] != 90 {
-				return proxy_err
+			if b[1] != 90 {
+				return nil, proxyErrorf("upstream", "upstream socks4 reply %d", b[1])
 			}
 		}
 	case SOCKS5:
@@ -577,26 +722,18 @@ func (server *PhantomInterface) ProxyHandshake(conn net.Conn, synpacket *Connect
 			if synpacket != nil {
 				err := ModifyAndSendPacket(synpacket, b[:], hint, server.TTL, 2)
 				if err != nil {
-					return err
+					return nil, err
 				}
 			}
 
-			n, err := conn.Write([]byte{0x05, 0x01, 0x00})
+			n, err := socks5Greeting(conn, b[:])
 			if err != nil {
-				return err
+				return nil, err
 			}
 			proxy_seq += uint32(n)
-			_, err = conn.Read(b[:])
-			if err != nil {
-				return err
-			}
-
-			if b[0] != 0x05 {
-				return proxy_err
-			}
 
 			if server.DNS != "" {
-				_, ips := NSLookup(host, server.Hint, server.DNS)
+				_, ips := server.Profile().NSLookup(host, server.Hint, server.DNS)
 				logPrintln(1, host, ips)
 				if ips != nil {
 					ip := ips[rand.Intn(len(ips))]
@@ -626,32 +763,43 @@ func (server *PhantomInterface) ProxyHandshake(conn net.Conn, synpacket *Connect
 			}
 
 			if err != nil {
-				return err
+				return nil, err
 			}
 			proxy_seq += uint32(n)
 			n, err = conn.Read(b[:])
 			if err != nil {
-				return err
+				return nil, err
 			}
 			if n < 2 {
-				return proxy_err
+				return nil, proxy_err
 			}
 			if b[0] != 0x05 {
-				return proxy_err
+				return nil, proxy_err
 			}
 			if b[1] != 0x00 {
-				return proxy_err
+				return nil, socksError(b[1])
 			}
 		}
+	case SS:
+		{
+			if synpacket != nil {
+				var b [264]byte
+				err := ModifyAndSendPacket(synpacket, b[:], hint, server.TTL, 2)
+				if err != nil {
+					return nil, err
+				}
+			}
+			return server.ssHandshake(conn, host, port)
+		}
 	default:
-		return proxy_err
+		return nil, proxy_err
 	}
 
 	if synpacket != nil {
 		synpacket.TCP.Seq += proxy_seq
 	}
 
-	return nil
+	return conn, nil
 }
 
 func relay(left, right net.Conn) (int64, int64, error) {
@@ -661,14 +809,17 @@ func relay(left, right net.Conn) (int64, int64, error) {
 	}
 	ch := make(chan res)
 
+	info := trackRelay(left, right)
+	defer untrackRelay(right)
+
 	go func() {
-		n, err := io.Copy(right, left)
+		n, err := io.Copy(right, info.reader(left))
 		right.SetDeadline(time.Now()) // wake up the other goroutine blocking on right
 		left.SetDeadline(time.Now())  // wake up the other goroutine blocking on left
 		ch <- res{n, err}
 	}()
 
-	n, err := io.Copy(left, right)
+	n, err := io.Copy(left, info.reader(right))
 	right.SetDeadline(time.Now()) // wake up the other goroutine blocking on right
 	left.SetDeadline(time.Now())  // wake up the other goroutine blocking on left
 	rs := <-ch
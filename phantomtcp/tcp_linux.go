@@ -25,9 +25,10 @@ func DialConnInfo(laddr, raddr *net.TCPAddr, server *PhantomInterface, payload [
 
 	AddConn(addr, server.Hint)
 
-	if (server.Hint & (HINT_MSS | HINT_TFO | HINT_HTFO | HINT_KEEPALIVE)) != 0 {
+	if (server.Hint&(HINT_MSS|HINT_TFO|HINT_HTFO|HINT_KEEPALIVE)) != 0 || server.InTTL != 0 || server.MAXTTL != 0 {
 		d := net.Dialer{Timeout: timeout, LocalAddr: laddr,
 			Control: func(network, address string, c syscall.RawConn) error {
+				var ferr error
 				err := c.Control(func(fd uintptr) {
 					if (server.Hint & HINT_MSS) != 0 {
 						syscall.SetsockoptInt(int(fd),
@@ -41,7 +42,18 @@ func DialConnInfo(laddr, raddr *net.TCPAddr, server *PhantomInterface, payload [
 					if (server.Hint & HINT_KEEPALIVE) != 0 {
 						syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_KEEPALIVE, 1)
 					}
+					if server.MAXTTL != 0 && (server.Hint&(HINT_TFO|HINT_HTFO)) == 0 {
+						syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TTL, int(server.MAXTTL))
+					}
+					// before connect, so the segments injected during the
+					// handshake are dropped as well
+					if server.InTTL != 0 {
+						ferr = AttachInTTLFilter(int(fd), raddr.IP.To4() == nil, server.InTTL)
+					}
 				})
+				if err == nil {
+					err = ferr
+				}
 				return err
 			}}
 		conn, err = d.Dial("tcp", addr)
@@ -107,6 +119,25 @@ const (
 	IP6T_SO_ORIGINAL_DST = 80
 )
 
+const SKF_NET_OFF = -0x100000
+
+// drop inbound segments that arrive with more hops left than inttl,
+// they were injected by a middlebox closer than the server
+func AttachInTTLFilter(fd int, ipv6 bool, inttl byte) error {
+	offset := SKF_NET_OFF + 8
+	if ipv6 {
+		offset = SKF_NET_OFF + 7
+	}
+
+	filter := []syscall.SockFilter{
+		*syscall.LsfStmt(syscall.BPF_LD|syscall.BPF_B|syscall.BPF_ABS, offset),
+		*syscall.LsfJump(syscall.BPF_JMP|syscall.BPF_JGT|syscall.BPF_K, int(inttl), 0, 1),
+		*syscall.LsfStmt(syscall.BPF_RET|syscall.BPF_K, 0),
+		*syscall.LsfStmt(syscall.BPF_RET|syscall.BPF_K, -1),
+	}
+	return syscall.AttachLsf(fd, filter)
+}
+
 func GetOriginalDST(conn *net.TCPConn) (*net.TCPAddr, error) {
 	file, err := conn.File()
 	if err != nil {
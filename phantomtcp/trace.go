@@ -0,0 +1,207 @@
+package phantomtcp
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// directory where the traces of failing protected connections are written
+var TraceDir string
+
+type TraceEvent struct {
+	Time  int64  `json:"time"` //microseconds since the handshake
+	Type  string `json:"type"` //syn, write, fake or end
+	Seq   uint32 `json:"seq,omitempty"`
+	Hint  uint32 `json:"hint,omitempty"`
+	TTL   byte   `json:"ttl,omitempty"`
+	Count int    `json:"count,omitempty"`
+	Data  []byte `json:"data,omitempty"`
+	Recv  int64  `json:"recv,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+type Trace struct {
+	Host      string           `json:"host"`
+	Port      int              `json:"port"`
+	Interface PhantomInterface `json:"interface"`
+	Seed      int64            `json:"seed"`
+	Payload   []byte           `json:"payload"`
+	Offset    int              `json:"offset"`
+	Length    int              `json:"length"`
+	Events    []TraceEvent     `json:"events"`
+
+	start  time.Time
+	replay bool
+	lock   sync.Mutex
+}
+
+var traces sync.Map
+
+func NewTrace(host string, port int, pface *PhantomInterface, seed int64, payload []byte, offset, length int) *Trace {
+	if TraceDir == "" {
+		return nil
+	}
+
+	return &Trace{
+		Host:      host,
+		Port:      port,
+		Interface: *pface,
+		Seed:      seed,
+		Payload:   payload,
+		Offset:    offset,
+		Length:    length,
+		start:     time.Now(),
+	}
+}
+
+func (trace *Trace) event(e TraceEvent) {
+	if trace == nil {
+		return
+	}
+
+	trace.lock.Lock()
+	e.Time = time.Since(trace.start).Microseconds()
+	trace.Events = append(trace.Events, e)
+	trace.lock.Unlock()
+}
+
+func (trace *Trace) Syn(synpacket *ConnectionInfo) {
+	trace.event(TraceEvent{Type: "syn", Seq: synpacket.TCP.Seq})
+}
+
+func (trace *Trace) Write(conn net.Conn, b []byte) (int, error) {
+	trace.event(TraceEvent{Type: "write", Data: b})
+	if trace != nil && trace.replay {
+		return len(b), nil
+	}
+	return conn.Write(b)
+}
+
+func (trace *Trace) SendFake(synpacket *ConnectionInfo, payload []byte, hint uint32, ttl uint8, count int) error {
+	if trace != nil {
+		trace.event(TraceEvent{
+			Type:  "fake",
+			Seq:   synpacket.TCP.Seq,
+			Hint:  hint,
+			TTL:   ttl,
+			Count: count,
+			Data:  append([]byte(nil), payload...),
+		})
+		if trace.replay {
+			return nil
+		}
+	}
+	return ModifyAndSendPacket(synpacket, payload, hint, ttl, count)
+}
+
+func (trace *Trace) Attach(conn net.Conn) {
+	if trace != nil {
+		traces.Store(conn, trace)
+	}
+}
+
+// called when conn is done, the trace is only written if nothing
+// was received from the server or the connection was broken
+func FinishTrace(conn net.Conn, recv int64, err error) {
+	result, ok := traces.LoadAndDelete(conn)
+	if !ok {
+		return
+	}
+	trace := result.(*Trace)
+	if recv > 0 && err == nil {
+		return
+	}
+
+	e := TraceEvent{Type: "end", Recv: recv}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	trace.event(e)
+
+	data, err := json.MarshalIndent(trace, "", "  ")
+	if err != nil {
+		logPrintln(1, err)
+		return
+	}
+	name := fmt.Sprintf("%s-%d.json", trace.Host, trace.start.UnixNano())
+	err = os.WriteFile(filepath.Join(TraceDir, name), data, 0644)
+	if err != nil {
+		logPrintln(1, err)
+		return
+	}
+	logPrintln(1, "trace:", name)
+}
+
+// run the strategy of a recorded trace again without network and
+// compare the packets it produces with the recorded ones
+func ReplayTrace(filename string) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+
+	var recorded Trace
+	err = json.Unmarshal(data, &recorded)
+	if err != nil {
+		return err
+	}
+
+	var seq uint32 = 0
+	if len(recorded.Events) > 0 && recorded.Events[0].Type == "syn" {
+		seq = recorded.Events[0].Seq
+	}
+
+	pface := recorded.Interface
+	replay := &Trace{start: time.Now(), replay: true}
+	fakepayload, cut, _ := pface.fakePayload(recorded.Payload, recorded.Offset, recorded.Length, recorded.Seed)
+	synpacket := &ConnectionInfo{TCP: layers.TCP{Seq: seq}}
+	err = pface.sendPayload(nil, synpacket, recorded.Payload, fakepayload, cut, replay)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(recorded.Host, recorded.Port)
+	diff := 0
+	for i, e := range recorded.Events {
+		mark := " "
+		if e.Type == "end" {
+			fmt.Printf("%s %8dus %-5s recv=%d %s\n", mark, e.Time, e.Type, e.Recv, e.Error)
+			continue
+		}
+		if i >= len(replay.Events) {
+			mark = "-"
+		} else {
+			r := replay.Events[i]
+			if r.Type != e.Type || r.Seq != e.Seq || r.Hint != e.Hint || r.TTL != e.TTL || r.Count != e.Count || !bytes.Equal(r.Data, e.Data) {
+				mark = "!"
+			}
+		}
+		if mark != " " {
+			diff++
+		}
+		fmt.Printf("%s %8dus %-5s seq=%d len=%d ttl=%d count=%d\n", mark, e.Time, e.Type, e.Seq, len(e.Data), e.TTL, e.Count)
+	}
+	n := len(recorded.Events)
+	if n > 0 && recorded.Events[n-1].Type == "end" {
+		n--
+	}
+	for i := n; i < len(replay.Events); i++ {
+		r := replay.Events[i]
+		fmt.Printf("+ %8s %-5s seq=%d len=%d ttl=%d count=%d\n", "", r.Type, r.Seq, len(r.Data), r.TTL, r.Count)
+		diff++
+	}
+
+	if diff > 0 {
+		return errors.New("replay differs from the trace")
+	}
+	return nil
+}
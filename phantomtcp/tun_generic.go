@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package phantomtcp
+
+import (
+	"errors"
+	"io"
+)
+
+func (profile *PhantomProfile) StartFakeTUN(name string, address string, mtu int) (io.Closer, error) {
+	return nil, errors.New("fake-tun is not supported on this platform")
+}
@@ -0,0 +1,480 @@
+//go:build linux
+// +build linux
+
+package phantomtcp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// flows of the TUN device without a packet for that long are forgotten,
+// TCP flows that sent both FINs or a RST after TUNTCPClosedTimeout
+var TUNTCPTimeout = time.Hour * 2
+var TUNTCPClosedTimeout = time.Second * 30
+var TUNUDPTimeout = time.Minute * 3
+
+// a TUN device the fake addresses are routed to: the TCP and UDP flows
+// read from it are written back as flows from peer to the address of the
+// device, where a listener and a UDP socket take them like a redirect and
+// a tproxy service, and the packets of their replies are written back as
+// from the original destination. The kernel ends the flows, as a NAT
+// would, so no userspace TCP stack is needed. It is not a capture of the
+// whole device: the default route is left alone and connections to real
+// addresses never reach it.
+type tunDevice struct {
+	file     *os.File
+	name     string
+	addr     net.IP //of the device, the listeners are bound to it
+	route    string //the fake network routed to the device
+	peer     net.IP //the rewritten flows come from it
+	listener net.Listener
+	udp      *net.UDPConn
+	tcpPort  uint16
+	udpPort  uint16
+
+	lock  sync.Mutex
+	flows map[tunFlow]uint16   //the port of peer of each flow
+	ports map[uint16]*tunEntry //the flows by the port of peer
+	next  uint16
+}
+
+// a flow read from the device
+type tunFlow struct {
+	proto    byte
+	src, dst [4]byte
+	sport    uint16
+	dport    uint16
+}
+
+type tunEntry struct {
+	flow  tunFlow
+	seen  int64 //unix seconds of the last packet
+	state byte  //of a TCP flow
+}
+
+const (
+	tunFinOut = 1 << iota //FIN sent by the client of the flow
+	tunFinIn              //FIN sent back to it
+	tunClosed             //both FINs or a RST were seen
+)
+
+func openTUN(name string) (*os.File, error) {
+	fd, err := unix.Open("/dev/net/tun", unix.O_RDWR|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	ifr, err := unix.NewIfreq(name)
+	if err == nil {
+		ifr.SetUint16(unix.IFF_TUN | unix.IFF_NO_PI)
+		err = unix.IoctlIfreq(fd, unix.TUNSETIFF, ifr)
+	}
+	if err == nil {
+		// so reads are interrupted by Close
+		err = unix.SetNonblock(fd, true)
+	}
+	if err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	return os.NewFile(uintptr(fd), "/dev/net/tun"), nil
+}
+
+func ipCommand(args ...string) error {
+	out, err := exec.Command("ip", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("ip %s: %v %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// StartFakeTUN creates the TUN device name with the IPv4 address, a CIDR
+// such as 198.18.0.1/30, routes the fake addresses to it and serves the
+// connections it reads until it is closed
+func (profile *PhantomProfile) StartFakeTUN(name string, address string, mtu int) (io.Closer, error) {
+	if VirtualNet == nil {
+		return nil, errors.New("fake-tun needs the IPv4 fake addresses of vaddrprefix")
+	}
+	ip, ipnet, err := net.ParseCIDR(address)
+	if err != nil {
+		return nil, err
+	}
+	ip = ip.To4()
+	if ones, _ := ipnet.Mask.Size(); ip == nil || ones > 30 {
+		return nil, errors.New("fake-tun needs an IPv4 address of a /30 or larger network")
+	}
+	// peer is another address of the network, not the network or broadcast one
+	peer := append(net.IP(nil), ip...)
+	peer[3]++
+	if broadcast := binary.BigEndian.Uint32(ipnet.IP.To4()) | ^binary.BigEndian.Uint32(ipnet.Mask); binary.BigEndian.Uint32(peer) >= broadcast {
+		peer[3] -= 2
+	}
+
+	file, err := openTUN(name)
+	if err != nil {
+		return nil, err
+	}
+	dev := &tunDevice{
+		file:  file,
+		name:  name,
+		addr:  ip,
+		peer:  peer,
+		flows: make(map[tunFlow]uint16),
+		ports: make(map[uint16]*tunEntry),
+		next:  1024,
+	}
+	err = ipCommand("addr", "replace", address, "dev", name)
+	if err == nil {
+		err = ipCommand("link", "set", "dev", name, "mtu", strconv.Itoa(mtu), "up")
+	}
+	if err == nil {
+		err = ipCommand("route", "replace", VirtualNet.String(), "dev", name)
+		if err == nil {
+			dev.route = VirtualNet.String()
+		}
+	}
+	if err == nil {
+		dev.listener, err = net.ListenTCP("tcp4", &net.TCPAddr{IP: ip})
+	}
+	if err == nil {
+		dev.udp, err = net.ListenUDP("udp4", &net.UDPAddr{IP: ip})
+	}
+	if err != nil {
+		dev.Close()
+		return nil, err
+	}
+	dev.tcpPort = uint16(dev.listener.Addr().(*net.TCPAddr).Port)
+	dev.udpPort = uint16(dev.udp.LocalAddr().(*net.UDPAddr).Port)
+	if VirtualNet6 != nil {
+		logPrintln(1, "fake-tun:", name, "is IPv4 only, the fake addresses of", VirtualNet6, "are not routed to it")
+	}
+
+	go dev.forward()
+	go dev.expire()
+	go profile.serveTUNTCP(dev)
+	go profile.serveTUNUDP(dev)
+	return dev, nil
+}
+
+// Close removes the route and the device, the connections it took are kept
+func (dev *tunDevice) Close() error {
+	if dev.route != "" {
+		if err := ipCommand("route", "del", dev.route, "dev", dev.name); err != nil {
+			logPrintln(1, "fake-tun:", err)
+		}
+	}
+	if dev.listener != nil {
+		dev.listener.Close()
+	}
+	if dev.udp != nil {
+		dev.udp.Close()
+	}
+	return dev.file.Close()
+}
+
+// forward rewrites the packets read from the device and writes them back
+func (dev *tunDevice) forward() {
+	packet := make([]byte, 65535)
+	for {
+		n, err := dev.file.Read(packet)
+		if err != nil {
+			if !errors.Is(err, os.ErrClosed) {
+				logPrintln(1, "fake-tun:", dev.name, err)
+			}
+			return
+		}
+		if dev.rewrite(packet[:n]) {
+			dev.file.Write(packet[:n])
+		}
+	}
+}
+
+// rewrite turns a packet of a flow into one between peer and the
+// listeners, or one of the listeners into one of the flow; other
+// packets, IPv6 and fragments are dropped
+func (dev *tunDevice) rewrite(p []byte) bool {
+	if len(p) < 20 || p[0]>>4 != 4 {
+		return false
+	}
+	ihl := int(p[0]&0x0f) * 4
+	total := int(binary.BigEndian.Uint16(p[2:4]))
+	if ihl < 20 || total > len(p) || total < ihl+8 || binary.BigEndian.Uint16(p[6:8])&0x3fff != 0 {
+		return false
+	}
+	proto := p[9]
+	listen := dev.tcpPort
+	switch proto {
+	case 6:
+		if total < ihl+20 {
+			return false
+		}
+	case 17:
+		listen = dev.udpPort
+	default:
+		return false
+	}
+
+	src, dst := p[12:16], p[16:20]
+	sport := binary.BigEndian.Uint16(p[ihl:])
+	dport := binary.BigEndian.Uint16(p[ihl+2:])
+	if sport == listen && net.IP(src).Equal(dev.addr) && net.IP(dst).Equal(dev.peer) {
+		flow, ok := dev.lookup(dport)
+		if !ok || flow.proto != proto {
+			return false
+		}
+		if proto == 6 {
+			dev.track(dport, p[ihl+13], false)
+		}
+		copy(src, flow.dst[:])
+		copy(dst, flow.src[:])
+		binary.BigEndian.PutUint16(p[ihl:], flow.dport)
+		binary.BigEndian.PutUint16(p[ihl+2:], flow.sport)
+	} else {
+		flow := tunFlow{proto: proto, sport: sport, dport: dport}
+		copy(flow.src[:], src)
+		copy(flow.dst[:], dst)
+		port := dev.portOf(flow)
+		if port == 0 {
+			return false
+		}
+		if proto == 6 {
+			dev.track(port, p[ihl+13], true)
+		}
+		copy(src, dev.peer)
+		copy(dst, dev.addr)
+		binary.BigEndian.PutUint16(p[ihl:], port)
+		binary.BigEndian.PutUint16(p[ihl+2:], listen)
+	}
+	tunChecksum(p[:total], ihl)
+	return true
+}
+
+// portOf returns the port of peer of flow, a new one for a new flow, 0
+// when all are in use
+func (dev *tunDevice) portOf(flow tunFlow) uint16 {
+	dev.lock.Lock()
+	defer dev.lock.Unlock()
+	now := time.Now().Unix()
+	if port, ok := dev.flows[flow]; ok {
+		dev.ports[port].seen = now
+		return port
+	}
+	for i := 0; i < 65536-1024; i++ {
+		port := dev.next
+		dev.next++
+		if dev.next == 0 {
+			dev.next = 1024
+		}
+		entry, ok := dev.ports[port]
+		if ok && entry.closed(now) {
+			delete(dev.flows, entry.flow)
+			ok = false
+		}
+		if !ok {
+			dev.flows[flow] = port
+			dev.ports[port] = &tunEntry{flow: flow, seen: now}
+			return port
+		}
+	}
+	return 0
+}
+
+// lookup returns the flow of the port of peer
+func (dev *tunDevice) lookup(port uint16) (tunFlow, bool) {
+	dev.lock.Lock()
+	defer dev.lock.Unlock()
+	entry, ok := dev.ports[port]
+	if !ok {
+		return tunFlow{}, false
+	}
+	entry.seen = time.Now().Unix()
+	return entry.flow, true
+}
+
+// track updates the state of the TCP flow of the port of peer with the
+// flags of a segment of it, out when sent by its client
+func (dev *tunDevice) track(port uint16, flags byte, out bool) {
+	dev.lock.Lock()
+	defer dev.lock.Unlock()
+	entry, ok := dev.ports[port]
+	if !ok {
+		return
+	}
+	switch {
+	case flags&0x04 != 0: //RST
+		entry.state |= tunClosed
+	case out && flags&0x12 == 0x02: //SYN
+		// the tuple is used again by a new connection
+		entry.state = 0
+	case flags&0x01 != 0: //FIN
+		if out {
+			entry.state |= tunFinOut
+		} else {
+			entry.state |= tunFinIn
+		}
+		if entry.state&(tunFinOut|tunFinIn) == tunFinOut|tunFinIn {
+			entry.state |= tunClosed
+		}
+	}
+}
+
+// closed reports whether the entry can be forgotten at now
+func (entry *tunEntry) closed(now int64) bool {
+	timeout := TUNTCPTimeout
+	if entry.flow.proto == 17 {
+		timeout = TUNUDPTimeout
+	} else if entry.state&tunClosed != 0 {
+		timeout = TUNTCPClosedTimeout
+	}
+	return now-entry.seen > int64(timeout/time.Second)
+}
+
+func (dev *tunDevice) expire() {
+	for {
+		time.Sleep(TUNTCPClosedTimeout)
+		if _, err := dev.file.Stat(); err != nil {
+			return
+		}
+		now := time.Now().Unix()
+		dev.lock.Lock()
+		for port, entry := range dev.ports {
+			if entry.closed(now) {
+				delete(dev.ports, port)
+				delete(dev.flows, entry.flow)
+			}
+		}
+		dev.lock.Unlock()
+	}
+}
+
+// tunChecksum computes the checksums of the IPv4 packet p again
+func tunChecksum(p []byte, ihl int) {
+	p[10], p[11] = 0, 0
+	binary.BigEndian.PutUint16(p[10:], ^foldChecksum(p[:ihl], 0))
+
+	segment := p[ihl:]
+	offset := 16
+	if p[9] == 17 {
+		offset = 6
+		if segment[6] == 0 && segment[7] == 0 {
+			// sent without a checksum
+			return
+		}
+	}
+	segment[offset], segment[offset+1] = 0, 0
+	sum := uint32(binary.BigEndian.Uint16(p[12:])) + uint32(binary.BigEndian.Uint16(p[14:])) +
+		uint32(binary.BigEndian.Uint16(p[16:])) + uint32(binary.BigEndian.Uint16(p[18:])) +
+		uint32(p[9]) + uint32(len(segment))
+	checksum := ^foldChecksum(segment, sum)
+	if checksum == 0 && p[9] == 17 {
+		checksum = 0xffff
+	}
+	binary.BigEndian.PutUint16(segment[offset:], checksum)
+}
+
+func foldChecksum(b []byte, sum uint32) uint16 {
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+	return uint16(sum)
+}
+
+func (profile *PhantomProfile) serveTUNTCP(dev *tunDevice) {
+	for {
+		conn, err := dev.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			logPrintln(1, "fake-tun:", err)
+			continue
+		}
+		flow, ok := dev.lookup(uint16(conn.RemoteAddr().(*net.TCPAddr).Port))
+		if !ok {
+			conn.Close()
+			continue
+		}
+		client := &addrConn{conn, &net.TCPAddr{IP: net.IP(flow.src[:]), Port: int(flow.sport)}}
+		addr := &net.TCPAddr{IP: net.IP(flow.dst[:]), Port: int(flow.dport)}
+		go profile.tcp_redirect(client, addr, "", nil, nil)
+	}
+}
+
+func (profile *PhantomProfile) serveTUNUDP(dev *tunDevice) {
+	var lock sync.Mutex
+	remotes := make(map[uint16]net.Conn) //by the port of peer
+	data := make([]byte, 65535)
+	for {
+		n, from, err := dev.udp.ReadFromUDP(data)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			logPrintln(1, "fake-tun:", err)
+			continue
+		}
+		port := uint16(from.Port)
+		lock.Lock()
+		remote, ok := remotes[port]
+		lock.Unlock()
+		if ok {
+			remote.Write(data[:n])
+			continue
+		}
+		flow, ok := dev.lookup(port)
+		if !ok {
+			continue
+		}
+
+		srcAddr := &net.UDPAddr{IP: net.IP(flow.src[:]), Port: int(flow.sport)}
+		dstAddr := &net.UDPAddr{IP: net.IP(flow.dst[:]), Port: int(flow.dport)}
+		remoteConn, proxyConn, err := profile.dialUDPFlow("TUN(UDP):", srcAddr, dstAddr, data[:n])
+		if err != nil {
+			logPrintln(1, err)
+			continue
+		}
+		if remoteConn == nil {
+			continue
+		}
+		lock.Lock()
+		remotes[port] = remoteConn
+		lock.Unlock()
+
+		go func(port uint16, from *net.UDPAddr, remoteConn, proxyConn net.Conn) {
+			b := make([]byte, 65535)
+			info := trackFlow(from, remoteConn)
+			for {
+				n, err := info.readFlow(remoteConn, b)
+				if err != nil {
+					break
+				}
+				dev.udp.WriteToUDP(b[:n], from)
+			}
+			untrackRelay(remoteConn)
+			lock.Lock()
+			delete(remotes, port)
+			lock.Unlock()
+			remoteConn.Close()
+			if proxyConn != nil {
+				proxyConn.Close()
+			}
+		}(port, from, remoteConn, proxyConn)
+	}
+}
@@ -0,0 +1,57 @@
+package phantomtcp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTUNFlowRelease(t *testing.T) {
+	tests := []struct {
+		name    string
+		flags   []byte //the flags of the segments of the flow
+		out     []bool
+		closed  bool
+		timeout time.Duration
+	}{
+		{"open", []byte{0x02, 0x12, 0x10}, []bool{true, false, true}, false, TUNTCPTimeout},
+		{"one fin", []byte{0x11}, []bool{true}, false, TUNTCPTimeout},
+		{"both fins", []byte{0x11, 0x11}, []bool{true, false}, true, TUNTCPClosedTimeout},
+		{"fin twice", []byte{0x11, 0x11}, []bool{true, true}, false, TUNTCPTimeout},
+		{"rst", []byte{0x04}, []bool{false}, true, TUNTCPClosedTimeout},
+		{"syn again", []byte{0x04, 0x02}, []bool{false, true}, false, TUNTCPTimeout},
+	}
+	for _, tt := range tests {
+		dev := &tunDevice{flows: make(map[tunFlow]uint16), ports: make(map[uint16]*tunEntry), next: 1024}
+		flow := tunFlow{proto: 6, sport: 40000, dport: 443}
+		port := dev.portOf(flow)
+		for i, flags := range tt.flags {
+			dev.track(port, flags, tt.out[i])
+		}
+		entry := dev.ports[port]
+		if closed := entry.state&tunClosed != 0; closed != tt.closed {
+			t.Errorf("%s: closed = %v, want %v", tt.name, closed, tt.closed)
+		}
+		seconds := int64(tt.timeout / time.Second)
+		if entry.closed(entry.seen+seconds) || !entry.closed(entry.seen+seconds+1) {
+			t.Errorf("%s: not forgotten after %v", tt.name, tt.timeout)
+		}
+	}
+}
+
+func TestTUNPortReuse(t *testing.T) {
+	dev := &tunDevice{flows: make(map[tunFlow]uint16), ports: make(map[uint16]*tunEntry), next: 1024}
+	old := tunFlow{proto: 6, sport: 40000, dport: 443}
+	port := dev.portOf(old)
+	dev.track(port, 0x04, true)
+	dev.ports[port].seen -= int64(TUNTCPClosedTimeout/time.Second) + 1
+
+	// a new flow takes the port of a closed flow that timed out
+	dev.next = port
+	flow := tunFlow{proto: 6, sport: 40001, dport: 443}
+	if got := dev.portOf(flow); got != port {
+		t.Fatalf("portOf = %d, want the port %d of the closed flow", got, port)
+	}
+	if _, ok := dev.flows[old]; ok {
+		t.Error("the closed flow is still mapped")
+	}
+}
@@ -41,12 +41,13 @@ func ComputeUDPChecksum(buffer []byte) uint16 {
 
 func relayUDP(left, right net.Conn) error {
 	ch := make(chan error)
+	info := trackFlow(left.RemoteAddr(), right)
+	defer untrackRelay(right)
 
 	go func() {
 		data := make([]byte, 1500)
 		for {
-			left.SetReadDeadline(time.Now().Add(time.Minute * 2))
-			n, err := left.Read(data)
+			n, err := info.readFlow(left, data)
 			if err != nil {
 				ch <- err
 				right.SetDeadline(time.Now())
@@ -60,9 +61,8 @@ func relayUDP(left, right net.Conn) error {
 	data := make([]byte, 1500)
 	var err error
 	for {
-		right.SetReadDeadline(time.Now().Add(time.Minute * 2))
 		var n int
-		n, err = right.Read(data)
+		n, err = info.readFlow(right, data)
 		if err != nil {
 			right.SetDeadline(time.Now())
 			left.SetDeadline(time.Now())
@@ -77,6 +77,81 @@ func relayUDP(left, right net.Conn) error {
 	return err
 }
 
+// dialUDPFlow connects the UDP flow of a client intercepted on its way to
+// dstAddr, a fake address or any other, and sends it first. A flow to a
+// name whose interface allows no UDP gets a nil conn, one to an address
+// without a rule is relayed as it is.
+func (profile *PhantomProfile) dialUDPFlow(from string, srcAddr, dstAddr *net.UDPAddr, first []byte) (net.Conn, net.Conn, error) {
+	var host string
+	if index := redirectIndex(dstAddr.IP); index != -1 {
+		host = profile.FakeName(index)
+		if host == "" {
+			logPrintln(4, from, srcAddr, "->", dstAddr, "out of range")
+			return nil, nil, nil
+		}
+	} else {
+		host = dstAddr.IP.String()
+	}
+
+	pface := profile.GetInterface(host)
+	if pface == nil {
+		if host != dstAddr.IP.String() {
+			logPrintln(4, from, srcAddr, "->", host, "no rule")
+			return nil, nil, nil
+		}
+		logPrintln(2, from, srcAddr, "->", dstAddr, "direct")
+		remoteConn, err := net.DialUDP("udp", nil, dstAddr)
+		if err == nil {
+			_, err = remoteConn.Write(first)
+			if err != nil {
+				remoteConn.Close()
+				return nil, nil, err
+			}
+		}
+		return remoteConn, nil, err
+	}
+
+	quic := dstAddr.Port == 443 && GetQUICVersion(first) != 0
+	// a SOCKS5 proxy relays UDP as well
+	if pface.Hint&HINT_UDP == 0 && pface.Protocol != SOCKS5 {
+		if pface.Hint&(HINT_HTTP3) == 0 {
+			logPrintln(4, from, srcAddr, "->", host, "not allow")
+			if quic {
+				profile.countQUIC(host, true)
+			}
+			return nil, nil, nil
+		}
+		if !quic {
+			logPrintln(4, from, srcAddr, "->", host, "not h3")
+			return nil, nil, nil
+		}
+	}
+	if quic {
+		profile.countQUIC(host, false)
+	}
+
+	logPrintln(1, from, srcAddr, "->", host, dstAddr.Port, pface)
+
+	remoteConn, proxyConn, err := pface.DialUDPProxy(host, dstAddr.Port)
+	if err == nil && pface.Hint&HINT_ZERO != 0 {
+		zero_data := make([]byte, 8+rand.Intn(1024))
+		_, err = remoteConn.Write(zero_data)
+	}
+	if err == nil {
+		_, err = remoteConn.Write(first)
+	}
+	if err != nil {
+		if remoteConn != nil {
+			remoteConn.Close()
+		}
+		if proxyConn != nil {
+			proxyConn.Close()
+		}
+		return nil, nil, err
+	}
+	return remoteConn, proxyConn, nil
+}
+
 func (pface *PhantomInterface) DialUDPProxy(host string, port int) (net.Conn, net.Conn, error) {
 	raddrs, err := pface.GetRemoteAddresses(host, port)
 	if err != nil {
@@ -85,7 +160,6 @@ func (pface *PhantomInterface) DialUDPProxy(host string, port int) (net.Conn, ne
 	raddr := raddrs[rand.Intn(len(raddrs))]
 
 	proxy_err := errors.New("invalid proxy")
-	var tcpConn net.Conn = nil
 
 	switch pface.Protocol {
 	case DIRECT:
@@ -104,96 +178,7 @@ func (pface *PhantomInterface) DialUDPProxy(host string, port int) (net.Conn, ne
 		udpConn, err := net.DialUDP("udp", laddr, &net.UDPAddr{IP: raddr.IP, Port: raddr.Port})
 		return udpConn, nil, err
 	case SOCKS5:
-		var proxy_seq uint32 = 0
-		var synpacket *ConnectionInfo
-		var hint uint32 = 0
-
-		laddr, err := GetLocalAddr(pface.Device, raddr.IP.To4() == nil)
-		if err != nil {
-			return nil, nil, err
-		}
-
-		hint = pface.Hint & HINT_MODIFY
-		if hint != 0 {
-			tcpConn, synpacket, err = DialConnInfo(laddr, raddr, pface, nil)
-			if err != nil {
-				return nil, nil, err
-			}
-
-			if synpacket == nil {
-				if tcpConn != nil {
-					tcpConn.Close()
-				}
-				return nil, nil, errors.New("connection does not exist")
-			}
-			synpacket.TCP.Seq++
-		} else {
-			tcpConn, err = net.DialTCP("tcp", laddr, raddr)
-			if err != nil {
-				return nil, nil, err
-			}
-		}
-
-		var b [264]byte
-		if hint != 0 {
-			err := ModifyAndSendPacket(synpacket, b[:], hint, pface.TTL, 2)
-			if err != nil {
-				tcpConn.Close()
-				return nil, nil, err
-			}
-		}
-
-		n, err := tcpConn.Write([]byte{0x05, 0x01, 0x00})
-		if err != nil {
-			tcpConn.Close()
-			return nil, nil, err
-		}
-		proxy_seq += uint32(n)
-		_, err = tcpConn.Read(b[:])
-		if err != nil {
-			tcpConn.Close()
-			return nil, nil, err
-		}
-
-		if b[0] != 0x05 {
-			tcpConn.Close()
-			return nil, nil, proxy_err
-		}
-
-		copy(b[:], []byte{0x05, 0x03, 0x00, 0x03})
-		hostLen := len(host)
-		b[4] = byte(hostLen)
-		copy(b[5:], []byte(host))
-		binary.BigEndian.PutUint16(b[5+hostLen:], uint16(port))
-		n, err = tcpConn.Write(b[:7+hostLen])
-		if err != nil {
-			tcpConn.Close()
-			return nil, nil, err
-		}
-		proxy_seq += uint32(n)
-		n, err = tcpConn.Read(b[:])
-		if err != nil {
-			tcpConn.Close()
-			return nil, nil, err
-		}
-		if n < 4 || b[0] != 0x05 || b[1] != 0x00 {
-			tcpConn.Close()
-			return nil, nil, proxy_err
-		}
-		var udpAddr net.UDPAddr
-		switch b[3] {
-		case 1:
-			port := int(binary.BigEndian.Uint16(b[8:10]))
-			udpAddr = net.UDPAddr{IP: net.IP(b[4:8]), Port: port}
-		case 4:
-			port := int(binary.BigEndian.Uint16(b[20:22]))
-			udpAddr = net.UDPAddr{IP: net.IP(b[4:20]), Port: port}
-		default:
-			tcpConn.Close()
-			return nil, nil, proxy_err
-		}
-		udpConn, err := net.DialUDP("udp", nil, &udpAddr)
-		return udpConn, tcpConn, err
+		return pface.dialSocks5UDP(raddr, host, port)
 	}
 
 	return nil, nil, proxy_err
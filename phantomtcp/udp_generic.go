@@ -3,5 +3,26 @@
 
 package phantomtcp
 
-func TProxyUDP(address string) {
+import (
+	"errors"
+	"net"
+)
+
+func ListenTProxyUDP(address string) (*net.UDPConn, error) {
+	return nil, errors.New("tproxy is not supported")
+}
+
+func (profile *PhantomProfile) TProxyUDP(client *net.UDPConn) {
+}
+
+func ListenTProxyTCP(address string) (net.Listener, error) {
+	return nil, errors.New("tproxy is not supported")
+}
+
+func (profile *PhantomProfile) TProxyProxy(client net.Conn) {
+	client.Close()
+}
+
+func tproxyCheck() error {
+	return errors.New("tproxy is not supported on this platform")
 }
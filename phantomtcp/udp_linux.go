@@ -1,105 +1,47 @@
 package phantomtcp
 
 import (
-	"encoding/binary"
-	"math/rand"
+	"context"
+	"errors"
 	"net"
+	"syscall"
 
 	"github.com/macronut/go-tproxy"
 )
 
-func TProxyUDP(address string) {
+func ListenTProxyUDP(address string) (*net.UDPConn, error) {
 	laddr, err := net.ResolveUDPAddr("udp", address)
 	if err != nil {
-		logPrintln(1, err)
-		return
-	}
-	client, err := tproxy.ListenUDP("udp", laddr)
-	if err != nil {
-		logPrintln(1, err)
-		return
+		return nil, err
 	}
-	defer client.Close()
+	return tproxy.ListenUDP("udp", laddr)
+}
 
+func (profile *PhantomProfile) TProxyUDP(client *net.UDPConn) {
 	data := make([]byte, 1500)
 	for {
 		n, srcAddr, dstAddr, err := tproxy.ReadFromUDP(client, data)
 		if err != nil {
-			logPrintln(1, err)
-			continue
-		}
-
-		var host string
-		dstIP4 := dstAddr.IP.To4()
-		if dstIP4 != nil {
-			if dstIP4[0] == VirtualAddrPrefix {
-				index := int(binary.BigEndian.Uint16(dstIP4[2:4]))
-				if index >= len(Nose) {
-					logPrintln(4, "TProxy(UDP):", srcAddr, "->", dstAddr, "out of range")
-					continue
-				}
-				host = Nose[index]
-			} else {
-				continue
-			}
-		} else if dstAddr.IP[0] == 0 {
-			index := int(binary.BigEndian.Uint32(dstAddr.IP[12:16]))
-			if index >= len(Nose) {
-				logPrintln(4, "TProxy(UDP):", srcAddr, "->", dstAddr, "out of range")
-				continue
-			}
-			host = Nose[index]
-		} else {
-			continue
-		}
-
-		pface := DefaultProfile.GetInterface(host)
-		if pface.Hint&HINT_UDP == 0 {
-			if pface.Hint&(HINT_HTTP3) == 0 {
-				logPrintln(4, "TProxy(UDP):", srcAddr, "->", host, "not allow")
-				continue
+			if errors.Is(err, net.ErrClosed) {
+				return
 			}
-			if GetQUICVersion(data[:n]) == 0 {
-				logPrintln(4, "TProxy(UDP):", srcAddr, "->", host, "not h3")
-				continue
-			}
-		}
-
-		logPrintln(1, "TProxy(UDP):", srcAddr, "->", host, dstAddr.Port, pface)
-
-		localConn, err := tproxy.DialUDP("udp", dstAddr, srcAddr)
-		if err != nil {
 			logPrintln(1, err)
 			continue
 		}
 
-		remoteConn, proxyConn, err := pface.DialUDPProxy(host, dstAddr.Port)
+		remoteConn, proxyConn, err := profile.dialUDPFlow("TProxy(UDP):", srcAddr, dstAddr, data[:n])
 		if err != nil {
 			logPrintln(1, err)
-			localConn.Close()
-			if proxyConn != nil {
-				proxyConn.Close()
-			}
 			continue
 		}
-
-		if pface.Hint&HINT_ZERO != 0 {
-			zero_data := make([]byte, 8+rand.Intn(1024))
-			_, err = remoteConn.Write(zero_data)
-			if err != nil {
-				logPrintln(1, err)
-				localConn.Close()
-				if proxyConn != nil {
-					proxyConn.Close()
-				}
-				continue
-			}
+		if remoteConn == nil {
+			continue
 		}
 
-		_, err = remoteConn.Write(data[:n])
+		localConn, err := tproxy.DialUDP("udp", dstAddr, srcAddr)
 		if err != nil {
 			logPrintln(1, err)
-			localConn.Close()
+			remoteConn.Close()
 			if proxyConn != nil {
 				proxyConn.Close()
 			}
@@ -116,3 +58,45 @@ func TProxyUDP(address string) {
 		}(localConn, remoteConn, proxyConn)
 	}
 }
+
+// ListenTProxyTCP listens at address for the TCP connections TPROXY
+// sends to it, whose local address is their original destination
+func ListenTProxyTCP(address string) (net.Listener, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var err error
+			c.Control(func(fd uintptr) {
+				err = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+			})
+			return err
+		},
+	}
+	return lc.Listen(context.Background(), "tcp", address)
+}
+
+// TProxyProxy handles a connection of a TPROXY listener like a
+// redirected one, by the rules of its original destination
+func (profile *PhantomProfile) TProxyProxy(client net.Conn) {
+	addr, ok := client.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		client.Close()
+		return
+	}
+	own, _ := ownAddresses.Load().(map[string]bool)
+	if addr.IP.IsLoopback() || own[addr.IP.String()] {
+		// to the listener itself, not intercepted
+		client.Close()
+		return
+	}
+	profile.tcp_redirect(client, addr, "", nil, nil)
+}
+
+// the socket option tproxy needs, it takes CAP_NET_ADMIN
+func tproxyCheck() error {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	return syscall.SetsockoptInt(fd, syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+}
@@ -0,0 +1,147 @@
+package phantomtcp
+
+import (
+	"errors"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the health of each DNS server: a server that failed UnhealthyFailures
+// queries in a row is skipped until a probe for ProbeName, sent every
+// ProbeInterval, gets an answer; the lookups of a rule whose servers are
+// all down fail at once instead of waiting for the timeout, 0 keeps
+// every server in use
+var UnhealthyFailures = 3
+var ProbeInterval = time.Second * 10
+var ProbeName = "example.com"
+
+type ServerHealth struct {
+	Server    string  `json:"server"`
+	Queries   uint64  `json:"queries"`
+	Errors    uint64  `json:"errors"`
+	RTT       float64 `json:"rtt"` //smoothed, in milliseconds
+	Healthy   bool    `json:"healthy"`
+	DownSince int64   `json:"down_since,omitempty"`
+}
+
+type upstreamHealth struct {
+	lock     sync.Mutex
+	stats    ServerHealth
+	failures int //consecutive
+	rtt      time.Duration
+}
+
+var upstreams sync.Map
+
+func upstream(u *url.URL) *upstreamHealth {
+	key := u.String()
+	if h, ok := upstreams.Load(key); ok {
+		return h.(*upstreamHealth)
+	}
+	h, _ := upstreams.LoadOrStore(key, &upstreamHealth{stats: ServerHealth{Server: key, Healthy: true}})
+	return h.(*upstreamHealth)
+}
+
+func (h *upstreamHealth) healthy() bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.stats.Healthy
+}
+
+// record counts a query, it returns true when the server just went down
+func (h *upstreamHealth) record(rtt time.Duration, err error) bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.stats.Queries++
+	if err == nil {
+		h.failures = 0
+		if h.rtt == 0 {
+			h.rtt = rtt
+		} else {
+			h.rtt = (h.rtt*7 + rtt) / 8
+		}
+		return false
+	}
+	h.stats.Errors++
+	h.failures++
+	if UnhealthyFailures <= 0 || !h.stats.Healthy || h.failures < UnhealthyFailures {
+		return false
+	}
+	h.stats.Healthy = false
+	h.stats.DownSince = time.Now().Unix()
+	return true
+}
+
+func (h *upstreamHealth) up() {
+	h.lock.Lock()
+	h.stats.Healthy = true
+	h.stats.DownSince = 0
+	h.failures = 0
+	h.lock.Unlock()
+}
+
+// probe queries a server that is down until it answers
+func (h *upstreamHealth) probe(u *url.URL, options ServerOptions) {
+	request := PackRequest(ProbeName, 1, 0, "")
+	for {
+		time.Sleep(ProbeInterval)
+		start := time.Now()
+		_, err := Exchange(u, request, options)
+		if err == nil {
+			logPrintln(1, "DNS server up:", u, time.Since(start))
+			h.up()
+			return
+		}
+		logPrintln(3, "DNS server probe:", u, err)
+	}
+}
+
+// exchange is Exchange counted in the health of u
+func exchange(u *url.URL, request []byte, options ServerOptions) ([]byte, error) {
+	start := time.Now()
+	response, err := Exchange(u, request, options)
+	h := upstream(u)
+	if h.record(time.Since(start), err) {
+		logPrintln(1, "DNS server down:", u, err)
+		go h.probe(u, options)
+	}
+	return response, err
+}
+
+// healthyServers returns the servers that are not down
+func healthyServers(servers []*url.URL) []*url.URL {
+	live := make([]*url.URL, 0, len(servers))
+	for _, u := range servers {
+		if upstream(u).healthy() {
+			live = append(live, u)
+		}
+	}
+	return live
+}
+
+func downError(servers []*url.URL) error {
+	var list []string
+	for _, u := range servers {
+		list = append(list, u.String())
+	}
+	return errors.New(strings.Join(list, ",") + ": down")
+}
+
+// UpstreamHealth returns the health of the DNS servers queried so far
+func UpstreamHealth() []ServerHealth {
+	var list []ServerHealth
+	upstreams.Range(func(key, value interface{}) bool {
+		h := value.(*upstreamHealth)
+		h.lock.Lock()
+		stats := h.stats
+		stats.RTT = float64(h.rtt) / float64(time.Millisecond)
+		h.lock.Unlock()
+		list = append(list, stats)
+		return true
+	})
+	sort.Slice(list, func(i, j int) bool { return list[i].Server < list[j].Server })
+	return list
+}
@@ -0,0 +1,58 @@
+package phantomtcp
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net"
+	"os"
+)
+
+// vaddr6-route=1 routes the IPv6 fake addresses to this host, so the
+// local applications send their connections to them instead of failing
+// without an IPv6 route
+var VirtualRoute = false
+
+var virtualRouted *net.IPNet
+
+var ulaNet = &net.IPNet{IP: net.ParseIP("fc00::"), Mask: net.CIDRMask(7, 128)}
+
+// the /64 unique local prefix of this host, fd00::/8 with a global ID
+// from the host name so it stays the same across restarts (RFC 4193)
+func localULA() string {
+	hostname, _ := os.Hostname()
+	sum := sha256.Sum256([]byte("phantomsocks " + hostname))
+	return fmt.Sprintf("fd%02x:%02x%02x:%02x%02x::/64", sum[0], sum[1], sum[2], sum[3], sum[4])
+}
+
+// InstallVirtualRoute adds the route of the IPv6 fake addresses when
+// VirtualRoute is set, it replaces the route of a previous prefix
+func InstallVirtualRoute() error {
+	if !VirtualRoute || VirtualNet6 == nil {
+		return nil
+	}
+	if virtualRouted != nil {
+		if virtualRouted.String() == VirtualNet6.String() {
+			return nil
+		}
+		RemoveVirtualRoute()
+	}
+	err := addLocalRoute(VirtualNet6)
+	if err != nil {
+		return fmt.Errorf("vaddr6-route %s: %v", VirtualNet6, err)
+	}
+	logPrintln(1, "vaddr6-route:", VirtualNet6)
+	virtualRouted = VirtualNet6
+	return nil
+}
+
+// RemoveVirtualRoute removes the route added by InstallVirtualRoute
+func RemoveVirtualRoute() {
+	if virtualRouted == nil {
+		return
+	}
+	err := deleteLocalRoute(virtualRouted)
+	if err != nil {
+		logPrintln(1, "vaddr6-route:", virtualRouted, err)
+	}
+	virtualRouted = nil
+}
@@ -0,0 +1,287 @@
+package phantomtcp
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how long -validate waits for a DNS server or a proxy
+var ValidateTimeout = time.Second * 5
+
+var knownProtocols = map[string]bool{
+	"": true, "direct": true, "redirect": true, "nat64": true, "http": true, "https": true,
+	"socks": true, "socks4": true, "socks5": true, "ss": true,
+}
+
+// CheckInterfaces returns the problems of the interfaces of a config:
+// unknown hints and protocols, bad DNS servers, addresses and headers
+func CheckInterfaces(interfaces []InterfaceConfig) []string {
+	var problems []string
+	names := make(map[string]bool)
+	for _, c := range interfaces {
+		where := "interface " + c.Name + ": "
+		if names[c.Name] {
+			problems = append(problems, where+"defined twice")
+		}
+		names[c.Name] = true
+
+		for _, h := range strings.Split(c.Hint, ",") {
+			if _, ok := HintMap[h]; h != "" && !ok {
+				problems = append(problems, where+"unknown hint "+h)
+			}
+		}
+		if c.Strategy != "" {
+			if _, _, unsupported := TranslateStrategy(c.Strategy); len(unsupported) > 0 {
+				problems = append(problems, where+"unsupported strategy "+strings.Join(unsupported, " "))
+			}
+		}
+		if !knownProtocols[c.Protocol] {
+			problems = append(problems, where+"unknown protocol "+c.Protocol)
+		}
+		if c.TTL < 0 || c.TTL > 255 || c.MAXTTL < 0 || c.MAXTTL > 255 || c.InTTL < 0 || c.InTTL > 255 {
+			problems = append(problems, where+"ttl out of range")
+		}
+		if _, err := parseHTTPRules(c.Headers); err != nil {
+			problems = append(problems, where+err.Error())
+		}
+		if c.DNS != "" {
+			if _, err := ParseServers(c.DNS); err != nil {
+				problems = append(problems, where+"bad dns: "+err.Error())
+			}
+		}
+		if proxyProtocol(c.Protocol) {
+			if _, _, err := net.SplitHostPort(c.Address); err != nil {
+				problems = append(problems, where+"bad address: "+err.Error())
+			}
+		}
+		if c.Protocol == "ss" {
+			if _, err := newSSCipher(c.Method, c.Password); err != nil {
+				problems = append(problems, where+err.Error())
+			}
+		}
+	}
+	return problems
+}
+
+func proxyProtocol(protocol string) bool {
+	switch protocol {
+	case "http", "https", "socks", "socks4", "socks5", "ss":
+		return true
+	}
+	return false
+}
+
+// CheckServers returns the DNS servers and proxies of the interfaces
+// that do not answer within ValidateTimeout
+func CheckServers(interfaces []InterfaceConfig) []string {
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	var problems []string
+	checked := make(map[string]bool)
+	check := func(what string, f func() error) {
+		if checked[what] {
+			return
+		}
+		checked[what] = true
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := f(); err != nil {
+				lock.Lock()
+				problems = append(problems, what+" unreachable: "+err.Error())
+				lock.Unlock()
+			}
+		}()
+	}
+
+	for _, c := range interfaces {
+		servers, err := ParseServers(c.DNS)
+		for _, u := range servers {
+			switch u.Scheme {
+			case "udp", "tcp", "tls", "https", "tfo":
+			default:
+				continue
+			}
+			u := u
+			check("dns "+u.String(), func() error {
+				return withTimeout(func() error {
+					options := ParseOptions(u.RawQuery)
+					_, err := Exchange(u, PackRequest("example.com", 1, 0, ""), options)
+					return err
+				})
+			})
+		}
+		if err == nil && proxyProtocol(c.Protocol) {
+			address := c.Address
+			check("proxy "+address, func() error {
+				conn, err := net.DialTimeout("tcp", address, ValidateTimeout)
+				if err == nil {
+					conn.Close()
+				}
+				return err
+			})
+		}
+	}
+	wg.Wait()
+	return problems
+}
+
+// the lookups have timeouts of their own, some longer than -validate waits
+func withTimeout(f func() error) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- f()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(ValidateTimeout):
+		return fmt.Errorf("no answer in %v", ValidateTimeout)
+	}
+}
+
+// LintProfile returns the lines of a rules file that load but likely not
+// as meant: rules listed twice or under two interfaces, sections of
+// unknown interfaces, bad addresses and option values
+func (profile *PhantomProfile) LintProfile(filename string) ([]string, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasSuffix(filename, ".json") {
+		lines, err := profile.profileLines(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", filename, err)
+		}
+		data = []byte(lines)
+	}
+	return profile.lint(bytes.NewReader(data), filename), nil
+}
+
+func (profile *PhantomProfile) lint(conf io.Reader, name string) []string {
+	type rule struct {
+		section string
+		line    int
+	}
+	var problems []string
+	report := func(n int, format string, v ...interface{}) {
+		problems = append(problems, fmt.Sprintf("%s:%d: ", name, n)+fmt.Sprintf(format, v...))
+	}
+
+	seen := make(map[string]rule)
+	section := ""
+	scanner := bufio.NewScanner(conf)
+	for n := 1; scanner.Scan(); n++ {
+		l := strings.TrimSpace(strings.SplitN(scanner.Text(), "#", 2)[0])
+		if l == "" {
+			continue
+		}
+		keys := strings.SplitN(l, "=", 2)
+		if len(keys) == 1 && l[0] == '[' {
+			section = strings.Trim(l, "[]")
+			if _, ok := profile.InterfaceMap[section]; !ok {
+				report(n, "unknown interface %s, its rules are skipped", section)
+			}
+			continue
+		}
+
+		if len(keys) == 2 {
+			if keys[0] == "client" {
+				// the rules of other clients
+				seen = make(map[string]rule)
+				section = ""
+				continue
+			}
+			if kind, ok := profileOptions[keys[0]]; ok {
+				if kind == optionInt {
+					if _, err := strconv.Atoi(keys[1]); err != nil {
+						report(n, "%s wants an integer", keys[0])
+					}
+				}
+				if keys[0] == "default" && keys[1] != "" {
+					if _, ok := profile.InterfaceMap[keys[1]]; !ok {
+						report(n, "unknown interface %s", keys[1])
+					}
+				}
+				continue
+			}
+			value := keys[1]
+			if !strings.HasPrefix(value, "[") && !strings.HasPrefix(value, ">") {
+				for _, addr := range strings.Split(value, ",") {
+					if looksLikeIP(addr) && net.ParseIP(addr) == nil {
+						report(n, "bad address %s", addr)
+					}
+				}
+			}
+		}
+
+		key := strings.ToLower(keys[0])
+		host := key
+		if h, port, err := net.SplitHostPort(key); err == nil {
+			if _, err := strconv.Atoi(port); err != nil {
+				report(n, "bad port %s", port)
+			}
+			host = h
+		}
+		if strings.Contains(host, "/") {
+			if _, _, err := net.ParseCIDR(host); err != nil && !strings.HasPrefix(host, "~") {
+				report(n, "bad network %s", host)
+			}
+		} else if looksLikeIP(host) && net.ParseIP(host) == nil {
+			report(n, "bad address %s", host)
+		}
+		if first, ok := seen[key]; ok {
+			if first.section == section {
+				report(n, "%s repeats line %d", keys[0], first.line)
+			} else {
+				report(n, "%s under [%s] conflicts with line %d under [%s]", keys[0], section, first.line, first.section)
+			}
+			continue
+		}
+		seen[key] = rule{section, n}
+	}
+	return problems
+}
+
+// an address as written, digits and dots or hex digits and colons
+func looksLikeIP(s string) bool {
+	if s == "" {
+		return false
+	}
+	if strings.Contains(s, ":") {
+		return strings.Trim(s, "0123456789abcdefABCDEF:.") == ""
+	}
+	return strings.Trim(s, "0123456789.") == "" && strings.Count(s, ".") == 3
+}
+
+// LintHosts returns the lines of a hosts file with a bad address
+func LintHosts(filename string) ([]string, error) {
+	hosts, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer hosts.Close()
+
+	var problems []string
+	scanner := bufio.NewScanner(hosts)
+	for n := 1; scanner.Scan(); n++ {
+		fields := strings.Fields(strings.SplitN(scanner.Text(), "#", 2)[0])
+		if len(fields) == 0 {
+			continue
+		}
+		if net.ParseIP(fields[0]) == nil {
+			problems = append(problems, fmt.Sprintf("%s:%d: bad address %s", filename, n, fields[0]))
+		} else if len(fields) < 2 {
+			problems = append(problems, fmt.Sprintf("%s:%d: address without a name", filename, n))
+		}
+	}
+	return problems, scanner.Err()
+}
@@ -5,15 +5,19 @@ package phantomtcp
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"net"
+	"reflect"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	"github.com/macronut/godivert"
+	"golang.org/x/sys/windows"
 )
 
 var HintMap = map[string]uint32{
@@ -43,6 +47,7 @@ var HintMap = map[string]uint32{
 	"udp":    HINT_UDP,
 	"no-tcp": HINT_NOTCP,
 	"delay":  HINT_DELAY,
+	"lazy":   HINT_LAZY,
 
 	"mode2":      HINT_MODE2,
 	"df":         HINT_DF,
@@ -61,25 +66,182 @@ var ConnWait6 [65536]uint32
 var winDivertLock sync.Mutex
 var winDivert *godivert.WinDivertHandle
 
+var errWinDivertClosed = errors.New("winDivert is not capturing")
+
 func DevicePrint() {
 }
 
-func connectionMonitor(layer uint8) {
-	filter := "tcp.Syn"
+var winDivertFilter string
+
+// set once ConnectionMonitor ran, winDivert is nil while there is nothing
+// to capture
+var winDivertEnabled bool
+
+// godivert does not wrap WinDivertShutdown: a handle shut down for
+// receiving takes no more packets and Recv returns the queued ones, then
+// fails with ERROR_NO_DATA
+var procWinDivertShutdown = windows.NewLazyDLL("WinDivert.dll").NewProc("WinDivertShutdown")
+
+const winDivertShutdownRecv = 1
+
+// above that many targets their addresses are widened to networks, the
+// filter of WinDivert takes at most 256 tests
+const winDivertFilterMaxTargets = 32
+
+// a filter narrower than that of the handle waits until the handle is
+// that old, addresses expiring one by one do not reopen it each time
+const winDivertKeepFilter = 5 * time.Minute
+
+var winDivertTargets []CaptureTarget
+var winDivertOpened time.Time
+
+// addresses of the network, a range unless it is a single address
+func winDivertAddrFilter(field string, ipnet *net.IPNet) string {
+	ones, bits := ipnet.Mask.Size()
+	if ones == bits {
+		return fmt.Sprintf("%s == %s", field, ipnet.IP)
+	}
+	last := make(net.IP, len(ipnet.IP))
+	for i := range ipnet.IP {
+		last[i] = ipnet.IP[i] | ^ipnet.Mask[i]
+	}
+	return fmt.Sprintf("%s >= %s and %s <= %s", field, ipnet.IP, field, last)
+}
+
+func winDivertTargetFilter(target CaptureTarget) string {
+	if target.Net == nil {
+		return fmt.Sprintf("tcp.DstPort == %d or tcp.SrcPort == %d", target.Port, target.Port)
+	}
+	field := "ip"
+	if len(target.Net.IP) == net.IPv6len {
+		field = "ipv6"
+	}
+	dst := winDivertAddrFilter(field+".DstAddr", target.Net)
+	src := winDivertAddrFilter(field+".SrcAddr", target.Net)
+	if target.Port != 0 {
+		dst += " and tcp.DstPort == " + strconv.Itoa(target.Port)
+		src += " and tcp.SrcPort == " + strconv.Itoa(target.Port)
+	}
+	return "(" + dst + ") or (" + src + ")"
+}
+
+// getWinDivertFilter returns "" when nothing is to be captured
+func getWinDivertFilter() (string, []CaptureTarget) {
+	targets := CaptureTargets(winDivertFilterMaxTargets)
+	if len(targets) == 0 {
+		return "", nil
+	}
+	if targets[0] == (CaptureTarget{}) {
+		return "tcp.Syn", targets
+	}
+
+	var filter strings.Builder
+	filter.WriteString("tcp.Syn and (")
+	for i, target := range targets {
+		if i > 0 {
+			filter.WriteString(" or ")
+		}
+		filter.WriteString("(" + winDivertTargetFilter(target) + ")")
+	}
+	filter.WriteString(")")
+
+	return filter.String(), targets
+}
+
+// containsTargets reports whether every target of inner is in one of outer
+func containsTargets(outer, inner []CaptureTarget) bool {
+	for _, t := range inner {
+		contained := false
+		for _, o := range outer {
+			if o.Contains(t) {
+				contained = true
+				break
+			}
+		}
+		if !contained {
+			return false
+		}
+	}
+	return true
+}
+
+// UpdateCaptureFilter opens a handle with the new filter before the old
+// one stops taking packets, the monitor of the old one passes on what it
+// has queued and closes it
+func UpdateCaptureFilter() error {
+	filter, targets := getWinDivertFilter()
 
-	var err error
 	winDivertLock.Lock()
-	winDivert, err = godivert.WinDivertOpen(filter, layer, 1, 0)
-	winDivertLock.Unlock()
-	if err != nil {
-		fmt.Printf("winDivert open failed: %v", err)
-		return
+	defer winDivertLock.Unlock()
+	if !winDivertEnabled || filter == winDivertFilter {
+		return nil
 	}
-	defer winDivert.Close()
+	if winDivert != nil && containsTargets(winDivertTargets, targets) && time.Since(winDivertOpened) < winDivertKeepFilter {
+		return nil
+	}
+
+	var handle *godivert.WinDivertHandle
+	if filter != "" {
+		var err error
+		handle, err = godivert.WinDivertOpen(filter, 0, 1, 0)
+		if err != nil {
+			return err
+		}
+		logPrintln(2, "winDivert filter:", filter)
+	} else {
+		logPrintln(2, "winDivert: no address to capture")
+	}
+
+	old := winDivert
+	winDivert = handle
+	winDivertFilter = filter
+	winDivertTargets = targets
+	winDivertOpened = time.Now()
+	if handle != nil {
+		go connectionMonitor(handle)
+	}
+	if old != nil {
+		drainWinDivert(old)
+	}
+
+	return nil
+}
+
+// drainWinDivert shuts handle down for receiving, WinDivert 1 has no
+// shutdown and its queued packets are dropped by closing it
+func drainWinDivert(handle *godivert.WinDivertHandle) {
+	if h, ok := winDivertDriverHandle(handle); ok && procWinDivertShutdown.Find() == nil {
+		r, _, err := procWinDivertShutdown.Call(h, winDivertShutdownRecv)
+		if r != 0 {
+			return
+		}
+		logPrintln(1, "winDivert shutdown:", err)
+	}
+	handle.Close()
+}
 
+// winDivertDriverHandle returns the handle of the driver, godivert keeps
+// it unexported and another version of it may not have it
+func winDivertDriverHandle(handle *godivert.WinDivertHandle) (uintptr, bool) {
+	field := reflect.ValueOf(handle).Elem().FieldByName("handle")
+	switch field.Kind() {
+	case reflect.Uintptr, reflect.Uint, reflect.Uint64:
+		return uintptr(field.Uint()), true
+	}
+	return 0, false
+}
+
+func connectionMonitor(handle *godivert.WinDivertHandle) {
 	for {
-		divertpacket, err := winDivert.Recv()
+		divertpacket, err := handle.Recv()
 		if err != nil {
+			if handle != getWinDivert() {
+				if err == windows.ERROR_NO_DATA {
+					// drained after drainWinDivert
+					handle.Close()
+				}
+				return
+			}
 			logPrintln(1, err)
 			continue
 		}
@@ -104,7 +266,7 @@ func connectionMonitor(layer uint8) {
 			if synack {
 				hint = ConnWait4[tcp.DstPort]
 				if hint == 0 {
-					winDivert.Send(divertpacket)
+					handle.Send(divertpacket)
 					continue
 				}
 				srcPort = tcp.DstPort
@@ -136,7 +298,7 @@ func connectionMonitor(layer uint8) {
 				}
 
 				ch := ConnInfo4[srcPort]
-				connInfo := &ConnectionInfo{nil, ip, *tcp}
+				connInfo := &ConnectionInfo{nil, ip, *tcp, nil}
 
 				if hint&(HINT_TFO|HINT_HTFO|HINT_SYNX2) != 0 {
 					if synack {
@@ -173,11 +335,11 @@ func connectionMonitor(layer uint8) {
 							}
 						}
 					} else if hint&HINT_SYNX2 != 0 {
-						winDivert.Send(divertpacket)
+						handle.Send(divertpacket)
 						SendPacket(packet)
 					}
 				} else {
-					winDivert.Send(divertpacket)
+					handle.Send(divertpacket)
 				}
 
 				go func(info *ConnectionInfo) {
@@ -187,7 +349,7 @@ func connectionMonitor(layer uint8) {
 					}
 				}(connInfo)
 			} else {
-				winDivert.Send(divertpacket)
+				handle.Send(divertpacket)
 			}
 		case *layers.IPv6:
 			var srcPort layers.TCPPort
@@ -196,7 +358,7 @@ func connectionMonitor(layer uint8) {
 			if synack {
 				hint = ConnWait6[tcp.DstPort]
 				if hint == 0 {
-					winDivert.Send(divertpacket)
+					handle.Send(divertpacket)
 					continue
 				}
 				srcPort = tcp.DstPort
@@ -227,7 +389,7 @@ func connectionMonitor(layer uint8) {
 				}
 
 				ch := ConnInfo6[srcPort]
-				connInfo := &ConnectionInfo{nil, ip, *tcp}
+				connInfo := &ConnectionInfo{nil, ip, *tcp, nil}
 
 				if hint&(HINT_TFO|HINT_HTFO|HINT_SYNX2) != 0 {
 					if synack {
@@ -264,11 +426,11 @@ func connectionMonitor(layer uint8) {
 							}
 						}
 					} else if hint&HINT_SYNX2 != 0 {
-						winDivert.Send(divertpacket)
+						handle.Send(divertpacket)
 						SendPacket(packet)
 					}
 				} else {
-					winDivert.Send(divertpacket)
+					handle.Send(divertpacket)
 				}
 
 				go func(info *ConnectionInfo) {
@@ -278,25 +440,57 @@ func connectionMonitor(layer uint8) {
 					}
 				}(connInfo)
 			} else {
-				winDivert.Send(divertpacket)
+				handle.Send(divertpacket)
 			}
 		default:
-			winDivert.Send(divertpacket)
+			handle.Send(divertpacket)
 		}
 	}
 }
 
+// WinDivert diverts at the network layer of every adapter and its filter
+// has no local address, the handle keeps working after a change
+func RebindCapture() {
+}
+
 func ConnectionMonitor(devices []string) bool {
 	for i := 0; i < 65536; i++ {
 		ConnInfo4[i] = make(chan *ConnectionInfo, 1)
 		ConnInfo6[i] = make(chan *ConnectionInfo, 1)
 	}
 
-	go connectionMonitor(0)
+	filter, targets := getWinDivertFilter()
+	var handle *godivert.WinDivertHandle
+	if filter != "" {
+		var err error
+		handle, err = godivert.WinDivertOpen(filter, 0, 1, 0)
+		if err != nil {
+			fmt.Printf("winDivert open failed: %v", err)
+			return false
+		}
+	}
+
+	winDivertLock.Lock()
+	winDivert = handle
+	winDivertFilter = filter
+	winDivertTargets = targets
+	winDivertOpened = time.Now()
+	winDivertEnabled = true
+	winDivertLock.Unlock()
+
+	if handle != nil {
+		go connectionMonitor(handle)
+	}
 
 	return true
 }
 
+func getWinDivert() *godivert.WinDivertHandle {
+	winDivertLock.Lock()
+	defer winDivertLock.Unlock()
+	return winDivert
+}
+
 func SendPacket(packet gopacket.Packet) error {
 	payload := packet.LinkLayer().LayerPayload()
 
@@ -307,7 +501,11 @@ func SendPacket(packet gopacket.Packet) error {
 	divertpacket.Addr = &divertAddr
 	divertpacket.ParseHeaders()
 
-	_, err := winDivert.Send(&divertpacket)
+	handle := getWinDivert()
+	if handle == nil {
+		return errWinDivertClosed
+	}
+	_, err := handle.Send(&divertpacket)
 	return err
 }
 
@@ -414,8 +612,12 @@ func ModifyAndSendPacket(connInfo *ConnectionInfo, payload []byte, hint uint32,
 	divertpacket.ParseHeaders()
 	//divertpacket.CalcNewChecksum(winDivert)
 
+	handle := getWinDivert()
+	if handle == nil {
+		return errWinDivertClosed
+	}
 	for i := 0; i < count; i++ {
-		_, err := winDivert.Send(&divertpacket)
+		_, err := handle.Send(&divertpacket)
 		if err != nil {
 			return err
 		}
@@ -558,7 +760,7 @@ func RedirectDNS() {
 		server := DefaultProfile.GetInterface(qname)
 		if server != nil {
 			logPrintln(1, qname, server)
-			_, response := NSRequest(request, true)
+			_, response := DefaultProfile.NSRequest(request, true, nil)
 			udpsize := len(response) + 8
 
 			var packetsize int
@@ -597,3 +799,12 @@ func RedirectDNS() {
 		}
 	}
 }
+
+// the driver is loaded when the first handle is opened
+func captureCheck(devices []string) []PreflightCheck {
+	handle, err := godivert.WinDivertOpen("false", 0, 1, 0)
+	if err == nil {
+		handle.Close()
+	}
+	return []PreflightCheck{newCheck("windivert", err, "run as administrator with WinDivert.dll and WinDivert64.sys next to phantomsocks")}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+
+	ptcp "github.com/macronut/phantomsocks/phantomtcp"
+)
+
+func usesTProxy(config *Config) bool {
+	for _, c := range append([]InstanceConfig{config.InstanceConfig}, config.Instances...) {
+		for _, service := range c.Services {
+			if service.Protocol == "tproxy" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// preflight prints the failed checks of the backends config needs, or
+// all of them with verbose, and returns whether they all passed
+func preflight(config *Config, devices []string, verbose bool) bool {
+	ok := true
+	for _, check := range ptcp.Preflight(devices, usesTProxy(config)) {
+		if check.OK {
+			if verbose {
+				fmt.Println("ok  ", check.Name)
+			}
+			continue
+		}
+		ok = false
+		fmt.Println("FAIL", check.Name+":", check.Detail)
+	}
+	return ok
+}
+
+// CheckConfig loads filename and checks what its backends need without
+// starting them
+func CheckConfig(filename string) bool {
+	config, err := LoadConfig(filename)
+	if err != nil {
+		fmt.Println(err)
+		return false
+	}
+
+	devices, err := ptcp.CreateInterfaces(config.Interfaces)
+	if err != nil {
+		fmt.Println(err)
+		return false
+	}
+	for _, c := range config.Instances {
+		_, profileDevices, err := ptcp.NewProfile(c.Interfaces)
+		if err != nil {
+			fmt.Println(c.Name, err)
+			return false
+		}
+		for _, dev := range profileDevices {
+			found := false
+			for _, d := range devices {
+				found = found || d == dev
+			}
+			if !found {
+				devices = append(devices, dev)
+			}
+		}
+	}
+	return preflight(config, devices, true)
+}
@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"errors"
+	"log"
+	"net/url"
+	"os"
+	"os/exec"
+)
+
+// shares the connection named PHANTOM_WAN with the one named PHANTOM_LAN
+// (the hotspot adapter) through ICS, PHANTOM_SHARE=0 stops sharing
+const icsScript = `$m = New-Object -ComObject HNetCfg.HNetShare
+foreach ($c in $m.EnumEveryConnection) {
+	$name = $m.NetConnectionProps.Invoke($c).Name
+	$conf = $m.INetSharingConfigurationForINetConnection.Invoke($c)
+	if ($name -ne $env:PHANTOM_WAN -and $name -ne $env:PHANTOM_LAN) { continue }
+	if ($env:PHANTOM_SHARE -ne "1") { $conf.DisableSharing(); continue }
+	if ($name -eq $env:PHANTOM_WAN) { $conf.EnableSharing(0) } else { $conf.EnableSharing(1) }
+}`
+
+func netsh(arg ...string) error {
+	out, err := exec.Command("netsh", arg...).CombinedOutput()
+	if err != nil {
+		return errors.New(string(out))
+	}
+	return nil
+}
+
+func shareConnection(wan, lan string, state bool) error {
+	share := "0"
+	if state {
+		share = "1"
+	}
+	cmd := exec.Command("powershell", "-NoProfile", "-NonInteractive", "-Command", icsScript)
+	cmd.Env = append(os.Environ(), "PHANTOM_WAN="+wan, "PHANTOM_LAN="+lan, "PHANTOM_SHARE="+share)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return errors.New(string(out))
+	}
+	return nil
+}
+
+// hotspot://address:port/?ssid=name&key=password&wan=Ethernet&lan=Local Area Connection* 10
+// starts a hosted network with ssid and shares wan with the hotspot
+// adapter lan, the connections of its clients are then forwarded to
+// the redirect service like those of this machine
+func setHotspot(q url.Values, state bool) error {
+	ssid, key := q.Get("ssid"), q.Get("key")
+	wan, lan := q.Get("wan"), q.Get("lan")
+
+	if state {
+		if ssid != "" {
+			err := netsh("wlan", "set", "hostednetwork", "mode=allow", "ssid="+ssid, "key="+key)
+			if err != nil {
+				return err
+			}
+			err = netsh("wlan", "start", "hostednetwork")
+			if err != nil {
+				return err
+			}
+		}
+		if wan != "" && lan != "" {
+			return shareConnection(wan, lan, true)
+		}
+		log.Println("hotspot: wan and lan are not set, ICS must be enabled manually")
+		return nil
+	}
+
+	if wan != "" && lan != "" {
+		err := shareConnection(wan, lan, false)
+		if err != nil {
+			log.Println("hotspot:", err)
+		}
+	}
+	if ssid != "" {
+		return netsh("wlan", "stop", "hostednetwork")
+	}
+	return nil
+}
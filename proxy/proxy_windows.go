@@ -28,7 +28,13 @@ func SetProxy(dev, address string, state bool) error {
 
 	if state {
 		switch u.Scheme {
-		case "redirect":
+		case "redirect", "hotspot":
+			if u.Scheme == "hotspot" {
+				err := setHotspot(u.Query(), true)
+				if err != nil {
+					return err
+				}
+			}
 			if state {
 				go ptcp.Redirect(proxyTCPAddr.IP.String(), proxyTCPAddr.Port, true)
 				go ptcp.RedirectDNS()
@@ -66,6 +72,8 @@ func SetProxy(dev, address string, state bool) error {
 		}
 	} else {
 		switch u.Scheme {
+		case "hotspot":
+			return setHotspot(u.Query(), false)
 		case "socks":
 			key, _, _ := registry.CreateKey(registry.CURRENT_USER, `SOFTWARE\Microsoft\Windows\CurrentVersion\Internet Settings`, registry.ALL_ACCESS)
 			key.SetDWordValue(`ProxyEnable`, uint32(0))
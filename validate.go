@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+
+	ptcp "github.com/macronut/phantomsocks/phantomtcp"
+)
+
+// ValidateConfig loads filename and the rules, hosts files and lists of
+// its instances without binding sockets, prints what is wrong with them
+// and whether their DNS servers and proxies answer, and returns whether
+// all is well
+func ValidateConfig(filename string) bool {
+	config, err := LoadConfig(filename)
+	if err != nil {
+		fmt.Println(filename+":", err)
+		return false
+	}
+
+	var problems []string
+	for _, c := range append([]InstanceConfig{config.InstanceConfig}, config.Instances...) {
+		prefix := ""
+		if c.Name != "" {
+			prefix = c.Name + ": "
+		}
+		report := func(list ...string) {
+			for _, problem := range list {
+				problems = append(problems, prefix+problem)
+			}
+		}
+
+		report(ptcp.CheckInterfaces(c.Interfaces)...)
+		profile, _, err := ptcp.NewProfile(c.Interfaces)
+		if err != nil {
+			// CheckInterfaces reported it
+			continue
+		}
+		for _, filename := range c.Profiles {
+			lint, err := profile.LintProfile(filename)
+			if err != nil {
+				report(err.Error())
+			}
+			report(lint...)
+		}
+		if c.HostsFile != "" {
+			lint, err := ptcp.LintHosts(c.HostsFile)
+			if err != nil {
+				report(err.Error())
+			}
+			report(lint...)
+		}
+
+		// loaded as a reload, which starts no listener
+		err = profile.ReloadRules(func(profile *ptcp.PhantomProfile) error {
+			return loadRules(profile, c)
+		})
+		if err != nil {
+			report(err.Error())
+		}
+		report(ptcp.CheckServers(c.Interfaces)...)
+	}
+
+	for _, problem := range problems {
+		fmt.Println(problem)
+	}
+	if len(problems) > 0 {
+		return false
+	}
+	fmt.Println(filename, "ok")
+	return true
+}